@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// These are the roles of the API keys.
+// The admin keys are accepted in every endpoint and can act on behalf of any subject.
+const (
+	RoleDriver = "driver"
+	RoleRider  = "rider"
+	RoleAdmin  = "admin"
+	// RolePartner is used by the city partners, they can only download the anonymous datasets.
+	RolePartner = "partner"
+)
+
+// ErrInvalidKey is returned when the API key does not exist.
+var ErrInvalidKey = errors.New("invalid api key")
+
+// Principal is the owner of an API key, Subject is the driver ID or the user ID depending on the role.
+// Tenant is the enterprise of the subject, it is empty for the subjects without enterprise.
+// The sandbox keys are used by the integrators to test, they only see the synthetic drivers of the sandbox.
+type Principal struct {
+	Role    string
+	Subject string
+	Tenant  string
+	Sandbox bool
+}
+
+type ctxKey struct{}
+
+// apiKeyKey is a hash with the role, the subject and the tenant of the key.
+func apiKeyKey(key string) string {
+	return fmt.Sprintf("apikey:%s", key)
+}
+
+// CreateKey saves an API key for the subject with the role, tenant is optional.
+func CreateKey(key, role, subject, tenant string, sandbox bool) error {
+	fields := map[string]interface{}{
+		"role":    role,
+		"subject": subject,
+	}
+	if tenant != "" {
+		fields["tenant"] = tenant
+	}
+	if sandbox {
+		fields["sandbox"] = "1"
+	}
+
+	rClient := storages.GetRedisClient()
+	return storages.Classify(rClient.HMSet(apiKeyKey(key), fields).Err())
+}
+
+// Lookup returns the principal of the API key.
+func Lookup(key string) (*Principal, error) {
+	rClient := storages.GetRedisClient()
+	var fields map[string]string
+	err := storages.WithRetry(func() (err error) {
+		fields, err = rClient.HGetAll(apiKeyKey(key)).Result()
+		return err
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if fields["role"] == "" || fields["subject"] == "" {
+		return nil, ErrInvalidKey
+	}
+
+	return &Principal{Role: fields["role"], Subject: fields["subject"], Tenant: fields["tenant"], Sandbox: fields["sandbox"] == "1"}, nil
+}
+
+// FromContext returns the principal of the request, nil if the request was not authenticated.
+func FromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(ctxKey{}).(*Principal)
+	return p
+}
+
+// alwaysRequired returns true for the roles whose routes need a key even when the authentication is disabled,
+// they can change any driver or request and export the datasets.
+func alwaysRequired(role string) bool {
+	return role == RoleAdmin || role == RolePartner
+}
+
+// Require returns a middleware that only lets pass the requests with a valid API key of the role.
+// The key is sent in the Authorization header as a bearer token. When enabled is false the requests of the driver and
+// rider routes pass without a principal, the admin and partner routes always need a key.
+func Require(enabled bool, role string, next http.HandlerFunc) http.HandlerFunc {
+	if !enabled && !alwaysRequired(role) {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if key == "" || key == r.Header.Get("Authorization") {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			httputil.WriteError(w, httputil.CodeUnauthorized, "missing api key")
+			return
+		}
+
+		p, err := Lookup(key)
+		if err == ErrInvalidKey {
+			httputil.WriteError(w, httputil.CodeUnauthorized, err.Error())
+			return
+		}
+		if err != nil {
+			httputil.WriteError(w, httputil.Code(storages.HTTPStatus(err)), "could not validate api key")
+			return
+		}
+		if p.Role != role && p.Role != RoleAdmin {
+			httputil.WriteError(w, httputil.CodeForbidden, "api key not allowed for this endpoint")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), ctxKey{}, p)
+		if p.Sandbox {
+			ctx = storages.WithSandbox(ctx, p.Tenant)
+		}
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// Tenant returns the tenant of the principal of the request, empty without principal.
+func Tenant(r *http.Request) string {
+	if p := FromContext(r.Context()); p != nil {
+		return p.Tenant
+	}
+	return ""
+}
+
+// CanActAs returns true if the principal of the request can act on behalf of the subject.
+// Requests without principal are allowed, it means that the authentication is disabled.
+func CanActAs(r *http.Request, subject string) bool {
+	p := FromContext(r.Context())
+	return p == nil || p.Role == RoleAdmin || p.Subject == subject
+}
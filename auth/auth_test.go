@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/douglasmakey/tracking/storages"
+)
+
+func TestRequire(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+
+	cases := []struct {
+		enabled bool
+		role    string
+		header  string
+		status  int
+	}{
+		// Disabled, the driver and rider routes pass without a key.
+		{false, RoleDriver, "", http.StatusOK},
+		{false, RoleRider, "", http.StatusOK},
+		// The admin and partner routes always need a key.
+		{false, RoleAdmin, "", http.StatusUnauthorized},
+		{false, RolePartner, "", http.StatusUnauthorized},
+		{true, RoleRider, "", http.StatusUnauthorized},
+		{true, RoleAdmin, "Basic abc", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if c.header != "" {
+			req.Header.Set("Authorization", c.header)
+		}
+		rec := httptest.NewRecorder()
+		Require(c.enabled, c.role, ok)(rec, req)
+		if rec.Code != c.status {
+			t.Errorf("enabled %v role %s header %q: expected %d, got %d", c.enabled, c.role, c.header, c.status, rec.Code)
+		}
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	if err := storages.GetRedisClient().Ping().Err(); err != nil {
+		t.Skipf("redis is not available: %v", err)
+	}
+	if err := CreateKey("test-driver-key", RoleDriver, "42", "", false); err != nil {
+		t.Fatalf("could not create key: %v", err)
+	}
+	defer storages.GetRedisClient().Del(apiKeyKey("test-driver-key"))
+
+	var got *Principal
+	h := func(w http.ResponseWriter, r *http.Request) { got = FromContext(r.Context()) }
+	send := func(role, key string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		rec := httptest.NewRecorder()
+		Require(true, role, h)(rec, req)
+		return rec.Code
+	}
+
+	if code := send(RoleDriver, "test-driver-key"); code != http.StatusOK || got == nil || got.Subject != "42" {
+		t.Errorf("expected the driver to pass, got %d %+v", code, got)
+	}
+	if code := send(RoleAdmin, "test-driver-key"); code != http.StatusForbidden {
+		t.Errorf("expected a driver key to be rejected in the admin routes, got %d", code)
+	}
+	if code := send(RoleAdmin, "unknown-key"); code != http.StatusUnauthorized {
+		t.Errorf("expected an unknown key to be rejected, got %d", code)
+	}
+}
+
+func TestCanActAs(t *testing.T) {
+	with := func(p *Principal) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if p == nil {
+			return req
+		}
+		return req.WithContext(context.WithValue(req.Context(), ctxKey{}, p))
+	}
+
+	if !CanActAs(with(nil), "1") {
+		t.Error("expected the requests without principal to pass")
+	}
+	if !CanActAs(with(&Principal{Role: RoleAdmin, Subject: "ops"}), "1") {
+		t.Error("expected the admins to act on behalf of anyone")
+	}
+	if !CanActAs(with(&Principal{Role: RoleDriver, Subject: "1"}), "1") {
+		t.Error("expected the driver to act on its own behalf")
+	}
+	if CanActAs(with(&Principal{Role: RoleDriver, Subject: "2"}), "1") {
+		t.Error("expected a driver to not act on behalf of another")
+	}
+}
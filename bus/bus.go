@@ -0,0 +1,136 @@
+// Package bus publishes the events of the requests, the trips and the drivers to a message bus (Kafka, NATS or Redis Streams),
+// so the downstream services like billing and analytics subscribe to them instead of polling the API.
+// The events are queued in memory and published in batches by a dispatcher, emitting an event never blocks a request.
+package bus
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/metrics"
+	"github.com/douglasmakey/tracking/retry"
+)
+
+// These are the types of the events.
+const (
+	DriverMatched   = "driver.matched"
+	RequestExpired  = "request.expired"
+	RequestCanceled = "request.canceled"
+	LocationUpdated = "location.updated"
+	// DriverRestricted is a driver warned for idling in a restricted zone without the required tags.
+	DriverRestricted = "driver.restricted_zone"
+)
+
+// TripEvent returns the type of the event of a state of a trip, e.g. trip.completed.
+func TripEvent(state string) string {
+	return "trip." + state
+}
+
+const (
+	// queueSize is the number of events waiting to be published, the events are dropped when it is full.
+	queueSize = 10000
+	// batchSize is the max number of events published at once.
+	batchSize = 500
+)
+
+// Event is a change published to the bus.
+type Event struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	// Key is the entity of the event, e.g. the request, so its events keep their order in the partitions of the bus.
+	Key      string            `json:"key"`
+	Tenant   string            `json:"tenant,omitempty"`
+	Data     map[string]string `json:"data,omitempty"`
+	Occurred time.Time         `json:"occurred_at"`
+}
+
+// Publisher sends the events to a bus.
+type Publisher interface {
+	Publish(ctx context.Context, events []Event) error
+}
+
+var (
+	mu        sync.RWMutex
+	publisher Publisher
+	events    = make(chan Event, queueSize)
+)
+
+// SetPublisher sets the publisher of the events, nil does not publish them.
+func SetPublisher(p Publisher) {
+	mu.Lock()
+	defer mu.Unlock()
+	publisher = p
+}
+
+// Enabled returns true if there is a publisher, the callers skip building the events otherwise.
+func Enabled() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return publisher != nil
+}
+
+// Emit queues the event, it does not block. The events are ignored when there is no publisher.
+func Emit(ev Event) {
+	if !Enabled() {
+		return
+	}
+	if ev.ID == "" {
+		ev.ID = logging.NewID()
+	}
+	if ev.Occurred.IsZero() {
+		ev.Occurred = time.Now().UTC()
+	}
+
+	select {
+	case events <- ev:
+	default:
+		metrics.BusEvents.WithLabelValues(ev.Type, "dropped").Inc()
+	}
+}
+
+// Start launches the dispatcher that publishes the queued events in order.
+func Start() {
+	go func() {
+		for ev := range events {
+			batch := drain(ev, events, batchSize)
+			mu.RLock()
+			p := publisher
+			mu.RUnlock()
+			if p == nil {
+				continue
+			}
+			publish(p, batch)
+		}
+	}()
+}
+
+// drain returns the first event with the events already queued, up to max.
+func drain(first Event, queue <-chan Event, max int) []Event {
+	batch := []Event{first}
+	for len(batch) < max {
+		select {
+		case ev := <-queue:
+			batch = append(batch, ev)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// publish sends the batch with the bus policy, the batch is dropped when the retries are exhausted.
+func publish(p Publisher, batch []Event) {
+	err := retry.For(retry.Bus).Do(context.Background(), retry.Bus, func() error {
+		return p.Publish(context.Background(), batch)
+	})
+	result := "published"
+	if err != nil {
+		result = "failed"
+		logging.Logger.Error("could not publish events to the bus", "events", len(batch), "error", err)
+	}
+	for _, ev := range batch {
+		metrics.BusEvents.WithLabelValues(ev.Type, result).Inc()
+	}
+}
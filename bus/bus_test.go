@@ -0,0 +1,61 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// fakePublisher keeps the published batches, it fails the first fails calls.
+type fakePublisher struct {
+	fails   int
+	batches [][]Event
+}
+
+func (p *fakePublisher) Publish(_ context.Context, events []Event) error {
+	if p.fails > 0 {
+		p.fails--
+		return errors.New("unavailable")
+	}
+	p.batches = append(p.batches, events)
+	return nil
+}
+
+func TestDrain(t *testing.T) {
+	queue := make(chan Event, 10)
+	for _, id := range []string{"2", "3", "4"} {
+		queue <- Event{ID: id}
+	}
+
+	batch := drain(Event{ID: "1"}, queue, 3)
+	if len(batch) != 3 || batch[0].ID != "1" || batch[2].ID != "3" {
+		t.Errorf("expected the events 1 to 3, got %+v", batch)
+	}
+	if batch := drain(Event{ID: "5"}, queue, 3); len(batch) != 2 || batch[1].ID != "4" {
+		t.Errorf("expected the events 5 and 4, got %+v", batch)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	p := &fakePublisher{fails: 1}
+	publish(p, []Event{{ID: "1", Type: DriverMatched}})
+	if len(p.batches) != 1 {
+		t.Errorf("expected the batch after a retry, got %+v", p.batches)
+	}
+}
+
+func TestEmit(t *testing.T) {
+	// Without publisher the events are not queued.
+	Emit(Event{Type: RequestExpired})
+	if len(events) != 0 {
+		t.Fatalf("expected no queued events, got %d", len(events))
+	}
+
+	SetPublisher(&fakePublisher{})
+	defer SetPublisher(nil)
+	Emit(Event{Type: RequestExpired, Key: "42"})
+	ev := <-events
+	if ev.ID == "" || ev.Occurred.IsZero() || ev.Key != "42" {
+		t.Errorf("expected the id and the time to be set, got %+v", ev)
+	}
+}
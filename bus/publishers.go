@@ -0,0 +1,95 @@
+package bus
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+)
+
+// Kafka publishes the events to a topic, the key of the messages is the key of the event.
+type Kafka struct {
+	Writer *kafka.Writer
+}
+
+// NewKafka returns a publisher to the topic of the brokers.
+func NewKafka(brokers []string, topic string) *Kafka {
+	return &Kafka{Writer: &kafka.Writer{
+		Addr:     kafka.TCP(brokers...),
+		Topic:    topic,
+		Balancer: &kafka.Hash{},
+	}}
+}
+
+// Publish writes the events in one request.
+func (k *Kafka) Publish(ctx context.Context, events []Event) error {
+	msgs := make([]kafka.Message, 0, len(events))
+	for _, ev := range events {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, kafka.Message{Key: []byte(ev.Key), Value: data})
+	}
+	return k.Writer.WriteMessages(ctx, msgs...)
+}
+
+// NATS publishes each event to the subject of its type under a prefix, e.g. tracking.driver.matched,
+// so the subscribers choose the events with the subjects, e.g. tracking.request.>.
+type NATS struct {
+	Conn   *nats.Conn
+	Prefix string
+}
+
+// NewNATS connects to the server, the client reconnects by itself.
+func NewNATS(url, prefix string) (*NATS, error) {
+	conn, err := nats.Connect(url, nats.Name("tracking"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+	return &NATS{Conn: conn, Prefix: prefix}, nil
+}
+
+// Publish sends the events and waits until the server has them.
+func (n *NATS) Publish(_ context.Context, events []Event) error {
+	for _, ev := range events {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		if err := n.Conn.Publish(n.Prefix+"."+ev.Type, data); err != nil {
+			return err
+		}
+	}
+	return n.Conn.Flush()
+}
+
+// RedisStream adds the events to a stream of the Redis of the service, the stream keeps about MaxLen events.
+// The subscribers read it with their own consumer groups.
+type RedisStream struct {
+	Client *storages.RedisClient
+	Stream string
+	MaxLen int64
+}
+
+// Publish adds the events in one pipeline, the fields are the type, the key and the event as JSON.
+func (s RedisStream) Publish(_ context.Context, events []Event) error {
+	_, err := s.Client.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, ev := range events {
+			data, err := json.Marshal(ev)
+			if err != nil {
+				return err
+			}
+			pipe.XAdd(&redis.XAddArgs{
+				Stream:       s.Stream,
+				MaxLenApprox: s.MaxLen,
+				Values:       map[string]interface{}{"type": ev.Type, "key": ev.Key, "event": data},
+			})
+		}
+		return nil
+	})
+	return storages.Classify(err)
+}
@@ -0,0 +1,187 @@
+package calendar
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// The calendar counts the supply (distinct drivers) and the demand (search requests) of each zone per hour,
+// the hours are kept for the trailing weeks and averaged by weekday and hour.
+
+// Weeks is the number of trailing weeks used in the calendar.
+const Weeks = 4
+
+// retention is the time that the hourly counters are kept.
+const retention = time.Hour * 24 * 7 * (Weeks + 1)
+
+// Slot is the average supply and demand of a zone for a weekday and hour.
+type Slot struct {
+	Weekday int     `json:"weekday"`
+	Hour    int     `json:"hour"`
+	Supply  float64 `json:"supply"`
+	Demand  float64 `json:"demand"`
+}
+
+// hourKey returns the key of the counter of the zone for the hour of t.
+func hourKey(kind, zone string, t time.Time) string {
+	return fmt.Sprintf("calendar:%s:%s:%s", kind, zone, t.UTC().Format("2006010215"))
+}
+
+// zonesKey is a set with the zones with demand in the day of t.
+func zonesKey(t time.Time) string {
+	return fmt.Sprintf("calendar:zones:%s", t.UTC().Format("20060102"))
+}
+
+// RecordSupply counts the driver in the zone of the location for the current hour.
+func RecordSupply(driverID string, p geo.Point) error {
+	key := hourKey("supply", geo.Zone(p), time.Now())
+	rClient := storages.GetRedisClient()
+	_, err := rClient.Pipelined(func(pipe redis.Pipeliner) error {
+		// A HyperLogLog counts the distinct drivers without keeping the IDs.
+		pipe.PFAdd(key, driverID)
+		pipe.Expire(key, retention)
+		return nil
+	})
+	return storages.Classify(err)
+}
+
+// RecordDemand counts a search request in the zone of the picking point for the current hour.
+func RecordDemand(p geo.Point) error {
+	now, zone := time.Now(), geo.Zone(p)
+	key := hourKey("demand", zone, now)
+	rClient := storages.GetRedisClient()
+	_, err := rClient.Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.Incr(key)
+		pipe.Expire(key, retention)
+		pipe.SAdd(zonesKey(now), zone)
+		pipe.Expire(zonesKey(now), retention)
+		return nil
+	})
+	return storages.Classify(err)
+}
+
+// Get returns the 168 slots of the week of the zone, the values are the averages of the trailing weeks until now.
+func Get(zone string, now time.Time) ([]Slot, error) {
+	now = now.UTC().Truncate(time.Hour)
+	supply := make([]*redis.IntCmd, 0, 168*Weeks)
+	demand := make([]*redis.StringCmd, 0, 168*Weeks)
+	hours := make([]time.Time, 0, 168*Weeks)
+
+	rClient := storages.GetRedisClient()
+	_, err := rClient.Pipelined(func(pipe redis.Pipeliner) error {
+		for i := 1; i <= 168*Weeks; i++ {
+			t := now.Add(-time.Duration(i) * time.Hour)
+			hours = append(hours, t)
+			supply = append(supply, pipe.PFCount(hourKey("supply", zone, t)))
+			demand = append(demand, pipe.Get(hourKey("demand", zone, t)))
+		}
+		return nil
+	})
+	// The missing demand counters return redis.Nil, they are zero.
+	if err != nil && err != redis.Nil {
+		return nil, storages.Classify(err)
+	}
+
+	slots := make([]Slot, 168)
+	for i := range slots {
+		slots[i].Weekday = i / 24
+		slots[i].Hour = i % 24
+	}
+	for i, t := range hours {
+		s := &slots[int(t.Weekday())*24+t.Hour()]
+		s.Supply += float64(supply[i].Val()) / Weeks
+		d, _ := demand[i].Int64()
+		s.Demand += float64(d) / Weeks
+	}
+
+	return slots, nil
+}
+
+// Zones returns the zones with demand in the days from the day of from until the day of to.
+func Zones(from, to time.Time) ([]string, error) {
+	var keys []string
+	for d := from.UTC().Truncate(time.Hour * 24); !d.After(to); d = d.Add(time.Hour * 24) {
+		keys = append(keys, zonesKey(d))
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	rClient := storages.GetRedisClient()
+	var zones []string
+	err := storages.WithRetry(func() (err error) {
+		zones, err = rClient.SUnion(keys...).Result()
+		return err
+	})
+	return zones, err
+}
+
+// Demand returns the search requests of the zone in each hour from the hour of from until the hour before to.
+func Demand(zone string, from, to time.Time) ([]int64, error) {
+	from = from.UTC().Truncate(time.Hour)
+	var cmds []*redis.StringCmd
+	rClient := storages.GetRedisClient()
+	err := storages.WithRetry(func() error {
+		cmds = cmds[:0]
+		_, err := rClient.Pipelined(func(pipe redis.Pipeliner) error {
+			for t := from; t.Before(to); t = t.Add(time.Hour) {
+				cmds = append(cmds, pipe.Get(hourKey("demand", zone, t)))
+			}
+			return nil
+		})
+		// The missing counters return redis.Nil, they are zero.
+		if err == redis.Nil {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	demand := make([]int64, len(cmds))
+	for i, cmd := range cmds {
+		demand[i], _ = cmd.Int64()
+	}
+	return demand, nil
+}
+
+// Supply returns the distinct drivers of the zone in the hour of now and the previous one, so it is not empty at the start of an hour.
+func Supply(zone string, now time.Time) (int64, error) {
+	rClient := storages.GetRedisClient()
+	var supply int64
+	err := storages.WithRetry(func() (err error) {
+		supply, err = rClient.PFCount(hourKey("supply", zone, now), hourKey("supply", zone, now.Add(-time.Hour))).Result()
+		return err
+	})
+	return supply, err
+}
+
+// Expected returns the slot of the zone for the weekday and hour of t, it is the hook used by the forecasts and the scheduling hints.
+func Expected(zone string, t time.Time) (Slot, error) {
+	slots, err := Get(zone, time.Now())
+	if err != nil {
+		return Slot{}, err
+	}
+
+	t = t.UTC()
+	return slots[int(t.Weekday())*24+t.Hour()], nil
+}
+
+// Hints returns the n slots of the zone with the highest demand per driver, they are the best hours for a driver to work in the zone.
+func Hints(slots []Slot, n int) []Slot {
+	ranked := make([]Slot, len(slots))
+	copy(ranked, slots)
+	ratio := func(s Slot) float64 { return s.Demand / (s.Supply + 1) }
+	sort.Slice(ranked, func(i, j int) bool { return ratio(ranked[i]) > ratio(ranked[j]) })
+
+	if n > len(ranked) {
+		n = len(ranked)
+	}
+	return ranked[:n]
+}
@@ -0,0 +1,210 @@
+// Package callbacks posts the events of the requests to the callback URL sent by the client in the search.
+// The events are signed with HMAC-SHA256 and retried with exponential backoff.
+package callbacks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/retry"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// The events wait in pendingKey until the dispatcher sends them, the failed ones wait in retryKey,
+// a sorted set where the score is the unix time of the next attempt. Both are shared by all the instances.
+const (
+	pendingKey = "callbacks:pending"
+	retryKey   = "callbacks:retry"
+)
+
+const (
+	// SignatureHeader has the signature of the body, "sha256=<hex>", and TimestampHeader the unix time used in the signature.
+	SignatureHeader = "X-Signature"
+	TimestampHeader = "X-Timestamp"
+
+	popTimeout = time.Second * 5
+)
+
+// Event is the body posted to the callback URL.
+type Event struct {
+	Event      string            `json:"event"`
+	RequestID  string            `json:"request_id"`
+	DriverID   string            `json:"driver_id,omitempty"`
+	Data       map[string]string `json:"data,omitempty"`
+	OccurredAt time.Time         `json:"occurred_at"`
+}
+
+// job is an event waiting to be delivered.
+type job struct {
+	URL     string `json:"url"`
+	Event   Event  `json:"event"`
+	Attempt int    `json:"attempt"`
+}
+
+// callbackKey keeps the callback URL of the request.
+func callbackKey(requestID string) string {
+	return fmt.Sprintf("request:%s:callback", requestID)
+}
+
+// Register saves the callback URL of the request during ttl.
+func Register(requestID, url string, ttl time.Duration) error {
+	rClient := storages.GetRedisClient()
+	return storages.Classify(rClient.Set(callbackKey(requestID), url, ttl).Err())
+}
+
+// Trigger queues the event if the request has a callback URL.
+func Trigger(requestID string, ev Event) error {
+	rClient := storages.GetRedisClient()
+	var url string
+	err := storages.WithRetry(func() (err error) {
+		url, err = rClient.Get(callbackKey(requestID)).Result()
+		return err
+	})
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if ev.OccurredAt.IsZero() {
+		ev.OccurredAt = time.Now().UTC()
+	}
+	data, err := json.Marshal(job{URL: url, Event: ev})
+	if err != nil {
+		return err
+	}
+	return storages.Classify(rClient.LPush(pendingKey, data).Err())
+}
+
+// Sign returns the signature of the body sent at timestamp, the receivers compute it again with the shared secret.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Dispatcher delivers the events.
+type Dispatcher struct {
+	Secret   string
+	Attempts int
+	Client   *http.Client
+}
+
+// NewDispatcher create and return a pointer to Dispatcher.
+func NewDispatcher(secret string, attempts int) *Dispatcher {
+	return &Dispatcher{Secret: secret, Attempts: attempts, Client: &http.Client{Timeout: time.Second * 5}}
+}
+
+// Start launches the goroutines that deliver the pending events and move the failed ones back when it is time to retry them.
+func (d *Dispatcher) Start() {
+	go d.dispatch()
+	go d.retry()
+}
+
+func (d *Dispatcher) dispatch() {
+	rClient := storages.GetRedisClient()
+	for {
+		res, err := rClient.BRPop(popTimeout, pendingKey).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			logging.Logger.Error("could not pop callback", "error", err)
+			time.Sleep(popTimeout)
+			continue
+		}
+
+		var j job
+		if err := json.Unmarshal([]byte(res[1]), &j); err != nil {
+			logging.Logger.Error("invalid callback", "job", res[1], "error", err)
+			continue
+		}
+
+		err = d.deliver(context.Background(), j)
+		if err == nil {
+			continue
+		}
+		j.Attempt++
+		if j.Attempt >= d.Attempts {
+			logging.Logger.Error("callback failed, giving up", "url", j.URL, "request_id", j.Event.RequestID, "event", j.Event.Event, "error", err)
+			continue
+		}
+		logging.Logger.Warn("callback failed, retrying", "url", j.URL, "request_id", j.Event.RequestID, "attempt", j.Attempt, "error", err)
+		data, _ := json.Marshal(j)
+		at := time.Now().Add(backoff(j.Attempt)).Unix()
+		if err := rClient.ZAdd(retryKey, redis.Z{Score: float64(at), Member: data}).Err(); err != nil {
+			logging.Logger.Error("could not schedule callback retry", "error", err)
+		}
+	}
+}
+
+// retry moves the events whose time has come back to the pending list.
+func (d *Dispatcher) retry() {
+	rClient := storages.GetRedisClient()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := strconv.FormatInt(time.Now().Unix(), 10)
+		jobs, err := rClient.ZRangeByScore(retryKey, redis.ZRangeBy{Min: "-inf", Max: now}).Result()
+		if err != nil {
+			logging.Logger.Error("could not get callback retries", "error", err)
+			continue
+		}
+		for _, j := range jobs {
+			// Only the instance that removes the job from the set moves it, so it is never sent twice.
+			if n, err := rClient.ZRem(retryKey, j).Result(); err != nil || n == 0 {
+				continue
+			}
+			if err := rClient.LPush(pendingKey, j).Err(); err != nil {
+				logging.Logger.Error("could not queue callback retry", "error", err)
+			}
+		}
+	}
+}
+
+// backoff returns the wait before the attempt with the callbacks policy, the retries are scheduled in Redis
+// so they survive the restarts and only the wait of the policy is used.
+func backoff(attempt int) time.Duration {
+	return retry.For(retry.Callbacks).Backoff(attempt)
+}
+
+// deliver posts the signed event, the non 2xx responses are errors.
+func (d *Dispatcher) deliver(ctx context.Context, j job) error {
+	body, err := json.Marshal(j.Event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, j.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	ts := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TimestampHeader, strconv.FormatInt(ts, 10))
+	req.Header.Set(SignatureHeader, Sign(d.Secret, ts, body))
+
+	res, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("callback returned %s", res.Status)
+	}
+	return nil
+}
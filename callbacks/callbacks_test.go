@@ -0,0 +1,54 @@
+package callbacks
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDeliver(t *testing.T) {
+	var valid bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		ts, _ := strconv.ParseInt(r.Header.Get(TimestampHeader), 10, 64)
+		valid = r.Header.Get(SignatureHeader) == Sign("secret", ts, body)
+	}))
+	defer server.Close()
+
+	d := NewDispatcher("secret", 3)
+	j := job{URL: server.URL, Event: Event{Event: "matched", RequestID: "1"}}
+	if err := d.deliver(context.Background(), j); err != nil {
+		t.Fatalf("could not deliver: %v", err)
+	}
+	if !valid {
+		t.Error("invalid signature")
+	}
+}
+
+func TestDeliverError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	if err := NewDispatcher("secret", 3).deliver(context.Background(), job{URL: server.URL}); err == nil {
+		t.Error("expected error for a 500 response")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	// The jitter takes up to 20% of the wait.
+	if d := backoff(1); d < time.Millisecond*800 || d > time.Second {
+		t.Errorf("unexpected first backoff %s", d)
+	}
+	if d := backoff(3); d < time.Millisecond*3200 || d > time.Second*4 {
+		t.Errorf("unexpected third backoff %s", d)
+	}
+	if d := backoff(100); d < time.Minute*4 || d > time.Minute*5 {
+		t.Errorf("the backoff must be capped, got %s", d)
+	}
+}
@@ -0,0 +1,223 @@
+// Package capacity plans the supply of the zones: it replays the requests of the last days against the current supply
+// of each zone and reports the expected match rate and wait time if the demand repeats.
+// The requests are the hourly demand of the calendar, each hour is a queue where the drivers are the servers.
+package capacity
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/douglasmakey/tracking/calendar"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/maintenance"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// reportKey keeps the last report as JSON, lockKey lets only one instance generate each report.
+const (
+	reportKey = "capacity:report"
+	lockKey   = "capacity:lock"
+)
+
+// Zone is the expected result of the replay in a zone.
+type Zone struct {
+	Zone string `json:"zone"`
+	// Supply is the drivers of the zone when the report was generated.
+	Supply   int64 `json:"supply"`
+	Requests int64 `json:"requests"`
+	// MatchRate is the share of the requests that find a driver and Wait the average wait of the matched requests.
+	MatchRate float64 `json:"match_rate"`
+	Wait      float64 `json:"wait_seconds"`
+	// SaturatedHours is the number of hours with more requests than the drivers can serve.
+	SaturatedHours int `json:"saturated_hours"`
+}
+
+// Report is the replay of the demand of the last Days, the zones are sorted from the lowest match rate.
+type Report struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	Days        int       `json:"days"`
+	Requests    int64     `json:"requests"`
+	MatchRate   float64   `json:"match_rate"`
+	Wait        float64   `json:"wait_seconds"`
+	Zones       []Zone    `json:"zones"`
+}
+
+// Model is how the drivers serve the requests.
+type Model struct {
+	// TripsPerHour is the number of requests that a driver serves in an hour.
+	TripsPerHour float64
+	// MaxWait is the time that a request waits for a driver before it expires, e.g. the TTL of the requests.
+	MaxWait time.Duration
+}
+
+// Replay returns the expected result of the hourly demand of a zone with the supply. Each hour is an M/M/c queue:
+// the requests arrive at the rate of the hour and wait for one of the supply drivers, the requests that would wait
+// more than MaxWait expire. When the requests are more than the drivers can serve, only the capacity is matched.
+func (m Model) Replay(demand []int64, supply int64) Zone {
+	z := Zone{Supply: supply}
+	var matched, waited float64
+	for _, requests := range demand {
+		if requests <= 0 {
+			continue
+		}
+		z.Requests += requests
+		n, wait, saturated := m.hour(float64(requests), float64(supply))
+		matched += n
+		waited += n * wait.Seconds()
+		if saturated {
+			z.SaturatedHours++
+		}
+	}
+	if z.Requests > 0 {
+		z.MatchRate = matched / float64(z.Requests)
+	}
+	if matched > 0 {
+		z.Wait = waited / matched
+	}
+	return z
+}
+
+// hour returns the matched requests of an hour and their average wait.
+func (m Model) hour(requests, drivers float64) (float64, time.Duration, bool) {
+	if drivers == 0 || m.TripsPerHour <= 0 {
+		return 0, 0, true
+	}
+	capacity := drivers * m.TripsPerHour
+	if requests >= capacity {
+		return capacity, m.MaxWait, true
+	}
+
+	// The wait is exponential with the probability of waiting as its weight,
+	// the requests that would wait more than MaxWait expire.
+	waits := erlangC(int(drivers), requests/m.TripsPerHour)
+	rate := capacity - requests
+	expired := waits * math.Exp(-rate*m.MaxWait.Hours())
+	wait := time.Duration(waits / rate * float64(time.Hour))
+	if wait > m.MaxWait {
+		wait = m.MaxWait
+	}
+	return requests * (1 - expired), wait, false
+}
+
+// erlangC returns the probability that a request waits in a queue with c servers and a load of a, it must be lower than c.
+// It is computed from the Erlang B recurrence, which does not overflow with many servers.
+func erlangC(c int, a float64) float64 {
+	b := 1.0
+	for k := 1; k <= c; k++ {
+		b = a * b / (float64(k) + a*b)
+	}
+	return float64(c) * b / (float64(c) - a*(1-b))
+}
+
+// Generate replays the demand of the days until now of every zone with its current supply.
+// The days are at most the weeks kept by the calendar.
+func Generate(now time.Time, days int, m Model) (Report, error) {
+	if max := calendar.Weeks * 7; days > max {
+		days = max
+	}
+	from := now.Add(-time.Duration(days) * time.Hour * 24)
+	zones, err := calendar.Zones(from, now)
+	if err != nil {
+		return Report{}, err
+	}
+
+	report := Report{GeneratedAt: now.UTC(), Days: days, Zones: make([]Zone, 0, len(zones))}
+	var matched, waited float64
+	for _, zone := range zones {
+		demand, err := calendar.Demand(zone, from, now)
+		if err != nil {
+			return Report{}, err
+		}
+		supply, err := calendar.Supply(zone, now)
+		if err != nil {
+			return Report{}, err
+		}
+		z := m.Replay(demand, supply)
+		if z.Requests == 0 {
+			continue
+		}
+		z.Zone = zone
+		report.Zones = append(report.Zones, z)
+		report.Requests += z.Requests
+		matched += z.MatchRate * float64(z.Requests)
+		waited += z.Wait * z.MatchRate * float64(z.Requests)
+	}
+	if report.Requests > 0 {
+		report.MatchRate = matched / float64(report.Requests)
+	}
+	if matched > 0 {
+		report.Wait = waited / matched
+	}
+	sort.Slice(report.Zones, func(i, j int) bool { return report.Zones[i].MatchRate < report.Zones[j].MatchRate })
+	return report, nil
+}
+
+// Get returns the last report, false if none was generated yet.
+func Get() (Report, bool, error) {
+	var data string
+	err := storages.WithRetry(func() (err error) {
+		data, err = storages.GetRedisClient().Get(reportKey).Result()
+		return err
+	})
+	if err == redis.Nil {
+		return Report{}, false, nil
+	}
+	if err != nil {
+		return Report{}, false, err
+	}
+	var r Report
+	if err := json.Unmarshal([]byte(data), &r); err != nil {
+		return Report{}, false, fmt.Errorf("invalid capacity report: %w", err)
+	}
+	return r, true, nil
+}
+
+// Planner generates the report every Interval with the demand of the last Days.
+type Planner struct {
+	Interval time.Duration
+	Days     int
+	Model    Model
+}
+
+// Start launches the planner in a goroutine, the first report is generated at start.
+func (p Planner) Start() {
+	go func() {
+		p.run(time.Now())
+		ticker := time.NewTicker(p.Interval)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			if maintenance.Paused() {
+				continue
+			}
+			p.run(now)
+		}
+	}()
+}
+
+func (p Planner) run(now time.Time) {
+	rClient := storages.GetRedisClient()
+	// Every instance runs the planner, only the first one of each interval generates the report.
+	ok, err := rClient.SetNX(lockKey, 1, p.Interval/2).Result()
+	if err != nil || !ok {
+		return
+	}
+
+	report, err := Generate(now, p.Days, p.Model)
+	if err != nil {
+		logging.Logger.Error("could not generate capacity report", "error", err)
+		return
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		logging.Logger.Error("could not encode capacity report", "error", err)
+		return
+	}
+	if err := rClient.Set(reportKey, data, 0).Err(); err != nil {
+		logging.Logger.Error("could not save capacity report", "error", err)
+	}
+}
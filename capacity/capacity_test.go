@@ -0,0 +1,48 @@
+package capacity
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestErlangC(t *testing.T) {
+	// A single server waits with the probability of its load.
+	if got := erlangC(1, 0.5); math.Abs(got-0.5) > 1e-9 {
+		t.Errorf("expected 0.5, got %v", got)
+	}
+	// Two servers with a load of 1: C = 1/3.
+	if got := erlangC(2, 1); math.Abs(got-1.0/3) > 1e-9 {
+		t.Errorf("expected 0.333, got %v", got)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	m := Model{TripsPerHour: 2, MaxWait: time.Minute * 4}
+
+	// Enough drivers: almost every request is matched with a short wait.
+	z := m.Replay([]int64{10, 0, 10}, 20)
+	if z.Requests != 20 || z.SaturatedHours != 0 {
+		t.Errorf("unexpected replay %+v", z)
+	}
+	if z.MatchRate < 0.99 || z.Wait > 60 {
+		t.Errorf("expected a high match rate and a short wait, got %+v", z)
+	}
+
+	// 5 drivers serve 10 requests per hour, the hour with 40 requests matches a quarter of them.
+	z = m.Replay([]int64{40}, 5)
+	if z.SaturatedHours != 1 || math.Abs(z.MatchRate-0.25) > 1e-9 || z.Wait != 240 {
+		t.Errorf("unexpected saturated replay %+v", z)
+	}
+
+	// Without drivers nothing is matched.
+	z = m.Replay([]int64{3}, 0)
+	if z.MatchRate != 0 || z.Wait != 0 || z.SaturatedHours != 1 {
+		t.Errorf("unexpected replay without supply %+v", z)
+	}
+
+	// Without demand there is nothing to report.
+	if z := m.Replay(nil, 5); z.Requests != 0 || z.MatchRate != 0 {
+		t.Errorf("unexpected empty replay %+v", z)
+	}
+}
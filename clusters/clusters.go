@@ -0,0 +1,189 @@
+// Package clusters groups the drivers of a viewport in geohash cells for the map dashboards,
+// the dashboards refresh often so they can receive only the cells that changed since their last response.
+package clusters
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// snapshotTTL is the time that the cells of a version are kept, a client that refreshes later receives all the cells.
+const snapshotTTL = time.Minute * 5
+
+// Cell is a group of drivers, Lat and Lng are the centroid of the drivers rounded to about 10m.
+// A cell with Count zero in a diff means that the cell is empty now.
+type Cell struct {
+	ID    string  `json:"id"`
+	Lat   float64 `json:"lat"`
+	Lng   float64 `json:"lng"`
+	Count int     `json:"count"`
+}
+
+// Build groups the drivers in the cells of the geohash precision, each driver has a single position
+// so the repeated pings of a driver are counted once.
+func Build(drivers []redis.GeoLocation, precision int) map[string]Cell {
+	type sum struct {
+		lat, lng float64
+		n        int
+	}
+	sums := make(map[string]*sum)
+	for _, d := range drivers {
+		id := geo.Geohash(geo.Point{Lat: d.Latitude, Lng: d.Longitude}, precision)
+		if sums[id] == nil {
+			sums[id] = &sum{}
+		}
+		sums[id].lat += d.Latitude
+		sums[id].lng += d.Longitude
+		sums[id].n++
+	}
+
+	round := func(v float64) float64 { return math.Round(v*1e4) / 1e4 }
+	cells := make(map[string]Cell, len(sums))
+	for id, s := range sums {
+		cells[id] = Cell{ID: id, Lat: round(s.lat / float64(s.n)), Lng: round(s.lng / float64(s.n)), Count: s.n}
+	}
+	return cells
+}
+
+// Version returns a token that identifies the cells, the same cells have the same version.
+func Version(cells map[string]Cell) string {
+	ids := make([]string, 0, len(cells))
+	for id := range cells {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	h := sha256.New()
+	for _, id := range ids {
+		c := cells[id]
+		fmt.Fprintf(h, "%s:%g:%g:%d;", id, c.Lat, c.Lng, c.Count)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// Diff returns the cells of cur that are new or changed since prev and the cells of prev that are empty now.
+func Diff(prev, cur map[string]Cell) []Cell {
+	changed := []Cell{}
+	for id, c := range cur {
+		if p, ok := prev[id]; !ok || p != c {
+			changed = append(changed, c)
+		}
+	}
+	for id, p := range prev {
+		if _, ok := cur[id]; !ok {
+			changed = append(changed, Cell{ID: id, Lat: p.Lat, Lng: p.Lng})
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool { return changed[i].ID < changed[j].ID })
+	return changed
+}
+
+// List returns the cells sorted by ID.
+func List(cells map[string]Cell) []Cell {
+	list := make([]Cell, 0, len(cells))
+	for _, c := range cells {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func snapshotKey(version string) string {
+	return fmt.Sprintf("clusters:snapshot:%s", version)
+}
+
+// Save keeps the cells of the version, so the next refresh of the client can be diffed against them.
+func Save(version string, cells map[string]Cell) error {
+	data, err := json.Marshal(cells)
+	if err != nil {
+		return err
+	}
+	rClient := storages.GetRedisClient()
+	return storages.Classify(rClient.Set(snapshotKey(version), data, snapshotTTL).Err())
+}
+
+// Load returns the cells of the version, false if the version expired or never existed.
+func Load(version string) (map[string]Cell, bool, error) {
+	rClient := storages.GetRedisClient()
+	var data []byte
+	err := storages.WithRetry(func() (err error) {
+		data, err = rClient.Get(snapshotKey(version)).Bytes()
+		return err
+	})
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	var cells map[string]Cell
+	if err := json.Unmarshal(data, &cells); err != nil {
+		return nil, false, err
+	}
+	return cells, true, nil
+}
+
+// Density is the number of drivers per cell of a box for the heatmaps of the dashboards.
+type Density struct {
+	Precision int       `json:"resolution"`
+	Total     int       `json:"total"`
+	Cells     []Cell    `json:"cells"`
+	Generated time.Time `json:"generated_at"`
+}
+
+// NewDensity returns the density of the cells of the precision.
+func NewDensity(cells map[string]Cell, precision int) *Density {
+	d := &Density{Precision: precision, Cells: List(cells), Generated: time.Now().UTC()}
+	for _, c := range d.Cells {
+		d.Total += c.Count
+	}
+	return d
+}
+
+// DensityKey returns the cache key of the density of a box, the corners are rounded to about 10m
+// so the dashboards that show the same area share it.
+func DensityKey(minLat, minLng, maxLat, maxLng float64, precision int) string {
+	return fmt.Sprintf("clusters:density:%d:%.4f,%.4f,%.4f,%.4f", precision, minLat, minLng, maxLat, maxLng)
+}
+
+// SaveDensity caches the density for ttl.
+func SaveDensity(key string, d *Density, ttl time.Duration) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	rClient := storages.GetRedisClient()
+	return storages.Classify(rClient.Set(key, data, ttl).Err())
+}
+
+// LoadDensity returns the cached density, false if it expired.
+func LoadDensity(key string) (*Density, bool, error) {
+	rClient := storages.GetRedisClient()
+	var data []byte
+	err := storages.WithRetry(func() (err error) {
+		data, err = rClient.Get(key).Bytes()
+		return err
+	})
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	var d Density
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, false, err
+	}
+	return &d, true, nil
+}
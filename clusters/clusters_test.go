@@ -0,0 +1,66 @@
+package clusters
+
+import (
+	"testing"
+
+	"github.com/go-redis/redis"
+)
+
+func TestBuildAndDiff(t *testing.T) {
+	drivers := []redis.GeoLocation{
+		{Name: "1", Latitude: -33.4489, Longitude: -70.6693},
+		{Name: "2", Latitude: -33.4490, Longitude: -70.6694},
+		{Name: "3", Latitude: -33.5000, Longitude: -70.7000},
+	}
+	prev := Build(drivers, 6)
+	if len(prev) != 2 {
+		t.Fatalf("expected 2 cells, got %d", len(prev))
+	}
+
+	// The same drivers have the same version.
+	if Version(prev) != Version(Build(drivers, 6)) {
+		t.Error("expected the same version")
+	}
+
+	// The driver 3 leaves and the driver 4 joins the first cell.
+	cur := Build([]redis.GeoLocation{drivers[0], drivers[1], {Name: "4", Latitude: -33.4489, Longitude: -70.6693}}, 6)
+	diff := Diff(prev, cur)
+	if len(diff) != 2 {
+		t.Fatalf("expected 2 changed cells, got %v", diff)
+	}
+	var removed, grown bool
+	for _, c := range diff {
+		if c.Count == 0 {
+			removed = true
+		}
+		if c.Count == 3 {
+			grown = true
+		}
+	}
+	if !removed || !grown {
+		t.Errorf("unexpected diff %v", diff)
+	}
+
+	if d := Diff(cur, cur); len(d) != 0 {
+		t.Errorf("expected no changes, got %v", d)
+	}
+}
+
+func TestDensity(t *testing.T) {
+	d := NewDensity(Build([]redis.GeoLocation{
+		{Name: "1", Latitude: -33.4489, Longitude: -70.6693},
+		{Name: "2", Latitude: -33.4490, Longitude: -70.6694},
+		{Name: "3", Latitude: -33.5000, Longitude: -70.7000},
+	}, 6), 6)
+	if d.Total != 3 || len(d.Cells) != 2 {
+		t.Errorf("unexpected density %+v", d)
+	}
+
+	// The boxes that differ by less than the rounding share the key.
+	if DensityKey(-33.50001, -70.70001, -33.4, -70.6, 6) != DensityKey(-33.50002, -70.70002, -33.4, -70.6, 6) {
+		t.Error("expected the same key")
+	}
+	if DensityKey(-33.5, -70.7, -33.4, -70.6, 6) == DensityKey(-33.5, -70.7, -33.4, -70.6, 7) {
+		t.Error("expected a key per resolution")
+	}
+}
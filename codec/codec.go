@@ -0,0 +1,96 @@
+// Package codec encodes the bodies of the high volume endpoints as JSON or MessagePack,
+// the format is negotiated with the Content-Type and Accept headers.
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// These are the supported media types.
+const (
+	JSON    = "application/json"
+	MsgPack = "application/msgpack"
+)
+
+// isMsgPack returns true for the media types used for MessagePack.
+func isMsgPack(mediaType string) bool {
+	switch mediaType {
+	case MsgPack, "application/x-msgpack", "application/vnd.msgpack":
+		return true
+	}
+	return false
+}
+
+func mediaType(header string) string {
+	t, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return ""
+	}
+	return t
+}
+
+// Decode decodes the body of the request according to its Content-Type, JSON is the default.
+func Decode(r *http.Request, v interface{}) error {
+	if isMsgPack(mediaType(r.Header.Get("Content-Type"))) {
+		dec := msgpack.NewDecoder(r.Body)
+		// The fields have the same names in both formats.
+		dec.SetCustomStructTag("json")
+		return dec.Decode(v)
+	}
+	return json.NewDecoder(r.Body).Decode(v)
+}
+
+// Negotiate returns the media type of the response, MessagePack if the client accepts it
+// or, without Accept, if the request was sent in MessagePack.
+func Negotiate(r *http.Request) string {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		if isMsgPack(mediaType(r.Header.Get("Content-Type"))) {
+			return MsgPack
+		}
+		return JSON
+	}
+	for _, part := range strings.Split(accept, ",") {
+		t := mediaType(strings.TrimSpace(part))
+		if isMsgPack(t) {
+			return MsgPack
+		}
+		if t == JSON || t == "*/*" || t == "application/*" {
+			return JSON
+		}
+	}
+	return JSON
+}
+
+// Encode writes v to w in the media type.
+func Encode(w io.Writer, media string, v interface{}) error {
+	if media == MsgPack {
+		enc := msgpack.NewEncoder(w)
+		enc.SetCustomStructTag("json")
+		return enc.Encode(v)
+	}
+	return json.NewEncoder(w).Encode(v)
+}
+
+// Write writes v as the body of the response in the negotiated media type.
+func Write(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	media := Negotiate(r)
+	var buf bytes.Buffer
+	if err := Encode(&buf, media, v); err != nil {
+		httputil.WriteError(w, httputil.CodeInternal, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", media)
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
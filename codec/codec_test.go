@@ -0,0 +1,32 @@
+package codec
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		contentType, accept, want string
+	}{
+		{"", "", JSON},
+		{"application/json", "", JSON},
+		{"application/msgpack", "", MsgPack},
+		{"application/json", "application/x-msgpack", MsgPack},
+		{"application/msgpack", "application/json", JSON},
+		{"", "text/html, application/msgpack;q=0.9", MsgPack},
+		{"", "*/*", JSON},
+	}
+	for _, tt := range tests {
+		r, _ := http.NewRequest(http.MethodPost, "/", nil)
+		if tt.contentType != "" {
+			r.Header.Set("Content-Type", tt.contentType)
+		}
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		if got := Negotiate(r); got != tt.want {
+			t.Errorf("Negotiate(%q, %q) = %s, want %s", tt.contentType, tt.accept, got, tt.want)
+		}
+	}
+}
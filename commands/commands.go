@@ -0,0 +1,223 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/metrics"
+	"github.com/gorilla/websocket"
+)
+
+// These are the kinds of commands that the server can push to a driver.
+const (
+	TypeOffer      = "offer"
+	TypeCancel     = "cancel"
+	TypeReposition = "reposition"
+	TypeWarning    = "warning"
+)
+
+const (
+	// retryInterval is the time that we wait for an ack before sending a command again.
+	retryInterval = time.Second * 5
+	// maxAttempts is the number of times that a command is sent before giving up.
+	maxAttempts = 5
+)
+
+// ErrNotConnected is returned when the driver does not have an open channel in any instance.
+var ErrNotConnected = errors.New("driver not connected")
+
+// Command is a message pushed from the server to a driver, the driver must ack it with the same Seq.
+type Command struct {
+	Seq     uint64      `json:"seq"`
+	Type    string      `json:"type"`
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+// ClientMessage is a message sent from the driver to the server.
+type ClientMessage struct {
+	Type string `json:"type"`
+	Seq  uint64 `json:"seq"`
+}
+
+type pending struct {
+	cmd      Command
+	attempts int
+	sentAt   time.Time
+}
+
+// Session is the channel of a connected driver.
+type Session struct {
+	// ID identifies the session in the admin API, a driver that reconnects has a new session.
+	ID       string
+	DriverID string
+	Started  time.Time
+
+	// received and sent count the messages of the session, lastActivity is the unix nano time of the last one.
+	received     uint64
+	sent         uint64
+	lastActivity int64
+
+	conn    *websocket.Conn
+	mu      sync.Mutex // protects conn writes, seq and pending
+	seq     uint64
+	pending map[uint64]*pending
+	done    chan struct{}
+}
+
+var (
+	mu       sync.RWMutex
+	sessions = make(map[string]*Session)
+)
+
+// Open registers a new channel for the driver, if the driver already has one the old one is closed.
+func Open(driverID string, conn *websocket.Conn) *Session {
+	now := time.Now()
+	s := &Session{
+		ID:           logging.NewID(),
+		DriverID:     driverID,
+		Started:      now,
+		lastActivity: now.UnixNano(),
+		conn:         conn,
+		pending:      make(map[uint64]*pending),
+		done:         make(chan struct{}),
+	}
+
+	mu.Lock()
+	old := sessions[driverID]
+	sessions[driverID] = s
+	if old == nil {
+		subscribe(driverID)
+	}
+	mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	} else {
+		metrics.CommandSessions.Inc()
+	}
+
+	go s.retryLoop()
+	return s
+}
+
+// Send pushes a command to the driver, the command is retried until the driver acks it. The command is relayed
+// to the instance with the session of the driver when it is not open in this instance.
+func Send(driverID, cmdType string, payload interface{}) error {
+	mu.RLock()
+	s, ok := sessions[driverID]
+	mu.RUnlock()
+	if !ok {
+		return relay(driverID, cmdType, payload)
+	}
+
+	return s.Send(cmdType, payload)
+}
+
+// Send pushes a command to the driver of this session.
+func (s *Session) Send(cmdType string, payload interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	p := &pending{cmd: Command{Seq: s.seq, Type: cmdType, Payload: payload}}
+	s.pending[p.cmd.Seq] = p
+	return s.write(p)
+}
+
+// Ack removes the command from the pending commands.
+func (s *Session) Ack(seq uint64) {
+	s.mu.Lock()
+	delete(s.pending, seq)
+	s.mu.Unlock()
+}
+
+// Listen reads the messages of the driver until the connection is closed.
+func (s *Session) Listen() {
+	defer s.Close()
+	for {
+		var msg ClientMessage
+		if err := s.conn.ReadJSON(&msg); err != nil {
+			if _, ok := err.(*json.SyntaxError); ok {
+				logging.Logger.Warn("invalid message from driver", "driver_id", s.DriverID, "error", err)
+				continue
+			}
+			return
+		}
+		atomic.AddUint64(&s.received, 1)
+		atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+
+		switch msg.Type {
+		case "ack":
+			s.Ack(msg.Seq)
+		default:
+			logging.Logger.Warn("unknown message type from driver", "type", msg.Type, "driver_id", s.DriverID)
+		}
+	}
+}
+
+// Close closes the connection and removes the session if it is still the current one for the driver.
+func (s *Session) Close() {
+	mu.Lock()
+	if sessions[s.DriverID] == s {
+		delete(sessions, s.DriverID)
+		unsubscribe(s.DriverID)
+		metrics.CommandSessions.Dec()
+	}
+	mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+		return
+	default:
+		close(s.done)
+		s.conn.Close()
+	}
+}
+
+// retryLoop sends again the commands that have not been acked in time.
+func (s *Session) retryLoop() {
+	ticker := time.NewTicker(retryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			for seq, p := range s.pending {
+				if time.Since(p.sentAt) < retryInterval {
+					continue
+				}
+				if p.attempts >= maxAttempts {
+					logging.Logger.Warn("command was not acked", "seq", seq, "driver_id", s.DriverID, "attempts", p.attempts)
+					delete(s.pending, seq)
+					continue
+				}
+				if err := s.write(p); err != nil {
+					logging.Logger.Warn("could not send command", "seq", seq, "driver_id", s.DriverID, "error", err)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// write sends the command through the connection, s.mu must be held.
+func (s *Session) write(p *pending) error {
+	p.attempts++
+	p.sentAt = time.Now()
+	s.conn.SetWriteDeadline(time.Now().Add(retryInterval))
+	if err := s.conn.WriteJSON(p.cmd); err != nil {
+		return err
+	}
+	atomic.AddUint64(&s.sent, 1)
+	atomic.StoreInt64(&s.lastActivity, p.sentAt.UnixNano())
+	return nil
+}
@@ -0,0 +1,97 @@
+package commands
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/douglasmakey/tracking/config"
+	"github.com/douglasmakey/tracking/recovery"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/gorilla/websocket"
+)
+
+// killChannel is the Redis channel of the terminated sessions, the payload is the session ID.
+const killChannel = "commands:kill"
+
+// closeTimeout is the max time to tell the driver why its session is terminated.
+const closeTimeout = time.Second
+
+// SessionInfo describes a session open in this instance.
+type SessionInfo struct {
+	ID           string    `json:"id"`
+	DriverID     string    `json:"driver_id"`
+	Shard        string    `json:"shard"`
+	Started      time.Time `json:"started"`
+	Duration     float64   `json:"duration_seconds"`
+	Received     uint64    `json:"messages_received"`
+	Sent         uint64    `json:"messages_sent"`
+	LastActivity time.Time `json:"last_activity"`
+}
+
+// Sessions returns the sessions open in this instance, the oldest first.
+func Sessions() []SessionInfo {
+	shard := config.Get().ShardID
+	now := time.Now()
+	mu.RLock()
+	list := make([]SessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		list = append(list, SessionInfo{
+			ID:           s.ID,
+			DriverID:     s.DriverID,
+			Shard:        shard,
+			Started:      s.Started,
+			Duration:     now.Sub(s.Started).Seconds(),
+			Received:     atomic.LoadUint64(&s.received),
+			Sent:         atomic.LoadUint64(&s.sent),
+			LastActivity: time.Unix(0, atomic.LoadInt64(&s.lastActivity)),
+		})
+	}
+	mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+	return list
+}
+
+// Terminate closes the session in any instance, e.g. a compromised device or a stuck connection. It returns true when the
+// session was open in this instance, otherwise the other instances are asked to close it. The driver can connect again.
+func Terminate(id string) (bool, error) {
+	if kill(id) {
+		return true, nil
+	}
+	rClient := storages.GetRedisClient()
+	return false, storages.Classify(rClient.Publish(killChannel, id).Err())
+}
+
+// kill closes the session if it is open in this instance.
+func kill(id string) bool {
+	var s *Session
+	mu.RLock()
+	for _, open := range sessions {
+		if open.ID == id {
+			s = open
+			break
+		}
+	}
+	mu.RUnlock()
+	if s == nil {
+		return false
+	}
+
+	// WriteControl can be called concurrently with the writes of the session.
+	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session terminated")
+	s.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeTimeout))
+	s.Close()
+	return true
+}
+
+// ListenKills closes the sessions terminated through any instance. The terminations published while the subscription
+// reconnects are lost, the admin can terminate the session again.
+func ListenKills() {
+	recovery.Go("session_kill_listener", func() {
+		sub := storages.GetRedisClient().Subscribe(killChannel)
+		defer sub.Close()
+		for msg := range sub.Channel() {
+			kill(msg.Payload)
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package commands
+
+import (
+	"encoding/json"
+
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/recovery"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// relayed is a command sent to a driver whose session is open in another instance.
+type relayed struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// relaySub receives the commands of the drivers with a session in this instance, it is nil until ListenCommands is called.
+// It is protected by mu, the channels are subscribed and unsubscribed with the sessions.
+var relaySub *redis.PubSub
+
+// commandsChannel is the Redis channel of the commands of the driver, only the instance with its session subscribes to it.
+func commandsChannel(driverID string) string {
+	return "commands:driver:" + driverID
+}
+
+// relay publishes the command to the instance that has the session of the driver, it returns ErrNotConnected
+// when no instance has it.
+func relay(driverID, cmdType string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	msg, err := json.Marshal(relayed{Type: cmdType, Payload: data})
+	if err != nil {
+		return err
+	}
+
+	rClient := storages.GetRedisClient()
+	n, err := rClient.Publish(commandsChannel(driverID), msg).Result()
+	if err != nil {
+		return storages.Classify(err)
+	}
+	if n == 0 {
+		return ErrNotConnected
+	}
+	return nil
+}
+
+// ListenCommands sends the commands published by any instance to the sessions open in this instance. The commands published
+// while the subscription reconnects are lost, like the commands of a driver without session.
+func ListenCommands() {
+	mu.Lock()
+	relaySub = storages.GetRedisClient().Subscribe()
+	channels := make([]string, 0, len(sessions))
+	for driverID := range sessions {
+		channels = append(channels, commandsChannel(driverID))
+	}
+	if len(channels) > 0 {
+		if err := relaySub.Subscribe(channels...); err != nil {
+			logging.Logger.Warn("could not subscribe to the commands of the drivers", "error", err)
+		}
+	}
+	sub := relaySub
+	mu.Unlock()
+
+	recovery.Go("command_relay", func() {
+		for msg := range sub.Channel() {
+			var r relayed
+			if err := json.Unmarshal([]byte(msg.Payload), &r); err != nil {
+				logging.Logger.Warn("invalid relayed command", "channel", msg.Channel, "error", err)
+				continue
+			}
+			driverID := msg.Channel[len(commandsChannel("")):]
+			mu.RLock()
+			s, ok := sessions[driverID]
+			mu.RUnlock()
+			if !ok {
+				continue
+			}
+			if err := s.Send(r.Type, r.Payload); err != nil {
+				logging.Logger.Warn("could not send relayed command", "driver_id", driverID, "type", r.Type, "error", err)
+			}
+		}
+	})
+}
+
+// subscribe receives the commands of the driver in this instance, mu must be held.
+func subscribe(driverID string) {
+	if relaySub == nil {
+		return
+	}
+	if err := relaySub.Subscribe(commandsChannel(driverID)); err != nil {
+		logging.Logger.Warn("could not subscribe to the commands of the driver", "driver_id", driverID, "error", err)
+	}
+}
+
+// unsubscribe stops receiving the commands of the driver in this instance, mu must be held.
+func unsubscribe(driverID string) {
+	if relaySub == nil {
+		return
+	}
+	if err := relaySub.Unsubscribe(commandsChannel(driverID)); err != nil {
+		logging.Logger.Warn("could not unsubscribe from the commands of the driver", "driver_id", driverID, "error", err)
+	}
+}
@@ -0,0 +1,706 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config contains the settings of the service, the values are read from environment variables.
+type Config struct {
+	// Addr is the address where the HTTP server listens.
+	Addr string
+	// FeaturesFile is the file where the match decisions are exported, empty disables the export.
+	FeaturesFile string
+
+	// RedisAddrs are the addresses of Redis: a single server, the Sentinels of RedisMasterName or the nodes of a cluster with RedisCluster.
+	RedisAddrs      []string
+	RedisMasterName string
+	RedisCluster    bool
+	RedisPassword   string
+	RedisDB         int
+	// RedisBreakerThreshold is the number of consecutive Redis errors that open the circuit breaker, RedisReconnectMax
+	// the max wait between the pings while it is open and RedisConnectTimeout how long the start waits for Redis.
+	RedisBreakerThreshold int
+	RedisReconnectMax     time.Duration
+	RedisConnectTimeout   time.Duration
+
+	// RedisPoolSize is the max number of connections to each Redis server and RedisMinIdleConns the connections kept open,
+	// zero keeps the defaults of the client. RedisPoolTimeout is how long a command waits for a free connection.
+	RedisPoolSize     int
+	RedisMinIdleConns int
+	RedisDialTimeout  time.Duration
+	RedisReadTimeout  time.Duration
+	RedisWriteTimeout time.Duration
+	RedisPoolTimeout  time.Duration
+	RedisIdleTimeout  time.Duration
+	// RedisMaxRedirects is the number of MOVED and ASK redirections followed by the cluster client, zero keeps the default.
+	// The writes of the locations are retried with the storage policy when the redirections are not enough during a reshard.
+	RedisMaxRedirects int
+
+	// LiveShards is the number of Redis channels of the live locations, the instances only subscribe to the channels
+	// of the drivers followed by their connections. Every instance must use the same number.
+	LiveShards int
+
+	// SearchWorkers is the number of goroutines that process search jobs.
+	SearchWorkers int
+	// SearchInterval is the time between two searches of the same request.
+	SearchInterval time.Duration
+	// With BatchMatching the requests that arrive within BatchWindow in the same cell, up to BatchSize, are assigned together
+	// minimizing the total distance of their drivers instead of the first request taking the nearest driver.
+	BatchMatching bool
+	BatchWindow   time.Duration
+	BatchSize     int
+	// RequestTTL is the duration that a request has to find a driver.
+	RequestTTL time.Duration
+	// SearchRadii is the radius in km around the picking point where the drivers are searched in each attempt,
+	// the radius grows with the attempts and the last one is kept until the request expires.
+	SearchRadii []float64
+	// AccessibleRequestTTL and AccessibleSearchRadii are used for the wheelchair accessible requests,
+	// there are fewer accessible vehicles so they search longer and farther.
+	AccessibleRequestTTL  time.Duration
+	AccessibleSearchRadii []float64
+	// ClassProfiles overrides the TTL and the search radii of the requests of a vehicle class, the format of CLASS_PROFILES is
+	// "class=radius/radius:ttl,...", e.g. "moto=1/2:1m,xl=3/6/10:6m". The profiles saved through the admin API override these.
+	ClassProfiles map[string]ClassProfile
+	// The requests can choose their TTL and search interval, they must be between these bounds.
+	MinRequestTTL     time.Duration
+	MaxRequestTTL     time.Duration
+	MinSearchInterval time.Duration
+	MaxSearchInterval time.Duration
+	// The scheduled rides start the pre-dispatch PreDispatchLead before the pickup: the candidates are tracked without reserving them
+	// and the best one is reserved when its predicted arrival plus PreDispatchMargin reaches the pickup time.
+	// MaxScheduleAhead is how far in the future a ride can be scheduled.
+	PreDispatchLead   time.Duration
+	PreDispatchMargin time.Duration
+	MaxScheduleAhead  time.Duration
+
+	// MatchingStrategy is the strategy used by the requests that do not choose one.
+	MatchingStrategy string
+	// LanguageBoost is added to the weighted score of the drivers that speak a language of the rider.
+	LanguageBoost float64
+	// MatchWeightDistance, MatchWeightRating and MatchWeightAcceptance are the weights of the distance, the rating and the
+	// acceptance rate in the weighted score, the weight of the idle time is the fairness weight.
+	MatchWeightDistance   float64
+	MatchWeightRating     float64
+	MatchWeightAcceptance float64
+	// GoHomeCorridor is the distance in km to the way home of the drivers in go-home mode,
+	// they are only offered the requests that drop off inside the corridor.
+	GoHomeCorridor float64
+
+	// AverageSpeed is the average speed in km/h of the drivers, it is used to estimate the ETA without a routing service.
+	// OSRMURL is the OSRM server used to estimate the ETA with the real routes, empty uses the average speed.
+	AverageSpeed float64
+	OSRMURL      string
+
+	// The fairness auditor checks every FairnessInterval the skew of the matches in the last FairnessWindow,
+	// with FairnessAutoAdjust the fairness weight of the weighted strategy is increased when the skew is over FairnessThreshold.
+	FairnessInterval   time.Duration
+	FairnessWindow     time.Duration
+	FairnessThreshold  float64
+	FairnessAutoAdjust bool
+
+	// Notifier is the channel of the messages to the users: log, webhook, firebase or twilio.
+	// The messages are tried NotifyAttempts times.
+	Notifier          string
+	NotifyAttempts    int
+	NotifyWebhookURL  string
+	FirebaseServerKey string
+	TwilioAccountSID  string
+	TwilioAuthToken   string
+	TwilioFrom        string
+
+	// IDSecret encrypts the identifiers exposed in the APIs, empty exposes them as they are.
+	IDSecret string
+
+	// CallbackSecret signs the events posted to the callback URLs of the requests, they are tried CallbackAttempts times.
+	CallbackSecret   string
+	CallbackAttempts int
+
+	// SandboxTimeScale divides the TTL and the search interval of the sandbox requests, so the integrators test the flows faster.
+	SandboxTimeScale int
+
+	// IdempotencyTTL is the time that the responses of the requests with an Idempotency-Key are kept.
+	IdempotencyTTL time.Duration
+
+	// HeatK is the min number of trips of a count in the datasets for the city partners, the lower counts are suppressed.
+	// HeatRetention is the time that the hourly datasets are kept.
+	HeatK         int
+	HeatRetention time.Duration
+
+	// MaintenanceRefresh is how often an instance reads the maintenance window started by any instance.
+	MaintenanceRefresh time.Duration
+
+	// The locations are also read from KafkaTopic when KafkaBrokers is set, the instances share the partitions
+	// with the consumer group KafkaGroup. They are saved in batches of up to KafkaBatchSize or every KafkaBatchWait.
+	KafkaBrokers   []string
+	KafkaTopic     string
+	KafkaGroup     string
+	KafkaBatchSize int
+	KafkaBatchWait time.Duration
+
+	// Bus is where the events of the requests, the trips and the locations are published: kafka, nats, redis or empty to not publish them.
+	// BusTopic is the Kafka topic, the prefix of the NATS subjects or the Redis stream, Kafka uses the brokers of KafkaBrokers.
+	// The Redis stream keeps about BusStreamMaxLen events.
+	Bus             string
+	BusTopic        string
+	NATSURL         string
+	BusStreamMaxLen int
+
+	// The locations of the GPS devices are also read from the MQTT broker at MQTTBroker when it is set, the + level of MQTTTopic
+	// is the ID of the driver, e.g. $share/tracking/drivers/+/location shares the messages between the instances when the broker supports it.
+	// MQTTQoS is the quality of service of the subscription.
+	MQTTBroker   string
+	MQTTClientID string
+	MQTTUsername string
+	MQTTPassword string
+	MQTTTopic    string
+	MQTTQoS      int
+
+	// The capacity report is generated every CapacityInterval replaying the demand of the last CapacityDays, at most the weeks
+	// of the calendar, with the current supply of each zone. CapacityTripsPerHour is the number of requests that a driver serves in an hour.
+	CapacityInterval     time.Duration
+	CapacityDays         int
+	CapacityTripsPerHour float64
+
+	// RetryPolicies overrides the retry policy of the integrations, the format of RETRY_POLICIES is
+	// "integration=attempts:initial:max,...", e.g. "storage=3:50ms:500ms,notify=5:200ms:5s".
+	RetryPolicies map[string]RetryPolicy
+
+	// ShardID identifies the instance in the shared queue, by default the hostname and the pid.
+	// The shards without heartbeat for ShardTimeout are considered dead and their tasks are run by the other shards.
+	ShardID      string
+	ShardTimeout time.Duration
+
+	// DriverTTL is the time after the last location when a driver is removed from the search,
+	// e.g. the driver closed the app. JanitorInterval is how often the stale drivers are removed.
+	DriverTTL       time.Duration
+	JanitorInterval time.Duration
+	// The consistency checker compares every ConsistencyInterval the GEO index with the state of the drivers,
+	// with ConsistencyRepair the discrepancies are repaired, otherwise they are only reported.
+	ConsistencyInterval time.Duration
+	ConsistencyRepair   bool
+	// RegionResolver splits the GEO index of the drivers by region: empty keeps one index, geohash uses the geohash cells
+	// of RegionPrecision characters and cities the polygons of RegionCitiesFile.
+	RegionResolver   string
+	RegionPrecision  int
+	RegionCitiesFile string
+	// LocationStore is where the locations of the drivers are searched: redis, memory, tile38 or postgis. Memory keeps them in the process
+	// for the tests and the local development, it is not shared between instances. Tile38 is the server at Tile38Addr
+	// and PostGIS the database of PostgresDSN, its schema is migrated on start.
+	LocationStore string
+	Tile38Addr    string
+	PostgresDSN   string
+	// The locations are written to the store in batches every LocationFlushInterval or when LocationFlushSize drivers are waiting,
+	// zero writes each location when it is received.
+	LocationFlushInterval time.Duration
+	LocationFlushSize     int
+	// PresenceTTL is the time after the last heartbeat when a driver is not online anymore,
+	// with RequireHeartbeat only the online drivers are matched even if their last location is still in the search.
+	PresenceTTL      time.Duration
+	RequireHeartbeat bool
+
+	// RecoverPanics turns the panics of the handlers into 500 responses instead of crashing the process,
+	// they are also sent to the Sentry compatible service of ErrorReportingDSN when it is set.
+	RecoverPanics     bool
+	ErrorReportingDSN string
+
+	// MaxBodyBytes is the max size in bytes of the bodies of the POST requests, before and after the decompression.
+	MaxBodyBytes int
+
+	// CORSOrigins are the origins of the browser applications that can call the API, e.g. the web console of the operations team,
+	// "*" allows any origin and empty disables CORS. The preflight requests are cached by the browsers for CORSMaxAge.
+	CORSOrigins []string
+	CORSMethods []string
+	CORSHeaders []string
+	CORSMaxAge  time.Duration
+
+	// AssetMaxSize is the max size in bytes of the photos of the drivers. The URLs are shown to the riders as they are
+	// or signed by the service of AssetSignerURL, the signed URLs are valid for AssetURLTTL.
+	AssetMaxSize   int
+	AssetSignerURL string
+	AssetURLTTL    time.Duration
+
+	// NearbyScanInterval is the time between two counts of the drivers around the subscribed points, at most NearbyLimit
+	// drivers are counted. The subscriptions have a radius up to NearbyMaxRadius km and last up to NearbyMaxTTL.
+	NearbyScanInterval time.Duration
+	NearbyLimit        int
+	NearbyMaxRadius    float64
+	NearbyMaxTTL       time.Duration
+
+	// RestrictedZoneInterval is the time between two patrols of the zones with required tags, the drivers without the tags
+	// idle inside one for more than RestrictedZoneGrace are warned.
+	RestrictedZoneInterval time.Duration
+	RestrictedZoneGrace    time.Duration
+
+	// MaxSkippedTicks is the max number of ticks in a row that a search that found nobody skips while no driver reports in its
+	// area, zero always searches. The areas with new locations are published every SupplyPublishInterval.
+	MaxSkippedTicks       int
+	SupplyPublishInterval time.Duration
+
+	// OfferTimeout is the time that the reserved driver has to respond to the offer of a request, the response is checked every
+	// OfferPollInterval. The request falls back to the next candidate when the driver declines or does not respond in time.
+	OfferTimeout      time.Duration
+	OfferPollInterval time.Duration
+
+	// The rider receives the distance and the ETA of the matched driver to the pickup at most every ApproachInterval,
+	// for up to ApproachTTL after the match.
+	ApproachInterval time.Duration
+	ApproachTTL      time.Duration
+
+	// DuplicateRequests is the policy for a search of a user that already has a request searching: reject, existing to return
+	// the active request, or allow.
+	DuplicateRequests string
+
+	// NoShowWait is the time that the driver waits at the pickup before marking the no-show of the riders, each rider is
+	// charged NoShowFee.
+	NoShowWait time.Duration
+	NoShowFee  float64
+
+	// RelayInterval is the time between two checks of the trips with legs, the driver of the next leg is searched when the driver
+	// of the current leg is within RelayLead km of the handoff zone.
+	RelayInterval time.Duration
+	RelayLead     float64
+
+	// TripRetention is the time that a trip is kept after its last change, the receipts and the feedback are read after the trip ends.
+	TripRetention time.Duration
+	// TripRouteRetention is the time that the route of a trip is kept after the trip ends, for the receipts and the disputes.
+	TripRouteRetention time.Duration
+
+	// DensityCacheTTL is the time that the driver density of a box is cached, the dashboards of a city share it.
+	DensityCacheTTL time.Duration
+
+	// PickupSuggestRadius is the max distance in km from the picking point to a suggested pickup point, a point is suggested
+	// after PickupMinTrips completed trips were picked up in it.
+	PickupSuggestRadius float64
+	PickupMinTrips      int
+
+	// StatusSnapshotInterval is the time between two snapshots of the outcomes of the requests of the instance for the status page.
+	StatusSnapshotInterval time.Duration
+
+	// AuthEnabled requires API keys on the driver and rider endpoints, the admin and partner endpoints always require them.
+	AuthEnabled bool
+	// RateLimits is the limit of requests per client of each route, the format of RATE_LIMITS is
+	// "route=rate:burst,..." where rate is the number of requests per second, e.g. "/tracking=1:5,/v2/search=0.1:3".
+	RateLimits map[string]RateLimit
+
+	// OTLPEndpoint is the host:port of the OpenTelemetry collector, empty disables the tracing.
+	OTLPEndpoint string
+	// OTLPInsecure disables TLS for the connection with the collector.
+	OTLPInsecure bool
+}
+
+// RateLimit is the number of requests per second allowed to a client and the burst over it.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// ClassProfile is the search of the requests of a vehicle class.
+type ClassProfile struct {
+	SearchRadii []float64
+	RequestTTL  time.Duration
+}
+
+// RetryPolicy is the number of attempts of an integration and the bounds of the wait between them.
+type RetryPolicy struct {
+	Attempts int
+	Initial  time.Duration
+	Max      time.Duration
+}
+
+var cfg *Config
+var once sync.Once
+
+// Get returns the configuration, it is loaded only once.
+func Get() *Config {
+	once.Do(func() {
+		cfg = &Config{
+			Addr:           getString("ADDR", ":8000"),
+			FeaturesFile:   getString("FEATURES_FILE", ""),
+			SearchWorkers:  getInt("SEARCH_WORKERS", 10),
+			SearchInterval: getDuration("SEARCH_INTERVAL", time.Second*30),
+			BatchMatching:  getBool("BATCH_MATCHING", false),
+			BatchWindow:    getDuration("BATCH_WINDOW", time.Millisecond*500),
+			BatchSize:      getInt("BATCH_SIZE", 10),
+			RequestTTL:     getDuration("REQUEST_TTL", time.Minute*4),
+			SearchRadii:    getFloats("SEARCH_RADII", "1,3,5,10"),
+			AuthEnabled:    getBool("AUTH_ENABLED", false),
+			RateLimits:     getRateLimits("RATE_LIMITS", "/tracking=1:5,/v2/search=0.1:3"),
+			OTLPEndpoint:   getString("OTEL_EXPORTER_OTLP_ENDPOINT", ""),
+			OTLPInsecure:   getBool("OTEL_EXPORTER_OTLP_INSECURE", false),
+
+			RecoverPanics:     getBool("RECOVER_PANICS", true),
+			ErrorReportingDSN: getString("ERROR_REPORTING_DSN", ""),
+
+			MaxBodyBytes: getInt("MAX_BODY_BYTES", 1<<20),
+
+			CORSOrigins: getStrings("CORS_ALLOWED_ORIGINS", ""),
+			CORSMethods: getStrings("CORS_ALLOWED_METHODS", "GET,POST,PUT,DELETE"),
+			CORSHeaders: getStrings("CORS_ALLOWED_HEADERS", "Authorization,Content-Type,Accept,Idempotency-Key,X-Request-ID"),
+			CORSMaxAge:  getDuration("CORS_MAX_AGE", time.Minute*10),
+
+			AssetMaxSize:   getInt("ASSET_MAX_SIZE", 5<<20),
+			AssetSignerURL: getString("ASSET_SIGNER_URL", ""),
+			AssetURLTTL:    getDuration("ASSET_URL_TTL", time.Minute*15),
+
+			NearbyScanInterval: getDuration("NEARBY_SCAN_INTERVAL", time.Second*15),
+			NearbyLimit:        getInt("NEARBY_LIMIT", 20),
+			NearbyMaxRadius:    getFloat("NEARBY_MAX_RADIUS", 5),
+			NearbyMaxTTL:       getDuration("NEARBY_MAX_TTL", time.Minute*30),
+
+			RestrictedZoneInterval: getDuration("RESTRICTED_ZONE_INTERVAL", time.Second*30),
+			RestrictedZoneGrace:    getDuration("RESTRICTED_ZONE_GRACE", time.Minute*5),
+
+			MaxSkippedTicks:       getInt("MAX_SKIPPED_TICKS", 5),
+			SupplyPublishInterval: getDuration("SUPPLY_PUBLISH_INTERVAL", time.Millisecond*200),
+
+			OfferTimeout:      getDuration("OFFER_TIMEOUT", time.Second*20),
+			OfferPollInterval: getDuration("OFFER_POLL_INTERVAL", time.Second*2),
+
+			ApproachInterval: getDuration("APPROACH_INTERVAL", time.Second*5),
+			ApproachTTL:      getDuration("APPROACH_TTL", time.Minute*30),
+
+			DuplicateRequests: getString("DUPLICATE_REQUESTS", "reject"),
+
+			NoShowWait: getDuration("NO_SHOW_WAIT", time.Minute*5),
+			NoShowFee:  getFloat("NO_SHOW_FEE", 5),
+
+			RelayInterval: getDuration("RELAY_INTERVAL", time.Second*30),
+			RelayLead:     getFloat("RELAY_LEAD", 20),
+
+			TripRetention:      getDuration("TRIP_RETENTION", time.Hour*24*90),
+			TripRouteRetention: getDuration("TRIP_ROUTE_RETENTION", time.Hour*24*90),
+
+			DensityCacheTTL: getDuration("DENSITY_CACHE_TTL", time.Second*10),
+
+			PickupSuggestRadius: getFloat("PICKUP_SUGGEST_RADIUS", 0.15),
+			PickupMinTrips:      getInt("PICKUP_MIN_TRIPS", 5),
+
+			StatusSnapshotInterval: getDuration("STATUS_SNAPSHOT_INTERVAL", time.Minute),
+
+			RedisAddrs:      getStrings("REDIS_ADDRS", "localhost:6379"),
+			RedisMasterName: getString("REDIS_MASTER_NAME", ""),
+			RedisCluster:    getBool("REDIS_CLUSTER", false),
+			RedisPassword:   getString("REDIS_PASSWORD", ""),
+			RedisDB:         getInt("REDIS_DB", 0),
+
+			RedisBreakerThreshold: getInt("REDIS_BREAKER_THRESHOLD", 5),
+			RedisReconnectMax:     getDuration("REDIS_RECONNECT_MAX", time.Second*10),
+			RedisConnectTimeout:   getDuration("REDIS_CONNECT_TIMEOUT", time.Second*30),
+
+			RedisPoolSize:     getInt("REDIS_POOL_SIZE", 0),
+			RedisMinIdleConns: getInt("REDIS_MIN_IDLE_CONNS", 0),
+			RedisDialTimeout:  getDuration("REDIS_DIAL_TIMEOUT", time.Second*5),
+			RedisReadTimeout:  getDuration("REDIS_READ_TIMEOUT", time.Second*3),
+			RedisWriteTimeout: getDuration("REDIS_WRITE_TIMEOUT", time.Second*3),
+			RedisPoolTimeout:  getDuration("REDIS_POOL_TIMEOUT", time.Second*4),
+			RedisIdleTimeout:  getDuration("REDIS_IDLE_TIMEOUT", time.Minute*5),
+			RedisMaxRedirects: getInt("REDIS_MAX_REDIRECTS", 0),
+
+			LiveShards: getInt("LIVE_SHARDS", 64),
+
+			MatchingStrategy: getString("MATCHING_STRATEGY", "nearest"),
+			LanguageBoost:    getFloat("LANGUAGE_BOOST", 0.1),
+			GoHomeCorridor:   getFloat("GO_HOME_CORRIDOR_KM", 2),
+
+			MatchWeightDistance:   getFloat("MATCH_WEIGHT_DISTANCE", 0.5),
+			MatchWeightRating:     getFloat("MATCH_WEIGHT_RATING", 0.15),
+			MatchWeightAcceptance: getFloat("MATCH_WEIGHT_ACCEPTANCE", 0.1),
+
+			AverageSpeed: getFloat("AVERAGE_SPEED_KMH", 30),
+			OSRMURL:      getString("OSRM_URL", ""),
+
+			FairnessInterval:   getDuration("FAIRNESS_INTERVAL", time.Minute*5),
+			FairnessWindow:     getDuration("FAIRNESS_WINDOW", time.Hour),
+			FairnessThreshold:  getFloat("FAIRNESS_THRESHOLD", 0.5),
+			FairnessAutoAdjust: getBool("FAIRNESS_AUTO_ADJUST", false),
+
+			Notifier:          getString("NOTIFIER", "log"),
+			NotifyAttempts:    getInt("NOTIFY_ATTEMPTS", 3),
+			NotifyWebhookURL:  getString("NOTIFY_WEBHOOK_URL", ""),
+			FirebaseServerKey: getString("FIREBASE_SERVER_KEY", ""),
+			TwilioAccountSID:  getString("TWILIO_ACCOUNT_SID", ""),
+			TwilioAuthToken:   getString("TWILIO_AUTH_TOKEN", ""),
+			TwilioFrom:        getString("TWILIO_FROM", ""),
+
+			IDSecret: getString("ID_SECRET", ""),
+
+			CallbackSecret:   getString("CALLBACK_SECRET", ""),
+			CallbackAttempts: getInt("CALLBACK_ATTEMPTS", 8),
+
+			SandboxTimeScale: getInt("SANDBOX_TIME_SCALE", 12),
+
+			IdempotencyTTL: getDuration("IDEMPOTENCY_TTL", time.Hour*24),
+
+			HeatK:         getInt("HEAT_K", 10),
+			HeatRetention: getDuration("HEAT_RETENTION", time.Hour*24*90),
+
+			MaintenanceRefresh: getDuration("MAINTENANCE_REFRESH", time.Second*5),
+
+			KafkaBrokers:   getStrings("KAFKA_BROKERS", ""),
+			KafkaTopic:     getString("KAFKA_TOPIC", "driver-locations"),
+			KafkaGroup:     getString("KAFKA_GROUP", "tracking"),
+			KafkaBatchSize: getInt("KAFKA_BATCH_SIZE", 500),
+			KafkaBatchWait: getDuration("KAFKA_BATCH_WAIT", time.Millisecond*100),
+
+			Bus:             getString("BUS", ""),
+			BusTopic:        getString("BUS_TOPIC", "tracking.events"),
+			NATSURL:         getString("NATS_URL", "nats://localhost:4222"),
+			BusStreamMaxLen: getInt("BUS_STREAM_MAX_LEN", 100000),
+
+			MQTTBroker:   getString("MQTT_BROKER", ""),
+			MQTTClientID: getString("MQTT_CLIENT_ID", "tracking-"+defaultShardID()),
+			MQTTUsername: getString("MQTT_USERNAME", ""),
+			MQTTPassword: getString("MQTT_PASSWORD", ""),
+			MQTTTopic:    getString("MQTT_TOPIC", "drivers/+/location"),
+			MQTTQoS:      getInt("MQTT_QOS", 1),
+
+			CapacityInterval:     getDuration("CAPACITY_INTERVAL", time.Hour),
+			CapacityDays:         getInt("CAPACITY_DAYS", 7),
+			CapacityTripsPerHour: getFloat("CAPACITY_TRIPS_PER_HOUR", 2),
+
+			RetryPolicies: getRetryPolicies("RETRY_POLICIES", ""),
+
+			ShardID:      getString("SHARD_ID", defaultShardID()),
+			ShardTimeout: getDuration("SHARD_TIMEOUT", time.Second*15),
+
+			DriverTTL:       getDuration("DRIVER_TTL", time.Minute*2),
+			JanitorInterval: getDuration("JANITOR_INTERVAL", time.Second*15),
+
+			ConsistencyInterval: getDuration("CONSISTENCY_INTERVAL", time.Minute),
+			ConsistencyRepair:   getBool("CONSISTENCY_REPAIR", false),
+
+			RegionResolver:   getString("REGION_RESOLVER", ""),
+			RegionPrecision:  getInt("REGION_PRECISION", 3),
+			RegionCitiesFile: getString("REGION_CITIES_FILE", ""),
+
+			LocationStore: getString("LOCATION_STORE", "redis"),
+			Tile38Addr:    getString("TILE38_ADDR", "localhost:9851"),
+			PostgresDSN:   getString("POSTGRES_DSN", "postgres://localhost:5432/tracking?sslmode=disable"),
+
+			LocationFlushInterval: getDuration("LOCATION_FLUSH_INTERVAL", time.Millisecond*50),
+			LocationFlushSize:     getInt("LOCATION_FLUSH_SIZE", 1000),
+
+			PresenceTTL:      getDuration("PRESENCE_TTL", time.Second*90),
+			RequireHeartbeat: getBool("REQUIRE_HEARTBEAT", false),
+
+			AccessibleRequestTTL:  getDuration("ACCESSIBLE_REQUEST_TTL", time.Minute*10),
+			AccessibleSearchRadii: getFloats("ACCESSIBLE_SEARCH_RADII", "5,10,15"),
+
+			ClassProfiles: getClassProfiles("CLASS_PROFILES", "moto=1/2:1m,xl=3/6/10:6m"),
+
+			MinRequestTTL:     getDuration("MIN_REQUEST_TTL", time.Second*30),
+			MaxRequestTTL:     getDuration("MAX_REQUEST_TTL", time.Minute*30),
+			MinSearchInterval: getDuration("MIN_SEARCH_INTERVAL", time.Second*5),
+			MaxSearchInterval: getDuration("MAX_SEARCH_INTERVAL", time.Minute*2),
+
+			PreDispatchLead:   getDuration("PRE_DISPATCH_LEAD", time.Minute*15),
+			PreDispatchMargin: getDuration("PRE_DISPATCH_MARGIN", time.Minute*2),
+			MaxScheduleAhead:  getDuration("MAX_SCHEDULE_AHEAD", time.Hour*24*7),
+		}
+	})
+
+	return cfg
+}
+
+func getString(name, def string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return def
+}
+
+func defaultShardID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+func getInt(name string, def int) int {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("invalid value %q for %s, using default %d", v, name, def)
+		return def
+	}
+	return i
+}
+
+func getFloat(name string, def float64) float64 {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Printf("invalid value %q for %s, using default %g", v, name, def)
+		return def
+	}
+	return f
+}
+
+// getFloats parses a comma separated list of numbers, e.g. 1,3,5. The invalid list uses the default.
+func getFloats(name, def string) []float64 {
+	parse := func(v string) ([]float64, error) {
+		var values []float64
+		for _, item := range strings.Split(v, ",") {
+			f, err := strconv.ParseFloat(strings.TrimSpace(item), 64)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, f)
+		}
+		return values, nil
+	}
+
+	values, err := parse(getString(name, def))
+	if err != nil {
+		log.Printf("invalid value for %s, using default %s: %v", name, def, err)
+		values, _ = parse(def)
+	}
+	return values
+}
+
+// getStrings parses a comma separated list, e.g. a:26379,b:26379. The empty items are ignored.
+func getStrings(name, def string) []string {
+	var values []string
+	for _, item := range strings.Split(getString(name, def), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, item)
+		}
+	}
+	if len(values) == 0 && def != "" {
+		values = strings.Split(def, ",")
+	}
+	return values
+}
+
+func getBool(name string, def bool) bool {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("invalid value %q for %s, using default %t", v, name, def)
+		return def
+	}
+	return b
+}
+
+func getRateLimits(name, def string) map[string]RateLimit {
+	v := getString(name, def)
+	limits := make(map[string]RateLimit)
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		var l RateLimit
+		route := strings.SplitN(item, "=", 2)
+		if len(route) != 2 {
+			log.Printf("invalid rate limit %q in %s", item, name)
+			continue
+		}
+		if _, err := fmt.Sscanf(route[1], "%g:%d", &l.Rate, &l.Burst); err != nil {
+			log.Printf("invalid rate limit %q in %s: %v", item, name, err)
+			continue
+		}
+		limits[route[0]] = l
+	}
+	return limits
+}
+
+func getRetryPolicies(name, def string) map[string]RetryPolicy {
+	v := getString(name, def)
+	policies := make(map[string]RetryPolicy)
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		integration := strings.SplitN(item, "=", 2)
+		parts := []string{}
+		if len(integration) == 2 {
+			parts = strings.Split(integration[1], ":")
+		}
+		if len(parts) != 3 {
+			log.Printf("invalid retry policy %q in %s", item, name)
+			continue
+		}
+		var p RetryPolicy
+		var err error
+		if p.Attempts, err = strconv.Atoi(parts[0]); err == nil {
+			if p.Initial, err = time.ParseDuration(parts[1]); err == nil {
+				p.Max, err = time.ParseDuration(parts[2])
+			}
+		}
+		if err != nil || p.Attempts < 1 {
+			log.Printf("invalid retry policy %q in %s: %v", item, name, err)
+			continue
+		}
+		policies[integration[0]] = p
+	}
+	return policies
+}
+
+func getClassProfiles(name, def string) map[string]ClassProfile {
+	v := getString(name, def)
+	profiles := make(map[string]ClassProfile)
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		class := strings.SplitN(item, "=", 2)
+		parts := []string{}
+		if len(class) == 2 {
+			parts = strings.Split(class[1], ":")
+		}
+		if len(parts) != 2 {
+			log.Printf("invalid class profile %q in %s", item, name)
+			continue
+		}
+		var p ClassProfile
+		var err error
+		for _, r := range strings.Split(parts[0], "/") {
+			var radius float64
+			if radius, err = strconv.ParseFloat(r, 64); err != nil {
+				break
+			}
+			p.SearchRadii = append(p.SearchRadii, radius)
+		}
+		if err == nil {
+			p.RequestTTL, err = time.ParseDuration(parts[1])
+		}
+		if err != nil || p.RequestTTL <= 0 {
+			log.Printf("invalid class profile %q in %s: %v", item, name, err)
+			continue
+		}
+		profiles[class[0]] = p
+	}
+	return profiles
+}
+
+func getDuration(name string, def time.Duration) time.Duration {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("invalid value %q for %s, using default %s", v, name, def)
+		return def
+	}
+	return d
+}
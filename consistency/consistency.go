@@ -0,0 +1,232 @@
+// Package consistency cross-checks the GEO index of the drivers with their state: the reserved and offline drivers must not be
+// searchable and the available drivers must be in the index. The discrepancies are reported with metrics and can be repaired.
+package consistency
+
+import (
+	"errors"
+	"time"
+
+	"github.com/douglasmakey/tracking/drivers"
+	"github.com/douglasmakey/tracking/history"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/maintenance"
+	"github.com/douglasmakey/tracking/metrics"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// ErrRebuildRunning is returned when the index is already being rebuilt.
+var ErrRebuildRunning = errors.New("the index is already being rebuilt")
+
+// rebuildLockKey lets only one rebuild run at a time, the lock expires if the instance dies during the rebuild.
+const (
+	rebuildLockKey = "drivers:rebuild:lock"
+	rebuildLockTTL = time.Minute * 10
+)
+
+// These are the kinds of discrepancies.
+const (
+	// KindReserved are searchable drivers with a reservation.
+	KindReserved = "reserved"
+	// KindOffline are searchable drivers whose period is offline.
+	KindOffline = "offline"
+	// KindMissing are available drivers that are not in the index, e.g. the location was removed without changing the period.
+	KindMissing = "missing"
+	// KindWithoutLastSeen are in the index without last seen time, the janitor never removes them.
+	KindWithoutLastSeen = "without_last_seen"
+	// KindWithoutLocation have a last seen time but are not in the index.
+	KindWithoutLocation = "without_location"
+)
+
+// kinds are all the kinds of discrepancies, the metrics of the kinds without discrepancies are reset to zero.
+var kinds = []string{KindReserved, KindOffline, KindMissing, KindWithoutLastSeen, KindWithoutLocation}
+
+// Report is the drivers of each kind of discrepancy.
+type Report struct {
+	Drivers       int                 `json:"drivers"`
+	Discrepancies map[string][]string `json:"discrepancies"`
+}
+
+// Consistent returns true if the report did not find any discrepancy.
+func (r Report) Consistent() bool {
+	for _, ids := range r.Discrepancies {
+		if len(ids) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Check compares the GEO index with the reservations and the periods of the drivers, it only reads.
+func Check() (Report, error) {
+	rClient := storages.GetRedisClient()
+	index, err := rClient.VerifyIndex()
+	if err != nil {
+		return Report{}, err
+	}
+	located, err := rClient.Located()
+	if err != nil {
+		return Report{}, err
+	}
+	fleet, err := drivers.Fleet()
+	if err != nil {
+		return Report{}, err
+	}
+
+	// The located drivers are checked for offline and the fleet for missing.
+	isLocated := make(map[string]bool, len(located))
+	for _, id := range located {
+		isLocated[id] = true
+	}
+	ids := append([]string{}, located...)
+	for _, id := range fleet {
+		if !isLocated[id] {
+			ids = append(ids, id)
+		}
+	}
+	periods, err := drivers.CurrentPeriods(ids)
+	if err != nil {
+		return Report{}, err
+	}
+
+	report := Report{Drivers: len(located), Discrepancies: map[string][]string{
+		KindReserved:        index.Reserved,
+		KindOffline:         {},
+		KindMissing:         {},
+		KindWithoutLastSeen: index.WithoutLastSeen,
+		KindWithoutLocation: index.WithoutLocation,
+	}}
+	for _, id := range ids {
+		switch {
+		case isLocated[id] && periods[id] == drivers.PeriodOffline:
+			report.Discrepancies[KindOffline] = append(report.Discrepancies[KindOffline], id)
+		case !isLocated[id] && periods[id] == drivers.PeriodAvailable:
+			report.Discrepancies[KindMissing] = append(report.Discrepancies[KindMissing], id)
+		}
+	}
+	return report, nil
+}
+
+// Repair fixes the discrepancies of the report: the drivers that must not be searchable are removed from the index
+// and the available drivers without location are moved offline, they are available again with their next location.
+// It returns the number of drivers repaired of each kind.
+func Repair(report Report) (map[string]int, error) {
+	rClient := storages.GetRedisClient()
+	repaired := make(map[string]int)
+	for _, kind := range []string{KindReserved, KindOffline, KindWithoutLastSeen, KindWithoutLocation} {
+		for _, id := range report.Discrepancies[kind] {
+			if err := rClient.RemoveDriverLocation(id); err != nil {
+				return repaired, err
+			}
+			repaired[kind]++
+		}
+	}
+	for _, id := range report.Discrepancies[KindMissing] {
+		changed, err := drivers.SetPeriod(id, drivers.PeriodOffline, drivers.PeriodAvailable)
+		if err != nil {
+			return repaired, err
+		}
+		if changed {
+			repaired[KindMissing]++
+		}
+	}
+	return repaired, nil
+}
+
+// Rebuild replaces the GEO index with one built from the state of the drivers, e.g. after the index was corrupted: the drivers seen
+// within ttl that are not offline or reserved are indexed at their last recorded location. The drivers without a recorded location
+// keep their position of the live index. The searches use the live index until the rebuilt one replaces it.
+func Rebuild(ttl time.Duration) (storages.RebuildReport, error) {
+	rClient := storages.GetRedisClient()
+	ok, err := rClient.SetNX(rebuildLockKey, 1, rebuildLockTTL).Result()
+	if err != nil {
+		return storages.RebuildReport{}, storages.Classify(err)
+	}
+	if !ok {
+		return storages.RebuildReport{}, ErrRebuildRunning
+	}
+	defer rClient.Del(rebuildLockKey)
+
+	start := time.Now()
+	ids, err := rClient.SeenSince(start.Add(-ttl))
+	if err != nil {
+		return storages.RebuildReport{}, err
+	}
+	periods, err := drivers.CurrentPeriods(ids)
+	if err != nil {
+		return storages.RebuildReport{}, err
+	}
+	reserved, err := rClient.Reserved(ids)
+	if err != nil {
+		return storages.RebuildReport{}, err
+	}
+
+	var locations []*redis.GeoLocation
+	var keep []string
+	for _, id := range ids {
+		if periods[id] == drivers.PeriodOffline || reserved[id] {
+			continue
+		}
+		p, ok, err := history.Last(id)
+		if err != nil {
+			return storages.RebuildReport{}, err
+		}
+		if !ok {
+			keep = append(keep, id)
+			continue
+		}
+		locations = append(locations, &redis.GeoLocation{Name: id, Latitude: p.Lat, Longitude: p.Lng})
+	}
+	return rClient.RebuildIndex(locations, keep, start)
+}
+
+// Checker runs the check every Interval, with AutoRepair the discrepancies are repaired.
+type Checker struct {
+	Interval   time.Duration
+	AutoRepair bool
+}
+
+// Start launches the checker in a goroutine.
+func (c Checker) Start() {
+	go func() {
+		ticker := time.NewTicker(c.Interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			// The checker is paused during maintenance, the index can be in the middle of a change.
+			if maintenance.Paused() {
+				continue
+			}
+			c.run()
+		}
+	}()
+}
+
+func (c Checker) run() {
+	report, err := Check()
+	if err != nil {
+		logging.Logger.Error("could not check the driver index", "error", err)
+		return
+	}
+	for _, kind := range kinds {
+		metrics.IndexDiscrepancies.WithLabelValues(kind).Set(float64(len(report.Discrepancies[kind])))
+	}
+	if report.Consistent() {
+		return
+	}
+	logging.Logger.Warn("driver index is not consistent",
+		"reserved", len(report.Discrepancies[KindReserved]), "offline", len(report.Discrepancies[KindOffline]),
+		"missing", len(report.Discrepancies[KindMissing]), "without_last_seen", len(report.Discrepancies[KindWithoutLastSeen]),
+		"without_location", len(report.Discrepancies[KindWithoutLocation]))
+	if !c.AutoRepair {
+		return
+	}
+
+	repaired, err := Repair(report)
+	for kind, n := range repaired {
+		metrics.IndexRepairs.WithLabelValues(kind).Add(float64(n))
+	}
+	if err != nil {
+		logging.Logger.Error("could not repair the driver index", "error", err)
+	}
+}
@@ -0,0 +1,91 @@
+// Package cors lets the browser applications of other origins call the API, e.g. the web console of the operations team.
+package cors
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/douglasmakey/tracking/httputil"
+)
+
+// exposed are the response headers that the browser applications can read.
+var exposed = strings.Join([]string{"Retry-After", "Idempotent-Replayed", "X-Request-ID"}, ", ")
+
+// Options are the origins allowed to call the API and what they can send, "*" in Origins allows any origin.
+// MaxAge is the time that the browsers cache the answer of a preflight request.
+type Options struct {
+	Origins []string
+	Methods []string
+	Headers []string
+	MaxAge  time.Duration
+}
+
+// allowed returns whether the origin can call the API.
+func (o Options) allowed(origin string) bool {
+	for _, a := range o.Origins {
+		if a == "*" || strings.EqualFold(a, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedMethod returns whether the origins can send requests with the method.
+func (o Options) allowedMethod(method string) bool {
+	for _, m := range o.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware adds the CORS headers to the responses of the allowed origins and answers their preflight requests, the routes
+// do not have to accept OPTIONS. The preflight requests of the other origins are rejected and their requests are served
+// without the headers, so the browser does not let them read the response. Without origins it returns next.
+func Middleware(next http.Handler, o Options) http.Handler {
+	if len(o.Origins) == 0 {
+		return next
+	}
+	methods, headers := strings.Join(o.Methods, ", "), strings.Join(o.Headers, ", ")
+	maxAge := strconv.Itoa(int(o.MaxAge.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// The response depends on the origin, the caches must keep one for each.
+		w.Header().Add("Vary", "Origin")
+
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !o.allowed(origin) {
+			if preflight {
+				httputil.WriteError(w, httputil.CodeForbidden, "origin not allowed")
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if !preflight {
+			w.Header().Set("Access-Control-Expose-Headers", exposed)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !o.allowedMethod(r.Header.Get("Access-Control-Request-Method")) {
+			httputil.WriteError(w, httputil.CodeForbidden, "method not allowed for the origin")
+			return
+		}
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		w.Header().Set("Access-Control-Allow-Methods", methods)
+		w.Header().Set("Access-Control-Allow-Headers", headers)
+		w.Header().Set("Access-Control-Max-Age", maxAge)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,70 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMiddleware(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	h := Middleware(ok, Options{
+		Origins: []string{"https://ops.example.com"},
+		Methods: []string{"GET", "POST"},
+		Headers: []string{"Authorization", "Content-Type"},
+		MaxAge:  time.Minute * 10,
+	})
+
+	// The preflight of an allowed origin is answered without reaching the routes.
+	req := httptest.NewRequest(http.MethodOptions, "/v2/search", nil)
+	req.Header.Set("Origin", "https://ops.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://ops.example.com" {
+		t.Errorf("unexpected allowed origin %q", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Methods"); got != "GET, POST" {
+		t.Errorf("unexpected allowed methods %q", got)
+	}
+	if got := rec.Header().Get("Access-Control-Max-Age"); got != "600" {
+		t.Errorf("unexpected max age %q", got)
+	}
+
+	// A method that is not allowed is rejected.
+	req.Header.Set("Access-Control-Request-Method", "DELETE")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", rec.Code)
+	}
+
+	// The requests of an allowed origin have the headers.
+	req = httptest.NewRequest(http.MethodPost, "/search", nil)
+	req.Header.Set("Origin", "https://ops.example.com")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Access-Control-Allow-Origin") == "" {
+		t.Errorf("unexpected response %d %v", rec.Code, rec.Header())
+	}
+
+	// The other origins do not have the headers and their preflight is rejected.
+	req.Header.Set("Origin", "https://evil.example.com")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("unexpected response %d %v", rec.Code, rec.Header())
+	}
+	req = httptest.NewRequest(http.MethodOptions, "/search", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", rec.Code)
+	}
+}
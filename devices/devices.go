@@ -0,0 +1,128 @@
+package devices
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// A driver can be logged in on several devices, only the device with the latest heartbeat is active
+// and the location updates of the other devices are rejected as stale.
+
+// Device is a device of a driver.
+type Device struct {
+	ID            string    `json:"id"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+	Active        bool      `json:"active"`
+}
+
+// devicesKey is a hash with the last heartbeat in milliseconds of each device of the driver.
+func devicesKey(driverID string) string {
+	return fmt.Sprintf("devices:%s", storages.Tag(driverID))
+}
+
+// activeKey keeps the ID of the active device of the driver.
+func activeKey(driverID string) string {
+	return fmt.Sprintf("devices:%s:active", storages.Tag(driverID))
+}
+
+// heartbeatScript records the heartbeat and makes the device active only if its heartbeat is the latest one,
+// it runs in Redis so two devices sending heartbeats at the same time can not leave an older device active.
+var heartbeatScript = redis.NewScript(`
+local active = redis.call("GET", KEYS[2])
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+if active and active ~= ARGV[1] then
+	local last = tonumber(redis.call("HGET", KEYS[1], active) or "0")
+	if last > tonumber(ARGV[2]) then
+		return 0
+	end
+end
+redis.call("SET", KEYS[2], ARGV[1])
+return 1
+`)
+
+// Heartbeat records that the device is alive at t, it returns true if the device is now the active one.
+func Heartbeat(driverID, deviceID string, t time.Time) (bool, error) {
+	rClient := storages.GetRedisClient()
+	ms := t.UnixNano() / int64(time.Millisecond)
+	n, err := heartbeatScript.Run(rClient, []string{devicesKey(driverID), activeKey(driverID)}, deviceID, ms).Int64()
+	if err != nil {
+		return false, storages.Classify(err)
+	}
+	return n == 1, nil
+}
+
+// Accept returns true if the location updates of the device must be accepted.
+// When the driver does not have an active device yet, the device becomes the active one.
+func Accept(driverID, deviceID string) (bool, error) {
+	rClient := storages.GetRedisClient()
+	if _, err := rClient.SetNX(activeKey(driverID), deviceID, 0).Result(); err != nil {
+		return false, storages.Classify(err)
+	}
+
+	var active string
+	err := storages.WithRetry(func() (err error) {
+		active, err = rClient.Get(activeKey(driverID)).Result()
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return active == deviceID, nil
+}
+
+// Check is like Accept but it does not make the device active, it is used by the dry runs.
+func Check(driverID, deviceID string) (bool, error) {
+	rClient := storages.GetRedisClient()
+	var active string
+	err := storages.WithRetry(func() (err error) {
+		active, err = rClient.Get(activeKey(driverID)).Result()
+		return err
+	})
+	if err == redis.Nil {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return active == deviceID, nil
+}
+
+// List returns the devices of the driver, the latest heartbeat first.
+func List(driverID string) ([]Device, error) {
+	rClient := storages.GetRedisClient()
+	var heartbeats map[string]string
+	var active string
+	err := storages.WithRetry(func() (err error) {
+		if heartbeats, err = rClient.HGetAll(devicesKey(driverID)).Result(); err != nil {
+			return err
+		}
+		active, err = rClient.Get(activeKey(driverID)).Result()
+		if err == redis.Nil {
+			err = nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]Device, 0, len(heartbeats))
+	for id, v := range heartbeats {
+		ms, _ := strconv.ParseInt(v, 10, 64)
+		devices = append(devices, Device{
+			ID:            id,
+			LastHeartbeat: time.Unix(0, ms*int64(time.Millisecond)).UTC(),
+			Active:        id == active,
+		})
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].LastHeartbeat.After(devices[j].LastHeartbeat) })
+
+	return devices, nil
+}
@@ -0,0 +1,75 @@
+package drivers
+
+import (
+	"strconv"
+
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// offersKey and acceptedKey are hashes with the number of offers of each driver and of the offers that it accepted.
+const (
+	offersKey   = "drivers:offers"
+	acceptedKey = "drivers:offers:accepted"
+)
+
+// acceptancePrior is the number of accepted offers that every driver starts with, the rate of a driver with few offers
+// stays near 1 instead of jumping to 0 with its first declined offer.
+const acceptancePrior = 5
+
+// RecordOffer counts an offer of the driver and whether it accepted it.
+func RecordOffer(driverID string, accepted bool) error {
+	rClient := storages.GetRedisClient()
+	_, err := rClient.Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.HIncrBy(offersKey, driverID, 1)
+		if accepted {
+			pipe.HIncrBy(acceptedKey, driverID, 1)
+		}
+		return nil
+	})
+	return storages.Classify(err)
+}
+
+// AcceptanceRates returns the historical acceptance rate of the drivers, from 0 to 1. The drivers without offers have a rate of 1.
+func AcceptanceRates(ids []string) (map[string]float64, error) {
+	rates := make(map[string]float64, len(ids))
+	if len(ids) == 0 {
+		return rates, nil
+	}
+
+	rClient := storages.GetRedisClient()
+	var offers, accepted *redis.SliceCmd
+	err := storages.WithRetry(func() error {
+		_, err := rClient.Pipelined(func(pipe redis.Pipeliner) error {
+			offers = pipe.HMGet(offersKey, ids...)
+			accepted = pipe.HMGet(acceptedKey, ids...)
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, id := range ids {
+		rates[id] = AcceptanceRate(count(accepted.Val(), i), count(offers.Val(), i))
+	}
+	return rates, nil
+}
+
+// AcceptanceRate returns the rate of the accepted offers smoothed with the prior.
+func AcceptanceRate(accepted, offers int64) float64 {
+	return float64(accepted+acceptancePrior) / float64(offers+acceptancePrior)
+}
+
+func count(values []interface{}, i int) int64 {
+	if i >= len(values) {
+		return 0
+	}
+	s, ok := values[i].(string)
+	if !ok {
+		return 0
+	}
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
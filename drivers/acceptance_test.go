@@ -0,0 +1,15 @@
+package drivers
+
+import "testing"
+
+func TestAcceptanceRate(t *testing.T) {
+	if r := AcceptanceRate(0, 0); r != 1 {
+		t.Errorf("expected 1 without offers, got %f", r)
+	}
+	if r := AcceptanceRate(0, 1); r >= 1 || r < 0.8 {
+		t.Errorf("expected a small drop after one declined offer, got %f", r)
+	}
+	if r := AcceptanceRate(10, 100); r > 0.2 {
+		t.Errorf("expected the rate of the history with many offers, got %f", r)
+	}
+}
@@ -0,0 +1,189 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/douglasmakey/tracking/storages"
+)
+
+// These are the assets that a driver can attach to its profile.
+const (
+	AssetPhoto        = "photo"
+	AssetVehiclePhoto = "vehicle_photo"
+)
+
+// ErrAssetNotFound is returned when the driver does not have the asset.
+var ErrAssetNotFound = errors.New("driver asset not found")
+
+// Asset is a reference to a file of the object store of the operator, the service never stores the file.
+// The content type and the size are declared by the client that uploaded it.
+type Asset struct {
+	Kind        string    `json:"kind"`
+	URL         string    `json:"url"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Updated     time.Time `json:"updated"`
+}
+
+// IsAssetKind returns whether kind is a known asset.
+func IsAssetKind(kind string) bool {
+	return kind == AssetPhoto || kind == AssetVehiclePhoto
+}
+
+// IsAssetType returns whether the assets can have the content type, only the images shown by the apps are accepted.
+func IsAssetType(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/webp":
+		return true
+	}
+	return false
+}
+
+// assetsKey is a hash with the assets of the driver as JSON by kind.
+func assetsKey(driverID string) string {
+	return fmt.Sprintf("driver:%s:assets", driverID)
+}
+
+// SaveAsset creates or replaces the asset of its kind.
+func SaveAsset(driverID string, a Asset) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	rClient := storages.GetRedisClient()
+	return storages.Classify(rClient.HSet(assetsKey(driverID), a.Kind, data).Err())
+}
+
+// DeleteAsset removes the asset of the kind, ErrAssetNotFound if the driver does not have it.
+func DeleteAsset(driverID, kind string) error {
+	rClient := storages.GetRedisClient()
+	n, err := rClient.HDel(assetsKey(driverID), kind).Result()
+	if err != nil {
+		return storages.Classify(err)
+	}
+	if n == 0 {
+		return ErrAssetNotFound
+	}
+	return nil
+}
+
+// Assets returns the assets of the driver by kind.
+func Assets(driverID string) (map[string]Asset, error) {
+	rClient := storages.GetRedisClient()
+	var fields map[string]string
+	err := storages.WithRetry(func() (err error) {
+		fields, err = rClient.HGetAll(assetsKey(driverID)).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	assets := make(map[string]Asset, len(fields))
+	for kind, data := range fields {
+		var a Asset
+		if err := json.Unmarshal([]byte(data), &a); err != nil {
+			return nil, err
+		}
+		assets[kind] = a
+	}
+	return assets, nil
+}
+
+// Signer returns the URL that the riders use to get an asset, e.g. a presigned URL of a private bucket.
+type Signer interface {
+	Sign(ctx context.Context, url string) (string, error)
+}
+
+// Passthrough returns the URLs as they are, it is the default signer for public buckets and CDNs.
+type Passthrough struct{}
+
+func (Passthrough) Sign(_ context.Context, url string) (string, error) {
+	return url, nil
+}
+
+// HTTPSigner asks a service of the operator to sign the URLs, it posts {"url": "...", "expires_in": 900}
+// and expects {"url": "..."}, so any object store can be used without its SDK in the service.
+type HTTPSigner struct {
+	Endpoint string
+	TTL      time.Duration
+	Client   *http.Client
+}
+
+// NewHTTPSigner create and return a pointer to HTTPSigner.
+func NewHTTPSigner(endpoint string, ttl time.Duration) *HTTPSigner {
+	return &HTTPSigner{Endpoint: endpoint, TTL: ttl, Client: &http.Client{Timeout: time.Second * 5}}
+}
+
+func (s *HTTPSigner) Sign(ctx context.Context, url string) (string, error) {
+	data, err := json.Marshal(map[string]interface{}{"url": url, "expires_in": int(s.TTL.Seconds())})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Endpoint, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return "", fmt.Errorf("%s returned %s", req.URL.Host, res.Status)
+	}
+
+	var body struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.URL == "" {
+		return "", fmt.Errorf("%s returned an empty url", req.URL.Host)
+	}
+	return body.URL, nil
+}
+
+var (
+	signerMu sync.RWMutex
+	signer   Signer = Passthrough{}
+)
+
+// SetSigner sets the signer of the asset URLs.
+func SetSigner(s Signer) {
+	signerMu.Lock()
+	defer signerMu.Unlock()
+	signer = s
+}
+
+// SignedAssets returns the URLs of the assets of the driver by kind, signed to be shown to the riders.
+func SignedAssets(ctx context.Context, driverID string) (map[string]string, error) {
+	assets, err := Assets(driverID)
+	if err != nil {
+		return nil, err
+	}
+
+	signerMu.RLock()
+	s := signer
+	signerMu.RUnlock()
+
+	urls := make(map[string]string, len(assets))
+	for kind, a := range assets {
+		url, err := s.Sign(ctx, a.URL)
+		if err != nil {
+			return nil, err
+		}
+		urls[kind] = url
+	}
+	return urls, nil
+}
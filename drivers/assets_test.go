@@ -0,0 +1,44 @@
+package drivers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPSigner(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			URL       string `json:"url"`
+			ExpiresIn int    `json:"expires_in"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.ExpiresIn != 60 {
+			t.Errorf("expected expires_in 60, got %d", body.ExpiresIn)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"url": body.URL + "?sig=abc"})
+	}))
+	defer srv.Close()
+
+	url, err := NewHTTPSigner(srv.URL, time.Minute).Sign(context.Background(), "https://cdn.example.com/1.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "https://cdn.example.com/1.jpg?sig=abc" {
+		t.Errorf("expected the signed url, got %q", url)
+	}
+}
+
+func TestHTTPSignerError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	if _, err := NewHTTPSigner(srv.URL, time.Minute).Sign(context.Background(), "https://cdn.example.com/1.jpg"); err == nil {
+		t.Error("expected an error")
+	}
+}
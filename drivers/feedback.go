@@ -0,0 +1,112 @@
+package drivers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// These are the tags that the riders can leave in the feedback of a trip.
+const (
+	TagCleanVehicle  = "clean_vehicle"
+	TagSafeDriving   = "safe_driving"
+	TagFriendly      = "friendly"
+	TagKnewRoute     = "knew_route"
+	TagLate          = "late"
+	TagDirtyVehicle  = "dirty_vehicle"
+	TagUnsafeDriving = "unsafe_driving"
+	TagRude          = "rude"
+)
+
+var feedbackTags = map[string]bool{
+	TagCleanVehicle: true, TagSafeDriving: true, TagFriendly: true, TagKnewRoute: true,
+	TagLate: true, TagDirtyVehicle: true, TagUnsafeDriving: true, TagRude: true,
+}
+
+// IsFeedbackTag returns true if tag is one of the feedback tags.
+func IsFeedbackTag(tag string) bool {
+	return feedbackTags[tag]
+}
+
+// feedbackKey is a hash with the totals of the feedback of the driver: the number of ratings, their sum, the tips,
+// the number of tips and a counter for each tag.
+func feedbackKey(driverID string) string {
+	return fmt.Sprintf("driver:%s:feedback", driverID)
+}
+
+// feedbackScript adds the rating ARGV[1] and the tags ARGV[2:] to the totals of the driver in KEYS[1]
+// and returns the new average of the ratings.
+var feedbackScript = redis.NewScript(`
+local count = redis.call("HINCRBY", KEYS[1], "ratings", 1)
+local sum = redis.call("HINCRBY", KEYS[1], "rating_sum", ARGV[1])
+for i = 2, #ARGV do
+	redis.call("HINCRBY", KEYS[1], "tag:" .. ARGV[i], 1)
+end
+return tostring(sum / count)
+`)
+
+// AddFeedback adds the rating from 1 to 5 and the tags of a trip to the driver, the rating used by the matching
+// is the average of the ratings of the riders from then on.
+func AddFeedback(driverID string, rating int, tags []string) error {
+	rClient := storages.GetRedisClient()
+	args := []interface{}{rating}
+	for _, t := range tags {
+		args = append(args, t)
+	}
+	avg, err := feedbackScript.Run(rClient, []string{feedbackKey(driverID)}, args...).String()
+	if err != nil {
+		return storages.Classify(err)
+	}
+	return storages.Classify(rClient.HSet(ratingsKey, driverID, avg).Err())
+}
+
+// AddTip adds the tip of a trip to the driver.
+func AddTip(driverID string, amount float64) error {
+	rClient := storages.GetRedisClient()
+	_, err := rClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HIncrByFloat(feedbackKey(driverID), "tips", amount)
+		pipe.HIncrBy(feedbackKey(driverID), "tipped", 1)
+		return nil
+	})
+	return storages.Classify(err)
+}
+
+// FeedbackSummary is the feedback received by a driver.
+type FeedbackSummary struct {
+	Ratings int     `json:"ratings"`
+	Rating  float64 `json:"rating,omitempty"`
+	Tipped  int     `json:"tipped"`
+	Tips    float64 `json:"tips"`
+	// Tags is the number of times each tag was left.
+	Tags map[string]int `json:"tags"`
+}
+
+// Feedback returns the feedback received by the driver.
+func Feedback(driverID string) (FeedbackSummary, error) {
+	rClient := storages.GetRedisClient()
+	var fields map[string]string
+	err := storages.WithRetry(func() (err error) {
+		fields, err = rClient.HGetAll(feedbackKey(driverID)).Result()
+		return err
+	})
+	if err != nil {
+		return FeedbackSummary{}, err
+	}
+
+	s := FeedbackSummary{Tags: map[string]int{}}
+	s.Ratings, _ = strconv.Atoi(fields["ratings"])
+	if sum, _ := strconv.Atoi(fields["rating_sum"]); s.Ratings > 0 {
+		s.Rating = float64(sum) / float64(s.Ratings)
+	}
+	s.Tipped, _ = strconv.Atoi(fields["tipped"])
+	s.Tips, _ = strconv.ParseFloat(fields["tips"], 64)
+	for field, v := range fields {
+		if tag := strings.TrimPrefix(field, "tag:"); tag != field {
+			s.Tags[tag], _ = strconv.Atoi(v)
+		}
+	}
+	return s, nil
+}
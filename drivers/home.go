@@ -0,0 +1,168 @@
+package drivers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// These are the errors of the go-home mode.
+var (
+	ErrNoHome       = errors.New("driver does not have a home location")
+	ErrNotGoingHome = errors.New("driver is not going home")
+)
+
+// GoHome is the go-home mode of a driver before ending the shift: it is only offered the requests toward its home
+// and it is taken offline after the last ride. RequestID is the request of the last ride once it was matched.
+type GoHome struct {
+	Home      geo.Point `json:"home"`
+	Since     time.Time `json:"since"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// homeKey keeps the home location of the driver.
+func homeKey(driverID string) string {
+	return fmt.Sprintf("driver:%s:home", driverID)
+}
+
+// goHomeKey keeps the go-home mode of the driver while it is enabled.
+func goHomeKey(driverID string) string {
+	return fmt.Sprintf("driver:%s:go-home", driverID)
+}
+
+// SetHome registers the home location of the driver.
+func SetHome(driverID string, home geo.Point) error {
+	data, err := json.Marshal(home)
+	if err != nil {
+		return err
+	}
+
+	rClient := storages.GetRedisClient()
+	return storages.Classify(rClient.Set(homeKey(driverID), data, 0).Err())
+}
+
+// EnableGoHome starts the go-home mode of the driver toward its registered home, ErrNoHome if it does not have one.
+func EnableGoHome(driverID string) (GoHome, error) {
+	rClient := storages.GetRedisClient()
+	data, err := rClient.Get(homeKey(driverID)).Bytes()
+	if err == redis.Nil {
+		return GoHome{}, ErrNoHome
+	}
+	if err != nil {
+		return GoHome{}, storages.Classify(err)
+	}
+
+	g := GoHome{Since: time.Now().UTC()}
+	if err := json.Unmarshal(data, &g.Home); err != nil {
+		return GoHome{}, err
+	}
+	if err := saveGoHome(driverID, g); err != nil {
+		return GoHome{}, err
+	}
+	return g, nil
+}
+
+// DisableGoHome ends the go-home mode of the driver, the driver keeps working as usual.
+func DisableGoHome(driverID string) error {
+	rClient := storages.GetRedisClient()
+	n, err := rClient.Del(goHomeKey(driverID)).Result()
+	if err != nil {
+		return storages.Classify(err)
+	}
+	if n == 0 {
+		return ErrNotGoingHome
+	}
+	return nil
+}
+
+// GoingHome returns the go-home mode of the drivers of ids that have it enabled.
+func GoingHome(ids []string) (map[string]GoHome, error) {
+	modes := make(map[string]GoHome)
+	if len(ids) == 0 {
+		return modes, nil
+	}
+
+	rClient := storages.GetRedisClient()
+	cmds := make([]*redis.StringCmd, len(ids))
+	err := storages.WithRetry(func() error {
+		_, err := rClient.Pipelined(func(pipe redis.Pipeliner) error {
+			for i, id := range ids {
+				cmds[i] = pipe.Get(goHomeKey(id))
+			}
+			return nil
+		})
+		if err == redis.Nil {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, id := range ids {
+		data, err := cmds[i].Bytes()
+		if err != nil {
+			continue
+		}
+		var g GoHome
+		if err := json.Unmarshal(data, &g); err == nil {
+			modes[id] = g
+		}
+	}
+	return modes, nil
+}
+
+// StartLastRide records the request matched with a driver going home, the driver is taken offline when the ride ends.
+func StartLastRide(driverID string, g GoHome, requestID string) error {
+	g.RequestID = requestID
+	return saveGoHome(driverID, g)
+}
+
+// EndLastRide ends the go-home mode of the driver if its last ride was matched, the driver is moved offline and removed
+// from the search. It returns true if the driver was taken offline.
+func EndLastRide(driverID string) (bool, error) {
+	modes, err := GoingHome([]string{driverID})
+	if err != nil {
+		return false, err
+	}
+	if g, ok := modes[driverID]; !ok || g.RequestID == "" {
+		return false, nil
+	}
+
+	rClient := storages.GetRedisClient()
+	if err := storages.Classify(rClient.Del(goHomeKey(driverID)).Err()); err != nil {
+		return false, err
+	}
+	if err := storages.Locations().RemoveDriverLocation(driverID); err != nil {
+		return false, err
+	}
+	if _, err := SetPeriod(driverID, PeriodOffline); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// TowardHome returns whether a ride from the driver position that drops off at dropoff takes the driver closer to home,
+// inside the corridor of width km around the straight way home.
+func (g GoHome) TowardHome(position, dropoff geo.Point, width float64) bool {
+	if geo.Distance(dropoff, g.Home) >= geo.Distance(position, g.Home) {
+		return false
+	}
+	return geo.DistanceToSegment(dropoff, position, g.Home) <= width
+}
+
+func saveGoHome(driverID string, g GoHome) error {
+	data, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+
+	rClient := storages.GetRedisClient()
+	return storages.Classify(rClient.Set(goHomeKey(driverID), data, 0).Err())
+}
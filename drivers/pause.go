@@ -0,0 +1,149 @@
+package drivers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// These are the errors of the pauses.
+var (
+	ErrAlreadyPaused = errors.New("driver already paused")
+	ErrNotPaused     = errors.New("driver not paused")
+)
+
+// maxPauses is the number of pause intervals kept for each driver.
+const maxPauses = 1000
+
+// PauseInterval is an interval when the driver does not receive requests, e.g. a break.
+// End is the time when the driver is resumed, for the pauses with duration it is known when the pause starts.
+type PauseInterval struct {
+	Reason string     `json:"reason"`
+	Start  time.Time  `json:"start"`
+	End    *time.Time `json:"end,omitempty"`
+}
+
+// pauseKey keeps the current pause of the driver, it expires when the pause has a duration so the driver is resumed automatically.
+func pauseKey(driverID string) string {
+	return fmt.Sprintf("driver:%s:pause", driverID)
+}
+
+// pausesKey is a list with the pause intervals of the driver for the shift reports.
+func pausesKey(driverID string) string {
+	return fmt.Sprintf("driver:%s:pauses", driverID)
+}
+
+// Pause pauses the driver, with d zero the pause lasts until Resume is called.
+func Pause(driverID, reason string, d time.Duration) (PauseInterval, error) {
+	p := PauseInterval{Reason: reason, Start: time.Now().UTC()}
+	if d > 0 {
+		end := p.Start.Add(d)
+		p.End = &end
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return p, err
+	}
+
+	rClient := storages.GetRedisClient()
+	ok, err := rClient.SetNX(pauseKey(driverID), data, d).Result()
+	if err != nil {
+		return p, storages.Classify(err)
+	}
+	if !ok {
+		return p, ErrAlreadyPaused
+	}
+
+	_, err = rClient.Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.RPush(pausesKey(driverID), data)
+		pipe.LTrim(pausesKey(driverID), -maxPauses, -1)
+		return nil
+	})
+	return p, storages.Classify(err)
+}
+
+// Resume ends the current pause of the driver before its timer.
+func Resume(driverID string) error {
+	rClient := storages.GetRedisClient()
+	data, err := rClient.Get(pauseKey(driverID)).Bytes()
+	if err == redis.Nil {
+		return ErrNotPaused
+	}
+	if err != nil {
+		return storages.Classify(err)
+	}
+
+	var p PauseInterval
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	end := time.Now().UTC()
+	p.End = &end
+	if data, err = json.Marshal(p); err != nil {
+		return err
+	}
+
+	// The current pause is the last interval of the list.
+	_, err = rClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(pauseKey(driverID))
+		pipe.LSet(pausesKey(driverID), -1, data)
+		return nil
+	})
+	return storages.Classify(err)
+}
+
+// Pauses returns the pause intervals of the driver that overlap with [from, to], zero from or to are not limited.
+func Pauses(driverID string, from, to time.Time) ([]PauseInterval, error) {
+	rClient := storages.GetRedisClient()
+	var entries []string
+	err := storages.WithRetry(func() (err error) {
+		entries, err = rClient.LRange(pausesKey(driverID), 0, -1).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pauses := make([]PauseInterval, 0, len(entries))
+	for _, e := range entries {
+		var p PauseInterval
+		if err := json.Unmarshal([]byte(e), &p); err != nil {
+			continue
+		}
+		if (!to.IsZero() && p.Start.After(to)) || (p.End != nil && p.End.Before(from)) {
+			continue
+		}
+		pauses = append(pauses, p)
+	}
+	return pauses, nil
+}
+
+// Available returns the drivers of ids that are not paused, in the same order.
+func Available(ids []string) ([]string, error) {
+	rClient := storages.GetRedisClient()
+	cmds := make([]*redis.IntCmd, len(ids))
+	err := storages.WithRetry(func() error {
+		_, err := rClient.Pipelined(func(pipe redis.Pipeliner) error {
+			for i, id := range ids {
+				cmds[i] = pipe.Exists(pauseKey(id))
+			}
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var available []string
+	for i, id := range ids {
+		if cmds[i].Val() == 0 {
+			available = append(available, id)
+		}
+	}
+	return available, nil
+}
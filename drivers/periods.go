@@ -0,0 +1,243 @@
+package drivers
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// These are the commercial periods of a driver required by the insurers: offline, available (P1),
+// en route to the picking point (P2) and on trip with the rider (P3).
+const (
+	PeriodOffline   = "offline"
+	PeriodAvailable = "P1"
+	PeriodEnRoute   = "P2"
+	PeriodOnTrip    = "P3"
+)
+
+// ValidPeriod returns true if period is one of the commercial periods.
+func ValidPeriod(period string) bool {
+	switch period {
+	case PeriodOffline, PeriodAvailable, PeriodEnRoute, PeriodOnTrip:
+		return true
+	}
+	return false
+}
+
+// maxPeriods is the number of period intervals kept for each driver.
+const maxPeriods = 10000
+
+// fleetKey is the set with the drivers that have periods, it is used to export the periods of the fleet.
+const fleetKey = "drivers:periods"
+
+// PeriodInterval is the time that the driver spent in a period, End is nil for the current period.
+type PeriodInterval struct {
+	Period string     `json:"period"`
+	Start  time.Time  `json:"start"`
+	End    *time.Time `json:"end,omitempty"`
+}
+
+// periodKey keeps the current period of the driver.
+func periodKey(driverID string) string {
+	return fmt.Sprintf("driver:%s:period", storages.Tag(driverID))
+}
+
+// periodsKey is a list with the period intervals of the driver.
+func periodsKey(driverID string) string {
+	return fmt.Sprintf("driver:%s:periods", storages.Tag(driverID))
+}
+
+// periodScript closes the current period in KEYS[1] and starts the period ARGV[1] at ARGV[3] with the interval ARGV[2].
+// ARGV[5:] are the periods that allow the transition, without them any period does. The drivers without period are offline.
+// It returns 1 if the period changed.
+var periodScript = redis.NewScript(`
+local cur = redis.call("GET", KEYS[1])
+local p
+local period = "offline"
+if cur then
+	p = cjson.decode(cur)
+	period = p.period
+end
+if period == ARGV[1] then
+	return 0
+end
+if #ARGV > 4 then
+	local allowed = false
+	for i = 5, #ARGV do
+		if ARGV[i] == period then
+			allowed = true
+		end
+	end
+	if not allowed then
+		return 0
+	end
+end
+if p then
+	p["end"] = ARGV[3]
+	redis.call("LSET", KEYS[2], -1, cjson.encode(p))
+end
+redis.call("SET", KEYS[1], ARGV[2])
+redis.call("RPUSH", KEYS[2], ARGV[2])
+redis.call("LTRIM", KEYS[2], -tonumber(ARGV[4]), -1)
+return 1
+`)
+
+// SetPeriod moves the driver to the period, from are the current periods that allow the change, e.g. a driver only becomes
+// available by sending its location when it was offline. It returns true if the period changed.
+func SetPeriod(driverID, period string, from ...string) (bool, error) {
+	now := time.Now().UTC()
+	data, err := json.Marshal(PeriodInterval{Period: period, Start: now})
+	if err != nil {
+		return false, err
+	}
+
+	args := []interface{}{period, data, now.Format(time.RFC3339Nano), maxPeriods}
+	for _, f := range from {
+		args = append(args, f)
+	}
+	rClient := storages.GetRedisClient()
+	keys := []string{periodKey(driverID), periodsKey(driverID)}
+	changed, err := periodScript.Run(rClient, keys, args...).Int64()
+	if err != nil || changed == 0 {
+		return false, storages.Classify(err)
+	}
+	// The fleet is in another slot of a cluster, it is not changed by the script.
+	return true, storages.Classify(rClient.SAdd(fleetKey, driverID).Err())
+}
+
+// MarkOffline moves the available drivers of ids to offline, e.g. the drivers removed for not sending their location.
+func MarkOffline(ids []string) error {
+	for _, id := range ids {
+		if _, err := SetPeriod(id, PeriodOffline, PeriodAvailable); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fleet returns the drivers that have periods.
+func Fleet() ([]string, error) {
+	rClient := storages.GetRedisClient()
+	var ids []string
+	err := storages.WithRetry(func() (err error) {
+		ids, err = rClient.SMembers(fleetKey).Result()
+		return err
+	})
+	return ids, err
+}
+
+// CurrentPeriods returns the current period of each driver of ids, the drivers without period are offline.
+func CurrentPeriods(ids []string) (map[string]string, error) {
+	rClient := storages.GetRedisClient()
+	cmds := make([]*redis.StringCmd, len(ids))
+	err := storages.WithRetry(func() error {
+		_, err := rClient.Pipelined(func(pipe redis.Pipeliner) error {
+			for i, id := range ids {
+				cmds[i] = pipe.Get(periodKey(id))
+			}
+			return nil
+		})
+		if err == redis.Nil {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	periods := make(map[string]string, len(ids))
+	for i, id := range ids {
+		periods[id] = PeriodOffline
+		var p PeriodInterval
+		if data, err := cmds[i].Bytes(); err == nil && json.Unmarshal(data, &p) == nil {
+			periods[id] = p.Period
+		}
+	}
+	return periods, nil
+}
+
+// Periods returns the period intervals of the driver that overlap with [from, to], zero from or to are not limited.
+func Periods(driverID string, from, to time.Time) ([]PeriodInterval, error) {
+	rClient := storages.GetRedisClient()
+	var entries []string
+	err := storages.WithRetry(func() (err error) {
+		entries, err = rClient.LRange(periodsKey(driverID), 0, -1).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parsePeriods(entries, from, to), nil
+}
+
+// FleetPeriods returns the period intervals of every driver that overlap with [from, to].
+func FleetPeriods(from, to time.Time) (map[string][]PeriodInterval, error) {
+	ids, err := Fleet()
+	if err != nil {
+		return nil, err
+	}
+
+	rClient := storages.GetRedisClient()
+	cmds := make([]*redis.StringSliceCmd, len(ids))
+	err = storages.WithRetry(func() error {
+		_, err := rClient.Pipelined(func(pipe redis.Pipeliner) error {
+			for i, id := range ids {
+				cmds[i] = pipe.LRange(periodsKey(id), 0, -1)
+			}
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fleet := make(map[string][]PeriodInterval, len(ids))
+	for i, id := range ids {
+		if periods := parsePeriods(cmds[i].Val(), from, to); len(periods) > 0 {
+			fleet[id] = periods
+		}
+	}
+	return fleet, nil
+}
+
+func parsePeriods(entries []string, from, to time.Time) []PeriodInterval {
+	periods := make([]PeriodInterval, 0, len(entries))
+	for _, e := range entries {
+		var p PeriodInterval
+		if err := json.Unmarshal([]byte(e), &p); err != nil {
+			continue
+		}
+		if (!to.IsZero() && p.Start.After(to)) || (p.End != nil && p.End.Before(from)) {
+			continue
+		}
+		periods = append(periods, p)
+	}
+	return periods
+}
+
+// PeriodTotals returns the time spent in each period, the intervals are clipped to [from, to]
+// and the current period ends at now.
+func PeriodTotals(periods []PeriodInterval, from, to, now time.Time) map[string]time.Duration {
+	totals := make(map[string]time.Duration)
+	for _, p := range periods {
+		start, end := p.Start, now
+		if p.End != nil {
+			end = *p.End
+		}
+		if !from.IsZero() && start.Before(from) {
+			start = from
+		}
+		if !to.IsZero() && end.After(to) {
+			end = to
+		}
+		if end.After(start) {
+			totals[p.Period] += end.Sub(start)
+		}
+	}
+	return totals
+}
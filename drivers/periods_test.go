@@ -0,0 +1,49 @@
+package drivers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeriodTotals(t *testing.T) {
+	base := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	at := func(m int) *time.Time {
+		t := base.Add(time.Duration(m) * time.Minute)
+		return &t
+	}
+	periods := []PeriodInterval{
+		{Period: PeriodAvailable, Start: base, End: at(30)},
+		{Period: PeriodEnRoute, Start: *at(30), End: at(40)},
+		{Period: PeriodOnTrip, Start: *at(40), End: at(70)},
+		{Period: PeriodAvailable, Start: *at(70)},
+	}
+
+	totals := PeriodTotals(periods, *at(10), *at(80), *at(90))
+	want := map[string]time.Duration{
+		PeriodAvailable: 30 * time.Minute,
+		PeriodEnRoute:   10 * time.Minute,
+		PeriodOnTrip:    30 * time.Minute,
+	}
+	for period, d := range want {
+		if totals[period] != d {
+			t.Errorf("%s: expected %v, got %v", period, d, totals[period])
+		}
+	}
+
+	// Without limits the current period ends at now.
+	totals = PeriodTotals(periods, time.Time{}, time.Time{}, *at(90))
+	if totals[PeriodAvailable] != 50*time.Minute {
+		t.Errorf("expected 50m available, got %v", totals[PeriodAvailable])
+	}
+}
+
+func TestValidPeriod(t *testing.T) {
+	for _, p := range []string{PeriodOffline, PeriodAvailable, PeriodEnRoute, PeriodOnTrip} {
+		if !ValidPeriod(p) {
+			t.Errorf("%s should be valid", p)
+		}
+	}
+	if ValidPeriod("P4") {
+		t.Error("P4 should not be valid")
+	}
+}
@@ -0,0 +1,114 @@
+package drivers
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// ErrProfileNotFound is returned when the driver does not have a profile.
+var ErrProfileNotFound = errors.New("driver profile not found")
+
+// Profile is the information of the driver shown to the riders, the rating is kept with the other ratings.
+type Profile struct {
+	Name        string  `json:"name"`
+	VehicleType string  `json:"vehicle_type"`
+	Plate       string  `json:"plate"`
+	Rating      float64 `json:"rating,omitempty"`
+	Capacity    int     `json:"capacity"`
+}
+
+// profileKey is a hash with the profile of the driver.
+func profileKey(driverID string) string {
+	return fmt.Sprintf("driver:%s:profile", driverID)
+}
+
+// SaveProfile creates or replaces the profile of the driver, a zero rating does not change the current one.
+func SaveProfile(driverID string, p Profile) error {
+	rClient := storages.GetRedisClient()
+	_, err := rClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HMSet(profileKey(driverID), map[string]interface{}{
+			"name":         p.Name,
+			"vehicle_type": p.VehicleType,
+			"plate":        p.Plate,
+			"capacity":     p.Capacity,
+		})
+		if p.Rating > 0 {
+			pipe.HSet(ratingsKey, driverID, p.Rating)
+		}
+		return nil
+	})
+	return storages.Classify(err)
+}
+
+// GetProfile returns the profile of the driver, ErrProfileNotFound if it does not have one.
+func GetProfile(driverID string) (Profile, error) {
+	profiles, err := Profiles([]string{driverID})
+	if err != nil {
+		return Profile{}, err
+	}
+	p, ok := profiles[driverID]
+	if !ok {
+		return Profile{}, ErrProfileNotFound
+	}
+	return p, nil
+}
+
+// DeleteProfile removes the profile of the driver, the rating is kept for the matching.
+func DeleteProfile(driverID string) error {
+	rClient := storages.GetRedisClient()
+	n, err := rClient.Del(profileKey(driverID)).Result()
+	if err != nil {
+		return storages.Classify(err)
+	}
+	if n == 0 {
+		return ErrProfileNotFound
+	}
+	return nil
+}
+
+// Profiles returns the profiles of the drivers, the drivers without profile are not in the map.
+func Profiles(ids []string) (map[string]Profile, error) {
+	profiles := make(map[string]Profile, len(ids))
+	if len(ids) == 0 {
+		return profiles, nil
+	}
+
+	rClient := storages.GetRedisClient()
+	cmds := make([]*redis.StringStringMapCmd, len(ids))
+	err := storages.WithRetry(func() error {
+		_, err := rClient.Pipelined(func(pipe redis.Pipeliner) error {
+			for i, id := range ids {
+				cmds[i] = pipe.HGetAll(profileKey(id))
+			}
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	ratings, err := Ratings(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, id := range ids {
+		fields := cmds[i].Val()
+		if len(fields) == 0 {
+			continue
+		}
+		capacity, _ := strconv.Atoi(fields["capacity"])
+		profiles[id] = Profile{
+			Name:        fields["name"],
+			VehicleType: fields["vehicle_type"],
+			Plate:       fields["plate"],
+			Rating:      ratings[id],
+			Capacity:    capacity,
+		}
+	}
+	return profiles, nil
+}
@@ -0,0 +1,45 @@
+package drivers
+
+import (
+	"strconv"
+
+	"github.com/douglasmakey/tracking/storages"
+)
+
+// ratingsKey is a hash with the average rating of each driver, from 1 to 5.
+const ratingsKey = "drivers:ratings"
+
+// SetRating sets the average rating of the driver.
+func SetRating(driverID string, rating float64) error {
+	rClient := storages.GetRedisClient()
+	return storages.Classify(rClient.HSet(ratingsKey, driverID, rating).Err())
+}
+
+// Ratings returns the ratings of the drivers, the drivers without rating are not in the map.
+func Ratings(ids []string) (map[string]float64, error) {
+	ratings := make(map[string]float64, len(ids))
+	if len(ids) == 0 {
+		return ratings, nil
+	}
+
+	rClient := storages.GetRedisClient()
+	var values []interface{}
+	err := storages.WithRetry(func() (err error) {
+		values, err = rClient.HMGet(ratingsKey, ids...).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			ratings[ids[i]] = f
+		}
+	}
+	return ratings, nil
+}
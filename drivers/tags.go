@@ -0,0 +1,97 @@
+package drivers
+
+import (
+	"fmt"
+
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// TagWAV is the tag of the drivers with a wheelchair accessible vehicle.
+const TagWAV = "wav"
+
+// These are the vehicle classes that the riders can request, a driver serves the classes that are in its tags.
+const (
+	ClassEconomy  = "economy"
+	ClassXL       = "xl"
+	ClassMoto     = "moto"
+	ClassDelivery = "delivery"
+)
+
+// IsClass returns whether class is a known vehicle class.
+func IsClass(class string) bool {
+	switch class {
+	case ClassEconomy, ClassXL, ClassMoto, ClassDelivery:
+		return true
+	}
+	return false
+}
+
+// tagsKey is the set with the tags of the driver.
+func tagsKey(driverID string) string {
+	return fmt.Sprintf("driver:%s:tags", driverID)
+}
+
+// SetTags replaces the tags of the driver.
+func SetTags(driverID string, tags []string) error {
+	rClient := storages.GetRedisClient()
+	_, err := rClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(tagsKey(driverID))
+		for _, t := range tags {
+			pipe.SAdd(tagsKey(driverID), t)
+		}
+		return nil
+	})
+	return storages.Classify(err)
+}
+
+// Tags returns the tags of the driver.
+func Tags(driverID string) ([]string, error) {
+	rClient := storages.GetRedisClient()
+	var tags []string
+	err := storages.WithRetry(func() (err error) {
+		tags, err = rClient.SMembers(tagsKey(driverID)).Result()
+		return err
+	})
+	return tags, err
+}
+
+// WithTag returns the drivers of ids that have the tag, in the same order.
+func WithTag(ids []string, tag string) ([]string, error) {
+	rClient := storages.GetRedisClient()
+	cmds := make([]*redis.BoolCmd, len(ids))
+	err := storages.WithRetry(func() error {
+		_, err := rClient.Pipelined(func(pipe redis.Pipeliner) error {
+			for i, id := range ids {
+				cmds[i] = pipe.SIsMember(tagsKey(id), tag)
+			}
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var tagged []string
+	for i, id := range ids {
+		if cmds[i].Val() {
+			tagged = append(tagged, id)
+		}
+	}
+	return tagged, nil
+}
+
+// WithTags returns the drivers of ids that have all the tags, in the same order.
+func WithTags(ids []string, tags []string) ([]string, error) {
+	for _, tag := range tags {
+		if len(ids) == 0 {
+			break
+		}
+		var err error
+		if ids, err = WithTag(ids, tag); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
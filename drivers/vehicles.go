@@ -0,0 +1,226 @@
+package drivers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// These are the errors of the vehicles.
+var (
+	ErrVehicleNotFound = errors.New("vehicle not found")
+	ErrNotCompliant    = errors.New("vehicle not compliant")
+	ErrOnTrip          = errors.New("driver is on a trip")
+)
+
+// maxVehicleChanges is the number of vehicle changes kept for each driver.
+const maxVehicleChanges = 1000
+
+// Vehicle is a vehicle that the drivers can drive, a driver drives one vehicle at a time.
+type Vehicle struct {
+	ID       string `json:"id"`
+	Type     string `json:"vehicle_type"`
+	Plate    string `json:"plate"`
+	Capacity int    `json:"capacity"`
+	// Classes are the vehicle classes that it serves and Amenities its other tags, e.g. wav.
+	// They are the tags of the driver while it drives the vehicle.
+	Classes   []string `json:"classes"`
+	Amenities []string `json:"amenities,omitempty"`
+	// The insurance and the inspection must be valid to switch to the vehicle.
+	InsuranceExpires  time.Time `json:"insurance_expires"`
+	InspectionExpires time.Time `json:"inspection_expires"`
+}
+
+// tags returns the tags of the drivers of the vehicle.
+func (v Vehicle) tags() []string {
+	return append(append([]string{}, v.Classes...), v.Amenities...)
+}
+
+// Check returns an ErrNotCompliant error with the reasons if the vehicle can not be driven at now.
+func (v Vehicle) Check(now time.Time) error {
+	var reasons []string
+	if !v.InsuranceExpires.After(now) {
+		reasons = append(reasons, "the insurance expired")
+	}
+	if !v.InspectionExpires.After(now) {
+		reasons = append(reasons, "the inspection expired")
+	}
+	if len(reasons) > 0 {
+		return fmt.Errorf("%w: %s", ErrNotCompliant, strings.Join(reasons, ", "))
+	}
+	return nil
+}
+
+// VehicleChange is a switch of the active vehicle of the driver, From is empty for the first vehicle.
+type VehicleChange struct {
+	From string    `json:"from,omitempty"`
+	To   string    `json:"to"`
+	At   time.Time `json:"at"`
+}
+
+// vehicleKey keeps the vehicle as JSON.
+func vehicleKey(vehicleID string) string {
+	return fmt.Sprintf("vehicle:%s", vehicleID)
+}
+
+// activeVehicleKey keeps the ID of the vehicle that the driver is driving.
+func activeVehicleKey(driverID string) string {
+	return fmt.Sprintf("driver:%s:vehicle", driverID)
+}
+
+// vehicleChangesKey is a list with the vehicle changes of the driver.
+func vehicleChangesKey(driverID string) string {
+	return fmt.Sprintf("driver:%s:vehicle:changes", driverID)
+}
+
+// SaveVehicle creates or replaces the vehicle, the drivers driving it keep their tags until they switch again.
+func SaveVehicle(v Vehicle) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return storages.Classify(storages.GetRedisClient().Set(vehicleKey(v.ID), data, 0).Err())
+}
+
+// GetVehicle returns the vehicle, ErrVehicleNotFound if it does not exist.
+func GetVehicle(vehicleID string) (Vehicle, error) {
+	rClient := storages.GetRedisClient()
+	var data []byte
+	err := storages.WithRetry(func() (err error) {
+		data, err = rClient.Get(vehicleKey(vehicleID)).Bytes()
+		return err
+	})
+	if err == redis.Nil {
+		return Vehicle{}, ErrVehicleNotFound
+	}
+	if err != nil {
+		return Vehicle{}, err
+	}
+	var v Vehicle
+	if err := json.Unmarshal(data, &v); err != nil {
+		return Vehicle{}, err
+	}
+	return v, nil
+}
+
+// ActiveVehicle returns the ID of the vehicle that the driver is driving, empty if it never chose one.
+func ActiveVehicle(driverID string) (string, error) {
+	rClient := storages.GetRedisClient()
+	var vehicleID string
+	err := storages.WithRetry(func() (err error) {
+		vehicleID, err = rClient.Get(activeVehicleKey(driverID)).Result()
+		return err
+	})
+	if err == redis.Nil {
+		return "", nil
+	}
+	return vehicleID, err
+}
+
+// ChangeVehicle switches the driver to the vehicle, the vehicle must be compliant and the driver can not be on a trip.
+// The tags of the previous vehicle are replaced with the tags of the new one, so the matching uses the new classes and amenities,
+// and the profile shown to the riders gets the new type, plate and capacity.
+func ChangeVehicle(driverID, vehicleID string) (VehicleChange, error) {
+	now := time.Now().UTC()
+	v, err := GetVehicle(vehicleID)
+	if err != nil {
+		return VehicleChange{}, err
+	}
+	if err := v.Check(now); err != nil {
+		return VehicleChange{}, err
+	}
+
+	periods, err := CurrentPeriods([]string{driverID})
+	if err != nil {
+		return VehicleChange{}, err
+	}
+	if p := periods[driverID]; p == PeriodEnRoute || p == PeriodOnTrip {
+		return VehicleChange{}, ErrOnTrip
+	}
+
+	change := VehicleChange{To: vehicleID, At: now}
+	if change.From, err = ActiveVehicle(driverID); err != nil {
+		return VehicleChange{}, err
+	}
+	var previous []string
+	if change.From != "" {
+		prev, err := GetVehicle(change.From)
+		if err != nil && err != ErrVehicleNotFound {
+			return VehicleChange{}, err
+		}
+		previous = prev.tags()
+	}
+	current, err := Tags(driverID)
+	if err != nil {
+		return VehicleChange{}, err
+	}
+	tags := replaceTags(current, previous, v.tags())
+
+	data, err := json.Marshal(change)
+	if err != nil {
+		return VehicleChange{}, err
+	}
+	rClient := storages.GetRedisClient()
+	_, err = rClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(activeVehicleKey(driverID), vehicleID, 0)
+		pipe.Del(tagsKey(driverID))
+		for _, t := range tags {
+			pipe.SAdd(tagsKey(driverID), t)
+		}
+		pipe.HMSet(profileKey(driverID), map[string]interface{}{
+			"vehicle_type": v.Type,
+			"plate":        v.Plate,
+			"capacity":     v.Capacity,
+		})
+		pipe.RPush(vehicleChangesKey(driverID), data)
+		pipe.LTrim(vehicleChangesKey(driverID), -maxVehicleChanges, -1)
+		return nil
+	})
+	if err != nil {
+		return VehicleChange{}, storages.Classify(err)
+	}
+	return change, nil
+}
+
+// replaceTags removes the tags of the previous vehicle and the vehicle classes from the tags of the driver and adds the tags
+// of the new vehicle, the tags that are not of the vehicle are kept.
+func replaceTags(current, previous, next []string) []string {
+	drop := make(map[string]bool, len(previous))
+	for _, t := range previous {
+		drop[t] = true
+	}
+	tags := make([]string, 0, len(current)+len(next))
+	for _, t := range current {
+		if !drop[t] && !IsClass(t) {
+			tags = append(tags, t)
+		}
+	}
+	return append(tags, next...)
+}
+
+// VehicleChanges returns the vehicle changes of the driver from the oldest to the newest.
+func VehicleChanges(driverID string) ([]VehicleChange, error) {
+	rClient := storages.GetRedisClient()
+	var entries []string
+	err := storages.WithRetry(func() (err error) {
+		entries, err = rClient.LRange(vehicleChangesKey(driverID), 0, -1).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]VehicleChange, 0, len(entries))
+	for _, e := range entries {
+		var c VehicleChange
+		if err := json.Unmarshal([]byte(e), &c); err != nil {
+			continue
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
@@ -0,0 +1,32 @@
+package drivers
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestVehicleCheck(t *testing.T) {
+	now := time.Now()
+	v := Vehicle{InsuranceExpires: now.Add(time.Hour), InspectionExpires: now.Add(time.Hour)}
+	if err := v.Check(now); err != nil {
+		t.Errorf("expected a compliant vehicle, got %v", err)
+	}
+
+	v.InspectionExpires = now.Add(-time.Hour)
+	if err := v.Check(now); !errors.Is(err, ErrNotCompliant) {
+		t.Errorf("expected ErrNotCompliant for an expired inspection, got %v", err)
+	}
+}
+
+func TestReplaceTags(t *testing.T) {
+	current := []string{ClassXL, TagWAV, "pet_friendly", ClassEconomy}
+	previous := []string{ClassXL, TagWAV}
+	next := []string{ClassMoto}
+
+	want := []string{"pet_friendly", ClassMoto}
+	if got := replaceTags(current, previous, next); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,116 @@
+// Package eta estimates the time that a driver needs to arrive to the picking point.
+package eta
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/retry"
+)
+
+// Provider estimates the travel time between two points.
+type Provider interface {
+	ETA(ctx context.Context, from, to geo.Point) (time.Duration, error)
+}
+
+// Haversine estimates the travel time with the straight distance and an average speed in km/h,
+// it does not need any external service.
+type Haversine struct {
+	Speed float64
+}
+
+func (h Haversine) ETA(_ context.Context, from, to geo.Point) (time.Duration, error) {
+	if h.Speed <= 0 {
+		return 0, fmt.Errorf("invalid average speed %g", h.Speed)
+	}
+	hours := geo.Distance(from, to) / h.Speed
+	return time.Duration(hours * float64(time.Hour)), nil
+}
+
+// OSRM estimates the travel time with the route service of an OSRM server, e.g. http://router.project-osrm.org.
+type OSRM struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+// NewOSRM create and return a pointer to OSRM with a client with timeout.
+func NewOSRM(baseURL string) *OSRM {
+	return &OSRM{BaseURL: baseURL, Client: &http.Client{Timeout: time.Second * 2}}
+}
+
+// ETA asks the route to the server with the routing retry policy, a route that does not exist is not retried.
+func (o *OSRM) ETA(ctx context.Context, from, to geo.Point) (time.Duration, error) {
+	var d time.Duration
+	err := retry.For(retry.Routing).Do(ctx, retry.Routing, func() (err error) {
+		d, err = o.route(ctx, from, to)
+		return err
+	})
+	return d, err
+}
+
+func (o *OSRM) route(ctx context.Context, from, to geo.Point) (time.Duration, error) {
+	url := fmt.Sprintf("%s/route/v1/driving/%f,%f;%f,%f?overview=false", o.BaseURL, from.Lng, from.Lat, to.Lng, to.Lat)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, retry.Permanent(err)
+	}
+	res, err := o.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		err := fmt.Errorf("osrm returned %s", res.Status)
+		if res.StatusCode >= 400 && res.StatusCode < 500 && res.StatusCode != http.StatusTooManyRequests {
+			return 0, retry.Permanent(err)
+		}
+		return 0, err
+	}
+	var body struct {
+		Code   string `json:"code"`
+		Routes []struct {
+			Duration float64 `json:"duration"`
+		} `json:"routes"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return 0, err
+	}
+	if body.Code != "Ok" || len(body.Routes) == 0 {
+		return 0, retry.Permanent(fmt.Errorf("osrm did not find a route: %s", body.Code))
+	}
+	return time.Duration(body.Routes[0].Duration * float64(time.Second)), nil
+}
+
+var (
+	mu       sync.RWMutex
+	provider Provider = fallback
+	// fallback is used when the provider fails, the average speed in the city is about 30 km/h.
+	fallback = Haversine{Speed: 30}
+)
+
+// SetProvider sets the provider used by Estimate and the average speed of the haversine fallback.
+func SetProvider(p Provider, speed float64) {
+	mu.Lock()
+	fallback = Haversine{Speed: speed}
+	provider = p
+	mu.Unlock()
+}
+
+// Estimate returns the travel time between the points, when the provider fails the haversine estimation is returned.
+func Estimate(ctx context.Context, from, to geo.Point) time.Duration {
+	mu.RLock()
+	p, h := provider, fallback
+	mu.RUnlock()
+
+	if d, err := p.ETA(ctx, from, to); err == nil {
+		return d
+	}
+	d, _ := h.ETA(ctx, from, to)
+	return d
+}
@@ -0,0 +1,46 @@
+package eta
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/douglasmakey/tracking/geo"
+)
+
+var (
+	santiago   = geo.Point{Lat: -33.448890, Lng: -70.669265}
+	valparaiso = geo.Point{Lat: -33.047238, Lng: -71.612688}
+)
+
+func TestHaversine(t *testing.T) {
+	// The distance between both cities is about 98km.
+	d, err := Haversine{Speed: 98}.ETA(context.Background(), santiago, valparaiso)
+	if err != nil {
+		t.Fatalf("could not estimate: %v", err)
+	}
+	if math.Abs(d.Minutes()-60) > 2 {
+		t.Errorf("unexpected eta %s", d)
+	}
+
+	if _, err := (Haversine{}).ETA(context.Background(), santiago, valparaiso); err == nil {
+		t.Error("expected error without speed")
+	}
+}
+
+type failingProvider struct{}
+
+func (failingProvider) ETA(context.Context, geo.Point, geo.Point) (time.Duration, error) {
+	return 0, errors.New("unavailable")
+}
+
+func TestEstimateFallback(t *testing.T) {
+	SetProvider(failingProvider{}, 98)
+	defer SetProvider(Haversine{Speed: 30}, 30)
+
+	if d := Estimate(context.Background(), santiago, valparaiso); math.Abs(d.Minutes()-60) > 2 {
+		t.Errorf("unexpected fallback eta %s", d)
+	}
+}
@@ -0,0 +1,229 @@
+// Package fairness audits how the matches are distributed between the active drivers of each zone.
+package fairness
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/maintenance"
+	"github.com/douglasmakey/tracking/matching"
+	"github.com/douglasmakey/tracking/metrics"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// The auditor keeps per hour the active drivers of each zone (a set), the matches of each driver in the zone (a hash)
+// and the zones with activity (a set), only the hours of the window are read.
+
+// retention is the time that the hourly keys are kept, it must be longer than the window of the auditor.
+const retention = time.Hour * 25
+
+func hour(t time.Time) string {
+	return t.UTC().Format("2006010215")
+}
+
+func activeKey(zone string, t time.Time) string {
+	return fmt.Sprintf("fairness:active:%s:%s", zone, hour(t))
+}
+
+func matchesKey(zone string, t time.Time) string {
+	return fmt.Sprintf("fairness:matches:%s:%s", zone, hour(t))
+}
+
+func zonesKey(t time.Time) string {
+	return fmt.Sprintf("fairness:zones:%s", hour(t))
+}
+
+// RecordActive counts the driver as active in the zone of the location for the current hour.
+func RecordActive(driverID string, p geo.Point) error {
+	now, zone := time.Now(), geo.Zone(p)
+	rClient := storages.GetRedisClient()
+	_, err := rClient.Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.SAdd(activeKey(zone, now), driverID)
+		pipe.Expire(activeKey(zone, now), retention)
+		pipe.SAdd(zonesKey(now), zone)
+		pipe.Expire(zonesKey(now), retention)
+		return nil
+	})
+	return storages.Classify(err)
+}
+
+// RecordMatch counts a match of the driver in the zone of the picking point for the current hour.
+func RecordMatch(driverID string, p geo.Point) error {
+	now, zone := time.Now(), geo.Zone(p)
+	rClient := storages.GetRedisClient()
+	_, err := rClient.Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.HIncrBy(matchesKey(zone, now), driverID, 1)
+		pipe.Expire(matchesKey(zone, now), retention)
+		// The driver that gets a match is active even if its location was recorded in another zone.
+		pipe.SAdd(activeKey(zone, now), driverID)
+		pipe.Expire(activeKey(zone, now), retention)
+		pipe.SAdd(zonesKey(now), zone)
+		pipe.Expire(zonesKey(now), retention)
+		return nil
+	})
+	return storages.Classify(err)
+}
+
+// Gini returns the Gini coefficient of the values, 0 when all of them are equal and close to 1 when one has everything.
+func Gini(values []float64) float64 {
+	n := len(values)
+	if n == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	var sum, weighted float64
+	for i, v := range sorted {
+		sum += v
+		weighted += float64(i+1) * v
+	}
+	if sum == 0 {
+		return 0
+	}
+	return (2*weighted)/(float64(n)*sum) - float64(n+1)/float64(n)
+}
+
+// Report is the result of an audit.
+type Report struct {
+	// Zones is the Gini coefficient of the matches per active driver of each zone.
+	Zones map[string]float64
+	// Overall is the Gini coefficient of all the active drivers.
+	Overall float64
+}
+
+// Audit computes the Gini coefficients of the matches in the window until now.
+func Audit(now time.Time, window time.Duration) (Report, error) {
+	hours := int(math.Ceil(window.Hours()))
+	if hours < 1 {
+		hours = 1
+	}
+
+	rClient := storages.GetRedisClient()
+	zones := make(map[string]bool)
+	for i := 0; i < hours; i++ {
+		var members []string
+		t := now.Add(-time.Duration(i) * time.Hour)
+		err := storages.WithRetry(func() (err error) {
+			members, err = rClient.SMembers(zonesKey(t)).Result()
+			return err
+		})
+		if err != nil {
+			return Report{}, err
+		}
+		for _, z := range members {
+			zones[z] = true
+		}
+	}
+
+	report := Report{Zones: make(map[string]float64, len(zones))}
+	overall := make(map[string]float64)
+	for zone := range zones {
+		counts, err := zoneMatches(zone, now, hours)
+		if err != nil {
+			return Report{}, err
+		}
+		values := make([]float64, 0, len(counts))
+		for driverID, c := range counts {
+			values = append(values, c)
+			overall[driverID] += c
+		}
+		report.Zones[zone] = Gini(values)
+	}
+
+	values := make([]float64, 0, len(overall))
+	for _, c := range overall {
+		values = append(values, c)
+	}
+	report.Overall = Gini(values)
+	return report, nil
+}
+
+// zoneMatches returns the matches of each active driver of the zone, the drivers without matches are zero.
+func zoneMatches(zone string, now time.Time, hours int) (map[string]float64, error) {
+	rClient := storages.GetRedisClient()
+	active := make([]*redis.StringSliceCmd, hours)
+	matches := make([]*redis.StringStringMapCmd, hours)
+	err := storages.WithRetry(func() error {
+		_, err := rClient.Pipelined(func(pipe redis.Pipeliner) error {
+			for i := 0; i < hours; i++ {
+				t := now.Add(-time.Duration(i) * time.Hour)
+				active[i] = pipe.SMembers(activeKey(zone, t))
+				matches[i] = pipe.HGetAll(matchesKey(zone, t))
+			}
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]float64)
+	for i := 0; i < hours; i++ {
+		for _, driverID := range active[i].Val() {
+			counts[driverID] += 0
+		}
+		for driverID, v := range matches[i].Val() {
+			n, _ := strconv.ParseFloat(v, 64)
+			counts[driverID] += n
+		}
+	}
+	return counts, nil
+}
+
+// Auditor runs the audit periodically, when the skew is over Threshold it increases the fairness weight of the weighted matching strategy.
+type Auditor struct {
+	Interval, Window time.Duration
+	Threshold        float64
+	AutoAdjust       bool
+	// Step is the increase of the fairness weight on each audit over the threshold, up to MaxWeight.
+	Step, MaxWeight float64
+}
+
+// Start launches the auditor in a goroutine.
+func (a Auditor) Start() {
+	metrics.FairnessWeight.Set(matching.FairnessWeight())
+	go func() {
+		ticker := time.NewTicker(a.Interval)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			if maintenance.Paused() {
+				continue
+			}
+			a.run(now)
+		}
+	}()
+}
+
+func (a Auditor) run(now time.Time) {
+	report, err := Audit(now, a.Window)
+	if err != nil {
+		logging.Logger.Error("could not audit fairness", "error", err)
+		return
+	}
+
+	for zone, g := range report.Zones {
+		metrics.MatchGini.WithLabelValues(zone).Set(g)
+	}
+	metrics.MatchGini.WithLabelValues("all").Set(report.Overall)
+
+	if !a.AutoAdjust || report.Overall <= a.Threshold {
+		return
+	}
+	weight := matching.FairnessWeight()
+	if weight >= a.MaxWeight {
+		return
+	}
+	weight = math.Min(weight+a.Step, a.MaxWeight)
+	matching.SetFairnessWeight(weight)
+	metrics.FairnessWeight.Set(weight)
+	logging.Logger.Warn("match skew over threshold, fairness weight increased", "gini", report.Overall, "weight", weight)
+}
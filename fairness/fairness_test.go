@@ -0,0 +1,25 @@
+package fairness
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGini(t *testing.T) {
+	tests := []struct {
+		values []float64
+		want   float64
+	}{
+		{nil, 0},
+		{[]float64{0, 0, 0}, 0},
+		{[]float64{3, 3, 3, 3}, 0},
+		// One driver has all the matches.
+		{[]float64{0, 0, 0, 4}, 0.75},
+		{[]float64{1, 2, 3, 4}, 0.25},
+	}
+	for _, tt := range tests {
+		if g := Gini(tt.values); math.Abs(g-tt.want) > 1e-9 {
+			t.Errorf("Gini(%v) = %f, want %f", tt.values, g, tt.want)
+		}
+	}
+}
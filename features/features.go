@@ -0,0 +1,85 @@
+package features
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Candidate is a driver that was considered for a match, Rating and Acceptance are the inputs of the ranking.
+type Candidate struct {
+	DriverID   string  `json:"driver_id"`
+	Distance   float64 `json:"distance_km"`
+	Rating     float64 `json:"rating,omitempty"`
+	Acceptance float64 `json:"acceptance_rate"`
+}
+
+// Vector contains the features of a match decision, data science uses them to train matching models offline.
+type Vector struct {
+	RequestID  string      `json:"request_id"`
+	DriverID   string      `json:"driver_id"`
+	Lat        float64     `json:"lat"`
+	Lng        float64     `json:"lng"`
+	Candidates []Candidate `json:"candidates"`
+	HourOfDay  int         `json:"hour_of_day"`
+	Weekday    int         `json:"weekday"`
+	// Supply is the number of drivers in the zone of the picking point and Demand the number of requests searching in the zone.
+	Zone      string    `json:"zone"`
+	Supply    int       `json:"supply"`
+	Demand    int64     `json:"demand"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Sink receives the vectors, implementations can write them to files, queues or a feature store.
+type Sink interface {
+	Write(v Vector) error
+}
+
+// NDJSONSink writes each vector as a JSON line.
+type NDJSONSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewNDJSONSink create and return a pointer to NDJSONSink that writes to w.
+func NewNDJSONSink(w io.Writer) *NDJSONSink {
+	return &NDJSONSink{enc: json.NewEncoder(w)}
+}
+
+// Write encodes the vector as a new line.
+func (s *NDJSONSink) Write(v Vector) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(v)
+}
+
+type nopSink struct{}
+
+func (nopSink) Write(Vector) error { return nil }
+
+var (
+	mu   sync.RWMutex
+	sink Sink = nopSink{}
+)
+
+// SetSink sets the sink used by Emit, by default the vectors are discarded.
+func SetSink(s Sink) {
+	mu.Lock()
+	sink = s
+	mu.Unlock()
+}
+
+// Emit sends the vector to the configured sink.
+func Emit(v Vector) error {
+	if v.Timestamp.IsZero() {
+		v.Timestamp = time.Now().UTC()
+	}
+	v.HourOfDay = v.Timestamp.Hour()
+	v.Weekday = int(v.Timestamp.Weekday())
+
+	mu.RLock()
+	s := sink
+	mu.RUnlock()
+	return s.Write(v)
+}
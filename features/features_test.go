@@ -0,0 +1,39 @@
+package features
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestNDJSONSink(t *testing.T) {
+	var buf bytes.Buffer
+	SetSink(NewNDJSONSink(&buf))
+	defer SetSink(nopSink{})
+
+	ts := time.Date(2018, 8, 1, 14, 0, 0, 0, time.UTC)
+	for _, id := range []string{"1", "2"} {
+		v := Vector{RequestID: id, DriverID: "d", Candidates: []Candidate{{DriverID: "d", Distance: 1.5}}, Timestamp: ts}
+		if err := Emit(v); err != nil {
+			t.Fatalf("could not emit vector: %v", err)
+		}
+	}
+
+	dec := json.NewDecoder(&buf)
+	var lines int
+	for dec.More() {
+		var v Vector
+		if err := dec.Decode(&v); err != nil {
+			t.Fatalf("could not decode line: %v", err)
+		}
+		if v.HourOfDay != 14 || v.Weekday != int(time.Wednesday) {
+			t.Errorf("unexpected time features %d %d", v.HourOfDay, v.Weekday)
+		}
+		lines++
+	}
+
+	if lines != 2 {
+		t.Errorf("expected 2 lines, got %d", lines)
+	}
+}
@@ -0,0 +1,164 @@
+package geo
+
+import (
+	"math"
+	"strings"
+)
+
+// earthRadius is the mean radius of the earth in km.
+const earthRadius = 6371.0
+
+// Point is a coordinate.
+type Point struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// Distance returns the great-circle distance in km between a and b using the haversine formula.
+func Distance(a, b Point) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLat := (b.Lat - a.Lat) * math.Pi / 180
+	dLng := (b.Lng - a.Lng) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+// DistanceToSegment returns the distance in km from p to the nearest point of the segment from a to b.
+// The points are projected on a plane around a, it is accurate for the distances of a city.
+func DistanceToSegment(p, a, b Point) float64 {
+	kx := earthRadius * math.Pi / 180 * math.Cos(a.Lat*math.Pi/180)
+	ky := earthRadius * math.Pi / 180
+	px, py := (p.Lng-a.Lng)*kx, (p.Lat-a.Lat)*ky
+	bx, by := (b.Lng-a.Lng)*kx, (b.Lat-a.Lat)*ky
+
+	t := 0.0
+	if l := bx*bx + by*by; l > 0 {
+		t = math.Max(0, math.Min(1, (px*bx+py*by)/l))
+	}
+	return math.Hypot(px-t*bx, py-t*by)
+}
+
+// InPolygon returns whether p is inside the polygon, it uses the ray casting algorithm.
+// The polygon is closed between the last point and the first one.
+func InPolygon(p Point, polygon []Point) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a.Lat > p.Lat) != (b.Lat > p.Lat) && p.Lng < (b.Lng-a.Lng)*(p.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lng {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+const base32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// Geohash returns the geohash of p with precision characters, it is used to group points in cells.
+func Geohash(p Point, precision int) string {
+	latRange := [2]float64{-90, 90}
+	lngRange := [2]float64{-180, 180}
+
+	hash := make([]byte, 0, precision)
+	var bit, ch int
+	even := true
+	for len(hash) < precision {
+		if even {
+			mid := (lngRange[0] + lngRange[1]) / 2
+			if p.Lng >= mid {
+				ch |= 1 << uint(4-bit)
+				lngRange[0] = mid
+			} else {
+				lngRange[1] = mid
+			}
+		} else {
+			mid := (latRange[0] + latRange[1]) / 2
+			if p.Lat >= mid {
+				ch |= 1 << uint(4-bit)
+				latRange[0] = mid
+			} else {
+				latRange[1] = mid
+			}
+		}
+		even = !even
+
+		if bit < 4 {
+			bit++
+		} else {
+			hash = append(hash, base32[ch])
+			bit, ch = 0, 0
+		}
+	}
+
+	return string(hash)
+}
+
+// GeohashCenter returns the center of the cell of the geohash, e.g. a point that stands for the points of the cell.
+// The characters that are not in the geohash alphabet are ignored.
+func GeohashCenter(hash string) Point {
+	min, max := GeohashBounds(hash)
+	return Point{Lat: (min.Lat + max.Lat) / 2, Lng: (min.Lng + max.Lng) / 2}
+}
+
+// GeohashBounds returns the south-west and north-east corners of the cell of the geohash, e.g. to find the points of a zone.
+// The characters that are not in the geohash alphabet are ignored.
+func GeohashBounds(hash string) (Point, Point) {
+	latRange := [2]float64{-90, 90}
+	lngRange := [2]float64{-180, 180}
+
+	even := true
+	for i := 0; i < len(hash); i++ {
+		ch := strings.IndexByte(base32, hash[i])
+		if ch < 0 {
+			continue
+		}
+		for bit := 4; bit >= 0; bit-- {
+			r := &latRange
+			if even {
+				r = &lngRange
+			}
+			mid := (r[0] + r[1]) / 2
+			if ch&(1<<uint(bit)) != 0 {
+				r[0] = mid
+			} else {
+				r[1] = mid
+			}
+			even = !even
+		}
+	}
+
+	return Point{Lat: latRange[0], Lng: lngRange[0]}, Point{Lat: latRange[1], Lng: lngRange[1]}
+}
+
+// zonePrecision is the geohash precision of the zones, a cell of about 5km x 5km.
+const zonePrecision = 5
+
+// Zone returns the ID of the zone that contains p.
+func Zone(p Point) string {
+	return Geohash(p, zonePrecision)
+}
+
+// EncodePolyline returns the points encoded with the polyline algorithm of the map providers, with 5 decimals.
+func EncodePolyline(points []Point) string {
+	var buf []byte
+	encode := func(v int64) {
+		v <<= 1
+		if v < 0 {
+			v = ^v
+		}
+		for v >= 0x20 {
+			buf = append(buf, byte((0x20|(v&0x1f))+63))
+			v >>= 5
+		}
+		buf = append(buf, byte(v+63))
+	}
+
+	var lat, lng int64
+	for _, p := range points {
+		pLat, pLng := int64(math.Round(p.Lat*1e5)), int64(math.Round(p.Lng*1e5))
+		encode(pLat - lat)
+		encode(pLng - lng)
+		lat, lng = pLat, pLng
+	}
+	return string(buf)
+}
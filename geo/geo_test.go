@@ -0,0 +1,83 @@
+package geo
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDistance(t *testing.T) {
+	santiago := Point{Lat: -33.448890, Lng: -70.669265}
+	valparaiso := Point{Lat: -33.047238, Lng: -71.612688}
+
+	// The distance between both cities is about 98km.
+	if d := Distance(santiago, valparaiso); math.Abs(d-98) > 2 {
+		t.Errorf("unexpected distance %f", d)
+	}
+	if d := Distance(santiago, santiago); d != 0 {
+		t.Errorf("distance to the same point must be 0, got %f", d)
+	}
+}
+
+func TestGeohash(t *testing.T) {
+	// Known value from the geohash reference implementation.
+	if h := Geohash(Point{Lat: 57.64911, Lng: 10.40744}, 11); h != "u4pruydqqvj" {
+		t.Errorf("unexpected geohash %s", h)
+	}
+	if h := Geohash(Point{Lat: -33.448890, Lng: -70.669265}, 5); len(h) != 5 {
+		t.Errorf("unexpected precision %s", h)
+	}
+}
+
+func TestGeohashCenter(t *testing.T) {
+	p := Point{Lat: -33.448890, Lng: -70.669265}
+	c := GeohashCenter(Geohash(p, 8))
+	// A cell of precision 8 is about 38m x 19m, its center is close to the point.
+	if d := Distance(p, c); d > 0.025 {
+		t.Errorf("center %+v is %fkm away from the point", c, d)
+	}
+	if h := Geohash(c, 8); h != Geohash(p, 8) {
+		t.Errorf("center is out of the cell, got %s", h)
+	}
+}
+
+func TestGeohashBounds(t *testing.T) {
+	p := Point{Lat: -33.448890, Lng: -70.669265}
+	min, max := GeohashBounds(Zone(p))
+	if p.Lat < min.Lat || p.Lat > max.Lat || p.Lng < min.Lng || p.Lng > max.Lng {
+		t.Errorf("point is out of the bounds %+v %+v", min, max)
+	}
+	// The south-west corner is the first point of the cell.
+	if h := Geohash(min, zonePrecision); h != Zone(p) {
+		t.Errorf("south-west corner is out of the cell, got %s", h)
+	}
+}
+
+func TestDistanceToSegment(t *testing.T) {
+	a := Point{Lat: -33.40, Lng: -70.60}
+	b := Point{Lat: -33.50, Lng: -70.60}
+
+	// A point on the segment.
+	if d := DistanceToSegment(Point{Lat: -33.45, Lng: -70.60}, a, b); d > 0.001 {
+		t.Errorf("expected 0, got %f", d)
+	}
+	// A point beside the segment, 0.01 degrees of longitude are about 0.93km at this latitude.
+	if d := DistanceToSegment(Point{Lat: -33.45, Lng: -70.59}, a, b); math.Abs(d-0.93) > 0.02 {
+		t.Errorf("unexpected distance %f", d)
+	}
+	// A point past the end is measured to the end.
+	p := Point{Lat: -33.60, Lng: -70.60}
+	if d, want := DistanceToSegment(p, a, b), Distance(p, b); math.Abs(d-want) > 0.1 {
+		t.Errorf("expected %f, got %f", want, d)
+	}
+}
+
+func TestEncodePolyline(t *testing.T) {
+	// Known value from the reference of the polyline algorithm.
+	points := []Point{{Lat: 38.5, Lng: -120.2}, {Lat: 40.7, Lng: -120.95}, {Lat: 43.252, Lng: -126.453}}
+	if p := EncodePolyline(points); p != "_p~iF~ps|U_ulLnnqC_mqNvxq`@" {
+		t.Errorf("unexpected polyline %s", p)
+	}
+	if p := EncodePolyline(nil); p != "" {
+		t.Errorf("expected an empty polyline, got %s", p)
+	}
+}
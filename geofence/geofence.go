@@ -0,0 +1,162 @@
+// Package geofence keeps named polygons of the city, e.g. the airport, downtown or restricted zones,
+// and the rules that the search applies to the requests picked up inside them.
+package geofence
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// ErrNotFound is returned when the zone does not exist.
+var ErrNotFound = errors.New("zone not found")
+
+// zonesKey is a hash with the zones as JSON by name.
+const zonesKey = "geofences"
+
+// Rules are applied to the requests whose picking point is inside the zone.
+type Rules struct {
+	// BlockPickups rejects the requests, e.g. a restricted zone.
+	BlockPickups bool `json:"block_pickups,omitempty"`
+	// Priority requests are queued with the accessible ones, the workers take them first.
+	Priority bool `json:"priority,omitempty"`
+	// Surge is the multiplier of the fare, zero or one is no surge.
+	Surge float64 `json:"surge_multiplier,omitempty"`
+	// RequiredTags restrict the entry to the drivers with all the tags, e.g. the permit of a permit-only airport area.
+	// Only those drivers are matched to the requests picked up inside and the others are warned when they idle inside.
+	RequiredTags []string `json:"required_tags,omitempty"`
+}
+
+// Zone is a named polygon, the polygon is closed between the last point and the first one.
+type Zone struct {
+	Name    string      `json:"name"`
+	Polygon []geo.Point `json:"polygon"`
+	Rules   Rules       `json:"rules"`
+}
+
+// Contains returns whether p is inside the polygon of the zone.
+func (z Zone) Contains(p geo.Point) bool {
+	return geo.InPolygon(p, z.Polygon)
+}
+
+// Save creates or replaces the zone.
+func Save(z Zone) error {
+	data, err := json.Marshal(z)
+	if err != nil {
+		return err
+	}
+
+	rClient := storages.GetRedisClient()
+	return storages.Classify(rClient.HSet(zonesKey, z.Name, data).Err())
+}
+
+// Get returns the zone with the name.
+func Get(name string) (Zone, error) {
+	rClient := storages.GetRedisClient()
+	var data []byte
+	err := storages.WithRetry(func() (err error) {
+		data, err = rClient.HGet(zonesKey, name).Bytes()
+		return err
+	})
+	if err == redis.Nil {
+		return Zone{}, ErrNotFound
+	}
+	if err != nil {
+		return Zone{}, err
+	}
+
+	var z Zone
+	err = json.Unmarshal(data, &z)
+	return z, err
+}
+
+// Delete removes the zone.
+func Delete(name string) error {
+	rClient := storages.GetRedisClient()
+	n, err := rClient.HDel(zonesKey, name).Result()
+	if err != nil {
+		return storages.Classify(err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	// The drivers idle in the zone are not tracked anymore.
+	return storages.Classify(rClient.Del(idleKey(name), warnedKey(name)).Err())
+}
+
+// List returns all the zones sorted by name.
+func List() ([]Zone, error) {
+	rClient := storages.GetRedisClient()
+	var entries map[string]string
+	err := storages.WithRetry(func() (err error) {
+		entries, err = rClient.HGetAll(zonesKey).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	zones := make([]Zone, 0, len(entries))
+	for _, e := range entries {
+		var z Zone
+		if err := json.Unmarshal([]byte(e), &z); err != nil {
+			continue
+		}
+		zones = append(zones, z)
+	}
+	sort.Slice(zones, func(i, j int) bool { return zones[i].Name < zones[j].Name })
+	return zones, nil
+}
+
+// Evaluation is the result of the rules of the zones that contain a point.
+type Evaluation struct {
+	Zones        []string `json:"zones"`
+	BlockPickups bool     `json:"block_pickups"`
+	Priority     bool     `json:"priority"`
+	Surge        float64  `json:"surge_multiplier"`
+	RequiredTags []string `json:"required_tags,omitempty"`
+}
+
+// Evaluate returns the rules of the zones that contain p: the pickups are blocked and the request has priority
+// if any zone says so, the surge is the highest one of the zones and the drivers need the tags of all the zones.
+func Evaluate(p geo.Point) (Evaluation, error) {
+	zones, err := List()
+	if err != nil {
+		return Evaluation{}, err
+	}
+	return evaluate(zones, p), nil
+}
+
+func evaluate(zones []Zone, p geo.Point) Evaluation {
+	ev := Evaluation{Zones: []string{}, Surge: 1}
+	for _, z := range zones {
+		if !z.Contains(p) {
+			continue
+		}
+		ev.Zones = append(ev.Zones, z.Name)
+		ev.BlockPickups = ev.BlockPickups || z.Rules.BlockPickups
+		ev.Priority = ev.Priority || z.Rules.Priority
+		if z.Rules.Surge > ev.Surge {
+			ev.Surge = z.Rules.Surge
+		}
+		for _, tag := range z.Rules.RequiredTags {
+			if !contains(ev.RequiredTags, tag) {
+				ev.RequiredTags = append(ev.RequiredTags, tag)
+			}
+		}
+	}
+	return ev
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
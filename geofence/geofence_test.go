@@ -0,0 +1,65 @@
+package geofence
+
+import (
+	"testing"
+
+	"github.com/douglasmakey/tracking/geo"
+)
+
+func TestContains(t *testing.T) {
+	z := Zone{Name: "downtown", Polygon: []geo.Point{
+		{Lat: -33.43, Lng: -70.67}, {Lat: -33.43, Lng: -70.63}, {Lat: -33.46, Lng: -70.63}, {Lat: -33.46, Lng: -70.67},
+	}}
+
+	if !z.Contains(geo.Point{Lat: -33.44, Lng: -70.65}) {
+		t.Error("expected the point to be inside")
+	}
+	if z.Contains(geo.Point{Lat: -33.50, Lng: -70.65}) {
+		t.Error("expected the point to be outside")
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	square := []geo.Point{{Lat: 0, Lng: 0}, {Lat: 0, Lng: 2}, {Lat: 2, Lng: 2}, {Lat: 2, Lng: 0}}
+	zones := []Zone{
+		{Name: "airport", Polygon: square, Rules: Rules{Priority: true, Surge: 1.5}},
+		{Name: "downtown", Polygon: square, Rules: Rules{Surge: 2}},
+		{Name: "restricted", Polygon: []geo.Point{{Lat: 5, Lng: 5}, {Lat: 5, Lng: 6}, {Lat: 6, Lng: 6}}, Rules: Rules{BlockPickups: true}},
+	}
+
+	ev := evaluate(zones, geo.Point{Lat: 1, Lng: 1})
+	if len(ev.Zones) != 2 || !ev.Priority || ev.BlockPickups || ev.Surge != 2 {
+		t.Errorf("unexpected evaluation %+v", ev)
+	}
+
+	ev = evaluate(zones, geo.Point{Lat: 10, Lng: 10})
+	if len(ev.Zones) != 0 || ev.Priority || ev.Surge != 1 {
+		t.Errorf("expected no rules outside the zones, got %+v", ev)
+	}
+}
+
+func TestEvaluateRequiredTags(t *testing.T) {
+	square := []geo.Point{{Lat: 0, Lng: 0}, {Lat: 0, Lng: 2}, {Lat: 2, Lng: 2}, {Lat: 2, Lng: 0}}
+	zones := []Zone{
+		{Name: "airport", Polygon: square, Rules: Rules{RequiredTags: []string{"airport_permit"}}},
+		{Name: "terminal", Polygon: square, Rules: Rules{RequiredTags: []string{"airport_permit", "terminal_permit"}}},
+	}
+
+	ev := evaluate(zones, geo.Point{Lat: 1, Lng: 1})
+	if len(ev.RequiredTags) != 2 || ev.RequiredTags[0] != "airport_permit" || ev.RequiredTags[1] != "terminal_permit" {
+		t.Errorf("expected the tags of both zones once, got %v", ev.RequiredTags)
+	}
+}
+
+func TestCenter(t *testing.T) {
+	z := Zone{Polygon: []geo.Point{{Lat: 0, Lng: 0}, {Lat: 0, Lng: 2}, {Lat: 2, Lng: 2}, {Lat: 2, Lng: 0}}}
+	c, radius := z.Center()
+	if c.Lat != 1 || c.Lng != 1 {
+		t.Errorf("expected the center at 1,1, got %+v", c)
+	}
+	for _, p := range z.Polygon {
+		if geo.Distance(c, p) > radius {
+			t.Errorf("expected the circle to cover %+v", p)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package geofence
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/douglasmakey/tracking/bus"
+	"github.com/douglasmakey/tracking/commands"
+	"github.com/douglasmakey/tracking/drivers"
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/maintenance"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+const (
+	// patrolLockKey lets only one instance patrol the zones on each tick.
+	patrolLockKey = "geofences:patrol:lock"
+	// patrolLimit is the max number of drivers searched in each zone.
+	patrolLimit = 1000
+)
+
+// idleKey is a hash with the unix time when each driver without the tags was first seen idle in the zone,
+// warnedKey the set of those drivers already warned. A driver leaves both when it leaves the zone or is matched.
+func idleKey(zone string) string {
+	return fmt.Sprintf("geofences:%s:idle", zone)
+}
+
+func warnedKey(zone string) string {
+	return fmt.Sprintf("geofences:%s:warned", zone)
+}
+
+// Center returns the center of the polygon and the distance in km to its farthest point, the circle covers the zone.
+func (z Zone) Center() (geo.Point, float64) {
+	var c geo.Point
+	if len(z.Polygon) == 0 {
+		return c, 0
+	}
+	for _, p := range z.Polygon {
+		c.Lat += p.Lat
+		c.Lng += p.Lng
+	}
+	c.Lat /= float64(len(z.Polygon))
+	c.Lng /= float64(len(z.Polygon))
+
+	radius := 0.0
+	for _, p := range z.Polygon {
+		if d := geo.Distance(c, p); d > radius {
+			radius = d
+		}
+	}
+	return c, radius
+}
+
+// Patrol warns the available drivers that idle in a restricted zone without its tags for more than Grace, every Interval.
+// The warning is a command pushed to the driver and an event of the bus, it is sent once each time the driver idles inside.
+type Patrol struct {
+	Interval time.Duration
+	Grace    time.Duration
+}
+
+// Start launches the patrol in a goroutine.
+func (p Patrol) Start() {
+	go func() {
+		ticker := time.NewTicker(p.Interval)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			if maintenance.Paused() {
+				continue
+			}
+			p.run(now)
+		}
+	}()
+}
+
+func (p Patrol) run(now time.Time) {
+	rClient := storages.GetRedisClient()
+	// Every instance runs the patrol, only the first one of each tick patrols the zones.
+	ok, err := rClient.SetNX(patrolLockKey, 1, p.Interval/2).Result()
+	if err != nil || !ok {
+		return
+	}
+
+	zones, err := List()
+	if err != nil {
+		logging.Logger.Error("could not get zones", "error", err)
+		return
+	}
+	for _, z := range zones {
+		if len(z.Rules.RequiredTags) == 0 {
+			continue
+		}
+		if err := p.patrol(z, now); err != nil {
+			logging.Logger.Warn("could not patrol zone", "zone", z.Name, "error", err)
+		}
+	}
+}
+
+// patrol records the drivers without the tags that are inside the zone and warns the ones inside for more than the grace.
+func (p Patrol) patrol(z Zone, now time.Time) error {
+	inside, err := Unpermitted(z)
+	if err != nil {
+		return err
+	}
+
+	rClient := storages.GetRedisClient()
+	idle, err := rClient.HGetAll(idleKey(z.Name)).Result()
+	if err != nil {
+		return err
+	}
+	insideSet := make(map[string]bool, len(inside))
+	for _, id := range inside {
+		insideSet[id] = true
+	}
+
+	var due []string
+	_, err = rClient.Pipelined(func(pipe redis.Pipeliner) error {
+		for id := range idle {
+			if !insideSet[id] {
+				pipe.HDel(idleKey(z.Name), id)
+				pipe.SRem(warnedKey(z.Name), id)
+			}
+		}
+		for _, id := range inside {
+			since, ok := idle[id]
+			if !ok {
+				pipe.HSet(idleKey(z.Name), id, now.Unix())
+				continue
+			}
+			first, _ := strconv.ParseInt(since, 10, 64)
+			if now.Sub(time.Unix(first, 0)) >= p.Grace {
+				due = append(due, id)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return storages.Classify(err)
+	}
+
+	for _, id := range due {
+		added, err := rClient.SAdd(warnedKey(z.Name), id).Result()
+		if err != nil {
+			return storages.Classify(err)
+		}
+		if added == 1 {
+			warn(z, id)
+		}
+	}
+	return nil
+}
+
+// Unpermitted returns the available drivers inside the zone that do not have all its tags.
+func Unpermitted(z Zone) ([]string, error) {
+	center, radius := z.Center()
+	found, err := storages.Locations().SearchDrivers(context.Background(), patrolLimit, center.Lat, center.Lng, radius)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, d := range found {
+		if z.Contains(geo.Point{Lat: d.Latitude, Lng: d.Longitude}) {
+			ids = append(ids, d.Name)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	permitted, err := drivers.WithTags(ids, z.Rules.RequiredTags)
+	if err != nil {
+		return nil, err
+	}
+	permittedSet := make(map[string]bool, len(permitted))
+	for _, id := range permitted {
+		permittedSet[id] = true
+	}
+	unpermitted := ids[:0]
+	for _, id := range ids {
+		if !permittedSet[id] {
+			unpermitted = append(unpermitted, id)
+		}
+	}
+	return unpermitted, nil
+}
+
+// warn pushes the warning to the driver, the drivers connected to other instances only get the event of the bus.
+func warn(z Zone, driverID string) {
+	logging.Logger.Info("driver idle in restricted zone", "driver_id", driverID, "zone", z.Name)
+	payload := map[string]interface{}{
+		"zone":          z.Name,
+		"required_tags": z.Rules.RequiredTags,
+		"message":       fmt.Sprintf("You need a permit to wait in %s, you will not receive requests from it.", z.Name),
+	}
+	if err := commands.Send(driverID, commands.TypeWarning, payload); err != nil && err != commands.ErrNotConnected {
+		logging.Logger.Warn("could not send warning to driver", "driver_id", driverID, "error", err)
+	}
+	bus.Emit(bus.Event{Type: bus.DriverRestricted, Key: driverID, Data: map[string]string{"zone": z.Name}})
+}
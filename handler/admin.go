@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/douglasmakey/tracking/commands"
+	"github.com/douglasmakey/tracking/config"
+	"github.com/douglasmakey/tracking/drivers"
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/douglasmakey/tracking/presence"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/douglasmakey/tracking/tasks"
+	"github.com/douglasmakey/tracking/validation"
+	"github.com/gorilla/mux"
+)
+
+// activeTasks returns the summaries of the searching tasks, the path is /admin/tasks.
+func activeTasks(w http.ResponseWriter, r *http.Request) {
+	list, err := tasks.ActiveTaskList()
+	if err != nil {
+		httputil.StorageError(w, r, "could not get tasks", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// runningTasks returns the attempts of the searching tasks running in the instance that serves the request,
+// the path is /admin/tasks/running.
+func runningTasks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, tasks.Running())
+}
+
+// driverSessions returns the command channels of the drivers open in the instance that serves the request with their duration,
+// messages and last activity, the path is /admin/sessions.
+func driverSessions(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, commands.Sessions())
+}
+
+// terminateSession closes the command channel of a driver in any instance, e.g. a compromised device or a stuck connection.
+// The outcome is closed when the session was open in the instance that serves the request, otherwise requested.
+// The path is /admin/sessions/{id}.
+func terminateSession(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	local, err := commands.Terminate(id)
+	if err != nil {
+		httputil.StorageError(w, r, "could not terminate session", err)
+		return
+	}
+	outcome := "requested"
+	if local {
+		outcome = "closed"
+	}
+
+	audit(r, "terminate_session", "session_id", id, "outcome", outcome)
+	writeJSON(w, http.StatusOK, map[string]string{"session_id": id, "outcome": outcome})
+}
+
+// onlineByRegion returns the number of drivers of each region with a heartbeat in the presence window,
+// the path is /admin/drivers/online.
+func onlineByRegion(w http.ResponseWriter, r *http.Request) {
+	regions, err := storages.GetRedisClient().RegionDrivers()
+	if err != nil {
+		httputil.StorageError(w, r, "could not get drivers", err)
+		return
+	}
+
+	window := config.Get().PresenceTTL
+	since := time.Now().Add(-window)
+	counts := make(map[string]int, len(regions))
+	for region, ids := range regions {
+		online, err := presence.Online(ids, since)
+		if err != nil {
+			httputil.StorageError(w, r, "could not count online drivers", err)
+			return
+		}
+		counts[region] = len(online)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"regions": counts, "window_seconds": window.Seconds()})
+}
+
+// recentMatches returns the last matches, the newest first. The path is /admin/matches?limit=n.
+func recentMatches(w http.ResponseWriter, r *http.Request) {
+	var v validation.Validator
+	limit := 0
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		v.Check(err == nil && limit >= 1 && limit <= 100, "limit", "must be between 1 and 100")
+	}
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+
+	list, err := tasks.RecentMatches(limit)
+	if err != nil {
+		httputil.StorageError(w, r, "could not get matches", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// forceCancelRequest cancels a searching request on behalf of its user, the path is /admin/requests/{id}/cancel.
+func forceCancelRequest(w http.ResponseWriter, r *http.Request) {
+	requestID := mux.Vars(r)["id"]
+
+	outcome, err := tasks.ForceCancel(requestID)
+	switch err {
+	case nil:
+	case tasks.ErrTaskNotFound:
+		httputil.WriteError(w, httputil.CodeNotFound, err.Error())
+		return
+	default:
+		httputil.StorageError(w, r, "could not cancel request", err)
+		return
+	}
+
+	audit(r, "force_cancel_request", "request_id", requestID, "outcome", outcome)
+	writeJSON(w, http.StatusOK, map[string]string{"request_id": requestID, "outcome": outcome})
+}
+
+// forceOfflineDriver removes a driver from the search and moves it offline, e.g. a driver whose app stopped responding
+// while it still looks online. The driver is online again with its next heartbeat. The path is /admin/drivers/{id}/offline.
+func forceOfflineDriver(w http.ResponseWriter, r *http.Request) {
+	driverID := mux.Vars(r)["id"]
+
+	rClient := storages.GetRedisClient()
+	if err := rClient.RemoveDriverLocation(driverID); err != nil {
+		httputil.StorageError(w, r, "could not remove driver", err)
+		return
+	}
+	released, err := rClient.ReleaseDriver(driverID)
+	if err != nil {
+		httputil.StorageError(w, r, "could not release driver", err)
+		return
+	}
+	if err := presence.Remove(driverID); err != nil {
+		httputil.StorageError(w, r, "could not remove driver", err)
+		return
+	}
+	if _, err := drivers.SetPeriod(driverID, drivers.PeriodOffline); err != nil {
+		httputil.StorageError(w, r, "could not record period", err)
+		return
+	}
+
+	audit(r, "force_offline_driver", "driver_id", driverID, "released", released)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"driver_id": driverID, "released": released})
+}
@@ -1,18 +1,231 @@
 package handler
 
 import (
-	"github.com/douglasmakey/tracking/handler/v2"
 	"net/http"
+
+	"github.com/douglasmakey/tracking/auth"
+	"github.com/douglasmakey/tracking/config"
+	"github.com/douglasmakey/tracking/cors"
+	"github.com/douglasmakey/tracking/handler/v2"
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/douglasmakey/tracking/idempotency"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/maintenance"
+	"github.com/douglasmakey/tracking/metrics"
+	"github.com/douglasmakey/tracking/payload"
+	"github.com/douglasmakey/tracking/ratelimit"
+	"github.com/douglasmakey/tracking/recovery"
+	"github.com/douglasmakey/tracking/tracing"
+	"github.com/gorilla/mux"
 )
 
-func NewHandler() *http.ServeMux {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/health", health)
-	mux.HandleFunc("/tracking", tracking)
-	mux.HandleFunc("/search", search)
+var (
+	notFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		httputil.WriteError(w, httputil.CodeNotFound, "not found")
+	})
+	methodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		httputil.WriteError(w, httputil.CodeMethodNotAllowed, "method not allowed")
+	})
+)
+
+// group returns a group of routes of the router that share the middlewares.
+// A group must reply 405 itself, otherwise a method mismatch in the group is seen as not found by the router.
+// The routes of the groups have the full path, the routes under a path prefix lose the 405 of their methods.
+func group(router *mux.Router, middlewares ...mux.MiddlewareFunc) *mux.Router {
+	g := router.NewRoute().Subrouter()
+	g.MethodNotAllowedHandler = methodNotAllowed
+	g.Use(middlewares...)
+	return g
+}
+
+// subgroup returns a group of routes inside a group, its middlewares run after those of the group.
+// The 405 is left to the group, a subgroup that replied it would also take the method mismatches of the routes before it
+// and the group would run its middlewares on the reply.
+func subgroup(parent *mux.Router, middlewares ...mux.MiddlewareFunc) *mux.Router {
+	g := parent.NewRoute().Subrouter()
+	g.Use(middlewares...)
+	return g
+}
+
+func NewHandler() http.Handler {
+	router := mux.NewRouter()
+	router.NotFoundHandler = notFound
+	router.MethodNotAllowedHandler = methodNotAllowed
+
+	router.Handle("/metrics", metrics.Handler()).Methods(http.MethodGet)
+	router.HandleFunc("/health", health).Methods(http.MethodGet)
+	router.HandleFunc("/status", serviceStatus).Methods(http.MethodGet)
+
+	authEnabled := config.Get().AuthEnabled
+	// require authenticates every route of a group with the role, the admin and partner groups need a key even if it is disabled.
+	require := func(role string) mux.MiddlewareFunc {
+		return func(next http.Handler) http.Handler {
+			return auth.Require(authEnabled, role, next.ServeHTTP)
+		}
+	}
+	// limit applies the rate limit configured for the route, it runs after the authentication to know the client.
+	limit := func(route string, next http.HandlerFunc) http.HandlerFunc {
+		l := config.Get().RateLimits[route]
+		return ratelimit.Middleware(route, ratelimit.Limit{Rate: l.Rate, Burst: l.Burst}, next)
+	}
+
+	// Drivers
+	drivers := group(router, require(auth.RoleDriver))
+	drivers.HandleFunc("/tracking", limit("/tracking", tracking)).Methods(http.MethodPost)
+	drivers.HandleFunc("/tracking/batch", limit("/tracking/batch", trackingBatch)).Methods(http.MethodPost)
+	drivers.HandleFunc("/tracking/stream", trackingStream).Methods(http.MethodPost)
+	drivers.HandleFunc("/driver/heartbeat", driverHeartbeat).Methods(http.MethodPost)
+	drivers.HandleFunc("/driver/offer/{id}/respond", respondOffer).Methods(http.MethodPost)
+	drivers.HandleFunc("/trips/{id}/arrived", driverArrived).Methods(http.MethodPost)
+	drivers.HandleFunc("/trips/{id}/no-show", markNoShow).Methods(http.MethodPost)
+	drivers.HandleFunc("/trips/{id}/handoff", handoffTrip).Methods(http.MethodPost)
+	drivers.HandleFunc("/trips", createTrip).Methods(http.MethodPost)
+	drivers.HandleFunc("/trips/{id}/riders", addTripRider).Methods(http.MethodPost)
+	drivers.HandleFunc("/trips/{id}/complete", completeTrip).Methods(http.MethodPost)
+	drivers.HandleFunc("/trips/{id}/legs", planTripLegs).Methods(http.MethodPost)
+	drivers.HandleFunc("/driver/ws", driverSocket).Methods(http.MethodGet)
+	drivers.HandleFunc("/driver/{id}/heartbeat", deviceHeartbeat).Methods(http.MethodPost)
+
+	// The management of the drivers.
+	router.HandleFunc("/drivers/online/count", onlineDrivers).Methods(http.MethodGet)
+	router.HandleFunc("/drivers/{id}/tags", driverTags).Methods(http.MethodGet)
+	router.HandleFunc("/drivers/{id}/languages", driverLanguages).Methods(http.MethodGet)
+	router.HandleFunc("/drivers/{id}/profile", driverProfile).Methods(http.MethodGet)
+	router.HandleFunc("/drivers/{id}/assets", driverAssets).Methods(http.MethodGet)
+	router.HandleFunc("/drivers/{id}/vehicle", driverVehicle).Methods(http.MethodGet)
+	router.HandleFunc("/drivers/{id}/vehicle/changes", driverVehicleChanges).Methods(http.MethodGet)
+	router.HandleFunc("/drivers/{id}/pauses", driverPauses).Methods(http.MethodGet)
+	router.HandleFunc("/drivers/{id}/feedback", driverFeedback).Methods(http.MethodGet)
+
+	// Only the driver can see its history and change its own state. The group goes after the reads of the same paths,
+	// it replies 405 to the methods that it does not have.
+	ownDrivers := group(router, require(auth.RoleDriver), ownDriver)
+	ownDrivers.HandleFunc("/driver/{id}/history", driverHistory).Methods(http.MethodGet)
+	ownDrivers.HandleFunc("/drivers/{id}/live", driverLive).Methods(http.MethodGet)
+	ownDrivers.HandleFunc("/drivers/{id}/periods", driverPeriods).Methods(http.MethodGet)
+	ownDrivers.HandleFunc("/drivers/{id}/pause", pauseDriver).Methods(http.MethodPost)
+	ownDrivers.HandleFunc("/drivers/{id}/resume", resumeDriver).Methods(http.MethodPost)
+	ownDrivers.HandleFunc("/drivers/{id}/period", driverPeriod).Methods(http.MethodPost)
+	ownDrivers.HandleFunc("/drivers/{id}/profile", saveDriverProfile).Methods(http.MethodPut)
+	ownDrivers.HandleFunc("/drivers/{id}/profile", deleteDriverProfile).Methods(http.MethodDelete)
+	ownDrivers.HandleFunc("/drivers/{id}/tags", setDriverTags).Methods(http.MethodPut)
+	ownDrivers.HandleFunc("/drivers/{id}/languages", setDriverLanguages).Methods(http.MethodPut)
+	ownDrivers.HandleFunc("/drivers/{id}/assets/{kind}", saveDriverAsset).Methods(http.MethodPut)
+	ownDrivers.HandleFunc("/drivers/{id}/assets/{kind}", deleteDriverAsset).Methods(http.MethodDelete)
+	ownDrivers.HandleFunc("/drivers/{id}/vehicle", changeDriverVehicle).Methods(http.MethodPut)
+	ownDrivers.HandleFunc("/drivers/{id}/home", setDriverHome).Methods(http.MethodPut)
+	ownDrivers.HandleFunc("/drivers/{id}/go-home", enableGoHome).Methods(http.MethodPost)
+	ownDrivers.HandleFunc("/drivers/{id}/go-home", disableGoHome).Methods(http.MethodDelete)
+
+	router.HandleFunc("/trips/{id}/plan", tripPlan).Methods(http.MethodGet)
+	router.HandleFunc("/zones/{id}/calendar", zoneCalendar).Methods(http.MethodGet)
+
+	// The driver of the trip reads the feedback left by its riders. The riders leave it on the same path, the 405 is left to their group.
+	tripDrivers := subgroup(router, require(auth.RoleDriver))
+	tripDrivers.HandleFunc("/trips/{id}/feedback", tripFeedback).Methods(http.MethodGet)
+
+	// Riders
+	riders := group(router, require(auth.RoleRider))
+	riders.HandleFunc("/search", maintenance.Middleware(limit("/search", payload.Gzip(search)))).Methods(http.MethodPost)
+	riders.HandleFunc("/trips/{id}/feedback", leaveFeedback).Methods(http.MethodPost)
+	riders.HandleFunc("/trips/{id}/tip", leaveTip).Methods(http.MethodPost)
+	riders.HandleFunc("/trips/{id}/receipts", tripReceipts).Methods(http.MethodGet)
+
+	// Only the user can use the routes of its account.
+	users := subgroup(riders, ownUser)
+	users.HandleFunc("/users/{id}/requests/cancel-all", cancelAllRequests).Methods(http.MethodPost)
+	users.HandleFunc("/users/{id}/contact", userContact).Methods(http.MethodGet)
+	users.HandleFunc("/users/{id}/contact", setUserContact).Methods(http.MethodPut)
+	users.HandleFunc("/users/{id}/languages", userLanguages).Methods(http.MethodGet)
+	users.HandleFunc("/users/{id}/languages", setUserLanguages).Methods(http.MethodPut)
+
+	// Sandbox
+	sandbox := subgroup(riders, sandboxOnly)
+	sandbox.HandleFunc("/sandbox/drivers", createSandboxDrivers).Methods(http.MethodPost)
+	sandbox.HandleFunc("/sandbox/drivers", clearSandboxDrivers).Methods(http.MethodDelete)
+
+	// Admin
+	admin := group(router, require(auth.RoleAdmin))
+	admin.HandleFunc("/clusters", driverClusters).Methods(http.MethodGet)
+	admin.HandleFunc("/admin/drivers/{id}/devices", driverDevices).Methods(http.MethodGet)
+	admin.HandleFunc("/admin/vehicles/{id}", vehicle).Methods(http.MethodGet)
+	admin.HandleFunc("/admin/vehicles/{id}", saveVehicle).Methods(http.MethodPut)
+	admin.HandleFunc("/admin/classes", classProfiles).Methods(http.MethodGet)
+	admin.HandleFunc("/admin/classes/{class}", saveClassProfile).Methods(http.MethodPut)
+	admin.HandleFunc("/admin/classes/{class}", deleteClassProfile).Methods(http.MethodDelete)
+	admin.HandleFunc("/admin/periods", fleetPeriods).Methods(http.MethodGet)
+	admin.HandleFunc("/admin/tenants/{tenant}/workflow", tenantWorkflow).Methods(http.MethodGet)
+	admin.HandleFunc("/admin/tenants/{tenant}/workflow", setTenantWorkflow).Methods(http.MethodPut)
+	admin.HandleFunc("/admin/tenants/{tenant}/workflow/preview", previewTenantWorkflow).Methods(http.MethodPost)
+	admin.HandleFunc("/admin/tenants/{tenant}/workflow/test", testTenantWorkflow).Methods(http.MethodPost)
+	admin.HandleFunc("/admin/maintenance", maintenanceWindow).Methods(http.MethodGet)
+	admin.HandleFunc("/admin/maintenance", startMaintenance).Methods(http.MethodPut)
+	admin.HandleFunc("/admin/maintenance", endMaintenance).Methods(http.MethodDelete)
+	admin.HandleFunc("/admin/capacity", capacityReport).Methods(http.MethodGet)
+	admin.HandleFunc("/admin/geofences", geofences).Methods(http.MethodGet)
+	admin.HandleFunc("/admin/geofences/{name}", getGeofence).Methods(http.MethodGet)
+	admin.HandleFunc("/admin/geofences/{name}", saveGeofence).Methods(http.MethodPut)
+	admin.HandleFunc("/admin/geofences/{name}", deleteGeofence).Methods(http.MethodDelete)
+	admin.HandleFunc("/admin/zones/{zone}/requests", zoneRequests).Methods(http.MethodGet)
+	admin.HandleFunc("/admin/tasks", activeTasks).Methods(http.MethodGet)
+	admin.HandleFunc("/admin/tasks/running", runningTasks).Methods(http.MethodGet)
+	admin.HandleFunc("/admin/sessions", driverSessions).Methods(http.MethodGet)
+	admin.HandleFunc("/admin/sessions/{id}", terminateSession).Methods(http.MethodDelete)
+	admin.HandleFunc("/admin/drivers/online", onlineByRegion).Methods(http.MethodGet)
+	admin.HandleFunc("/admin/matches", recentMatches).Methods(http.MethodGet)
+	admin.HandleFunc("/admin/requests/{id}/cancel", forceCancelRequest).Methods(http.MethodPost)
+	admin.HandleFunc("/admin/drivers/{id}/offline", forceOfflineDriver).Methods(http.MethodPost)
+	// The drivers must not set their own rating.
+	admin.HandleFunc("/drivers/{id}/rating", driverRating).Methods(http.MethodPut)
+
+	// Runbook
+	admin.HandleFunc("/admin/runbook/zones/{zone}/flush-reservations", flushZoneReservations).Methods(http.MethodPost)
+	admin.HandleFunc("/admin/runbook/drivers/{id}/release", releaseDriver).Methods(http.MethodPost)
+	admin.HandleFunc("/admin/runbook/rebuild-area-index", rebuildAreaIndex).Methods(http.MethodPost)
+	admin.HandleFunc("/admin/runbook/verify-geo-index", verifyGeoIndex).Methods(http.MethodGet)
+	admin.HandleFunc("/admin/runbook/rebuild-geo-index", rebuildGeoIndex).Methods(http.MethodPost)
+
+	// Partners
+	partners := group(router, require(auth.RolePartner))
+	partners.HandleFunc("/partners/heat", heatExport).Methods(http.MethodGet)
 
 	// V2
-	mux.HandleFunc("/v2/search", v2.SearchV2)
-	mux.HandleFunc("/v2/cancel", v2.CancelRequest)
-	return mux
+	// The retries of the apps must not create the same request twice, the replays do not count for the rate limit.
+	idempotent := func(route string, next http.HandlerFunc) http.HandlerFunc {
+		return idempotency.Middleware(route, config.Get().IdempotencyTTL, next)
+	}
+	api := group(router, require(auth.RoleRider))
+	api.HandleFunc("/v2/search", maintenance.Middleware(idempotent("/v2/search", limit("/v2/search", v2.SearchV2)))).Methods(http.MethodPost)
+	api.HandleFunc("/v2/search/{id}/events", v2.SearchEvents).Methods(http.MethodGet)
+	api.HandleFunc("/v2/cancel", idempotent("/v2/cancel", limit("/v2/cancel", v2.CancelRequest))).Methods(http.MethodPost)
+	api.HandleFunc("/v2/request/{id}", v2.RequestStatus).Methods(http.MethodGet)
+	api.HandleFunc("/v2/nearby/subscribe", limit("/v2/nearby/subscribe", v2.NearbySubscribe)).Methods(http.MethodPost)
+	api.HandleFunc("/v2/nearby/subscribe/{id}", v2.NearbyUnsubscribe).Methods(http.MethodDelete)
+	api.HandleFunc("/v2/trip/{id}/route", v2.TripRoute).Methods(http.MethodGet)
+	// The density is only for the operations dashboards.
+	admin.HandleFunc("/v2/density", v2.Density).Methods(http.MethodGet)
+
+	// Every route is measured and traced, the label is the template of the route that matched the request.
+	route := func(r *http.Request) string {
+		var match mux.RouteMatch
+		if !router.Match(r, &match) || match.Route == nil {
+			return ""
+		}
+		tpl, _ := match.Route.GetPathTemplate()
+		return tpl
+	}
+	var h http.Handler = router
+	// The streams of locations are kept open, their lines are limited by the handler.
+	unlimited := func(r *http.Request) bool { return route(r) == "/tracking/stream" }
+	h = payload.Middleware(h, int64(config.Get().MaxBodyBytes), unlimited)
+	if config.Get().RecoverPanics {
+		h = recovery.Middleware(h, route)
+	}
+	h = metrics.Middleware(h, route)
+	h = tracing.Middleware(h, route)
+	// The preflight requests of the browsers are answered before the routes, they only accept their own methods.
+	cfg := config.Get()
+	h = cors.Middleware(h, cors.Options{Origins: cfg.CORSOrigins, Methods: cfg.CORSMethods, Headers: cfg.CORSHeaders, MaxAge: cfg.CORSMaxAge})
+
+	return logging.Middleware(h)
 }
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/douglasmakey/tracking/clusters"
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/douglasmakey/tracking/validation"
+)
+
+// defaultClusterPrecision is the geohash precision of the cells, a cell of about 1.2km x 0.6km.
+const defaultClusterPrecision = 6
+
+// driverClusters returns the drivers of the viewport grouped in cells, the path is
+// /clusters?min_lat=&min_lng=&max_lat=&max_lng=&precision=&since=
+// With since, the version of the previous response, only the cells that changed are returned and the empty cells have count 0.
+// If the version expired all the cells are returned with full=true.
+func driverClusters(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var v validation.Validator
+	float := func(name string) float64 {
+		f, err := strconv.ParseFloat(q.Get(name), 64)
+		v.Check(err == nil, name, "must be a number")
+		return f
+	}
+	minLat, minLng, maxLat, maxLng := float("min_lat"), float("min_lng"), float("max_lat"), float("max_lng")
+	v.Latitude("min_lat", minLat)
+	v.Longitude("min_lng", minLng)
+	v.Latitude("max_lat", maxLat)
+	v.Longitude("max_lng", maxLng)
+	v.Check(minLat <= maxLat && minLng <= maxLng, "max_lat", "the max corner must be north east of the min corner")
+	precision := defaultClusterPrecision
+	if p := q.Get("precision"); p != "" {
+		var err error
+		precision, err = strconv.Atoi(p)
+		v.Check(err == nil && precision >= 1 && precision <= 9, "precision", "must be between 1 and 9")
+	}
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+
+	drivers, err := storages.LocationsFor(r.Context()).DriversInBox(r.Context(), minLat, minLng, maxLat, maxLng)
+	if err != nil {
+		httputil.StorageError(w, r, "could not get drivers", err)
+		return
+	}
+
+	cells := clusters.Build(drivers, precision)
+	version := clusters.Version(cells)
+	// The version includes the precision, a client that zooms receives all the cells.
+	version = strconv.Itoa(precision) + "-" + version
+	if err := clusters.Save(version, cells); err != nil {
+		logging.FromContext(r.Context()).Warn("could not save clusters snapshot", "error", err)
+	}
+
+	body := struct {
+		Version string          `json:"version"`
+		Full    bool            `json:"full"`
+		Cells   []clusters.Cell `json:"cells"`
+	}{Version: version, Full: true, Cells: clusters.List(cells)}
+
+	if since := q.Get("since"); since != "" {
+		prev, ok, err := clusters.Load(since)
+		if err != nil {
+			logging.FromContext(r.Context()).Warn("could not load clusters snapshot", "error", err)
+		}
+		if ok {
+			body.Full = false
+			body.Cells = clusters.Diff(prev, cells)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, body)
+}
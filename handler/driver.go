@@ -0,0 +1,157 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/douglasmakey/tracking/auth"
+	"github.com/douglasmakey/tracking/config"
+	"github.com/douglasmakey/tracking/devices"
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/presence"
+	"github.com/douglasmakey/tracking/tasks"
+	"github.com/douglasmakey/tracking/validation"
+	"github.com/gorilla/mux"
+)
+
+// deviceHeartbeat receives the heartbeat of a driver device, the path is /driver/{id}/heartbeat.
+// The device with the latest heartbeat becomes the active one and the locations of the others are rejected,
+// the heartbeat of the active device also keeps the driver online.
+func deviceHeartbeat(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		DeviceID string `json:"device_id"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+	var v validation.Validator
+	v.Required("device_id", body.DeviceID)
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+
+	driverID, now := mux.Vars(r)["id"], time.Now()
+	// A driver can only send the heartbeat of its own devices.
+	if !auth.CanActAs(r, driverID) {
+		httputil.WriteError(w, httputil.CodeForbidden, "api key does not belong to the driver")
+		return
+	}
+	active, err := devices.Heartbeat(driverID, body.DeviceID, now)
+	if err != nil {
+		httputil.StorageError(w, r, "could not save heartbeat", err)
+		return
+	}
+	if active {
+		if err := presence.Ping(driverID, now); err != nil {
+			httputil.StorageError(w, r, "could not save heartbeat", err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]bool{"active": active})
+}
+
+// driverHeartbeat receives the heartbeat of the driver app, e.g. {"id": "42"}. The drivers are online while they send it.
+func driverHeartbeat(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		ID string `json:"id"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+	var v validation.Validator
+	v.Required("id", body.ID)
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+	// A driver can only send its own heartbeat.
+	if !auth.CanActAs(r, body.ID) {
+		httputil.WriteError(w, httputil.CodeForbidden, "api key does not belong to the driver")
+		return
+	}
+
+	if err := presence.Ping(body.ID, time.Now()); err != nil {
+		httputil.StorageError(w, r, "could not save heartbeat", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// respondOffer receives the response of a driver to the offer of a request, e.g. {"driver_id": "42", "accept": true},
+// the path is /driver/offer/{id}/respond. The rider is notified when the request follows the acceptance.
+func respondOffer(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		DriverID string `json:"driver_id"`
+		Accept   *bool  `json:"accept"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+	var v validation.Validator
+	v.Required("driver_id", body.DriverID)
+	v.Check(body.Accept != nil, "accept", "is required")
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+	// A driver can only respond to its own offers.
+	if !auth.CanActAs(r, body.DriverID) {
+		httputil.WriteError(w, httputil.CodeForbidden, "api key does not belong to the driver")
+		return
+	}
+
+	requestID := mux.Vars(r)["id"]
+	err := tasks.RespondOffer(requestID, body.DriverID, *body.Accept, time.Now())
+	switch err {
+	case nil:
+	case tasks.ErrOfferNotFound:
+		httputil.WriteError(w, httputil.CodeNotFound, err.Error())
+		return
+	case tasks.ErrOfferAnswered, tasks.ErrOfferExpired:
+		httputil.WriteError(w, httputil.CodeConflict, err.Error())
+		return
+	default:
+		httputil.StorageError(w, r, "could not save response", err)
+		return
+	}
+
+	response := tasks.OfferDeclined
+	if *body.Accept {
+		response = tasks.OfferAccepted
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"request_id": requestID, "response": response})
+}
+
+// onlineDrivers returns the number of drivers with a heartbeat in the presence window, the path is /drivers/online/count.
+func onlineDrivers(w http.ResponseWriter, r *http.Request) {
+	window := config.Get().PresenceTTL
+	n, err := presence.OnlineCount(time.Now().Add(-window))
+	if err != nil {
+		httputil.StorageError(w, r, "could not count online drivers", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"online": n, "window_seconds": window.Seconds()})
+}
+
+// driverDevices returns the devices of a driver, the path is /admin/drivers/{id}/devices.
+func driverDevices(w http.ResponseWriter, r *http.Request) {
+	list, err := devices.List(mux.Vars(r)["id"])
+	if err != nil {
+		httputil.StorageError(w, r, "could not get devices", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
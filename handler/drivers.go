@@ -0,0 +1,474 @@
+package handler
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/douglasmakey/tracking/auth"
+	"github.com/douglasmakey/tracking/config"
+	"github.com/douglasmakey/tracking/drivers"
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/validation"
+	"github.com/gorilla/mux"
+)
+
+// ownDriver only lets the driver use the routes with its id in the path, e.g. /drivers/{id}/...
+func ownDriver(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !auth.CanActAs(r, mux.Vars(r)["id"]) {
+			httputil.WriteError(w, httputil.CodeForbidden, "api key does not belong to the driver")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// driverTags returns the tags of the driver.
+func driverTags(w http.ResponseWriter, r *http.Request) {
+	tags, err := drivers.Tags(mux.Vars(r)["id"])
+	if err != nil {
+		httputil.StorageError(w, r, "could not get tags", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"tags": tags})
+}
+
+// setDriverTags replaces the tags of the driver, e.g. {"tags": ["wav"]}.
+func setDriverTags(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Tags []string `json:"tags"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+	if err := drivers.SetTags(mux.Vars(r)["id"], body.Tags); err != nil {
+		httputil.StorageError(w, r, "could not save tags", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+// driverProfile returns the profile of the driver shown to the riders.
+func driverProfile(w http.ResponseWriter, r *http.Request) {
+	p, err := drivers.GetProfile(mux.Vars(r)["id"])
+	if err == drivers.ErrProfileNotFound {
+		httputil.WriteError(w, httputil.CodeNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		httputil.StorageError(w, r, "could not get profile", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+// saveDriverProfile creates or replaces the profile of the driver,
+// e.g. {"name": "Ana", "vehicle_type": "sedan", "plate": "AB-1234", "rating": 4.9, "capacity": 4}.
+func saveDriverProfile(w http.ResponseWriter, r *http.Request) {
+	var p drivers.Profile
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+	var v validation.Validator
+	v.Required("name", p.Name)
+	v.Required("vehicle_type", p.VehicleType)
+	v.Required("plate", p.Plate)
+	v.Positive("capacity", float64(p.Capacity))
+	if p.Rating != 0 {
+		v.Between("rating", p.Rating, 1, 5)
+	}
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+
+	if err := drivers.SaveProfile(mux.Vars(r)["id"], p); err != nil {
+		httputil.StorageError(w, r, "could not save profile", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+// deleteDriverProfile removes the profile of the driver.
+func deleteDriverProfile(w http.ResponseWriter, r *http.Request) {
+	err := drivers.DeleteProfile(mux.Vars(r)["id"])
+	if err == drivers.ErrProfileNotFound {
+		httputil.WriteError(w, httputil.CodeNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		httputil.StorageError(w, r, "could not delete profile", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// driverAssets returns the assets of the driver by kind, the URLs are the stored references, not the signed ones.
+func driverAssets(w http.ResponseWriter, r *http.Request) {
+	assets, err := drivers.Assets(mux.Vars(r)["id"])
+	if err != nil {
+		httputil.StorageError(w, r, "could not get assets", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"assets": assets})
+}
+
+// saveDriverAsset attaches a file uploaded to the object store to the driver, the path is /drivers/{id}/assets/{kind}
+// with kind photo or vehicle_photo, e.g. {"url": "https://cdn.example.com/drivers/42.jpg", "content_type": "image/jpeg", "size": 48213}.
+func saveDriverAsset(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var a drivers.Asset
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+	a.Kind = vars["kind"]
+	a.Updated = time.Now()
+
+	maxSize := config.Get().AssetMaxSize
+	var v validation.Validator
+	v.Check(drivers.IsAssetKind(a.Kind), "kind", "must be photo or vehicle_photo")
+	v.Required("url", a.URL)
+	if a.URL != "" {
+		u, err := url.Parse(a.URL)
+		v.Check(err == nil && u.IsAbs() && u.Host != "", "url", "must be an absolute url")
+	}
+	v.Check(drivers.IsAssetType(a.ContentType), "content_type", "must be image/jpeg, image/png or image/webp")
+	v.Positive("size", float64(a.Size))
+	v.Check(a.Size <= int64(maxSize), "size", fmt.Sprintf("must be at most %d bytes", maxSize))
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+
+	if err := drivers.SaveAsset(vars["id"], a); err != nil {
+		httputil.StorageError(w, r, "could not save asset", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, a)
+}
+
+// deleteDriverAsset removes the asset of the driver, the file is left in the object store.
+func deleteDriverAsset(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	err := drivers.DeleteAsset(vars["id"], vars["kind"])
+	if err == drivers.ErrAssetNotFound {
+		httputil.WriteError(w, httputil.CodeNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		httputil.StorageError(w, r, "could not delete asset", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pauseDriver pauses the driver, the driver does not receive requests until it is resumed or the duration elapses,
+// e.g. {"reason": "lunch", "duration": "30m"}. Without duration the pause lasts until /drivers/{id}/resume.
+func pauseDriver(w http.ResponseWriter, r *http.Request) {
+	driverID := mux.Vars(r)["id"]
+
+	body := struct {
+		Reason   string `json:"reason"`
+		Duration string `json:"duration"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+	var v validation.Validator
+	v.Required("reason", body.Reason)
+	var d time.Duration
+	if body.Duration != "" {
+		var err error
+		d, err = time.ParseDuration(body.Duration)
+		v.Check(err == nil && d > 0, "duration", "must be a positive duration, e.g. 30m")
+	}
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+
+	p, err := drivers.Pause(driverID, body.Reason, d)
+	if err == drivers.ErrAlreadyPaused {
+		httputil.WriteError(w, httputil.CodeConflict, err.Error())
+		return
+	}
+	if err != nil {
+		httputil.StorageError(w, r, "could not pause driver", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, p)
+}
+
+// resumeDriver ends the pause of the driver.
+func resumeDriver(w http.ResponseWriter, r *http.Request) {
+	driverID := mux.Vars(r)["id"]
+
+	err := drivers.Resume(driverID)
+	if err == drivers.ErrNotPaused {
+		httputil.WriteError(w, httputil.CodeConflict, err.Error())
+		return
+	}
+	if err != nil {
+		httputil.StorageError(w, r, "could not resume driver", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// driverPauses returns the pause intervals of the driver for the shift reports, the path is /drivers/{id}/pauses?from=&to=
+func driverPauses(w http.ResponseWriter, r *http.Request) {
+	driverID := mux.Vars(r)["id"]
+
+	from, to, ok := timeRange(w, r)
+	if !ok {
+		return
+	}
+
+	pauses, err := drivers.Pauses(driverID, from, to)
+	if err != nil {
+		httputil.StorageError(w, r, "could not get pauses", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, pauses)
+}
+
+// driverRating sets the average rating of the driver, it is used by the highest_rating and weighted matching strategies,
+// e.g. {"rating": 4.8}.
+func driverRating(w http.ResponseWriter, r *http.Request) {
+	driverID := mux.Vars(r)["id"]
+
+	body := struct {
+		Rating float64 `json:"rating"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+	var v validation.Validator
+	v.Between("rating", body.Rating, 1, 5)
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+
+	if err := drivers.SetRating(driverID, body.Rating); err != nil {
+		httputil.StorageError(w, r, "could not save rating", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, body)
+}
+
+// driverFeedback returns the ratings, the tips and the tags left by the riders about the driver, the path is /drivers/{id}/feedback.
+func driverFeedback(w http.ResponseWriter, r *http.Request) {
+	driverID := mux.Vars(r)["id"]
+
+	f, err := drivers.Feedback(driverID)
+	if err != nil {
+		httputil.StorageError(w, r, "could not get feedback", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, f)
+}
+
+// driverPeriod changes the commercial period of the driver, the driver app sends it at the pickup and the drop-off,
+// e.g. {"period": "P3"}. The available (P1) and en route (P2) periods are also set by the locations and the matches.
+func driverPeriod(w http.ResponseWriter, r *http.Request) {
+	driverID := mux.Vars(r)["id"]
+
+	body := struct {
+		Period string `json:"period"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+	var v validation.Validator
+	v.Check(drivers.ValidPeriod(body.Period), "period", "must be offline, P1, P2 or P3")
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+
+	// The drivers going home are taken offline after the drop-off of their last ride.
+	if body.Period == drivers.PeriodAvailable {
+		offline, err := drivers.EndLastRide(driverID)
+		if err != nil {
+			httputil.StorageError(w, r, "could not end the last ride", err)
+			return
+		}
+		if offline {
+			body.Period = drivers.PeriodOffline
+			writeJSON(w, http.StatusOK, body)
+			return
+		}
+	}
+
+	if _, err := drivers.SetPeriod(driverID, body.Period); err != nil {
+		httputil.StorageError(w, r, "could not save period", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, body)
+}
+
+// setDriverHome registers the home location of the driver used by the go-home mode, e.g. {"lat": -33.45, "lng": -70.66}.
+func setDriverHome(w http.ResponseWriter, r *http.Request) {
+	driverID := mux.Vars(r)["id"]
+
+	var home geo.Point
+	if err := json.NewDecoder(r.Body).Decode(&home); err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+	var v validation.Validator
+	v.Point("", home)
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+
+	if err := drivers.SetHome(driverID, home); err != nil {
+		httputil.StorageError(w, r, "could not save home", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, home)
+}
+
+// enableGoHome starts the go-home mode of the driver: it is only offered the requests that drop off toward its home
+// and it is taken offline after the drop-off of the ride.
+func enableGoHome(w http.ResponseWriter, r *http.Request) {
+	driverID := mux.Vars(r)["id"]
+
+	g, err := drivers.EnableGoHome(driverID)
+	if err == drivers.ErrNoHome {
+		httputil.WriteError(w, httputil.CodeConflict, err.Error())
+		return
+	}
+	if err != nil {
+		httputil.StorageError(w, r, "could not enable go-home mode", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, g)
+}
+
+// disableGoHome ends the go-home mode of the driver.
+func disableGoHome(w http.ResponseWriter, r *http.Request) {
+	driverID := mux.Vars(r)["id"]
+
+	err := drivers.DisableGoHome(driverID)
+	if err == drivers.ErrNotGoingHome {
+		httputil.WriteError(w, httputil.CodeConflict, err.Error())
+		return
+	}
+	if err != nil {
+		httputil.StorageError(w, r, "could not disable go-home mode", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// periodReport is the time in seconds spent in each period and the intervals of the periods.
+type periodReport struct {
+	DriverID  string                   `json:"driver_id"`
+	Seconds   map[string]float64       `json:"seconds"`
+	Intervals []drivers.PeriodInterval `json:"intervals,omitempty"`
+}
+
+func newPeriodReport(driverID string, periods []drivers.PeriodInterval, from, to time.Time) periodReport {
+	report := periodReport{DriverID: driverID, Seconds: make(map[string]float64), Intervals: periods}
+	for period, d := range drivers.PeriodTotals(periods, from, to, time.Now()) {
+		report.Seconds[period] = d.Seconds()
+	}
+	return report
+}
+
+// driverPeriods returns the commercial periods of the driver for the insurers, the path is /drivers/{id}/periods?from=&to=
+func driverPeriods(w http.ResponseWriter, r *http.Request) {
+	driverID := mux.Vars(r)["id"]
+
+	from, to, ok := timeRange(w, r)
+	if !ok {
+		return
+	}
+
+	periods, err := drivers.Periods(driverID, from, to)
+	if err != nil {
+		httputil.StorageError(w, r, "could not get periods", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newPeriodReport(driverID, periods, from, to))
+}
+
+// fleetPeriods exports the time spent in each commercial period by every driver, the path is /admin/periods?from=&to=&format=
+// With format=csv each row is a period interval: driver_id,period,start,end.
+func fleetPeriods(w http.ResponseWriter, r *http.Request) {
+	from, to, ok := timeRange(w, r)
+	if !ok {
+		return
+	}
+
+	fleet, err := drivers.FleetPeriods(from, to)
+	if err != nil {
+		httputil.StorageError(w, r, "could not get periods", err)
+		return
+	}
+
+	ids := make([]string, 0, len(fleet))
+	for id := range fleet {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="periods.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"driver_id", "period", "start", "end"})
+		for _, id := range ids {
+			for _, p := range fleet[id] {
+				end := ""
+				if p.End != nil {
+					end = p.End.Format(time.RFC3339)
+				}
+				cw.Write([]string{id, p.Period, p.Start.Format(time.RFC3339), end})
+			}
+		}
+		cw.Flush()
+		return
+	}
+
+	reports := make([]periodReport, 0, len(ids))
+	for _, id := range ids {
+		report := newPeriodReport(id, fleet[id], from, to)
+		// The fleet report only has the totals, the intervals are exported with CSV.
+		report.Intervals = nil
+		reports = append(reports, report)
+	}
+	writeJSON(w, http.StatusOK, reports)
+}
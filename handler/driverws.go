@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/douglasmakey/tracking/auth"
+	"github.com/douglasmakey/tracking/commands"
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/validation"
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// driverSocket opens the command channel of a driver, the path is /driver/ws?id={id}
+// The server pushes commands (offers, cancellations, repositioning hints) and the driver acks each one by its seq.
+func driverSocket(w http.ResponseWriter, r *http.Request) {
+	driverID := r.URL.Query().Get("id")
+	var v validation.Validator
+	v.Required("id", driverID)
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+	// A driver can only open its own channel, it is checked before the upgrade to reply with an error.
+	if !auth.CanActAs(r, driverID) {
+		httputil.WriteError(w, httputil.CodeForbidden, "api key does not belong to the driver")
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already replied to the client.
+		logging.FromContext(r.Context()).Warn("could not upgrade connection", "error", err)
+		return
+	}
+
+	session := commands.Open(driverID, conn)
+	session.Listen()
+}
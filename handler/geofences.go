@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/douglasmakey/tracking/geofence"
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/validation"
+	"github.com/gorilla/mux"
+)
+
+// geofences returns all the zones, the path is /admin/geofences.
+func geofences(w http.ResponseWriter, r *http.Request) {
+	zones, err := geofence.List()
+	if err != nil {
+		httputil.StorageError(w, r, "could not get zones", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, zones)
+}
+
+// getGeofence returns a zone, the path is /admin/geofences/{name}.
+func getGeofence(w http.ResponseWriter, r *http.Request) {
+	z, err := geofence.Get(mux.Vars(r)["name"])
+	if err == geofence.ErrNotFound {
+		httputil.WriteError(w, httputil.CodeNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		httputil.StorageError(w, r, "could not get zone", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, z)
+}
+
+// saveGeofence creates or replaces a zone,
+// e.g. {"polygon": [{"lat": -33.39, "lng": -70.79}, ...], "rules": {"priority": true, "surge_multiplier": 1.5}}.
+func saveGeofence(w http.ResponseWriter, r *http.Request) {
+	var z geofence.Zone
+	if err := json.NewDecoder(r.Body).Decode(&z); err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+	z.Name = mux.Vars(r)["name"]
+
+	var v validation.Validator
+	v.Check(len(z.Polygon) >= 3, "polygon", "must have at least 3 points")
+	for _, p := range z.Polygon {
+		v.Point("polygon.", p)
+	}
+	if z.Rules.Surge != 0 {
+		v.Between("rules.surge_multiplier", z.Rules.Surge, 1, 10)
+	}
+	for _, tag := range z.Rules.RequiredTags {
+		v.Check(tag != "", "rules.required_tags", "must not have empty tags")
+	}
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+
+	if err := geofence.Save(z); err != nil {
+		httputil.StorageError(w, r, "could not save zone", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, z)
+}
+
+// deleteGeofence removes a zone.
+func deleteGeofence(w http.ResponseWriter, r *http.Request) {
+	err := geofence.Delete(mux.Vars(r)["name"])
+	if err == geofence.ErrNotFound {
+		httputil.WriteError(w, httputil.CodeNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		httputil.StorageError(w, r, "could not delete zone", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,49 +1,142 @@
 package handler
 
 import (
-	"encoding/json"
-	"log"
+	"fmt"
 	"net/http"
+	"strconv"
 
+	"github.com/douglasmakey/tracking/auth"
+	"github.com/douglasmakey/tracking/codec"
+	"github.com/douglasmakey/tracking/drivers"
+	"github.com/douglasmakey/tracking/eta"
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/douglasmakey/tracking/idcodec"
+	"github.com/douglasmakey/tracking/ingest"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/matching"
 	"github.com/douglasmakey/tracking/storages"
+	"github.com/douglasmakey/tracking/tracing"
+	"github.com/douglasmakey/tracking/validation"
+	"github.com/go-redis/redis"
 )
 
 // tracking receive the driver coord and saves the coord in redis
 func tracking(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	var driver ingest.Location
+	_, span := tracing.Start(r.Context(), "decode")
+	err := codec.Decode(r, &driver)
+	tracing.End(span, err)
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
 		return
 	}
-	// crate an anonymous struct for driver data.
-	var driver = struct {
-		ID  string  `json:"id"`
-		Lat float64 `json:"lat"`
-		Lng float64 `json:"lng"`
-	}{}
 
-	rClient := storages.GetRedisClient()
+	dryRun := isDryRun(r)
+	if !acceptLocation(w, r, driver, dryRun) {
+		return
+	}
 
-	if err := json.NewDecoder(r.Body).Decode(&driver); err != nil {
-		log.Printf("could not decode request: %v", err)
-		http.Error(w, "could not decode request", http.StatusInternalServerError)
+	if dryRun {
+		codec.Write(w, r, http.StatusOK, ingest.Preview(driver))
 		return
 	}
 
-	// Add new location
-	// You can save locations in another db
-	rClient.AddDriverLocation(driver.Lng, driver.Lat, driver.ID)
+	if err := ingest.Save(r.Context(), driver); err != nil {
+		httputil.StorageError(w, r, "could not save location", err)
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 	return
 }
 
-// search receives lat and lng of the picking point and searches drivers about this point.
-func search(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+// maxBatchSize is the maximum number of locations of a batch.
+const maxBatchSize = 1000
+
+// trackingBatch receives many locations at once, the mobile apps buffer the locations while they are offline and flush them later.
+// All the locations are written with a single pipeline.
+func trackingBatch(w http.ResponseWriter, r *http.Request) {
+	var locations []ingest.Location
+	_, span := tracing.Start(r.Context(), "decode")
+	err := codec.Decode(r, &locations)
+	tracing.End(span, err)
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+	if len(locations) == 0 || len(locations) > maxBatchSize {
+		httputil.WriteError(w, httputil.CodeInvalidRequest, fmt.Sprintf("the batch must have between 1 and %d locations", maxBatchSize))
 		return
 	}
-	rClient := storages.GetRedisClient()
+
+	// All the invalid locations are reported at once, the batch is rejected.
+	var v validation.Validator
+	for i, l := range locations {
+		v.Merge(fmt.Sprintf("[%d].", i), ingest.Validate(l))
+	}
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+
+	dryRun := isDryRun(r)
+	for _, l := range locations {
+		if !acceptLocation(w, r, l, dryRun) {
+			return
+		}
+	}
+
+	if dryRun {
+		codec.Write(w, r, http.StatusOK, ingest.Preview(locations...))
+		return
+	}
+
+	if err := ingest.Save(r.Context(), locations...); err != nil {
+		httputil.StorageError(w, r, "could not save locations", err)
+		return
+	}
+
+	codec.Write(w, r, http.StatusOK, map[string]int{"accepted": len(locations)})
+}
+
+// isDryRun returns true if the request has dry_run=true, the locations are checked but not stored.
+func isDryRun(r *http.Request) bool {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	return dryRun
+}
+
+// acceptLocation checks that the client can send the location, otherwise it writes the error and returns false.
+// With dryRun nothing is written to the storage.
+func acceptLocation(w http.ResponseWriter, r *http.Request, l ingest.Location, dryRun bool) bool {
+	if err := ingest.Validate(l); err != nil {
+		validation.Write(w, err)
+		return false
+	}
+
+	// A driver can only send its own location.
+	if !auth.CanActAs(r, l.ID) {
+		httputil.WriteError(w, httputil.CodeForbidden, "api key does not belong to the driver")
+		return false
+	}
+
+	err := ingest.Accept(l, dryRun)
+	if err == ingest.ErrStaleDevice {
+		httputil.WriteError(w, httputil.CodeStaleDevice, err.Error())
+		return false
+	}
+	if err != nil {
+		httputil.StorageError(w, r, "could not check device", err)
+		return false
+	}
+	return true
+}
+
+// search receives lat and lng of the picking point and searches drivers about this point.
+func search(w http.ResponseWriter, r *http.Request) {
+	rClient := storages.LocationsFor(r.Context())
 
 	body := struct {
 		Lat   float64 `json:"lat"`
@@ -51,21 +144,71 @@ func search(w http.ResponseWriter, r *http.Request) {
 		Limit int     `json:"limit"`
 	}{}
 
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		log.Printf("could not decode request: %v", err)
-		http.Error(w, "could not decode request", http.StatusInternalServerError)
+	_, span := tracing.Start(r.Context(), "decode")
+	err := codec.Decode(r, &body)
+	tracing.End(span, err)
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+
+	var v validation.Validator
+	v.Latitude("lat", body.Lat)
+	v.Longitude("lng", body.Lng)
+	v.Positive("limit", float64(body.Limit))
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
 		return
 	}
 
-	drivers := rClient.SearchDrivers(body.Limit, body.Lat, body.Lng, 15)
-	data, err := json.Marshal(drivers)
+	nearby, err := rClient.SearchDrivers(r.Context(), body.Limit, body.Lat, body.Lng, 15)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httputil.StorageError(w, r, "could not search drivers", err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(data)
-	return
+	ids := make([]string, len(nearby))
+	for i, d := range nearby {
+		ids[i] = d.Name
+	}
+	profiles, err := drivers.Profiles(ids)
+	if err != nil {
+		httputil.StorageError(w, r, "could not get driver profiles", err)
+		return
+	}
+
+	// The score of the weighted strategy mixes the distance, the rating and the acceptance rate of the drivers.
+	candidates := make([]matching.Candidate, len(nearby))
+	for i, d := range nearby {
+		candidates[i] = matching.Candidate{DriverID: d.Name, Distance: d.Dist}
+	}
+	weighted, _ := matching.Get(matching.StrategyWeighted)
+	if err := weighted.Rank(candidates); err != nil {
+		httputil.StorageError(w, r, "could not score drivers", err)
+		return
+	}
+	scores := make(map[string]float64, len(candidates))
+	for _, c := range candidates {
+		scores[c.DriverID] = c.Score
+	}
+
+	// Each driver has the estimated time to arrive to the picking point, its score and its profile, if it has one.
+	type driverETA struct {
+		redis.GeoLocation
+		ETA     float64          `json:"eta_seconds"`
+		Score   float64          `json:"score"`
+		Profile *drivers.Profile `json:"profile,omitempty"`
+	}
+	pickup := geo.Point{Lat: body.Lat, Lng: body.Lng}
+	result := make([]driverETA, len(nearby))
+	for i, d := range nearby {
+		result[i] = driverETA{ETA: eta.Estimate(r.Context(), geo.Point{Lat: d.Latitude, Lng: d.Longitude}, pickup).Seconds(), Score: scores[d.Name]}
+		if p, ok := profiles[d.Name]; ok {
+			result[i].Profile = &p
+		}
+		d.Name = idcodec.Encode(idcodec.KindDriver, d.Name)
+		result[i].GeoLocation = d
+	}
+	codec.Write(w, r, http.StatusOK, result)
 }
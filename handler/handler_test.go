@@ -2,8 +2,13 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"github.com/douglasmakey/tracking/config"
+	"github.com/douglasmakey/tracking/drivers"
 	"github.com/douglasmakey/tracking/storages"
+	"github.com/gorilla/mux"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -29,8 +34,12 @@ func TestHandlerTracking(t *testing.T) {
 func TestHandlerSearch(t *testing.T) {
 	// Add driver
 	client := storages.GetRedisClient()
-	client.AddDriverLocation(-70.66925, -33.448890, "1")
-	client.AddDriverLocation(-70.66925, -33.448890, "2")
+	client.AddDriverLocation(context.Background(), -70.66925, -33.448890, "1")
+	client.AddDriverLocation(context.Background(), -70.66925, -33.448890, "2")
+	if err := drivers.SaveProfile("1", drivers.Profile{Name: "Ana", VehicleType: "sedan", Plate: "AB-1234", Capacity: 4}); err != nil {
+		t.Fatalf("could not save profile: %v", err)
+	}
+	defer drivers.DeleteProfile("1")
 
 	// Data and request
 	jsonData := []byte(`{"lat": -33.448890, "lng": -70.669265, "limit": 2}`)
@@ -52,6 +61,7 @@ func TestHandlerSearch(t *testing.T) {
 		Name      string
 		Latitude  float64
 		Longitude float64
+		Profile   *drivers.Profile
 	}{}
 
 	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
@@ -61,8 +71,336 @@ func TestHandlerSearch(t *testing.T) {
 	if result[0].Name != "1" {
 		t.Error("the first item in result could be driver one")
 	}
+	if result[0].Profile == nil || result[0].Profile.Name != "Ana" {
+		t.Errorf("the driver one must have its profile, got %+v", result[0].Profile)
+	}
+	if result[1].Profile != nil {
+		t.Errorf("the driver two does not have a profile, got %+v", result[1].Profile)
+	}
 
 	// Remove drivers
 	client.RemoveDriverLocation("1")
 	client.RemoveDriverLocation("2")
 }
+
+func TestHandlerDriverHistory(t *testing.T) {
+	driverData := []byte(`{"id": "history_1", "lat": -33.448890, "lng": -70.669265}`)
+	req, err := http.NewRequest(http.MethodPost, "http://localhost:8000/tracking", bytes.NewBuffer(driverData))
+	if err != nil {
+		t.Fatalf("could not create test request: %v", err)
+	}
+	tracking(httptest.NewRecorder(), req)
+
+	req, err = http.NewRequest(http.MethodGet, "http://localhost:8000/driver/history_1/history", nil)
+	if err != nil {
+		t.Fatalf("could not create test request: %v", err)
+	}
+
+	req = mux.SetURLVars(req, map[string]string{"id": "history_1"})
+
+	rec := httptest.NewRecorder()
+	driverHistory(rec, req)
+	res := rec.Result()
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("unexpected status code %s", res.Status)
+	}
+
+	result := []struct {
+		Lat float64
+		Lng float64
+	}{}
+
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		t.Errorf("could not decode response %v", err)
+	}
+
+	if len(result) == 0 || result[len(result)-1].Lat != -33.448890 {
+		t.Error("the last point in history should be the tracked location")
+	}
+
+	// Remove driver
+	client := storages.GetRedisClient()
+	client.RemoveDriverLocation("history_1")
+	client.Del("history:history_1")
+}
+
+func TestHandlerTrackingBatch(t *testing.T) {
+	batchData := []byte(`[
+		{"id": "batch_1", "lat": -33.448890, "lng": -70.669265, "timestamp": "2018-08-01T10:00:00Z"},
+		{"id": "batch_1", "lat": -33.448000, "lng": -70.669000, "timestamp": "2018-08-01T10:00:05Z"},
+		{"id": "batch_2", "lat": -33.448890, "lng": -70.669265}
+	]`)
+	req, err := http.NewRequest(http.MethodPost, "http://localhost:8000/tracking/batch", bytes.NewBuffer(batchData))
+	if err != nil {
+		t.Fatalf("could not create test request: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	trackingBatch(rec, req)
+	res := rec.Result()
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("unexpected status code %s", res.Status)
+	}
+
+	// The position of the driver is the latest location of the batch.
+	client := storages.GetRedisClient()
+	pos, err := client.GeoPos("drivers", "batch_1").Result()
+	if err != nil || len(pos) != 1 || pos[0] == nil {
+		t.Fatalf("could not get position of driver: %v", err)
+	}
+	if math.Abs(pos[0].Latitude - -33.448000) > 0.0001 {
+		t.Errorf("unexpected latitude %f", pos[0].Latitude)
+	}
+
+	// Remove drivers
+	client.RemoveDriverLocation("batch_1")
+	client.RemoveDriverLocation("batch_2")
+	client.Del("history:batch_1", "history:batch_2")
+}
+
+func TestHandlerTrackingDryRun(t *testing.T) {
+	driverData := []byte(`{"id": "dry_run_1", "lat": -33.448890, "lng": -70.669265}`)
+	req, err := http.NewRequest(http.MethodPost, "http://localhost:8000/tracking?dry_run=true", bytes.NewBuffer(driverData))
+	if err != nil {
+		t.Fatalf("could not create test request: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	tracking(rec, req)
+	res := rec.Result()
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("unexpected status code %s", res.Status)
+	}
+
+	var result struct {
+		Positions []struct {
+			ID string
+		}
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		t.Fatalf("could not decode response: %v", err)
+	}
+	if len(result.Positions) != 1 || result.Positions[0].ID != "dry_run_1" {
+		t.Errorf("unexpected positions %v", result.Positions)
+	}
+
+	// Nothing is stored.
+	client := storages.GetRedisClient()
+	pos, err := client.GeoPos("drivers", "dry_run_1").Result()
+	if err != nil || len(pos) != 1 || pos[0] != nil {
+		t.Errorf("the location of the driver must not be stored: %v", err)
+	}
+}
+
+func TestHandlerTrackingStream(t *testing.T) {
+	stream := []byte(`{"id": "stream_1", "lat": -33.448890, "lng": -70.669265}
+not json
+{"id": "stream_2", "lat": -33.448890, "lng": -70.669265}
+`)
+	req, err := http.NewRequest(http.MethodPost, "http://localhost:8000/tracking/stream", bytes.NewBuffer(stream))
+	if err != nil {
+		t.Fatalf("could not create test request: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	trackingStream(rec, req)
+	res := rec.Result()
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("unexpected status code %s", res.Status)
+	}
+
+	// The stream is short so there is only the final ack.
+	var ack streamAck
+	if err := json.NewDecoder(res.Body).Decode(&ack); err != nil {
+		t.Fatalf("could not decode ack: %v", err)
+	}
+	if !ack.Done || ack.Line != 3 || ack.Accepted != 2 || len(ack.Rejected) != 1 || ack.Rejected[0].Line != 2 {
+		t.Errorf("unexpected ack %+v", ack)
+	}
+
+	// Remove drivers
+	client := storages.GetRedisClient()
+	client.RemoveDriverLocation("stream_1")
+	client.RemoveDriverLocation("stream_2")
+	client.Del("history:stream_1", "history:stream_2")
+}
+
+func TestHandlerSearchValidation(t *testing.T) {
+	jsonData := []byte(`{"lat": 91, "lng": -70.669265, "limit": 0}`)
+	req, err := http.NewRequest(http.MethodPost, "http://localhost:8000/search", bytes.NewBuffer(jsonData))
+	if err != nil {
+		t.Fatalf("could not create test request: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	search(rec, req)
+	res := rec.Result()
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("unexpected status code %s", res.Status)
+	}
+
+	body := struct {
+		Error struct {
+			Fields []struct {
+				Field string `json:"field"`
+			} `json:"fields"`
+		} `json:"error"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatalf("could not decode response %v", err)
+	}
+	if fields := body.Error.Fields; len(fields) != 2 || fields[0].Field != "lat" || fields[1].Field != "limit" {
+		t.Errorf("unexpected invalid fields %v", fields)
+	}
+}
+
+func TestHandlerRespondOfferValidation(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/driver/offer/1/respond", bytes.NewBufferString(`{"driver_id": "42"}`))
+	rec := httptest.NewRecorder()
+	respondOffer(rec, mux.SetURLVars(req, map[string]string{"id": "1"}))
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status code %d", rec.Code)
+	}
+	body := struct {
+		Error struct {
+			Fields []struct {
+				Field string `json:"field"`
+			} `json:"fields"`
+		} `json:"error"`
+	}{}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("could not decode response %v", err)
+	}
+	if fields := body.Error.Fields; len(fields) != 1 || fields[0].Field != "accept" {
+		t.Errorf("unexpected invalid fields %v", fields)
+	}
+}
+
+func TestHandlerSaveClassProfileValidation(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPut, "/admin/classes/moto", bytes.NewBufferString(`{"search_radii": [2, 1], "timeout_seconds": 60}`))
+	rec := httptest.NewRecorder()
+	saveClassProfile(rec, mux.SetURLVars(req, map[string]string{"class": "moto"}))
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status code %d", rec.Code)
+	}
+	body := struct {
+		Error struct {
+			Fields []struct {
+				Field string `json:"field"`
+			} `json:"fields"`
+		} `json:"error"`
+	}{}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("could not decode response %v", err)
+	}
+	if fields := body.Error.Fields; len(fields) != 1 || fields[0].Field != "search_radii" {
+		t.Errorf("unexpected invalid fields %v", fields)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	// The requests without an api key are rejected before reaching the handlers.
+	defer func(enabled bool) { config.Get().AuthEnabled = enabled }(config.Get().AuthEnabled)
+	config.Get().AuthEnabled = true
+	h := NewHandler()
+
+	cases := []struct {
+		method, path string
+		status       int
+	}{
+		{http.MethodGet, "/tracking", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/drivers/1/tags", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/drivers/1/periods", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/v2/request/1", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/drivers/1/unknown", http.StatusNotFound},
+		{http.MethodGet, "/v2/request", http.StatusNotFound},
+		{http.MethodPut, "/trips/1/feedback", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/users/1/contact", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/sandbox/drivers", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/driver/offer/1/respond", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/admin/requests/1/cancel", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/trips/1/handoff", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/v2/density", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/status", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/admin/runbook/rebuild-geo-index", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/admin/sessions/abc", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/v2/trip/1/route", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/driver/ws?id=1", http.StatusUnauthorized},
+		{http.MethodGet, "/driver/1/history", http.StatusUnauthorized},
+		{http.MethodPost, "/driver/1/heartbeat", http.StatusUnauthorized},
+		{http.MethodPut, "/drivers/1/tags", http.StatusUnauthorized},
+		{http.MethodPut, "/drivers/1/languages", http.StatusUnauthorized},
+		{http.MethodPut, "/drivers/1/profile", http.StatusUnauthorized},
+		{http.MethodDelete, "/drivers/1/profile", http.StatusUnauthorized},
+		{http.MethodPut, "/drivers/1/assets/photo", http.StatusUnauthorized},
+		{http.MethodDelete, "/drivers/1/assets/photo", http.StatusUnauthorized},
+		{http.MethodPut, "/drivers/1/vehicle", http.StatusUnauthorized},
+		{http.MethodPost, "/drivers/1/pause", http.StatusUnauthorized},
+		{http.MethodPost, "/drivers/1/resume", http.StatusUnauthorized},
+		{http.MethodPut, "/drivers/1/rating", http.StatusUnauthorized},
+		{http.MethodPost, "/drivers/1/period", http.StatusUnauthorized},
+		{http.MethodPut, "/drivers/1/home", http.StatusUnauthorized},
+		{http.MethodPost, "/drivers/1/go-home", http.StatusUnauthorized},
+		{http.MethodDelete, "/drivers/1/go-home", http.StatusUnauthorized},
+		{http.MethodPost, "/trips", http.StatusUnauthorized},
+		{http.MethodPost, "/trips/1/riders", http.StatusUnauthorized},
+		{http.MethodPost, "/trips/1/complete", http.StatusUnauthorized},
+		{http.MethodPost, "/trips/1/legs", http.StatusUnauthorized},
+		{http.MethodPost, "/trips/1/feedback", http.StatusUnauthorized},
+		{http.MethodGet, "/trips/1/feedback", http.StatusUnauthorized},
+		{http.MethodGet, "/trips/1/receipts", http.StatusUnauthorized},
+		{http.MethodGet, "/drivers/1/live", http.StatusUnauthorized},
+		{http.MethodGet, "/drivers/1/periods", http.StatusUnauthorized},
+		{http.MethodPost, "/trips/1/tip", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(c.method, c.path, nil))
+		if rec.Code != c.status {
+			t.Errorf("%s %s: expected status %d, got %d", c.method, c.path, c.status, rec.Code)
+		}
+		var body struct {
+			Error struct {
+				Code string `json:"code"`
+			} `json:"error"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || body.Error.Code == "" {
+			t.Errorf("%s %s: expected an error envelope, got %v", c.method, c.path, err)
+		}
+	}
+}
+
+func TestRouterAdminKey(t *testing.T) {
+	// The admin and partner routes need a key even without the authentication of the drivers and riders.
+	defer func(enabled bool) { config.Get().AuthEnabled = enabled }(config.Get().AuthEnabled)
+	config.Get().AuthEnabled = false
+	h := NewHandler()
+
+	for _, c := range []struct{ method, path string }{
+		{http.MethodPost, "/admin/requests/1/cancel"},
+		{http.MethodPost, "/admin/drivers/1/offline"},
+		{http.MethodPut, "/admin/vehicles/1"},
+		{http.MethodPost, "/admin/runbook/rebuild-geo-index"},
+		{http.MethodPut, "/drivers/1/rating"},
+		{http.MethodGet, "/v2/density"},
+		{http.MethodGet, "/partners/heat"},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(c.method, c.path, nil))
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s: expected status 401, got %d", c.method, c.path, rec.Code)
+		}
+	}
+}
@@ -1,14 +1,19 @@
 package handler
 
 import (
+	"github.com/douglasmakey/tracking/logging"
 	"github.com/douglasmakey/tracking/storages"
-	"log"
 	"net/http"
+	"time"
 )
 
 func health(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	// While the circuit breaker is open Redis is not pinged, the breaker probes it until it is back.
+	if open, since := storages.GetBreaker().State(); open {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+			"status": "unavailable",
+			"redis":  map[string]interface{}{"breaker": "open", "since": since.UTC().Format(time.RFC3339)},
+		})
 		return
 	}
 
@@ -17,7 +22,7 @@ func health(w http.ResponseWriter, r *http.Request) {
 	// Checks that the communication with redis is alive.
 	if err := redis.Ping().Err(); err != nil {
 		// Put yours logs HERE
-		log.Printf("redis unaccessible error: %v ", err)
+		logging.FromContext(r.Context()).Error("redis unaccessible", "error", err)
 		w.WriteHeader(http.StatusServiceUnavailable)
 	} else {
 		w.WriteHeader(http.StatusOK)
@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"encoding/csv"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/douglasmakey/tracking/heat"
+	"github.com/douglasmakey/tracking/httputil"
+)
+
+// maxHeatRange is the max time range of a heat export.
+const maxHeatRange = time.Hour * 24 * 31
+
+// heatExport returns the anonymous trip density per zone and hour for the city partners, the path is /partners/heat?from=&to=&format=
+// Without range it returns the last 24 hours, with format=csv each row is zone,hour,starts,ends.
+func heatExport(w http.ResponseWriter, r *http.Request) {
+	from, to, ok := timeRange(w, r)
+	if !ok {
+		return
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if from.IsZero() {
+		from = to.Add(-time.Hour * 24)
+	}
+	if to.Before(from) || to.Sub(from) > maxHeatRange {
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "the range must be positive and at most 31 days")
+		return
+	}
+
+	cells, err := heat.Datasets(from, to)
+	if err != nil {
+		httputil.StorageError(w, r, "could not get heat datasets", err)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="heat.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"zone", "hour", "starts", "ends"})
+		for _, c := range cells {
+			cw.Write([]string{c.Zone, c.Hour.Format(time.RFC3339), strconv.FormatInt(c.Starts, 10), strconv.FormatInt(c.Ends, 10)})
+		}
+		cw.Flush()
+		return
+	}
+
+	writeJSON(w, http.StatusOK, cells)
+}
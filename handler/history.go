@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/douglasmakey/tracking/history"
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/gorilla/mux"
+)
+
+// driverHistory returns the locations reported by a driver, the path is /driver/{id}/history?from=&to=
+// from and to are optional and must be in RFC3339 format.
+func driverHistory(w http.ResponseWriter, r *http.Request) {
+	driverID := mux.Vars(r)["id"]
+
+	from, to, ok := timeRange(w, r)
+	if !ok {
+		return
+	}
+
+	points, err := history.Range(driverID, from, to)
+	if err != nil {
+		httputil.StorageError(w, r, "could not get history", err)
+		return
+	}
+
+	data, err := json.Marshal(points)
+	if err != nil {
+		httputil.WriteError(w, httputil.CodeInternal, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return
+}
+
+// timeRange parses the optional from and to query params in RFC3339 format, on error it writes the response and returns false.
+func timeRange(w http.ResponseWriter, r *http.Request) (from, to time.Time, ok bool) {
+	var err error
+	if v := r.URL.Query().Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			httputil.WriteError(w, httputil.CodeInvalidRequest, "invalid from, expected RFC3339")
+			return from, to, false
+		}
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			httputil.WriteError(w, httputil.CodeInvalidRequest, "invalid to, expected RFC3339")
+			return from, to, false
+		}
+	}
+	return from, to, true
+}
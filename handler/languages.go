@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/douglasmakey/tracking/languages"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/validation"
+	"github.com/gorilla/mux"
+)
+
+// decodeLanguages reads a body like {"languages": ["es", "en"]}, on error it writes the response and returns false.
+func decodeLanguages(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	body := struct {
+		Languages []string `json:"languages"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return nil, false
+	}
+	var v validation.Validator
+	for _, lang := range body.Languages {
+		v.Check(languages.Valid(lang), "languages", fmt.Sprintf("invalid language %q", lang))
+	}
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
+		return nil, false
+	}
+	if body.Languages == nil {
+		body.Languages = []string{}
+	}
+	return body.Languages, true
+}
+
+// driverLanguages returns the languages spoken by the driver, the path is /drivers/{id}/languages.
+func driverLanguages(w http.ResponseWriter, r *http.Request) {
+	driverID := mux.Vars(r)["id"]
+
+	spoken, err := languages.Drivers([]string{driverID})
+	if err != nil {
+		httputil.StorageError(w, r, "could not get languages", err)
+		return
+	}
+	langs := spoken[driverID]
+	if langs == nil {
+		langs = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"languages": langs})
+}
+
+// setDriverLanguages replaces the languages spoken by the driver, e.g. {"languages": ["es", "en"]}.
+func setDriverLanguages(w http.ResponseWriter, r *http.Request) {
+	langs, ok := decodeLanguages(w, r)
+	if !ok {
+		return
+	}
+	if err := languages.SetDriver(mux.Vars(r)["id"], langs); err != nil {
+		httputil.StorageError(w, r, "could not save languages", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"languages": langs})
+}
+
+// userLanguages returns the languages preferred by the rider, the path is /users/{id}/languages.
+func userLanguages(w http.ResponseWriter, r *http.Request) {
+	langs, err := languages.Rider(mux.Vars(r)["id"])
+	if err != nil {
+		httputil.StorageError(w, r, "could not get languages", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"languages": langs})
+}
+
+// setUserLanguages replaces the languages preferred by the rider in order of preference, e.g. {"languages": ["es", "en"]}.
+func setUserLanguages(w http.ResponseWriter, r *http.Request) {
+	langs, ok := decodeLanguages(w, r)
+	if !ok {
+		return
+	}
+	if err := languages.SetRider(mux.Vars(r)["id"], langs); err != nil {
+		httputil.StorageError(w, r, "could not save languages", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"languages": langs})
+}
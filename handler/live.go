@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/douglasmakey/tracking/live"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// liveWriteTimeout is the max time to write an update, a subscriber that does not read is disconnected.
+const liveWriteTimeout = time.Second * 10
+
+// driverLive streams the locations of the driver through a WebSocket, the path is /drivers/{id}/live.
+// Each message is a JSON location, e.g. {"driver_id":"abc","lat":1,"lng":2,"timestamp":"..."}.
+func driverLive(w http.ResponseWriter, r *http.Request) {
+	driverID := mux.Vars(r)["id"]
+
+	sub, cancel, err := live.GetHub().Subscribe(driverID)
+	if err != nil {
+		httputil.StorageError(w, r, "could not follow driver", err)
+		return
+	}
+	defer cancel()
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already replied to the client.
+		logging.FromContext(r.Context()).Warn("could not upgrade connection", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	// The subscriber does not send messages, reading detects when it closes the connection.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case _, ok := <-sub.Ready():
+			if !ok {
+				return
+			}
+			for {
+				l, ok, err := sub.Next()
+				if err != nil {
+					// The subscriber lost updates, it is disconnected to follow the driver again.
+					logging.FromContext(r.Context()).Warn("live subscriber failed", "driver_id", driverID, "error", err)
+					conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, err.Error()), time.Now().Add(liveWriteTimeout))
+					return
+				}
+				if !ok {
+					break
+				}
+				conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+				if err := conn.WriteJSON(l); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/maintenance"
+	"github.com/douglasmakey/tracking/validation"
+)
+
+// maintenanceWindow returns the current maintenance window, the path is /admin/maintenance.
+func maintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	window, ok, err := maintenance.Get()
+	if err != nil {
+		httputil.StorageError(w, r, "could not get maintenance window", err)
+		return
+	}
+	if !ok {
+		httputil.WriteError(w, httputil.CodeNotFound, "the service is not in maintenance")
+		return
+	}
+	writeJSON(w, http.StatusOK, window)
+}
+
+// startMaintenance begins a maintenance window that ends by itself, e.g. {"reason": "database upgrade", "until": "2020-01-01T03:00:00Z"}.
+func startMaintenance(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Reason string    `json:"reason"`
+		Until  time.Time `json:"until"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+
+	var v validation.Validator
+	v.Check(body.Until.After(time.Now()), "until", "must be in the future")
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+
+	window, err := maintenance.Start(body.Reason, body.Until)
+	if err != nil {
+		httputil.StorageError(w, r, "could not start maintenance", err)
+		return
+	}
+	logging.FromContext(r.Context()).Info("maintenance started", "reason", window.Reason, "until", window.Until)
+	writeJSON(w, http.StatusOK, window)
+}
+
+// endMaintenance finishes the maintenance window before its end.
+func endMaintenance(w http.ResponseWriter, r *http.Request) {
+	if err := maintenance.End(); err != nil {
+		httputil.StorageError(w, r, "could not end maintenance", err)
+		return
+	}
+	logging.FromContext(r.Context()).Info("maintenance ended")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/douglasmakey/tracking/auth"
+	"github.com/douglasmakey/tracking/config"
+	"github.com/douglasmakey/tracking/consistency"
+	"github.com/douglasmakey/tracking/drivers"
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/douglasmakey/tracking/tasks"
+	"github.com/gorilla/mux"
+)
+
+// The runbook operations fix the common incidents, they are idempotent so they can be run again until the incident is solved.
+// Every operation is written to the audit log with the admin that ran it.
+
+// audit logs the runbook operation run by the admin of the request.
+func audit(r *http.Request, operation string, args ...interface{}) {
+	actor := "anonymous"
+	if p := auth.FromContext(r.Context()); p != nil {
+		actor = p.Subject
+	}
+	args = append([]interface{}{"audit", true, "operation", operation, "actor", actor}, args...)
+	logging.FromContext(r.Context()).Info("runbook operation", args...)
+}
+
+// flushZoneReservations releases the drivers reserved in a zone, e.g. after an incident that left the requests of the zone
+// without finishing. The path is /admin/runbook/zones/{zone}/flush-reservations.
+func flushZoneReservations(w http.ResponseWriter, r *http.Request) {
+	zone := mux.Vars(r)["zone"]
+
+	released, err := storages.GetRedisClient().FlushReservations(zone)
+	if err != nil {
+		httputil.StorageError(w, r, "could not flush reservations", err)
+		return
+	}
+
+	audit(r, "flush_reservations", "zone", zone, "released", len(released))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"zone": zone, "released": released})
+}
+
+// releaseDriver removes the reservation of a stuck driver and moves it back to available, it receives requests again
+// with its next location. The path is /admin/runbook/drivers/{id}/release.
+func releaseDriver(w http.ResponseWriter, r *http.Request) {
+	driverID := mux.Vars(r)["id"]
+
+	released, err := storages.GetRedisClient().ReleaseDriver(driverID)
+	if err != nil {
+		httputil.StorageError(w, r, "could not release driver", err)
+		return
+	}
+	if _, err := drivers.SetPeriod(driverID, drivers.PeriodAvailable, drivers.PeriodEnRoute, drivers.PeriodOnTrip); err != nil {
+		httputil.StorageError(w, r, "could not release driver", err)
+		return
+	}
+
+	audit(r, "release_driver", "driver_id", driverID, "released", released)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"driver_id": driverID, "released": released})
+}
+
+// rebuildAreaIndex rebuilds the index of the searching requests by zone from the search queues,
+// the path is /admin/runbook/rebuild-area-index.
+func rebuildAreaIndex(w http.ResponseWriter, r *http.Request) {
+	counts, err := tasks.RebuildAreaIndex()
+	if err != nil {
+		httputil.StorageError(w, r, "could not rebuild the index", err)
+		return
+	}
+
+	audit(r, "rebuild_area_index", "zones", len(counts))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"zones": counts})
+}
+
+// verifyGeoIndex reports the discrepancies between the GEO index of the drivers and their state,
+// the path is /admin/runbook/verify-geo-index.
+func verifyGeoIndex(w http.ResponseWriter, r *http.Request) {
+	report, err := consistency.Check()
+	if err != nil {
+		httputil.StorageError(w, r, "could not verify the index", err)
+		return
+	}
+
+	audit(r, "verify_geo_index", "drivers", report.Drivers, "consistent", report.Consistent())
+	writeJSON(w, http.StatusOK, report)
+}
+
+// rebuildGeoIndex replaces the GEO index of the drivers with one rebuilt from their state and their last recorded locations,
+// e.g. after the index was corrupted or its keys changed. The path is /admin/runbook/rebuild-geo-index.
+func rebuildGeoIndex(w http.ResponseWriter, r *http.Request) {
+	report, err := consistency.Rebuild(config.Get().DriverTTL)
+	switch err {
+	case nil:
+	case consistency.ErrRebuildRunning, storages.ErrRebuildMismatch:
+		httputil.WriteError(w, httputil.CodeConflict, err.Error())
+		return
+	default:
+		httputil.StorageError(w, r, "could not rebuild the index", err)
+		return
+	}
+
+	audit(r, "rebuild_geo_index", "drivers", report.Drivers, "kept", report.Kept, "removed", report.Removed)
+	writeJSON(w, http.StatusOK, report)
+}
+
+// zoneRequests returns the searching requests picked up in a zone, the path is /admin/zones/{zone}/requests.
+func zoneRequests(w http.ResponseWriter, r *http.Request) {
+	ids, err := tasks.AreaRequests(mux.Vars(r)["zone"])
+	if err != nil {
+		httputil.StorageError(w, r, "could not get requests", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ids)
+}
@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+
+	"github.com/douglasmakey/tracking/drivers"
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/douglasmakey/tracking/validation"
+	"github.com/go-redis/redis"
+)
+
+// maxSyntheticDrivers is the max number of synthetic drivers created at once.
+const maxSyntheticDrivers = 100
+
+// sandboxOnly only lets the sandbox API keys use the routes, they manage the synthetic drivers of the tenant.
+func sandboxOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !storages.IsSandbox(r.Context()) {
+			httputil.WriteError(w, httputil.CodeForbidden, "only the sandbox api keys can manage synthetic drivers")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// createSandboxDrivers creates synthetic drivers around a point, the path is /sandbox/drivers,
+// e.g. {"lat": -33.44, "lng": -70.66, "count": 10, "radius_km": 2, "wav": false}.
+func createSandboxDrivers(w http.ResponseWriter, r *http.Request) {
+	rClient := storages.ClientFor(r.Context())
+
+	body := struct {
+		Lat    float64 `json:"lat"`
+		Lng    float64 `json:"lng"`
+		Count  int     `json:"count"`
+		Radius float64 `json:"radius_km"`
+		WAV    bool    `json:"wav"`
+	}{Radius: 2}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+	var v validation.Validator
+	v.Latitude("lat", body.Lat)
+	v.Longitude("lng", body.Lng)
+	v.Between("count", float64(body.Count), 1, maxSyntheticDrivers)
+	v.Positive("radius_km", body.Radius)
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+
+	// The drivers are spread uniformly in the circle, a degree of latitude is about 111km.
+	locations := make([]*redis.GeoLocation, body.Count)
+	ids := make([]string, body.Count)
+	for i := range locations {
+		d, angle := body.Radius*math.Sqrt(rand.Float64())/111, rand.Float64()*2*math.Pi
+		ids[i] = fmt.Sprintf("synthetic-%d", rand.Int63())
+		locations[i] = &redis.GeoLocation{
+			Name:      ids[i],
+			Latitude:  body.Lat + d*math.Sin(angle),
+			Longitude: body.Lng + d*math.Cos(angle)/math.Cos(body.Lat*math.Pi/180),
+		}
+	}
+	if err := rClient.AddDriverLocations(r.Context(), locations); err != nil {
+		httputil.StorageError(w, r, "could not create drivers", err)
+		return
+	}
+	if body.WAV {
+		for _, id := range ids {
+			if err := drivers.SetTags(id, []string{drivers.TagWAV}); err != nil {
+				httputil.StorageError(w, r, "could not tag drivers", err)
+				return
+			}
+		}
+	}
+
+	writeJSON(w, http.StatusCreated, map[string][]string{"drivers": ids})
+}
+
+// clearSandboxDrivers removes all the synthetic drivers of the tenant.
+func clearSandboxDrivers(w http.ResponseWriter, r *http.Request) {
+	if err := storages.ClientFor(r.Context()).ClearDrivers(); err != nil {
+		httputil.StorageError(w, r, "could not remove drivers", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
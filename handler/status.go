@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/maintenance"
+	"github.com/douglasmakey/tracking/statuspage"
+	"github.com/douglasmakey/tracking/storages"
+)
+
+// serviceStatus returns the current state of the service and its health over the last day, week and month for the public
+// status page, the path is /status. The windows are omitted while they cannot be read, e.g. Redis is unavailable.
+func serviceStatus(w http.ResponseWriter, r *http.Request) {
+	state := statuspage.StatusOperational
+	if _, ok := maintenance.Active(); ok {
+		state = statuspage.StatusMaintenance
+	}
+	if storages.GetBreaker().Open() {
+		state = statuspage.StatusDegraded
+	}
+
+	body := struct {
+		Status    string                     `json:"status"`
+		Generated time.Time                  `json:"generated_at"`
+		Windows   []statuspage.WindowSummary `json:"windows,omitempty"`
+	}{Status: state, Generated: time.Now().UTC()}
+
+	if state != statuspage.StatusDegraded {
+		windows, err := statuspage.Summary()
+		if err != nil {
+			logging.FromContext(r.Context()).Warn("could not get status windows", "error", err)
+			body.Status = statuspage.StatusDegraded
+		}
+		body.Windows = windows
+	}
+	writeJSON(w, http.StatusOK, body)
+}
@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/douglasmakey/tracking/auth"
+	"github.com/douglasmakey/tracking/ingest"
+	"github.com/douglasmakey/tracking/logging"
+)
+
+// errForbiddenDriver is returned for the lines of drivers that the API key can not act as.
+var errForbiddenDriver = errors.New("api key does not belong to the driver")
+
+const (
+	// streamAckEvery and streamAckInterval control how often the received locations are saved and acknowledged.
+	streamAckEvery    = 100
+	streamAckInterval = time.Second
+	// maxStreamLine is the max size of a line of the stream.
+	maxStreamLine = 64 * 1024
+)
+
+// streamAck is written to the response after the locations are saved, Line is the last line saved.
+// After an error the client must send again the lines after Line.
+type streamAck struct {
+	Line     int            `json:"line"`
+	Accepted int            `json:"accepted"`
+	Rejected []streamReject `json:"rejected,omitempty"`
+	Error    string         `json:"error,omitempty"`
+	Done     bool           `json:"done,omitempty"`
+}
+
+// streamReject is a line that was not accepted, the other lines of the stream are not affected.
+type streamReject struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// trackingStream receives the locations as NDJSON in a chunked request that the client keeps open,
+// it is used by the gateways that aggregate many devices. The locations are saved in batches and each batch
+// is acknowledged with a JSON line in the response.
+func trackingStream(w http.ResponseWriter, r *http.Request) {
+	// Without full duplex the server does not let us read the body after writing the first ack.
+	rc := http.NewResponseController(w)
+	if err := rc.EnableFullDuplex(); err != nil {
+		logging.FromContext(r.Context()).Warn("could not enable full duplex", "error", err)
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	ack := func(a streamAck) bool {
+		if err := enc.Encode(a); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+
+	var (
+		pending     []ingest.Location
+		current     streamAck
+		line, saved int
+		last        = time.Now()
+	)
+	// flush saves the pending locations and acknowledges them, it returns false when the stream must stop.
+	flush := func(done bool) bool {
+		if len(pending) > 0 {
+			if err := ingest.Save(r.Context(), pending...); err != nil {
+				logging.FromContext(r.Context()).Error("could not save locations", "error", err)
+				ack(streamAck{Line: saved, Error: "could not save locations"})
+				return false
+			}
+		}
+		saved = line
+		current.Line, current.Done = line, done
+		ok := ack(current)
+		pending, current, last = pending[:0], streamAck{}, time.Now()
+		return ok
+	}
+
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 0, 4096), maxStreamLine)
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		if err := streamLocation(r, scanner.Bytes(), &pending); err != nil {
+			current.Rejected = append(current.Rejected, streamReject{Line: line, Error: err.Error()})
+		} else {
+			current.Accepted++
+		}
+
+		if len(pending)+len(current.Rejected) >= streamAckEvery || time.Since(last) >= streamAckInterval {
+			if !flush(false) {
+				return
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		logging.FromContext(r.Context()).Warn("could not read stream", "error", err)
+		current.Error = err.Error()
+	}
+	flush(true)
+}
+
+// streamLocation checks the location of the line and adds it to pending.
+func streamLocation(r *http.Request, data []byte, pending *[]ingest.Location) error {
+	var l ingest.Location
+	if err := json.Unmarshal(data, &l); err != nil {
+		return err
+	}
+	if err := ingest.Validate(l); err != nil {
+		return err
+	}
+	if !auth.CanActAs(r, l.ID) {
+		return errForbiddenDriver
+	}
+	if err := ingest.Accept(l, false); err != nil {
+		return err
+	}
+
+	*pending = append(*pending, l)
+	return nil
+}
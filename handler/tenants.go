@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/douglasmakey/tracking/workflow"
+	"github.com/gorilla/mux"
+)
+
+// tenantWorkflow returns the workflow engine of a tenant, the path is /admin/tenants/{tenant}/workflow.
+func tenantWorkflow(w http.ResponseWriter, r *http.Request) {
+	e, err := workflow.GetEngine(mux.Vars(r)["tenant"])
+	if err == workflow.ErrNotConfigured {
+		httputil.WriteError(w, httputil.CodeNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		httputil.StorageError(w, r, "could not get workflow engine", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, e)
+}
+
+// setTenantWorkflow sets the workflow engine of a tenant,
+// e.g. {"kind": "temporal", "url": "http://temporal:7243", "namespace": "default", "signal": "state_changed"}.
+func setTenantWorkflow(w http.ResponseWriter, r *http.Request) {
+	var e workflow.Engine
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+	err := workflow.SetEngine(mux.Vars(r)["tenant"], e)
+	if _, ok := err.(*storages.Error); ok {
+		httputil.StorageError(w, r, "could not save workflow engine", err)
+		return
+	}
+	if err != nil {
+		httputil.WriteError(w, httputil.CodeInvalidRequest, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// previewTenantWorkflow renders an event with the template of the engine in the body, or with the saved engine of the tenant,
+// the path is /admin/tenants/{tenant}/workflow/preview, e.g. {"engine": {"kind": "http", "url": "...", "template": "..."}}.
+// The event is a sample of a matched request unless one is given.
+func previewTenantWorkflow(w http.ResponseWriter, r *http.Request) {
+	tenant := mux.Vars(r)["tenant"]
+	e, ev, ok := workflowTest(w, r, tenant)
+	if !ok {
+		return
+	}
+
+	body, err := e.Render(ev)
+	if err != nil {
+		httputil.WriteError(w, httputil.CodeInvalidRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"content_type": e.BodyType(), "body": string(body)})
+}
+
+// testTenantWorkflow delivers an event once to the engine in the body, or to the saved engine of the tenant, and reports
+// whether it was accepted, the path is /admin/tenants/{tenant}/workflow/test. The body is the same as the preview.
+func testTenantWorkflow(w http.ResponseWriter, r *http.Request) {
+	tenant := mux.Vars(r)["tenant"]
+	e, ev, ok := workflowTest(w, r, tenant)
+	if !ok {
+		return
+	}
+
+	res := map[string]interface{}{"delivered": true}
+	if err := workflow.Test(r.Context(), e, ev); err != nil {
+		res = map[string]interface{}{"delivered": false, "error": err.Error()}
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// workflowTest decodes the engine and the event of a preview or a test, on error it writes the response and returns false.
+func workflowTest(w http.ResponseWriter, r *http.Request, tenant string) (workflow.Engine, workflow.Event, bool) {
+	body := struct {
+		Engine *workflow.Engine `json:"engine"`
+		Event  *workflow.Event  `json:"event"`
+	}{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+			httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+			return workflow.Engine{}, workflow.Event{}, false
+		}
+	}
+
+	var e workflow.Engine
+	if body.Engine != nil {
+		e = *body.Engine
+	} else {
+		var err error
+		e, err = workflow.GetEngine(tenant)
+		if err == workflow.ErrNotConfigured {
+			httputil.WriteError(w, httputil.CodeNotFound, err.Error())
+			return workflow.Engine{}, workflow.Event{}, false
+		}
+		if err != nil {
+			httputil.StorageError(w, r, "could not get workflow engine", err)
+			return workflow.Engine{}, workflow.Event{}, false
+		}
+	}
+	ev := workflow.SampleEvent(tenant)
+	if body.Event != nil {
+		ev = *body.Event
+		ev.Tenant = tenant
+	}
+	return e, ev, true
+}
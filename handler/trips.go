@@ -0,0 +1,447 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/douglasmakey/tracking/auth"
+	"github.com/douglasmakey/tracking/config"
+	"github.com/douglasmakey/tracking/drivers"
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/geofence"
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/douglasmakey/tracking/idcodec"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/trips"
+	"github.com/douglasmakey/tracking/validation"
+	"github.com/gorilla/mux"
+)
+
+// createTrip creates a pooled trip that starts at the driver location, e.g. {"lat": 1, "lng": 2, "driver_id": "abc"}.
+func createTrip(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		geo.Point
+		DriverID string `json:"driver_id"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+	var v validation.Validator
+	v.Point("", body.Point)
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+	// A driver can only create its own trips, the trips without a driver are created by the admins.
+	if !auth.CanActAs(r, body.DriverID) {
+		httputil.WriteError(w, httputil.CodeForbidden, "api key does not belong to the driver")
+		return
+	}
+
+	t, err := trips.Create(body.Point, body.DriverID, auth.Tenant(r))
+	if err != nil {
+		httputil.StorageError(w, r, "could not create trip", err)
+		return
+	}
+
+	t.ID = idcodec.Encode(idcodec.KindTrip, t.ID)
+	writeJSON(w, http.StatusCreated, t)
+}
+
+// tripID decodes the public id of the trip in the path, on error it writes the response and returns false.
+func tripID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id, err := idcodec.Decode(idcodec.KindTrip, mux.Vars(r)["id"])
+	if err != nil {
+		httputil.WriteError(w, httputil.CodeNotFound, "not found")
+		return "", false
+	}
+	return id, true
+}
+
+// tripPlan returns the plan of the trip, the path is /trips/{id}/plan.
+func tripPlan(w http.ResponseWriter, r *http.Request) {
+	id, ok := tripID(w, r)
+	if !ok {
+		return
+	}
+
+	t, err := trips.Get(id)
+	if err != nil {
+		tripError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, t.Plan)
+}
+
+// addTripRider adds a rider to the trip and returns the new plan, the path is /trips/{id}/riders.
+func addTripRider(w http.ResponseWriter, r *http.Request) {
+	id, ok := tripID(w, r)
+	if !ok {
+		return
+	}
+
+	var rider trips.Rider
+	if err := json.NewDecoder(r.Body).Decode(&rider); err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+	var v validation.Validator
+	v.Required("id", rider.ID)
+	v.Point("pickup.", rider.Pickup)
+	v.Point("dropoff.", rider.Dropoff)
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+	if !driverOf(w, r, id) {
+		return
+	}
+
+	t, err := trips.AddRider(id, rider)
+	if err != nil {
+		tripError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, t.Plan)
+}
+
+// completeTrip splits the fare of the trip between its riders and returns the receipts, the path is /trips/{id}/complete.
+func completeTrip(w http.ResponseWriter, r *http.Request) {
+	id, ok := tripID(w, r)
+	if !ok {
+		return
+	}
+
+	body := struct {
+		Fare float64 `json:"fare"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+	var v validation.Validator
+	v.NotNegative("fare", body.Fare)
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+	if !driverOf(w, r, id) {
+		return
+	}
+
+	t, err := trips.Complete(id, body.Fare)
+	if err != nil {
+		tripError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, t.Receipts)
+}
+
+// tripReceipts returns the share of the fare of each rider of a completed trip, the path is /trips/{id}/receipts.
+func tripReceipts(w http.ResponseWriter, r *http.Request) {
+	id, ok := tripID(w, r)
+	if !ok {
+		return
+	}
+
+	t, err := trips.Get(id)
+	if err != nil {
+		tripError(w, r, err)
+		return
+	}
+	if !riderOfTrip(w, r, t) {
+		return
+	}
+	if !t.Completed() {
+		tripError(w, r, trips.ErrNotCompleted)
+		return
+	}
+	writeJSON(w, http.StatusOK, t.Receipts)
+}
+
+// leaveFeedback saves the rating and the tags that the rider left about the driver of a completed trip,
+// the path is /trips/{id}/feedback, e.g. {"rider_id": "abc", "rating": 5, "tags": ["friendly"]}.
+func leaveFeedback(w http.ResponseWriter, r *http.Request) {
+	id, ok := tripID(w, r)
+	if !ok {
+		return
+	}
+
+	var f trips.Feedback
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+	var v validation.Validator
+	v.Required("rider_id", f.RiderID)
+	v.Between("rating", float64(f.Rating), 1, 5)
+	seen := map[string]bool{}
+	for _, tag := range f.Tags {
+		v.Check(drivers.IsFeedbackTag(tag), "tags", fmt.Sprintf("unknown tag %q", tag))
+		v.Check(!seen[tag], "tags", fmt.Sprintf("duplicated tag %q", tag))
+		seen[tag] = true
+	}
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+	if !riderOf(w, r, f.RiderID) {
+		return
+	}
+
+	if err := trips.LeaveFeedback(id, f); err != nil {
+		tripError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// leaveTip saves the tip that the rider left to the driver of a completed trip, the path is /trips/{id}/tip,
+// e.g. {"rider_id": "abc", "amount": 2.5}.
+func leaveTip(w http.ResponseWriter, r *http.Request) {
+	id, ok := tripID(w, r)
+	if !ok {
+		return
+	}
+
+	var tip trips.Tip
+	if err := json.NewDecoder(r.Body).Decode(&tip); err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+	var v validation.Validator
+	v.Required("rider_id", tip.RiderID)
+	v.Positive("amount", tip.Amount)
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+	if !riderOf(w, r, tip.RiderID) {
+		return
+	}
+
+	if err := trips.LeaveTip(id, tip); err != nil {
+		tripError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// driverArrived records that the driver of the trip arrived at the pickup and returns when the no-show can be marked,
+// the path is /trips/{id}/arrived.
+func driverArrived(w http.ResponseWriter, r *http.Request) {
+	id, ok := tripID(w, r)
+	if !ok {
+		return
+	}
+	if !driverOf(w, r, id) {
+		return
+	}
+
+	t, err := trips.Arrive(id, time.Now())
+	if err != nil {
+		tripError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"trip_id":    idcodec.Encode(idcodec.KindTrip, t.ID),
+		"arrived_at": t.Arrived,
+		"no_show_at": t.Arrived.Add(config.Get().NoShowWait),
+	})
+}
+
+// markNoShow ends the trip when the riders did not board after the no-show wait, the riders are charged the no-show fee
+// and the driver is available again. The path is /trips/{id}/no-show.
+func markNoShow(w http.ResponseWriter, r *http.Request) {
+	id, ok := tripID(w, r)
+	if !ok {
+		return
+	}
+	if !driverOf(w, r, id) {
+		return
+	}
+
+	cfg := config.Get()
+	t, err := trips.MarkNoShow(id, time.Now(), cfg.NoShowWait, cfg.NoShowFee)
+	if err != nil {
+		tripError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"trip_id": idcodec.Encode(idcodec.KindTrip, t.ID),
+		"state":   trips.StateNoShow,
+		"fee":     cfg.NoShowFee,
+	})
+}
+
+// planTripLegs splits a long trip in legs driven in relay, e.g. {"handoff_zones": ["toll-north", "service-km120"]}.
+// The driver of each next leg is searched as the trip nears the handoff zone. The path is /trips/{id}/legs.
+func planTripLegs(w http.ResponseWriter, r *http.Request) {
+	id, ok := tripID(w, r)
+	if !ok {
+		return
+	}
+	body := struct {
+		Handoffs []string `json:"handoff_zones"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+	var v validation.Validator
+	v.Check(len(body.Handoffs) > 0, "handoff_zones", "must have at least one zone")
+	for _, h := range body.Handoffs {
+		v.Check(h != "", "handoff_zones", "must not be empty")
+	}
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+	if !driverOf(w, r, id) {
+		return
+	}
+
+	t, err := trips.PlanLegs(id, body.Handoffs)
+	if err == geofence.ErrNotFound {
+		v.Add("handoff_zones", err.Error())
+		validation.Write(w, v.Err())
+		return
+	}
+	if err != nil {
+		tripError(w, r, err)
+		return
+	}
+	t.ID = idcodec.Encode(idcodec.KindTrip, t.ID)
+	writeJSON(w, http.StatusOK, t)
+}
+
+// handoffTrip passes the trip to the driver of its next leg, the driver must be inside the handoff zone,
+// e.g. {"driver_id": "abc", "lat": 1, "lng": 2}. The path is /trips/{id}/handoff.
+func handoffTrip(w http.ResponseWriter, r *http.Request) {
+	id, ok := tripID(w, r)
+	if !ok {
+		return
+	}
+	body := struct {
+		geo.Point
+		DriverID string `json:"driver_id"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+	var v validation.Validator
+	v.Required("driver_id", body.DriverID)
+	v.Point("", body.Point)
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+	if !auth.CanActAs(r, body.DriverID) {
+		httputil.WriteError(w, httputil.CodeForbidden, "api key does not belong to the driver")
+		return
+	}
+
+	t, err := trips.Handoff(id, body.DriverID, body.Point)
+	if err != nil {
+		tripError(w, r, err)
+		return
+	}
+	t.ID = idcodec.Encode(idcodec.KindTrip, t.ID)
+	writeJSON(w, http.StatusOK, t)
+}
+
+// driverOf checks that the API key belongs to the driver of the trip, on error it writes the response and returns false.
+func driverOf(w http.ResponseWriter, r *http.Request, id string) bool {
+	t, err := trips.Get(id)
+	if err != nil {
+		tripError(w, r, err)
+		return false
+	}
+	if !auth.CanActAs(r, t.DriverID) {
+		httputil.WriteError(w, httputil.CodeForbidden, "api key does not belong to the driver")
+		return false
+	}
+	return true
+}
+
+// riderOf checks that the API key belongs to the rider, on error it writes the response and returns false.
+func riderOf(w http.ResponseWriter, r *http.Request, riderID string) bool {
+	if !auth.CanActAs(r, riderID) {
+		httputil.WriteError(w, httputil.CodeForbidden, "api key does not belong to the rider")
+		return false
+	}
+	return true
+}
+
+// riderOfTrip checks that the API key belongs to a rider of the trip, on error it writes the response and returns false.
+func riderOfTrip(w http.ResponseWriter, r *http.Request, t *trips.Trip) bool {
+	for _, rider := range t.Riders {
+		if auth.CanActAs(r, rider.ID) {
+			return true
+		}
+	}
+	// A trip without riders is only read by the admins or without authentication.
+	if auth.CanActAs(r, "") {
+		return true
+	}
+	httputil.WriteError(w, httputil.CodeForbidden, "api key does not belong to a rider of the trip")
+	return false
+}
+
+// tripFeedback returns the feedback and the tips left by the riders of the trip to its driver, the path is /trips/{id}/feedback.
+func tripFeedback(w http.ResponseWriter, r *http.Request) {
+	id, ok := tripID(w, r)
+	if !ok {
+		return
+	}
+	if !driverOf(w, r, id) {
+		return
+	}
+
+	f, err := trips.GetFeedback(id)
+	if err != nil {
+		tripError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, f)
+}
+
+func tripError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case trips.ErrNotFound:
+		httputil.WriteError(w, httputil.CodeNotFound, err.Error())
+		return
+	case trips.ErrCompleted, trips.ErrNotCompleted, trips.ErrNoDriver, trips.ErrFeedbackExists, trips.ErrNoShow, trips.ErrNotArrived, trips.ErrTooEarly,
+		trips.ErrLegsPlanned, trips.ErrNoHandoff, trips.ErrOutsideHandoff, trips.ErrConflict:
+		httputil.WriteError(w, httputil.CodeConflict, err.Error())
+		return
+	case trips.ErrNotRider:
+		httputil.WriteError(w, httputil.CodeForbidden, err.Error())
+		return
+	}
+	httputil.StorageError(w, r, "could not get trip", err)
+}
+
+// writeJSON writes v as the JSON body of the response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		httputil.WriteError(w, httputil.CodeInternal, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/douglasmakey/tracking/auth"
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/douglasmakey/tracking/idcodec"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/notify"
+	"github.com/douglasmakey/tracking/tasks"
+	"github.com/gorilla/mux"
+)
+
+// ownUser only lets the user use the routes with the path /users/{id}/...
+func ownUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !auth.CanActAs(r, mux.Vars(r)["id"]) {
+			httputil.WriteError(w, httputil.CodeForbidden, "api key does not belong to the user")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// cancelAllRequests cancels atomically all the open requests of a user, the path is /users/{id}/requests/cancel-all.
+// It is used when an account is suspended in the middle of a search, the response has the outcome of each request.
+func cancelAllRequests(w http.ResponseWriter, r *http.Request) {
+	outcomes, err := tasks.CancelAll(mux.Vars(r)["id"])
+	if err != nil {
+		httputil.StorageError(w, r, "could not cancel requests", err)
+		return
+	}
+
+	type result struct {
+		RequestID string `json:"request_id"`
+		Outcome   string `json:"outcome"`
+	}
+	results := make([]result, 0, len(outcomes))
+	for id, outcome := range outcomes {
+		results = append(results, result{RequestID: idcodec.Encode(idcodec.KindRequest, id), Outcome: outcome})
+	}
+
+	writeJSON(w, http.StatusOK, results)
+}
+
+// userContact returns how the user receives the notifications.
+func userContact(w http.ResponseWriter, r *http.Request) {
+	c, err := notify.GetContact(mux.Vars(r)["id"])
+	if err != nil {
+		httputil.StorageError(w, r, "could not get contact", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+// setUserContact updates how the user receives the notifications, e.g. {"push_token": "...", "phone": "+56911111111"}.
+func setUserContact(w http.ResponseWriter, r *http.Request) {
+	var c notify.Contact
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+	if err := notify.SetContact(mux.Vars(r)["id"], c); err != nil {
+		httputil.StorageError(w, r, "could not save contact", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
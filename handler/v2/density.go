@@ -0,0 +1,78 @@
+package v2
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/douglasmakey/tracking/clusters"
+	"github.com/douglasmakey/tracking/config"
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/douglasmakey/tracking/validation"
+)
+
+// defaultDensityResolution is the geohash precision of the cells, a cell of about 1.2km x 0.6km.
+const defaultDensityResolution = 6
+
+// Density returns the number of drivers per geohash cell of a box for the heatmaps of the operations dashboards, the path is
+// /v2/density?bbox=min_lng,min_lat,max_lng,max_lat&resolution= where resolution is the geohash precision between 1 and 9.
+// The density of a box is cached for a few seconds, so the dashboards that refresh together read the GEO index once.
+func Density(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var v validation.Validator
+	var corners [4]float64
+	parts := strings.Split(q.Get("bbox"), ",")
+	v.Check(len(parts) == 4, "bbox", "must be min_lng,min_lat,max_lng,max_lat")
+	if len(parts) == 4 {
+		for i, p := range parts {
+			f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+			v.Check(err == nil, "bbox", "must be numbers")
+			corners[i] = f
+		}
+	}
+	minLng, minLat, maxLng, maxLat := corners[0], corners[1], corners[2], corners[3]
+	v.Longitude("bbox", minLng)
+	v.Latitude("bbox", minLat)
+	v.Longitude("bbox", maxLng)
+	v.Latitude("bbox", maxLat)
+	v.Check(minLat <= maxLat && minLng <= maxLng, "bbox", "the max corner must be north east of the min corner")
+	resolution := defaultDensityResolution
+	if res := q.Get("resolution"); res != "" {
+		var err error
+		resolution, err = strconv.Atoi(res)
+		v.Check(err == nil && resolution >= 1 && resolution <= 9, "resolution", "must be between 1 and 9")
+	}
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+
+	key := clusters.DensityKey(minLat, minLng, maxLat, maxLng, resolution)
+	d, ok, err := clusters.LoadDensity(key)
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("could not load density", "error", err)
+	}
+	if !ok {
+		drivers, err := storages.LocationsFor(r.Context()).DriversInBox(r.Context(), minLat, minLng, maxLat, maxLng)
+		if err != nil {
+			httputil.StorageError(w, r, "could not get drivers", err)
+			return
+		}
+		d = clusters.NewDensity(clusters.Build(drivers, resolution), resolution)
+		if err := clusters.SaveDensity(key, d, config.Get().DensityCacheTTL); err != nil {
+			logging.FromContext(r.Context()).Warn("could not save density", "error", err)
+		}
+	}
+
+	data, err := json.Marshal(d)
+	if err != nil {
+		httputil.WriteError(w, httputil.CodeInternal, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
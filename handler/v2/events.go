@@ -0,0 +1,115 @@
+package v2
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/douglasmakey/tracking/auth"
+	"github.com/douglasmakey/tracking/config"
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/douglasmakey/tracking/idcodec"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/tasks"
+	"github.com/gorilla/mux"
+)
+
+// keepAliveInterval is how often a comment is sent to keep the connection open through the proxies.
+const keepAliveInterval = time.Second * 15
+
+// SearchEvents streams the progress of a search request as Server-Sent Events, the path is /v2/search/{id}/events.
+// The first event is the current status, then every step of the search is sent until the request finishes,
+// e.g. "event: radius_widened\ndata: {"type":"radius_widened","attempt":2,"radius_km":3,...}". A matched request is followed
+// by the distance and the ETA of the driver to the pickup, e.g. "event: driver_approaching\ndata: {"distance_km":1.2,"eta_seconds":180,...}".
+func SearchEvents(w http.ResponseWriter, r *http.Request) {
+	requestID, err := idcodec.Decode(idcodec.KindRequest, mux.Vars(r)["id"])
+	if err != nil {
+		httputil.WriteError(w, httputil.CodeNotFound, "request not found")
+		return
+	}
+
+	// Subscribe before reading the status, so no event is lost between both.
+	sub := tasks.SubscribeEvents(requestID)
+	defer sub.Close()
+
+	s, err := tasks.GetStatus(requestID)
+	if err == tasks.ErrStatusNotFound {
+		httputil.WriteError(w, httputil.CodeNotFound, "request not found")
+		return
+	}
+	if err != nil {
+		httputil.StorageError(w, r, "could not get request status", err)
+		return
+	}
+
+	// A rider can only follow its own requests.
+	if !auth.CanActAs(r, s.UserID) {
+		httputil.WriteError(w, httputil.CodeForbidden, "request does not belong to the user")
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(ev tasks.Event) bool {
+		if ev.DriverID != "" {
+			ev.DriverID = idcodec.Encode(idcodec.KindDriver, ev.DriverID)
+		}
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return false
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+
+	// After the match the stream follows the driver on its way to the pickup, until it is at the pickup or the approach window ends.
+	var approachEnd <-chan time.Time
+	follow := func(state string, at time.Time) bool {
+		switch {
+		case state == tasks.StateMatched:
+			remaining := config.Get().ApproachTTL - time.Since(at)
+			approachEnd = time.After(remaining)
+			return remaining > 0
+		case state == tasks.EventDriverAtPickup:
+			return false
+		}
+		return !tasks.IsTerminal(state)
+	}
+	if !send(tasks.Event{Type: s.State, Radius: s.Radius, DriverID: s.DriverID, Time: s.UpdatedAt}) || !follow(s.State, s.UpdatedAt) {
+		return
+	}
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	events := sub.Channel()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-approachEnd:
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		case msg, ok := <-events:
+			if !ok {
+				return
+			}
+			var ev tasks.Event
+			if err := json.Unmarshal([]byte(msg.Payload), &ev); err != nil {
+				logging.FromContext(r.Context()).Warn("invalid search event", "error", err)
+				continue
+			}
+			if !send(ev) || !follow(ev.Type, ev.Time) {
+				return
+			}
+		}
+	}
+}
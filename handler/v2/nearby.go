@@ -0,0 +1,103 @@
+package v2
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/douglasmakey/tracking/auth"
+	"github.com/douglasmakey/tracking/codec"
+	"github.com/douglasmakey/tracking/config"
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/nearby"
+	"github.com/douglasmakey/tracking/validation"
+	"github.com/gorilla/mux"
+)
+
+// NearbySubscribe subscribes the rider to the drivers around a point, the rider is notified each time the number of drivers
+// within the radius changes, e.g. {"lat": -33.44, "lng": -70.65, "radius_km": 1, "ttl_seconds": 600, "callback_url": "https://..."}.
+func NearbySubscribe(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Lat, Lng    float64
+		Radius      float64 `json:"radius_km"`
+		TTL         int     `json:"ttl_seconds"`
+		CallbackURL string  `json:"callback_url"`
+	}{}
+	if err := codec.Decode(r, &body); err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+
+	cfg := config.Get()
+	var v validation.Validator
+	v.Latitude("lat", body.Lat)
+	v.Longitude("lng", body.Lng)
+	v.Between("radius_km", body.Radius, 0.1, cfg.NearbyMaxRadius)
+	if body.TTL != 0 {
+		v.Between("ttl_seconds", float64(body.TTL), 60, cfg.NearbyMaxTTL.Seconds())
+	}
+	if body.CallbackURL != "" {
+		u, err := url.Parse(body.CallbackURL)
+		v.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "callback_url", "must be an http or https URL")
+	}
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+
+	ttl := cfg.NearbyMaxTTL
+	if body.TTL != 0 {
+		ttl = time.Duration(body.TTL) * time.Second
+	}
+	// The user is the owner of the API key, without authentication we use a placeholder.
+	userID := "anonymous"
+	if p := auth.FromContext(r.Context()); p != nil {
+		userID = p.Subject
+	}
+
+	s, err := nearby.Subscribe(userID, geo.Point{Lat: body.Lat, Lng: body.Lng}, body.Radius, ttl, body.CallbackURL)
+	if err != nil {
+		httputil.StorageError(w, r, "could not subscribe", err)
+		return
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		httputil.WriteError(w, httputil.CodeInternal, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(data)
+}
+
+// NearbyUnsubscribe removes a subscription of the rider, the path is /v2/nearby/subscribe/{id}.
+func NearbyUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	s, err := nearby.Get(id)
+	if err == nearby.ErrNotFound {
+		httputil.WriteError(w, httputil.CodeNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		httputil.StorageError(w, r, "could not unsubscribe", err)
+		return
+	}
+
+	// A rider can only remove its own subscriptions.
+	if !auth.CanActAs(r, s.UserID) {
+		httputil.WriteError(w, httputil.CodeForbidden, fmt.Sprintf("subscription %s does not belong to the user", id))
+		return
+	}
+
+	err = nearby.Unsubscribe(id)
+	if err != nil && err != nearby.ErrNotFound {
+		httputil.StorageError(w, r, "could not unsubscribe", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,58 @@
+package v2
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/douglasmakey/tracking/auth"
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/douglasmakey/tracking/idcodec"
+	"github.com/douglasmakey/tracking/trips"
+	"github.com/gorilla/mux"
+)
+
+// TripRoute returns the path driven during a trip as an encoded polyline with the time of each point, the path is /v2/trip/{id}/route.
+// It is used for the receipts and the disputes, e.g. {"trip_id": "...", "polyline": "_p~iF~ps|U", "timestamps": [...], "distance_km": 4.2}.
+func TripRoute(w http.ResponseWriter, r *http.Request) {
+	id, err := idcodec.Decode(idcodec.KindTrip, mux.Vars(r)["id"])
+	if err != nil {
+		httputil.WriteError(w, httputil.CodeNotFound, "trip not found")
+		return
+	}
+
+	t, err := trips.Get(id)
+	if err == trips.ErrNotFound {
+		httputil.WriteError(w, httputil.CodeNotFound, "trip not found")
+		return
+	}
+	if err != nil {
+		httputil.StorageError(w, r, "could not get trip", err)
+		return
+	}
+
+	// Only the riders and the driver of the trip can see its route.
+	allowed := auth.CanActAs(r, t.DriverID)
+	for _, rider := range t.Riders {
+		allowed = allowed || auth.CanActAs(r, rider.ID)
+	}
+	if !allowed {
+		httputil.WriteError(w, httputil.CodeForbidden, "trip does not belong to the user")
+		return
+	}
+
+	route, err := trips.GetRoute(id)
+	if err != nil {
+		httputil.StorageError(w, r, "could not get trip route", err)
+		return
+	}
+	route.TripID = mux.Vars(r)["id"]
+
+	data, err := json.Marshal(route)
+	if err != nil {
+		httputil.WriteError(w, httputil.CodeInternal, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -3,57 +3,300 @@ package v2
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"time"
 
+	"github.com/douglasmakey/tracking/auth"
+	"github.com/douglasmakey/tracking/calendar"
+	"github.com/douglasmakey/tracking/callbacks"
+	"github.com/douglasmakey/tracking/codec"
+	"github.com/douglasmakey/tracking/config"
+	"github.com/douglasmakey/tracking/drivers"
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/geofence"
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/douglasmakey/tracking/idcodec"
+	"github.com/douglasmakey/tracking/languages"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/matching"
+	"github.com/douglasmakey/tracking/pickups"
 	"github.com/douglasmakey/tracking/storages"
 	"github.com/douglasmakey/tracking/tasks"
+	"github.com/douglasmakey/tracking/tracing"
+	"github.com/douglasmakey/tracking/validation"
+	"github.com/go-redis/redis"
 )
 
+// ownerKey keeps the user ID of the request.
+func ownerKey(requestID string) string {
+	return fmt.Sprintf("request:%s:user", requestID)
+}
+
 func SearchV2(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	body := struct {
+		Lat, Lng float64
+		// Dropoff is the destination of the rider, the drivers going home are only offered the requests with a destination.
+		Dropoff *geo.Point `json:"dropoff"`
+		// Accessible requests need a wheelchair accessible vehicle.
+		Accessible bool `json:"wheelchair_accessible"`
+		// VehicleClass is the class of vehicle requested: economy, xl, moto or delivery, empty matches any driver.
+		VehicleClass string `json:"vehicle_class"`
+		// Strategy is the matching strategy, e.g. nearest, least_recently_matched, highest_rating or weighted.
+		Strategy string `json:"strategy"`
+		// Languages are the ISO 639-1 codes preferred by the rider for this request, empty uses the preferences of the rider.
+		Languages []string `json:"languages"`
+		// MaxDistance is the max distance in km of the driver, the drivers farther are never offered.
+		MaxDistance float64 `json:"max_distance_km"`
+		// CallbackURL receives a signed event when the request is matched, expires or is canceled.
+		CallbackURL string `json:"callback_url"`
+		// Timeout is the time in seconds that the request has to find a driver and RetryInterval the time between two searches,
+		// zero uses the configured ones.
+		Timeout       int `json:"timeout_seconds"`
+		RetryInterval int `json:"retry_interval_seconds"`
+		// PickupAt schedules the ride, the driver is chosen some minutes before the pickup. Empty is as soon as possible.
+		PickupAt *time.Time `json:"pickup_at"`
+		// MaxPositionAge is the max age in seconds of the last position of the driver, the drivers with older positions are not offered.
+		MaxPositionAge int `json:"max_position_age_seconds"`
+		// DeliveryWindow is the promised window of a delivery, only the drivers that can drop off before its end are offered.
+		DeliveryWindow *tasks.DeliveryWindow `json:"delivery_window"`
+	}{}
+
+	_, span := tracing.Start(r.Context(), "decode")
+	err := codec.Decode(r, &body)
+	tracing.End(span, err)
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+
+	cfg := config.Get()
+	var v validation.Validator
+	v.Latitude("lat", body.Lat)
+	v.Longitude("lng", body.Lng)
+	if body.Dropoff != nil {
+		v.Point("dropoff.", *body.Dropoff)
+	}
+	if body.Strategy != "" {
+		if _, err := matching.Get(body.Strategy); err != nil {
+			v.Add("strategy", err.Error())
+		}
+	}
+	if body.VehicleClass != "" {
+		v.Check(drivers.IsClass(body.VehicleClass), "vehicle_class", "must be economy, xl, moto or delivery")
+	}
+	for _, lang := range body.Languages {
+		v.Check(languages.Valid(lang), "languages", fmt.Sprintf("invalid language %q", lang))
+	}
+	v.NotNegative("max_distance_km", body.MaxDistance)
+	if body.CallbackURL != "" {
+		u, err := url.Parse(body.CallbackURL)
+		v.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "callback_url", "must be an http or https URL")
+	}
+	if body.Timeout != 0 {
+		v.Between("timeout_seconds", float64(body.Timeout), cfg.MinRequestTTL.Seconds(), cfg.MaxRequestTTL.Seconds())
+	}
+	if body.RetryInterval != 0 {
+		v.Between("retry_interval_seconds", float64(body.RetryInterval), cfg.MinSearchInterval.Seconds(), cfg.MaxSearchInterval.Seconds())
+	}
+	if body.MaxPositionAge != 0 {
+		v.Positive("max_position_age_seconds", float64(body.MaxPositionAge))
+	}
+	if body.PickupAt != nil {
+		ahead := time.Until(*body.PickupAt)
+		v.Check(ahead > 0 && ahead <= cfg.MaxScheduleAhead, "pickup_at", fmt.Sprintf("must be in the next %s", cfg.MaxScheduleAhead))
+	}
+	if body.DeliveryWindow != nil {
+		v.Check(body.VehicleClass == drivers.ClassDelivery, "delivery_window", "only the delivery requests have a window")
+		v.Check(body.Dropoff != nil, "dropoff", "is required with a delivery window")
+		v.Check(body.DeliveryWindow.To.After(time.Now()), "delivery_window.to", "must be in the future")
+		v.Check(!body.DeliveryWindow.From.After(body.DeliveryWindow.To), "delivery_window.from", "must not be after the end of the window")
+	}
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
 		return
 	}
+
+	// The rules of the zones of the picking point.
+	zones, err := geofence.Evaluate(geo.Point{Lat: body.Lat, Lng: body.Lng})
+	if err != nil {
+		httputil.StorageError(w, r, "could not create request", err)
+		return
+	}
+	if zones.BlockPickups {
+		httputil.WriteError(w, httputil.CodePickupBlocked, "pickups are not allowed in the zone")
+		return
+	}
+
+	// The accessible requests have more time to find a driver, there are fewer WAV drivers.
+	ttl := cfg.RequestTTL
+	if body.Accessible {
+		ttl = cfg.AccessibleRequestTTL
+	}
+	// The profile of the vehicle class replaces the defaults, e.g. the motos search closer and shorter.
+	var radii []float64
+	if body.VehicleClass != "" {
+		profile, err := tasks.GetClassProfile(body.VehicleClass)
+		switch err {
+		case nil:
+			ttl, radii = profile.TTL(), profile.SearchRadii
+		case tasks.ErrProfileNotFound:
+		default:
+			httputil.StorageError(w, r, "could not create request", err)
+			return
+		}
+	}
+	if body.Timeout != 0 {
+		ttl = time.Duration(body.Timeout) * time.Second
+	}
+	var interval time.Duration
+	if body.RetryInterval != 0 {
+		interval = time.Duration(body.RetryInterval) * time.Second
+	}
+
+	// The sandbox requests search the synthetic drivers with accelerated timers.
+	tenant, sandbox := storages.Sandbox(r.Context())
+	if sandbox && cfg.SandboxTimeScale > 1 {
+		scale := time.Duration(cfg.SandboxTimeScale)
+		ttl /= scale
+		if interval == 0 {
+			interval = cfg.SearchInterval
+		}
+		interval /= scale
+	}
+
+	// The scheduled rides search from the pre-dispatch until the TTL after the pickup time, the wait is not accelerated in the sandbox.
+	if body.PickupAt != nil {
+		ttl += time.Until(*body.PickupAt)
+	}
+
 	rClient := storages.GetRedisClient()
 	// We use Redis to keep a key unique for each request.
 	// With this key also we will know if the request is active or if the user canceled the request.
 	requestID, err := rClient.Incr("request_id").Result()
 	if err != nil {
+		httputil.StorageError(w, r, "could not create request", err)
 		return
 	}
 	key := strconv.Itoa(int(requestID))
+	if sandbox {
+		key = storages.SandboxNamespace(tenant) + key
+	}
+
+	// The user is the owner of the API key, without authentication we use a placeholder.
+	userID := fmt.Sprintf("requestor_%s", key)
+	if p := auth.FromContext(r.Context()); p != nil {
+		userID = p.Subject
+	}
 
 	// Set true value for the key and also the expiration time, this expiration time is the duration that has the request to find a driver.
-	rClient.Set(key, true, time.Minute*4)
-	body := struct {
-		Lat, Lng float64
-	}{}
+	// The key exists before the request is claimed, so a second search of the user sees this request as searching.
+	if err := rClient.Set(key, true, ttl).Err(); err != nil {
+		httputil.StorageError(w, r, "could not create request", err)
+		return
+	}
 
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		log.Printf("could not decode request: %v", err)
-		http.Error(w, "could not decode request", http.StatusInternalServerError)
+	// A user searches one driver at a time, the scheduled rides do not count.
+	if policy := cfg.DuplicateRequests; policy != tasks.DuplicatesAllow && body.PickupAt == nil {
+		active, err := tasks.ClaimActive(userID, key, ttl)
+		if err != nil {
+			rClient.Del(key)
+			httputil.StorageError(w, r, "could not create request", err)
+			return
+		}
+		if active != "" {
+			// The new request is not created, nobody else knows its key.
+			rClient.Del(key)
+			activeID := idcodec.Encode(idcodec.KindRequest, active)
+			if policy == tasks.DuplicatesExisting {
+				codec.Write(w, r, http.StatusOK, map[string]interface{}{"request_id": activeID, "existing": true})
+				return
+			}
+			httputil.WriteError(w, httputil.CodeActiveRequest, fmt.Sprintf("the user already has the active request %s", activeID))
+			return
+		}
+	}
+
+	if !sandbox {
+		if err := calendar.RecordDemand(geo.Point{Lat: body.Lat, Lng: body.Lng}); err != nil {
+			logging.FromContext(r.Context()).Warn("could not record demand", "error", err)
+		}
+	}
+
+	// Keep the owner of the request, only the owner can cancel it.
+	if err := rClient.Set(ownerKey(key), userID, ttl).Err(); err != nil {
+		httputil.StorageError(w, r, "could not create request", err)
 		return
 	}
+	if err := tasks.AddUserRequest(userID, key, ttl); err != nil {
+		httputil.StorageError(w, r, "could not create request", err)
+		return
+	}
+	if body.CallbackURL != "" {
+		// The expiration is seen by the workers after the TTL, the callback must outlive the request.
+		if err := callbacks.Register(key, body.CallbackURL, ttl+time.Hour); err != nil {
+			httputil.StorageError(w, r, "could not create request", err)
+			return
+		}
+	}
 
-	// We create a new task and launch with a goroutine.
-	rTask := tasks.NewRequestDriverTask(key, fmt.Sprintf("requestor_%s", key), body.Lat, body.Lng)
-	go rTask.Run()
+	prefs := body.Languages
+	if len(prefs) == 0 {
+		if prefs, err = languages.Rider(userID); err != nil {
+			httputil.StorageError(w, r, "could not create request", err)
+			return
+		}
+	}
 
-	// Return 200 and request_id
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf(`{"request_id": %s}`, key)))
+	// We create a new task and add it to the queue, the workers will run it.
+	rTask := tasks.NewRequestDriverTask(key, userID, body.Lat, body.Lng)
+	rTask.CorrelationID = logging.CorrelationID(r.Context())
+	rTask.Dropoff = body.Dropoff
+	rTask.Accessible = body.Accessible
+	rTask.Priority = zones.Priority
+	rTask.Surge = zones.Surge
+	rTask.RequiredTags = zones.RequiredTags
+	rTask.VehicleClass = body.VehicleClass
+	rTask.SearchRadii = radii
+	rTask.Strategy = body.Strategy
+	rTask.Languages = prefs
+	rTask.MaxDistance = body.MaxDistance
+	if body.PickupAt != nil {
+		rTask.PickupAt = *body.PickupAt
+	}
+	rTask.MaxPositionAge = time.Duration(body.MaxPositionAge) * time.Second
+	rTask.Window = body.DeliveryWindow
+	rTask.Interval = interval
+	rTask.Sandbox = sandbox
+	rTask.Tenant = auth.Tenant(r)
+	rTask.Trace = tracing.Inject(r.Context())
+	if err := tasks.Enqueue(rTask); err != nil {
+		httputil.StorageError(w, r, "could not create request", err)
+		return
+	}
+
+	// Return 200 and the public request_id
+	resp := map[string]interface{}{
+		"request_id":       idcodec.Encode(idcodec.KindRequest, key),
+		"radius_km":        rTask.Radius(),
+		"surge_multiplier": zones.Surge,
+		"zones":            zones.Zones,
+	}
+	// The nearest popular pickup point helps the rider and the driver to meet, the request is created without it.
+	suggestion, err := pickups.Suggest(geo.Point{Lat: body.Lat, Lng: body.Lng})
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("could not suggest pickup point", "error", err)
+	}
+	if suggestion != nil {
+		resp["suggested_pickup"] = suggestion
+	}
+	codec.Write(w, r, http.StatusOK, resp)
 
 }
 
 func CancelRequest(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
-	}
 	rClient := storages.GetRedisClient()
 
 	body := struct {
@@ -61,14 +304,50 @@ func CancelRequest(w http.ResponseWriter, r *http.Request) {
 	}{}
 
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		log.Printf("could not decode request: %v", err)
-		http.Error(w, "could not decode request", http.StatusInternalServerError)
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+
+	var v validation.Validator
+	v.Required("request_id", body.RequestID)
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+
+	requestID, err := idcodec.Decode(idcodec.KindRequest, body.RequestID)
+	if err != nil {
+		httputil.WriteError(w, httputil.CodeNotFound, "request not found")
+		return
+	}
+
+	owner, err := rClient.Get(ownerKey(requestID)).Result()
+	if err == redis.Nil {
+		httputil.WriteError(w, httputil.CodeNotFound, "request not found")
+		return
+	}
+	if err != nil {
+		httputil.StorageError(w, r, "could not cancel request", err)
+		return
+	}
+
+	// A rider can only cancel its own requests.
+	if !auth.CanActAs(r, owner) {
+		httputil.WriteError(w, httputil.CodeForbidden, "request does not belong to the user")
+		return
+	}
+
+	outcomes, err := tasks.Cancel(owner, requestID)
+	if err != nil {
+		httputil.StorageError(w, r, "could not cancel request", err)
 		return
 	}
 
-	rClient.Set(body.RequestID, false, time.Minute*1)
+	data, _ := json.Marshal(map[string]string{"request_id": body.RequestID, "outcome": outcomes[requestID]})
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	w.Write(data)
 	return
 
 }
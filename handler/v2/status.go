@@ -0,0 +1,67 @@
+package v2
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/douglasmakey/tracking/auth"
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/douglasmakey/tracking/idcodec"
+	"github.com/douglasmakey/tracking/tasks"
+	"github.com/gorilla/mux"
+)
+
+// RequestStatus returns the current state of a search request, the path is /v2/request/{id}.
+// The riders poll it to know the result of /v2/search, e.g. {"state": "matched", "driver_id": "..."}.
+func RequestStatus(w http.ResponseWriter, r *http.Request) {
+	requestID, err := idcodec.Decode(idcodec.KindRequest, mux.Vars(r)["id"])
+	if err != nil {
+		httputil.WriteError(w, httputil.CodeNotFound, "request not found")
+		return
+	}
+
+	s, err := tasks.GetStatus(requestID)
+	if err == tasks.ErrStatusNotFound {
+		httputil.WriteError(w, httputil.CodeNotFound, "request not found")
+		return
+	}
+	if err != nil {
+		httputil.StorageError(w, r, "could not get request status", err)
+		return
+	}
+
+	// A rider can only see its own requests.
+	if !auth.CanActAs(r, s.UserID) {
+		httputil.WriteError(w, httputil.CodeForbidden, "request does not belong to the user")
+		return
+	}
+
+	body := struct {
+		RequestID string    `json:"request_id"`
+		State     string    `json:"state"`
+		DriverID  string    `json:"driver_id,omitempty"`
+		Radius    float64   `json:"radius_km,omitempty"`
+		UpdatedAt time.Time `json:"updated_at"`
+		// PositionAge is the age in seconds of the last position of the driver when it was matched.
+		PositionAge *float64 `json:"position_age_seconds,omitempty"`
+	}{
+		RequestID: mux.Vars(r)["id"],
+		State:     s.State,
+		Radius:    s.Radius,
+		UpdatedAt: s.UpdatedAt,
+	}
+	if s.DriverID != "" {
+		body.DriverID = idcodec.Encode(idcodec.KindDriver, s.DriverID)
+		body.PositionAge = &s.PositionAge
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		httputil.WriteError(w, httputil.CodeInternal, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
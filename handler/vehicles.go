@@ -0,0 +1,190 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/douglasmakey/tracking/config"
+	"github.com/douglasmakey/tracking/drivers"
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/tasks"
+	"github.com/douglasmakey/tracking/validation"
+	"github.com/gorilla/mux"
+)
+
+// vehicle returns a vehicle, the path is /admin/vehicles/{id}.
+func vehicle(w http.ResponseWriter, r *http.Request) {
+	v, err := drivers.GetVehicle(mux.Vars(r)["id"])
+	if err == drivers.ErrVehicleNotFound {
+		httputil.WriteError(w, httputil.CodeNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		httputil.StorageError(w, r, "could not get vehicle", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+// saveVehicle creates or replaces a vehicle, e.g. {"vehicle_type": "van", "plate": "AB-1234", "capacity": 6, "classes": ["xl"],
+// "amenities": ["wav"], "insurance_expires": "2021-01-01T00:00:00Z", "inspection_expires": "2021-01-01T00:00:00Z"}.
+func saveVehicle(w http.ResponseWriter, r *http.Request) {
+	var v drivers.Vehicle
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+	v.ID = mux.Vars(r)["id"]
+
+	var val validation.Validator
+	val.Required("vehicle_type", v.Type)
+	val.Required("plate", v.Plate)
+	val.Positive("capacity", float64(v.Capacity))
+	val.Check(len(v.Classes) > 0, "classes", "must have at least one class")
+	for _, c := range v.Classes {
+		val.Check(drivers.IsClass(c), "classes", "must be economy, xl, moto or delivery")
+	}
+	if err := val.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+
+	if err := drivers.SaveVehicle(v); err != nil {
+		httputil.StorageError(w, r, "could not save vehicle", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+// driverVehicle returns the vehicle that the driver is driving, the path is /drivers/{id}/vehicle.
+func driverVehicle(w http.ResponseWriter, r *http.Request) {
+	vehicleID, err := drivers.ActiveVehicle(mux.Vars(r)["id"])
+	if err != nil {
+		httputil.StorageError(w, r, "could not get vehicle", err)
+		return
+	}
+	if vehicleID == "" {
+		httputil.WriteError(w, httputil.CodeNotFound, "the driver does not have a vehicle")
+		return
+	}
+	v, err := drivers.GetVehicle(vehicleID)
+	if err == drivers.ErrVehicleNotFound {
+		httputil.WriteError(w, httputil.CodeNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		httputil.StorageError(w, r, "could not get vehicle", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+// changeDriverVehicle switches the driver to another vehicle in the middle of the shift, e.g. {"vehicle_id": "42"}.
+// The vehicle must be compliant and the driver can not be on a trip, the change is written to the audit log.
+func changeDriverVehicle(w http.ResponseWriter, r *http.Request) {
+	driverID := mux.Vars(r)["id"]
+
+	body := struct {
+		VehicleID string `json:"vehicle_id"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+	var v validation.Validator
+	v.Required("vehicle_id", body.VehicleID)
+	if err := v.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+
+	change, err := drivers.ChangeVehicle(driverID, body.VehicleID)
+	switch {
+	case err == drivers.ErrVehicleNotFound:
+		httputil.WriteError(w, httputil.CodeNotFound, err.Error())
+		return
+	case errors.Is(err, drivers.ErrNotCompliant):
+		httputil.WriteError(w, httputil.CodeVehicleNotCompliant, err.Error())
+		return
+	case err == drivers.ErrOnTrip:
+		httputil.WriteError(w, httputil.CodeConflict, err.Error())
+		return
+	case err != nil:
+		httputil.StorageError(w, r, "could not change vehicle", err)
+		return
+	}
+
+	logging.FromContext(r.Context()).Info("vehicle changed", "audit", true, "driver_id", driverID, "from", change.From, "to", change.To)
+	writeJSON(w, http.StatusOK, change)
+}
+
+// driverVehicleChanges returns the vehicle changes of the driver, the path is /drivers/{id}/vehicle/changes.
+func driverVehicleChanges(w http.ResponseWriter, r *http.Request) {
+	changes, err := drivers.VehicleChanges(mux.Vars(r)["id"])
+	if err != nil {
+		httputil.StorageError(w, r, "could not get vehicle changes", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, changes)
+}
+
+// classProfiles returns the search profiles of the vehicle classes, the path is /admin/classes.
+func classProfiles(w http.ResponseWriter, r *http.Request) {
+	list, err := tasks.ClassProfiles()
+	if err != nil {
+		httputil.StorageError(w, r, "could not get class profiles", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// saveClassProfile replaces the search profile of a vehicle class for the new requests, e.g. {"search_radii": [1, 2], "timeout_seconds": 60}.
+// The path is /admin/classes/{class}.
+func saveClassProfile(w http.ResponseWriter, r *http.Request) {
+	var p tasks.ClassProfile
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		logging.FromContext(r.Context()).Warn("could not decode request", "error", err)
+		httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decode request")
+		return
+	}
+	p.Class = mux.Vars(r)["class"]
+
+	cfg := config.Get()
+	var val validation.Validator
+	val.Check(drivers.IsClass(p.Class), "class", "must be economy, xl, moto or delivery")
+	val.Check(len(p.SearchRadii) > 0, "search_radii", "must have at least one radius")
+	for i, radius := range p.SearchRadii {
+		val.Check(radius > 0 && (i == 0 || radius >= p.SearchRadii[i-1]), "search_radii", "must be positive and not decreasing")
+	}
+	val.Between("timeout_seconds", float64(p.Timeout), cfg.MinRequestTTL.Seconds(), cfg.MaxRequestTTL.Seconds())
+	if err := val.Err(); err != nil {
+		validation.Write(w, err)
+		return
+	}
+
+	if err := tasks.SaveClassProfile(p); err != nil {
+		httputil.StorageError(w, r, "could not save class profile", err)
+		return
+	}
+	p.Source = tasks.ProfileAdmin
+	writeJSON(w, http.StatusOK, p)
+}
+
+// deleteClassProfile removes the saved search profile of a vehicle class, it uses the configured profile again.
+// The path is /admin/classes/{class}.
+func deleteClassProfile(w http.ResponseWriter, r *http.Request) {
+	err := tasks.DeleteClassProfile(mux.Vars(r)["class"])
+	if errors.Is(err, tasks.ErrProfileNotFound) {
+		httputil.WriteError(w, httputil.CodeNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		httputil.StorageError(w, r, "could not delete class profile", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/douglasmakey/tracking/calendar"
+	"github.com/douglasmakey/tracking/capacity"
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/gorilla/mux"
+)
+
+// hintsCount is the number of best hours returned with the calendar.
+const hintsCount = 5
+
+// zoneCalendar returns the hourly supply and demand of a zone, the path is /zones/{id}/calendar.
+// The id of a zone is the geohash of 5 characters that contains it.
+func zoneCalendar(w http.ResponseWriter, r *http.Request) {
+	zone := mux.Vars(r)["id"]
+	slots, err := calendar.Get(zone, time.Now())
+	if err != nil {
+		httputil.StorageError(w, r, "could not get calendar", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"zone":  zone,
+		"weeks": calendar.Weeks,
+		"slots": slots,
+		"hints": calendar.Hints(slots, hintsCount),
+	})
+}
+
+// capacityReport returns the last capacity report, the expected match rate and wait of each zone if the demand of the last days
+// repeats with the current supply. The path is /admin/capacity.
+func capacityReport(w http.ResponseWriter, r *http.Request) {
+	report, ok, err := capacity.Get()
+	if err != nil {
+		httputil.StorageError(w, r, "could not get capacity report", err)
+		return
+	}
+	if !ok {
+		httputil.WriteError(w, httputil.CodeNotFound, "the capacity report was not generated yet")
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
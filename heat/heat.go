@@ -0,0 +1,198 @@
+// Package heat builds the anonymous datasets of trip density shared with the city partners.
+package heat
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/maintenance"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// The trip starts and ends are counted per hour in a hash by zone, the raw points are never stored.
+// Every hour the counters of the previous hour are turned into a dataset, the counts lower than K are suppressed.
+
+// These are the kinds of points that are counted.
+const (
+	KindStart = "start"
+	KindEnd   = "end"
+)
+
+// retention is the time that the hourly counters are kept, the datasets are generated from them.
+const retention = time.Hour * 48
+
+func hour(t time.Time) string {
+	return t.UTC().Format("2006010215")
+}
+
+func countsKey(kind string, t time.Time) string {
+	return fmt.Sprintf("heat:%s:%s", kind, hour(t))
+}
+
+func datasetKey(t time.Time) string {
+	return fmt.Sprintf("heat:dataset:%s", hour(t))
+}
+
+// Cell is the number of trips that started and ended in a zone during an hour.
+type Cell struct {
+	Zone   string    `json:"zone"`
+	Hour   time.Time `json:"hour"`
+	Starts int64     `json:"starts"`
+	Ends   int64     `json:"ends"`
+}
+
+// Record counts a trip start or end in the zone of p for the current hour.
+func Record(kind string, p geo.Point) error {
+	key := countsKey(kind, time.Now())
+	rClient := storages.GetRedisClient()
+	_, err := rClient.Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.HIncrBy(key, geo.Zone(p), 1)
+		pipe.Expire(key, retention)
+		return nil
+	})
+	return storages.Classify(err)
+}
+
+// Anonymize returns the cells with the counts lower than k set to zero, the cells without counts are removed.
+// Every published count belongs at least to k trips, so no trip can be singled out.
+func Anonymize(cells []Cell, k int64) []Cell {
+	anonymous := make([]Cell, 0, len(cells))
+	for _, c := range cells {
+		if c.Starts < k {
+			c.Starts = 0
+		}
+		if c.Ends < k {
+			c.Ends = 0
+		}
+		if c.Starts > 0 || c.Ends > 0 {
+			anonymous = append(anonymous, c)
+		}
+	}
+	return anonymous
+}
+
+// Generate builds the anonymous dataset of the hour of t from the counters.
+func Generate(t time.Time, k int64) ([]Cell, error) {
+	t = t.UTC().Truncate(time.Hour)
+	rClient := storages.GetRedisClient()
+	var starts, ends map[string]string
+	err := storages.WithRetry(func() (err error) {
+		if starts, err = rClient.HGetAll(countsKey(KindStart, t)).Result(); err != nil {
+			return err
+		}
+		ends, err = rClient.HGetAll(countsKey(KindEnd, t)).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	byZone := make(map[string]*Cell)
+	cell := func(zone string) *Cell {
+		if byZone[zone] == nil {
+			byZone[zone] = &Cell{Zone: zone, Hour: t}
+		}
+		return byZone[zone]
+	}
+	for zone, v := range starts {
+		cell(zone).Starts, _ = strconv.ParseInt(v, 10, 64)
+	}
+	for zone, v := range ends {
+		cell(zone).Ends, _ = strconv.ParseInt(v, 10, 64)
+	}
+
+	cells := make([]Cell, 0, len(byZone))
+	for _, c := range byZone {
+		cells = append(cells, *c)
+	}
+	sort.Slice(cells, func(i, j int) bool { return cells[i].Zone < cells[j].Zone })
+	return Anonymize(cells, k), nil
+}
+
+// Datasets returns the cells of the generated datasets of the hours in [from, to].
+func Datasets(from, to time.Time) ([]Cell, error) {
+	var keys []string
+	for t := from.UTC().Truncate(time.Hour); !t.After(to); t = t.Add(time.Hour) {
+		keys = append(keys, datasetKey(t))
+	}
+	if len(keys) == 0 {
+		return []Cell{}, nil
+	}
+
+	rClient := storages.GetRedisClient()
+	var values []interface{}
+	err := storages.WithRetry(func() (err error) {
+		values, err = rClient.MGet(keys...).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cells := []Cell{}
+	for _, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			// The hour was not generated.
+			continue
+		}
+		var hourCells []Cell
+		if err := json.Unmarshal([]byte(data), &hourCells); err != nil {
+			return nil, err
+		}
+		cells = append(cells, hourCells...)
+	}
+	return cells, nil
+}
+
+// Exporter generates the dataset of each hour once it has finished, the datasets are kept for Retention.
+type Exporter struct {
+	// K is the min number of trips of a published count.
+	K         int64
+	Retention time.Duration
+}
+
+// Start launches the exporter in a goroutine.
+func (e Exporter) Start() {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			// The exporter is paused during maintenance, the hour is exported on the next tick after it.
+			if maintenance.Paused() {
+				continue
+			}
+			e.run(now.Add(-time.Hour))
+		}
+	}()
+}
+
+func (e Exporter) run(t time.Time) {
+	rClient := storages.GetRedisClient()
+	exists, err := rClient.Exists(datasetKey(t)).Result()
+	if err != nil || exists == 1 {
+		return
+	}
+
+	cells, err := Generate(t, e.K)
+	if err != nil {
+		logging.Logger.Error("could not generate heat dataset", "hour", hour(t), "error", err)
+		return
+	}
+	data, err := json.Marshal(cells)
+	if err != nil {
+		logging.Logger.Error("could not encode heat dataset", "error", err)
+		return
+	}
+	// Every instance runs the exporter, only the first one saves the dataset.
+	if err := rClient.SetNX(datasetKey(t), data, e.Retention).Err(); err != nil {
+		logging.Logger.Error("could not save heat dataset", "hour", hour(t), "error", err)
+	}
+}
@@ -0,0 +1,26 @@
+package heat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAnonymize(t *testing.T) {
+	h := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	cells := []Cell{
+		{Zone: "a", Hour: h, Starts: 12, Ends: 3},
+		{Zone: "b", Hour: h, Starts: 2, Ends: 1},
+		{Zone: "c", Hour: h, Starts: 10, Ends: 10},
+	}
+
+	got := Anonymize(cells, 10)
+	if len(got) != 2 {
+		t.Fatalf("expected 2 cells, got %d", len(got))
+	}
+	if got[0].Zone != "a" || got[0].Starts != 12 || got[0].Ends != 0 {
+		t.Errorf("unexpected cell %+v", got[0])
+	}
+	if got[1].Zone != "c" || got[1].Starts != 10 || got[1].Ends != 10 {
+		t.Errorf("unexpected cell %+v", got[1])
+	}
+}
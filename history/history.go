@@ -0,0 +1,130 @@
+package history
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// maxPointsPerDriver is the approximate number of points kept in each driver stream, older points are trimmed by Redis.
+const maxPointsPerDriver = 10000
+
+// Point is a driver location at a given time.
+type Point struct {
+	Lat       float64   `json:"lat"`
+	Lng       float64   `json:"lng"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// streamKey returns the name of the Redis Stream that keeps the history of a driver.
+func streamKey(driverID string) string {
+	return fmt.Sprintf("history:%s", driverID)
+}
+
+// Record appends a location to the driver history.
+// We use Redis Streams, Redis assigns to each entry an ID that starts with the time in milliseconds when it was added,
+// so the stream can be queried by time range without an extra index.
+func Record(driverID string, lat, lng float64) error {
+	return RecordBatch(driverID, []Point{{Lat: lat, Lng: lng}})
+}
+
+// RecordBatch appends the locations to the driver history in one round trip.
+// The points buffered by the devices keep their own timestamp, but the time range of the queries is the time when they were received.
+func RecordBatch(driverID string, points []Point) error {
+	rClient := storages.GetRedisClient()
+	_, err := rClient.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, p := range points {
+			values := map[string]interface{}{
+				"lat": p.Lat,
+				"lng": p.Lng,
+			}
+			if !p.Timestamp.IsZero() {
+				values["ts"] = p.Timestamp.UnixNano() / int64(time.Millisecond)
+			}
+			pipe.XAdd(&redis.XAddArgs{
+				Stream:       streamKey(driverID),
+				MaxLenApprox: maxPointsPerDriver,
+				Values:       values,
+			})
+		}
+		return nil
+	})
+	return storages.Classify(err)
+}
+
+// Range returns the driver locations between from and to, both inclusive.
+// A zero time means that side of the range is open.
+func Range(driverID string, from, to time.Time) ([]Point, error) {
+	start, end := "-", "+"
+	if !from.IsZero() {
+		start = strconv.FormatInt(from.UnixNano()/int64(time.Millisecond), 10)
+	}
+	if !to.IsZero() {
+		end = strconv.FormatInt(to.UnixNano()/int64(time.Millisecond), 10)
+	}
+
+	rClient := storages.GetRedisClient()
+	var msgs []redis.XMessage
+	err := storages.WithRetry(func() (err error) {
+		msgs, err = rClient.XRange(streamKey(driverID), start, end).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	points := make([]Point, 0, len(msgs))
+	for _, msg := range msgs {
+		p, err := ParsePoint(msg)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+
+	return points, nil
+}
+
+// Last returns the last location of the driver, ok is false when it does not have any.
+func Last(driverID string) (p Point, ok bool, err error) {
+	rClient := storages.GetRedisClient()
+	var msgs []redis.XMessage
+	err = storages.WithRetry(func() (err error) {
+		msgs, err = rClient.XRevRangeN(streamKey(driverID), "+", "-", 1).Result()
+		return err
+	})
+	if err != nil || len(msgs) == 0 {
+		return Point{}, false, err
+	}
+	p, err = ParsePoint(msgs[0])
+	return p, err == nil, err
+}
+
+// ParsePoint converts a stream entry in a Point, the timestamp is the one sent by the device or the time of the entry ID.
+// The routes of the trips use the same entries.
+func ParsePoint(msg redis.XMessage) (Point, error) {
+	var p Point
+	var ms int64
+	if _, err := fmt.Sscanf(msg.ID, "%d-", &ms); err != nil {
+		return p, fmt.Errorf("invalid entry id %q: %v", msg.ID, err)
+	}
+	if ts, ok := msg.Values["ts"]; ok {
+		ms, _ = strconv.ParseInt(fmt.Sprint(ts), 10, 64)
+	}
+	p.Timestamp = time.Unix(0, ms*int64(time.Millisecond)).UTC()
+
+	lat, err := strconv.ParseFloat(fmt.Sprint(msg.Values["lat"]), 64)
+	if err != nil {
+		return p, fmt.Errorf("invalid lat in entry %q: %v", msg.ID, err)
+	}
+	lng, err := strconv.ParseFloat(fmt.Sprint(msg.Values["lng"]), 64)
+	if err != nil {
+		return p, fmt.Errorf("invalid lng in entry %q: %v", msg.ID, err)
+	}
+	p.Lat, p.Lng = lat, lng
+
+	return p, nil
+}
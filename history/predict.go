@@ -0,0 +1,30 @@
+package history
+
+import (
+	"time"
+
+	"github.com/douglasmakey/tracking/geo"
+)
+
+// Predict returns the position of the driver at t extrapolated with the velocity between the last two points,
+// the points must be in time order. With one point it returns it, the driver is assumed to be stopped.
+func Predict(points []Point, t time.Time) geo.Point {
+	if len(points) == 0 {
+		return geo.Point{}
+	}
+	last := points[len(points)-1]
+	if len(points) == 1 {
+		return geo.Point{Lat: last.Lat, Lng: last.Lng}
+	}
+
+	prev := points[len(points)-2]
+	dt := last.Timestamp.Sub(prev.Timestamp).Seconds()
+	if dt <= 0 {
+		return geo.Point{Lat: last.Lat, Lng: last.Lng}
+	}
+	ahead := t.Sub(last.Timestamp).Seconds()
+	return geo.Point{
+		Lat: last.Lat + (last.Lat-prev.Lat)/dt*ahead,
+		Lng: last.Lng + (last.Lng-prev.Lng)/dt*ahead,
+	}
+}
@@ -0,0 +1,30 @@
+package history
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/douglasmakey/tracking/geo"
+)
+
+func TestPredict(t *testing.T) {
+	now := time.Now()
+	points := []Point{
+		{Lat: -33.40, Lng: -70.60, Timestamp: now.Add(-20 * time.Second)},
+		{Lat: -33.41, Lng: -70.60, Timestamp: now.Add(-10 * time.Second)},
+	}
+
+	// The driver moves 0.01 degrees south every 10 seconds.
+	p := Predict(points, now.Add(20*time.Second))
+	if math.Abs(p.Lat-(-33.44)) > 1e-9 || p.Lng != -70.60 {
+		t.Errorf("unexpected prediction %+v", p)
+	}
+
+	if p := Predict(points[:1], now); p != (geo.Point{Lat: -33.40, Lng: -70.60}) {
+		t.Errorf("expected the only point, got %+v", p)
+	}
+	if p := Predict(nil, now); p != (geo.Point{}) {
+		t.Errorf("expected zero point, got %+v", p)
+	}
+}
@@ -0,0 +1,119 @@
+// Package httputil writes the errors of the API with the same JSON envelope,
+// e.g. {"error": {"code": "not_found", "message": "request not found"}}.
+package httputil
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/storages"
+)
+
+// These are the codes of the errors, the clients must branch on the code and not on the message.
+const (
+	// CodeInvalidRequest is returned when the body can not be decoded.
+	CodeInvalidRequest = "invalid_request"
+	// CodePayloadTooLarge is returned when the body is larger than the max size of the requests.
+	CodePayloadTooLarge = "payload_too_large"
+	// CodeValidationFailed is returned when some fields are invalid, the envelope has the fields.
+	CodeValidationFailed = "validation_failed"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeConflict         = "conflict"
+	// CodeStaleDevice is returned for the locations of a device that is not the active one of the driver.
+	CodeStaleDevice = "stale_device"
+	// CodeRequestInProgress is returned while a request with the same Idempotency-Key is running.
+	CodeRequestInProgress = "request_in_progress"
+	// CodeIdempotencyKeyReused is returned when an Idempotency-Key is sent again with a different request.
+	CodeIdempotencyKeyReused = "idempotency_key_reused"
+	CodeRateLimited          = "rate_limited"
+	// CodeActiveRequest is returned when the user searches while another request of the user is searching.
+	CodeActiveRequest = "active_request"
+	// CodePickupBlocked is returned when the picking point is in a zone that does not allow pickups.
+	CodePickupBlocked = "pickup_blocked"
+	CodeInternal      = "internal"
+	// CodeUnavailable is returned when the storage is not available, the client can retry after Retry-After.
+	CodeUnavailable = "unavailable"
+	// CodeMaintenance is returned for the new requests during a maintenance window, Retry-After is the end of the window.
+	CodeMaintenance = "maintenance"
+	// CodeVehicleNotCompliant is returned when a driver switches to a vehicle with an expired insurance or inspection.
+	CodeVehicleNotCompliant = "vehicle_not_compliant"
+)
+
+// statuses is the catalog of the codes with their HTTP status.
+var statuses = map[string]int{
+	CodeInvalidRequest:       http.StatusBadRequest,
+	CodePayloadTooLarge:      http.StatusRequestEntityTooLarge,
+	CodeValidationFailed:     http.StatusBadRequest,
+	CodeUnauthorized:         http.StatusUnauthorized,
+	CodeForbidden:            http.StatusForbidden,
+	CodeNotFound:             http.StatusNotFound,
+	CodeMethodNotAllowed:     http.StatusMethodNotAllowed,
+	CodeConflict:             http.StatusConflict,
+	CodeStaleDevice:          http.StatusConflict,
+	CodeRequestInProgress:    http.StatusConflict,
+	CodeActiveRequest:        http.StatusConflict,
+	CodeIdempotencyKeyReused: http.StatusUnprocessableEntity,
+	CodeRateLimited:          http.StatusTooManyRequests,
+	CodePickupBlocked:        http.StatusUnprocessableEntity,
+	CodeVehicleNotCompliant:  http.StatusUnprocessableEntity,
+	CodeInternal:             http.StatusInternalServerError,
+	CodeUnavailable:          http.StatusServiceUnavailable,
+	CodeMaintenance:          http.StatusServiceUnavailable,
+}
+
+// Status returns the HTTP status of the code, the unknown codes are internal errors.
+func Status(code string) int {
+	if status, ok := statuses[code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// Code returns the generic code of an HTTP status, it is used when the status comes from another package.
+func Code(status int) string {
+	switch status {
+	case http.StatusServiceUnavailable:
+		return CodeUnavailable
+	case http.StatusBadRequest:
+		return CodeInvalidRequest
+	case http.StatusNotFound:
+		return CodeNotFound
+	}
+	return CodeInternal
+}
+
+// Error is the body of an error response.
+type Error struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Fields  interface{} `json:"fields,omitempty"`
+}
+
+// WriteError writes the error with the status of the code.
+func WriteError(w http.ResponseWriter, code, message string) {
+	Write(w, Error{Code: code, Message: message})
+}
+
+// Write writes the error, it is used when the error has fields.
+func Write(w http.ResponseWriter, e Error) {
+	data, _ := json.Marshal(map[string]Error{"error": e})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(Status(e.Code))
+	w.Write(data)
+}
+
+// StorageError logs the error and replies with 503 and Retry-After for transient storage errors and 500 for the others.
+func StorageError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	logging.FromContext(r.Context()).Error(msg, "error", err)
+	status := storages.HTTPStatus(err)
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", strconv.Itoa(int(storages.RetryAfter.Seconds())))
+	}
+	WriteError(w, Code(status), msg)
+}
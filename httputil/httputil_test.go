@@ -0,0 +1,56 @@
+package httputil
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/douglasmakey/tracking/storages"
+)
+
+func TestWriteError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	WriteError(rec, CodeNotFound, "request not found")
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+	var body struct {
+		Error Error `json:"error"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error.Code != CodeNotFound || body.Error.Message != "request not found" {
+		t.Errorf("unexpected error %+v", body.Error)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	for code := range statuses {
+		if Status(code) < 400 {
+			t.Errorf("%s has status %d", code, Status(code))
+		}
+	}
+	if Status("unknown") != http.StatusInternalServerError {
+		t.Error("the unknown codes must be internal errors")
+	}
+}
+
+func TestStorageError(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	rec := httptest.NewRecorder()
+	StorageError(rec, req, "could not get request", storages.ErrUnavailable)
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 503 with Retry-After, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	rec = httptest.NewRecorder()
+	StorageError(rec, req, "could not get request", errors.New("ERR syntax error"))
+	if rec.Code != http.StatusInternalServerError || rec.Header().Get("Retry-After") != "" {
+		t.Errorf("expected 500 without Retry-After, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
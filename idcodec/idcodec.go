@@ -0,0 +1,118 @@
+// Package idcodec converts the internal identifiers to the public ones exposed in the APIs and the share links,
+// with a secret they are encrypted so they can not be enumerated.
+package idcodec
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"sync"
+)
+
+// These are the kinds of identifiers, an identifier of a kind can not be decoded as another kind.
+const (
+	KindRequest = "request"
+	KindTrip    = "trip"
+	KindDriver  = "driver"
+)
+
+// ErrInvalid is returned when the public identifier can not be decoded.
+var ErrInvalid = errors.New("invalid identifier")
+
+// Codec encodes and decodes the identifiers.
+type Codec interface {
+	Encode(kind, id string) string
+	Decode(kind, public string) (string, error)
+}
+
+// Plain exposes the identifiers as they are, it is used when there is no secret.
+type Plain struct{}
+
+func (Plain) Encode(_, id string) string { return id }
+
+func (Plain) Decode(_, public string) (string, error) {
+	if public == "" {
+		return "", ErrInvalid
+	}
+	return public, nil
+}
+
+// Encrypted encrypts the identifiers with AES-GCM. The nonce is derived from the identifier,
+// so an identifier has always the same public form and the links keep working.
+type Encrypted struct {
+	aead     cipher.AEAD
+	nonceKey []byte
+}
+
+// NewEncrypted create and return a pointer to Encrypted with keys derived from the secret.
+func NewEncrypted(secret string) (*Encrypted, error) {
+	if secret == "" {
+		return nil, errors.New("empty secret")
+	}
+	key := sha256.Sum256([]byte("idcodec:key:" + secret))
+	nonceKey := sha256.Sum256([]byte("idcodec:nonce:" + secret))
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Encrypted{aead: aead, nonceKey: nonceKey[:]}, nil
+}
+
+func (e *Encrypted) Encode(kind, id string) string {
+	mac := hmac.New(sha256.New, e.nonceKey)
+	mac.Write([]byte(kind + ":" + id))
+	nonce := mac.Sum(nil)[:e.aead.NonceSize()]
+
+	// The kind is authenticated data, a trip ID can not be used as a request ID.
+	sealed := e.aead.Seal(nonce, nonce, []byte(id), []byte(kind))
+	return base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+func (e *Encrypted) Decode(kind, public string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(public)
+	if err != nil || len(data) < e.aead.NonceSize() {
+		return "", ErrInvalid
+	}
+	nonce, sealed := data[:e.aead.NonceSize()], data[e.aead.NonceSize():]
+	id, err := e.aead.Open(nil, nonce, sealed, []byte(kind))
+	if err != nil {
+		return "", ErrInvalid
+	}
+	return string(id), nil
+}
+
+var (
+	mu    sync.RWMutex
+	codec Codec = Plain{}
+)
+
+// SetCodec sets the codec used by Encode and Decode, by default the identifiers are not changed.
+func SetCodec(c Codec) {
+	mu.Lock()
+	codec = c
+	mu.Unlock()
+}
+
+// Encode returns the public form of the identifier.
+func Encode(kind, id string) string {
+	mu.RLock()
+	c := codec
+	mu.RUnlock()
+	return c.Encode(kind, id)
+}
+
+// Decode returns the internal identifier of the public one.
+func Decode(kind, public string) (string, error) {
+	mu.RLock()
+	c := codec
+	mu.RUnlock()
+	return c.Decode(kind, public)
+}
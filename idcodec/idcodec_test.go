@@ -0,0 +1,33 @@
+package idcodec
+
+import "testing"
+
+func TestEncrypted(t *testing.T) {
+	c, err := NewEncrypted("secret")
+	if err != nil {
+		t.Fatalf("could not create codec: %v", err)
+	}
+
+	public := c.Encode(KindRequest, "42")
+	if public == "42" {
+		t.Fatal("the identifier must be encrypted")
+	}
+	if again := c.Encode(KindRequest, "42"); again != public {
+		t.Errorf("the same identifier must have the same public form, got %s and %s", public, again)
+	}
+	if id, err := c.Decode(KindRequest, public); err != nil || id != "42" {
+		t.Errorf("unexpected decode %q %v", id, err)
+	}
+
+	// An identifier can not be decoded as another kind or with another secret.
+	if _, err := c.Decode(KindTrip, public); err != ErrInvalid {
+		t.Errorf("expected ErrInvalid for another kind, got %v", err)
+	}
+	other, _ := NewEncrypted("other")
+	if _, err := other.Decode(KindRequest, public); err != ErrInvalid {
+		t.Errorf("expected ErrInvalid for another secret, got %v", err)
+	}
+	if _, err := c.Decode(KindRequest, "43"); err != ErrInvalid {
+		t.Errorf("expected ErrInvalid for a plain identifier, got %v", err)
+	}
+}
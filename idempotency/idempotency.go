@@ -0,0 +1,161 @@
+// Package idempotency replays the response of a request sent again with the same Idempotency-Key header,
+// so the retries of the mobile apps do not create the same resource twice.
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/ratelimit"
+	"github.com/douglasmakey/tracking/storages"
+)
+
+// Header is the header with the key chosen by the client, e.g. a UUID generated for each action of the user.
+const Header = "Idempotency-Key"
+
+const (
+	// maxKeyLength is the max length of a key.
+	maxKeyLength = 255
+	// maxBody is the max size of the body that is read to compare the retries.
+	maxBody = 1 << 20
+	// lockTTL is the max time that a request holds its key, the retries during that time receive 409.
+	lockTTL = time.Minute
+)
+
+// entry is what is stored for a key, Pending is true while the first request is running.
+// Fingerprint is the hash of the body, a retry with the same key must send the same body.
+type entry struct {
+	Pending     bool   `json:"pending,omitempty"`
+	Fingerprint string `json:"fingerprint"`
+	Status      int    `json:"status,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+// recorder keeps the response written by the handler.
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// Middleware stores the response of the requests with an Idempotency-Key for ttl and replays it to the retries,
+// the keys are scoped by route and client. The 5xx and 429 responses are not stored so the client can retry them.
+// If Redis is not available the requests run without the check.
+func Middleware(route string, ttl time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(Header)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxKeyLength {
+			httputil.WriteError(w, httputil.CodeInvalidRequest, fmt.Sprintf("%s must have at most %d characters", Header, maxKeyLength))
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxBody))
+		if err != nil {
+			httputil.WriteError(w, httputil.CodeInvalidRequest, "could not read request")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		fingerprint := hex.EncodeToString(sum[:])
+
+		log := logging.FromContext(r.Context())
+		rKey := fmt.Sprintf("idempotency:%s:%s:%s", route, ratelimit.ClientKey(r), key)
+		rClient := storages.GetRedisClient()
+		pending, _ := json.Marshal(entry{Pending: true, Fingerprint: fingerprint})
+		ok, err := rClient.SetNX(rKey, pending, lockTTL).Result()
+		if err != nil {
+			log.Warn("could not check idempotency key", "route", route, "error", err)
+			next(w, r)
+			return
+		}
+		if !ok {
+			replay(w, r, rKey, fingerprint)
+			return
+		}
+
+		rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+
+		if rec.status >= http.StatusInternalServerError || rec.status == http.StatusTooManyRequests {
+			if err := rClient.Del(rKey).Err(); err != nil {
+				log.Warn("could not release idempotency key", "route", route, "error", err)
+			}
+			return
+		}
+		data, err := json.Marshal(entry{
+			Fingerprint: fingerprint,
+			Status:      rec.status,
+			ContentType: rec.Header().Get("Content-Type"),
+			Body:        rec.body.Bytes(),
+		})
+		if err != nil {
+			log.Warn("could not encode response", "error", err)
+			return
+		}
+		if err := rClient.Set(rKey, data, ttl).Err(); err != nil {
+			log.Warn("could not save idempotent response", "route", route, "error", err)
+		}
+	}
+}
+
+// replay writes the stored response of the key.
+func replay(w http.ResponseWriter, r *http.Request, rKey, fingerprint string) {
+	rClient := storages.GetRedisClient()
+	var data []byte
+	err := storages.WithRetry(func() (err error) {
+		data, err = rClient.Get(rKey).Bytes()
+		return err
+	})
+	if err != nil {
+		// The key expired between both commands or Redis is not available, the client can retry.
+		logging.FromContext(r.Context()).Warn("could not get idempotent response", "error", err)
+		w.Header().Set("Retry-After", "1")
+		httputil.WriteError(w, httputil.CodeUnavailable, "could not get the previous response")
+		return
+	}
+
+	var e entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		httputil.WriteError(w, httputil.CodeInternal, err.Error())
+		return
+	}
+	if e.Fingerprint != fingerprint {
+		httputil.WriteError(w, httputil.CodeIdempotencyKeyReused, fmt.Sprintf("%s was used with a different request", Header))
+		return
+	}
+	if e.Pending {
+		w.Header().Set("Retry-After", "1")
+		httputil.WriteError(w, httputil.CodeRequestInProgress, fmt.Sprintf("a request with the same %s is in progress", Header))
+		return
+	}
+
+	if e.ContentType != "" {
+		w.Header().Set("Content-Type", e.ContentType)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(e.Status)
+	w.Write(e.Body)
+}
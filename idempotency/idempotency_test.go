@@ -0,0 +1,45 @@
+package idempotency
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/douglasmakey/tracking/storages"
+)
+
+func TestMiddleware(t *testing.T) {
+	calls := 0
+	h := Middleware("/test", time.Minute, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"call": %d}`, calls)
+	})
+
+	key := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	defer storages.GetRedisClient().Del(fmt.Sprintf("idempotency:/test:ip:192.0.2.1:%s", key))
+	send := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/test", bytes.NewBufferString(body))
+		req.Header.Set(Header, key)
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+
+	first := send(`{"lat": 1}`)
+	second := send(`{"lat": 1}`)
+	if calls != 1 {
+		t.Fatalf("expected the handler to run once, it ran %d times", calls)
+	}
+	if second.Body.String() != first.Body.String() || second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("expected the replay of %q, got %q", first.Body.String(), second.Body.String())
+	}
+
+	if rec := send(`{"lat": 2}`); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for a different body, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,203 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/douglasmakey/tracking/bus"
+	"github.com/douglasmakey/tracking/calendar"
+	"github.com/douglasmakey/tracking/devices"
+	"github.com/douglasmakey/tracking/drivers"
+	"github.com/douglasmakey/tracking/fairness"
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/history"
+	"github.com/douglasmakey/tracking/idcodec"
+	"github.com/douglasmakey/tracking/live"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/metrics"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/douglasmakey/tracking/supply"
+	"github.com/douglasmakey/tracking/tasks"
+	"github.com/douglasmakey/tracking/trips"
+	"github.com/douglasmakey/tracking/validation"
+	"github.com/go-redis/redis"
+)
+
+// ErrStaleDevice is returned when the location comes from a device that is not the active one of the driver.
+var ErrStaleDevice = errors.New("stale device, another device of the driver is active")
+
+// Location is a location reported by a driver, it is the same for all the ingestion endpoints.
+type Location struct {
+	ID  string  `json:"id"`
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+	// DeviceID is optional, when it is sent only the locations of the active device of the driver are accepted.
+	DeviceID string `json:"device_id,omitempty"`
+	// Timestamp is optional, it is the time when the device took the location.
+	Timestamp time.Time `json:"timestamp,omitempty"`
+}
+
+// Validate checks that the location has a driver and valid coordinates, the error is a validation.Errors.
+func Validate(l Location) error {
+	var v validation.Validator
+	v.Required("id", l.ID)
+	v.Latitude("lat", l.Lat)
+	v.Longitude("lng", l.Lng)
+	return v.Err()
+}
+
+// Accept checks that the location comes from the active device of the driver.
+// With dryRun the active device of the driver is not changed.
+func Accept(l Location, dryRun bool) error {
+	if l.DeviceID == "" {
+		return nil
+	}
+
+	check := devices.Accept
+	if dryRun {
+		check = devices.Check
+	}
+	ok, err := check(l.ID, l.DeviceID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrStaleDevice
+	}
+	return nil
+}
+
+// Save stores the locations, the current position of each driver is the latest location and it is written in a single pipeline.
+// The side effects (history, trip routes, calendar) are best effort, they are logged but do not reject the locations.
+func Save(ctx context.Context, locations ...Location) error {
+	latest := latestByDriver(locations)
+
+	geoLocations := make([]*redis.GeoLocation, 0, len(latest))
+	for _, l := range latest {
+		geoLocations = append(geoLocations, &redis.GeoLocation{Longitude: l.Lng, Latitude: l.Lat, Name: l.ID})
+	}
+
+	// The reserved drivers are not put back in the search, their requests have them.
+	available, err := storages.ClientFor(ctx).WithoutReserved(geoLocations)
+	if err != nil {
+		return err
+	}
+
+	// Add new locations
+	// You can save locations in another db
+	if len(available) > 0 {
+		if err := storages.LocationsFor(ctx).AddDriverLocations(ctx, available); err != nil {
+			return err
+		}
+	}
+	// The sandbox drivers are not part of the supply, history or reports.
+	if storages.IsSandbox(ctx) {
+		return nil
+	}
+	metrics.LocationUpdates.Add(float64(len(locations)))
+
+	// The searches waiting in the areas of the drivers search again.
+	positions := make([]geo.Point, len(latest))
+	for i, l := range latest {
+		positions[i] = geo.Point{Lat: l.Lat, Lng: l.Lng}
+	}
+	supply.Record(positions...)
+
+	log := logging.FromContext(ctx)
+	// The live subscribers are best effort, the location is already saved.
+	updates := make([]live.Location, len(latest))
+	for i, l := range latest {
+		updates[i] = live.Location{DriverID: l.ID, Lat: l.Lat, Lng: l.Lng, Timestamp: l.Timestamp}
+		if l.Timestamp.IsZero() {
+			updates[i].Timestamp = time.Now().UTC()
+		}
+	}
+	if err := live.Publish(updates); err != nil {
+		log.Warn("could not publish locations", "error", err)
+	}
+
+	// The riders waiting for the drivers receive their distance to the pickup.
+	approaching := make(map[string]geo.Point, len(latest))
+	for i, l := range latest {
+		approaching[l.ID] = positions[i]
+	}
+	if err := tasks.Approach(ctx, approaching); err != nil {
+		log.Warn("could not update the approach of the drivers", "error", err)
+	}
+
+	if bus.Enabled() {
+		for _, u := range updates {
+			id := idcodec.Encode(idcodec.KindDriver, u.DriverID)
+			bus.Emit(bus.Event{Type: bus.LocationUpdated, Key: id, Occurred: u.Timestamp, Data: map[string]string{
+				"driver_id": id,
+				"lat":       strconv.FormatFloat(u.Lat, 'f', -1, 64),
+				"lng":       strconv.FormatFloat(u.Lng, 'f', -1, 64),
+			}})
+		}
+	}
+	for _, l := range latest {
+		if err := calendar.RecordSupply(l.ID, geo.Point{Lat: l.Lat, Lng: l.Lng}); err != nil {
+			log.Warn("could not record supply", "driver_id", l.ID, "error", err)
+		}
+		if err := fairness.RecordActive(l.ID, geo.Point{Lat: l.Lat, Lng: l.Lng}); err != nil {
+			log.Warn("could not record active driver", "driver_id", l.ID, "error", err)
+		}
+		// The offline drivers become available with their first location.
+		if _, err := drivers.SetPeriod(l.ID, drivers.PeriodAvailable, drivers.PeriodOffline); err != nil {
+			log.Warn("could not record period", "driver_id", l.ID, "error", err)
+		}
+	}
+
+	// Keep the locations in the driver history and in the route of its active trip.
+	points := make(map[string][]history.Point)
+	for _, l := range locations {
+		points[l.ID] = append(points[l.ID], history.Point{Lat: l.Lat, Lng: l.Lng, Timestamp: l.Timestamp})
+	}
+	for id, p := range points {
+		if err := history.RecordBatch(id, p); err != nil {
+			log.Warn("could not record history", "driver_id", id, "error", err)
+		}
+		if err := trips.RecordRoute(id, p); err != nil {
+			log.Warn("could not record trip route", "driver_id", id, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// DryRun is what Save would store for the locations.
+type DryRun struct {
+	// Positions are the current positions of the drivers that would be updated.
+	Positions []Location `json:"positions"`
+	// History is the number of points that would be added to the history of each driver.
+	History map[string]int `json:"history"`
+}
+
+// Preview returns what Save would store without persisting anything, the device integrators use it to verify their payloads.
+func Preview(locations ...Location) DryRun {
+	history := make(map[string]int)
+	for _, l := range locations {
+		history[l.ID]++
+	}
+	return DryRun{Positions: latestByDriver(locations), History: history}
+}
+
+// latestByDriver returns the newest location of each driver, the locations without timestamp are newer than the previous ones.
+func latestByDriver(locations []Location) []Location {
+	index := make(map[string]int)
+	latest := make([]Location, 0, len(locations))
+	for _, l := range locations {
+		i, ok := index[l.ID]
+		if !ok {
+			index[l.ID] = len(latest)
+			latest = append(latest, l)
+			continue
+		}
+		if l.Timestamp.IsZero() || !l.Timestamp.Before(latest[i].Timestamp) {
+			latest[i] = l
+		}
+	}
+	return latest
+}
@@ -0,0 +1,103 @@
+// Package languages keeps the languages spoken by the drivers and the languages preferred by the riders,
+// the matching prefers the drivers that share a language with the rider.
+package languages
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// driversKey is a hash with the languages of each driver separated by commas.
+const driversKey = "drivers:languages"
+
+// riderKey keeps the languages of the rider in order of preference separated by commas.
+func riderKey(userID string) string {
+	return fmt.Sprintf("user:%s:languages", userID)
+}
+
+// Valid returns true if code is an ISO 639-1 code, e.g. en or es.
+func Valid(code string) bool {
+	if len(code) != 2 {
+		return false
+	}
+	for _, c := range code {
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// SetDriver replaces the languages spoken by the driver, an empty list removes them.
+func SetDriver(driverID string, langs []string) error {
+	rClient := storages.GetRedisClient()
+	if len(langs) == 0 {
+		return storages.Classify(rClient.HDel(driversKey, driverID).Err())
+	}
+	return storages.Classify(rClient.HSet(driversKey, driverID, strings.Join(langs, ",")).Err())
+}
+
+// Drivers returns the languages spoken by the drivers, the drivers without languages are not in the map.
+func Drivers(ids []string) (map[string][]string, error) {
+	langs := make(map[string][]string, len(ids))
+	if len(ids) == 0 {
+		return langs, nil
+	}
+
+	rClient := storages.GetRedisClient()
+	var values []interface{}
+	err := storages.WithRetry(func() (err error) {
+		values, err = rClient.HMGet(driversKey, ids...).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range values {
+		if s, ok := v.(string); ok && s != "" {
+			langs[ids[i]] = strings.Split(s, ",")
+		}
+	}
+	return langs, nil
+}
+
+// SetRider replaces the languages preferred by the rider, the first one is the preferred one. An empty list removes them.
+func SetRider(userID string, langs []string) error {
+	rClient := storages.GetRedisClient()
+	if len(langs) == 0 {
+		return storages.Classify(rClient.Del(riderKey(userID)).Err())
+	}
+	return storages.Classify(rClient.Set(riderKey(userID), strings.Join(langs, ","), 0).Err())
+}
+
+// Rider returns the languages preferred by the rider, empty if it does not have preferences.
+func Rider(userID string) ([]string, error) {
+	rClient := storages.GetRedisClient()
+	var value string
+	err := storages.WithRetry(func() (err error) {
+		value, err = rClient.Get(riderKey(userID)).Result()
+		return err
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if value == "" {
+		return []string{}, nil
+	}
+	return strings.Split(value, ","), nil
+}
+
+// Shared returns the first language of the rider that the driver speaks, empty if they do not share one.
+func Shared(rider, driver []string) string {
+	for _, r := range rider {
+		for _, d := range driver {
+			if r == d {
+				return r
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,28 @@
+package languages
+
+import "testing"
+
+func TestShared(t *testing.T) {
+	tests := []struct {
+		rider, driver []string
+		want          string
+	}{
+		{[]string{"es", "en"}, []string{"en", "es"}, "es"},
+		{[]string{"fr", "en"}, []string{"en", "es"}, "en"},
+		{[]string{"fr"}, []string{"en"}, ""},
+		{nil, []string{"en"}, ""},
+	}
+	for _, tt := range tests {
+		if got := Shared(tt.rider, tt.driver); got != tt.want {
+			t.Errorf("Shared(%v, %v) = %q, want %q", tt.rider, tt.driver, got, tt.want)
+		}
+	}
+}
+
+func TestValid(t *testing.T) {
+	for code, want := range map[string]bool{"en": true, "es": true, "EN": false, "eng": false, "": false, "e1": false} {
+		if got := Valid(code); got != want {
+			t.Errorf("Valid(%q) = %t, want %t", code, got, want)
+		}
+	}
+}
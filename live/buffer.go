@@ -0,0 +1,200 @@
+package live
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/douglasmakey/tracking/metrics"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// ErrOverflow is returned to a subscriber that fell behind more updates than its resume log keeps, the newer updates were lost
+// and it must follow the driver again.
+var ErrOverflow = errors.New("subscriber fell too far behind")
+
+const (
+	// spillLimit is the max number of updates in the resume log of a subscriber.
+	spillLimit = 10000
+	// spillTTL is the time that the resume log of a subscriber is kept after its last update, it is removed when the subscriber leaves.
+	spillTTL = time.Hour
+)
+
+// spillKey is the Redis list of the updates of the subscriber that did not fit in its buffer, the oldest first.
+func spillKey(subscriberID string) string {
+	return fmt.Sprintf("live:spill:%s", subscriberID)
+}
+
+// resumeLog keeps the updates that do not fit in the buffers of the subscribers, it is replaced in the tests.
+type resumeLog interface {
+	// Push appends the update to the log and returns its length.
+	Push(key string, data []byte) (int64, error)
+	// Pop removes and returns up to n updates from the head of the log.
+	Pop(key string, n int) ([][]byte, error)
+	Delete(key string) error
+}
+
+// redisLog is the resume log in Redis lists.
+type redisLog struct{}
+
+func (redisLog) Push(key string, data []byte) (int64, error) {
+	var push *redis.IntCmd
+	_, err := storages.GetRedisClient().Pipelined(func(pipe redis.Pipeliner) error {
+		push = pipe.RPush(key, data)
+		pipe.Expire(key, spillTTL)
+		return nil
+	})
+	if err != nil {
+		return 0, storages.Classify(err)
+	}
+	return push.Val(), nil
+}
+
+func (redisLog) Pop(key string, n int) ([][]byte, error) {
+	var rng *redis.StringSliceCmd
+	_, err := storages.GetRedisClient().TxPipelined(func(pipe redis.Pipeliner) error {
+		rng = pipe.LRange(key, 0, int64(n-1))
+		pipe.LTrim(key, int64(n), -1)
+		return nil
+	})
+	if err != nil {
+		return nil, storages.Classify(err)
+	}
+	items := make([][]byte, len(rng.Val()))
+	for i, v := range rng.Val() {
+		items[i] = []byte(v)
+	}
+	return items, nil
+}
+
+func (redisLog) Delete(key string) error {
+	return storages.Classify(storages.GetRedisClient().Del(key).Err())
+}
+
+// Subscription receives the updates of a driver. The updates are kept in a bounded ring buffer, when it is full they spill
+// to the resume log of the subscription and they are read back in order once the buffer is drained, so a slow subscriber
+// neither grows the memory of the instance nor loses updates silently.
+type Subscription struct {
+	id    string
+	log   resumeLog
+	limit int
+	// ready is signaled when there are updates to read, it is closed when the subscription is canceled.
+	ready chan struct{}
+
+	mu         sync.Mutex
+	ring       []Location
+	head, size int
+	// spilled is the number of updates in the resume log, the new updates go to the log while it is not empty to keep the order.
+	spilled int
+	err     error
+	closed  bool
+}
+
+func newSubscription(id string, log resumeLog, buffer, limit int) *Subscription {
+	return &Subscription{id: id, log: log, limit: limit, ready: make(chan struct{}, 1), ring: make([]Location, buffer)}
+}
+
+// Ready returns the channel signaled when there are updates to read with Next, it is closed when the subscription is canceled.
+func (s *Subscription) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Next returns the oldest unread update, ok is false when there are none. The error is returned once the updates
+// kept before it are read, e.g. ErrOverflow.
+func (s *Subscription) Next() (l Location, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.size == 0 && s.spilled > 0 {
+		s.refill()
+	}
+	if s.size > 0 {
+		l = s.ring[s.head]
+		s.head = (s.head + 1) % len(s.ring)
+		s.size--
+		return l, true, nil
+	}
+	return Location{}, false, s.err
+}
+
+// push keeps the update in the buffer or in the resume log, an update that can not be kept fails the subscription.
+func (s *Subscription) push(l Location) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.err != nil {
+		return
+	}
+	if s.spilled == 0 && s.size < len(s.ring) {
+		s.ring[(s.head+s.size)%len(s.ring)] = l
+		s.size++
+	} else {
+		s.spill(l)
+	}
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Subscription) spill(l Location) {
+	data, err := json.Marshal(l)
+	if err != nil {
+		s.err = err
+		return
+	}
+	n, err := s.log.Push(spillKey(s.id), data)
+	if err != nil {
+		s.err = err
+		return
+	}
+	s.spilled = int(n)
+	if s.spilled > s.limit {
+		s.err = ErrOverflow
+		return
+	}
+	metrics.LiveSpilledUpdates.Inc()
+}
+
+// refill moves the oldest updates of the resume log to the empty buffer.
+func (s *Subscription) refill() {
+	items, err := s.log.Pop(spillKey(s.id), len(s.ring))
+	if err != nil {
+		s.err = err
+		return
+	}
+	if len(items) == 0 {
+		// The log expired, its updates are lost.
+		s.spilled = 0
+		s.err = ErrOverflow
+		return
+	}
+	s.spilled -= len(items)
+	if s.spilled < 0 {
+		s.spilled = 0
+	}
+	for _, data := range items {
+		var l Location
+		if err := json.Unmarshal(data, &l); err != nil {
+			continue
+		}
+		s.ring[(s.head+s.size)%len(s.ring)] = l
+		s.size++
+	}
+}
+
+// close stops the subscription and removes its resume log.
+func (s *Subscription) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.ready)
+	if s.spilled == 0 {
+		return nil
+	}
+	return s.log.Delete(spillKey(s.id))
+}
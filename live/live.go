@@ -0,0 +1,218 @@
+// Package live sends the location updates of the drivers to the WebSocket subscribers of any instance.
+// The updates are published in Redis channels sharded by driver, each instance only subscribes to the shards
+// of the drivers that its connections follow, so an instance does not receive every location of the fleet.
+package live
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// Location is a location update of a driver.
+type Location struct {
+	DriverID  string    `json:"driver_id"`
+	Lat       float64   `json:"lat"`
+	Lng       float64   `json:"lng"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// subscriberBuffer is the number of updates kept in memory for a slow subscriber, the newer updates spill to its resume log.
+const subscriberBuffer = 16
+
+var (
+	mu     sync.RWMutex
+	shards = 64
+)
+
+// SetShards sets the number of channels of the updates, every instance must use the same number.
+func SetShards(n int) {
+	mu.Lock()
+	shards = n
+	mu.Unlock()
+}
+
+func shardCount() int {
+	mu.RLock()
+	defer mu.RUnlock()
+	return shards
+}
+
+// Shard returns the shard of the driver.
+func Shard(driverID string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(driverID))
+	return int(h.Sum32() % uint32(n))
+}
+
+// channel is the Redis channel of the updates of the shard.
+func channel(shard int) string {
+	return fmt.Sprintf("locations:%d", shard)
+}
+
+// Publish sends the locations to the channels of their shards.
+func Publish(locations []Location) error {
+	if len(locations) == 0 {
+		return nil
+	}
+	n := shardCount()
+	rClient := storages.GetRedisClient()
+	_, err := rClient.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, l := range locations {
+			data, err := json.Marshal(l)
+			if err != nil {
+				return err
+			}
+			pipe.Publish(channel(Shard(l.DriverID, n)), data)
+		}
+		return nil
+	})
+	return storages.Classify(err)
+}
+
+// pubsub is the subscription of the hub to the channels, it is a *redis.PubSub.
+type pubsub interface {
+	Subscribe(channels ...string) error
+	Unsubscribe(channels ...string) error
+	Channel() <-chan *redis.Message
+}
+
+// Hub delivers the updates received by the instance to its subscribers, it subscribes to the channel of a shard
+// when the first driver of the shard is followed and unsubscribes when the last one is not followed anymore.
+type Hub struct {
+	shards int
+	sub    pubsub
+	log    resumeLog
+	// buffer is the size of the buffer of each subscriber and spillLimit the size of its resume log.
+	buffer     int
+	spillLimit int
+
+	mu          sync.Mutex
+	subscribers map[string]map[*Subscription]struct{}
+	// followed is the number of drivers with subscribers of each shard.
+	followed map[int]int
+}
+
+func newHub(sub pubsub, log resumeLog, shards int) *Hub {
+	h := &Hub{
+		shards:      shards,
+		sub:         sub,
+		log:         log,
+		buffer:      subscriberBuffer,
+		spillLimit:  spillLimit,
+		subscribers: make(map[string]map[*Subscription]struct{}),
+		followed:    make(map[int]int),
+	}
+	go h.dispatch()
+	return h
+}
+
+var (
+	hub     *Hub
+	hubOnce sync.Once
+)
+
+// GetHub returns the hub of the instance, it is created with the first subscriber.
+func GetHub() *Hub {
+	hubOnce.Do(func() {
+		hub = newHub(storages.GetRedisClient().Subscribe(), redisLog{}, shardCount())
+	})
+	return hub
+}
+
+// Subscribe follows the updates of the driver, cancel must be called when the subscriber leaves.
+func (h *Hub) Subscribe(driverID string) (*Subscription, func(), error) {
+	s := newSubscription(logging.NewID(), h.log, h.buffer, h.spillLimit)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	subs, ok := h.subscribers[driverID]
+	if !ok {
+		shard := Shard(driverID, h.shards)
+		if h.followed[shard] == 0 {
+			if err := h.sub.Subscribe(channel(shard)); err != nil {
+				return nil, nil, storages.Classify(err)
+			}
+		}
+		h.followed[shard]++
+		subs = make(map[*Subscription]struct{})
+		h.subscribers[driverID] = subs
+	}
+	subs[s] = struct{}{}
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() { h.unsubscribe(driverID, s) })
+	}
+	return s, cancel, nil
+}
+
+func (h *Hub) unsubscribe(driverID string, s *Subscription) {
+	if err := s.close(); err != nil {
+		logging.Logger.Warn("could not remove resume log", "driver_id", driverID, "error", err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	subs := h.subscribers[driverID]
+	delete(subs, s)
+	if len(subs) > 0 {
+		return
+	}
+
+	delete(h.subscribers, driverID)
+	shard := Shard(driverID, h.shards)
+	h.followed[shard]--
+	if h.followed[shard] > 0 {
+		return
+	}
+	delete(h.followed, shard)
+	if err := h.sub.Unsubscribe(channel(shard)); err != nil {
+		logging.Logger.Warn("could not unsubscribe from locations", "shard", shard, "error", err)
+	}
+}
+
+// Shards returns the shards that the instance is subscribed to.
+func (h *Hub) Shards() []int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	shards := make([]int, 0, len(h.followed))
+	for s := range h.followed {
+		shards = append(shards, s)
+	}
+	sort.Ints(shards)
+	return shards
+}
+
+// dispatch delivers the updates of the subscribed shards, the updates of the drivers without subscribers in the instance are ignored.
+func (h *Hub) dispatch() {
+	for msg := range h.sub.Channel() {
+		var l Location
+		if err := json.Unmarshal([]byte(msg.Payload), &l); err != nil {
+			logging.Logger.Warn("invalid location update", "channel", msg.Channel, "error", err)
+			continue
+		}
+		h.deliver(l)
+	}
+}
+
+// deliver pushes the update to the subscribers of the driver, the hub is not locked while the slow subscribers spill it.
+func (h *Hub) deliver(l Location) {
+	h.mu.Lock()
+	subs := make([]*Subscription, 0, len(h.subscribers[l.DriverID]))
+	for s := range h.subscribers[l.DriverID] {
+		subs = append(subs, s)
+	}
+	h.mu.Unlock()
+
+	for _, s := range subs {
+		s.push(l)
+	}
+}
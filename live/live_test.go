@@ -0,0 +1,180 @@
+package live
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/go-redis/redis"
+)
+
+type fakePubSub struct {
+	subscribed map[string]bool
+	messages   chan *redis.Message
+}
+
+func (f *fakePubSub) Subscribe(channels ...string) error {
+	for _, c := range channels {
+		f.subscribed[c] = true
+	}
+	return nil
+}
+
+func (f *fakePubSub) Unsubscribe(channels ...string) error {
+	for _, c := range channels {
+		delete(f.subscribed, c)
+	}
+	return nil
+}
+
+func (f *fakePubSub) Channel() <-chan *redis.Message {
+	return f.messages
+}
+
+func TestHubSubscriptions(t *testing.T) {
+	sub := &fakePubSub{subscribed: map[string]bool{}, messages: make(chan *redis.Message)}
+	defer close(sub.messages)
+	h := newHub(sub, newMemoryLog(), 1)
+
+	_, cancelA, err := h.Subscribe("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cancelB, _ := h.Subscribe("b")
+	if !sub.subscribed[channel(0)] || !reflect.DeepEqual(h.Shards(), []int{0}) {
+		t.Fatalf("expected the shard to be subscribed, got %v", sub.subscribed)
+	}
+
+	// The shard is kept while another driver of the shard is followed.
+	cancelA()
+	cancelA()
+	if !sub.subscribed[channel(0)] {
+		t.Fatal("expected the shard to be subscribed while b is followed")
+	}
+	cancelB()
+	if sub.subscribed[channel(0)] || len(h.Shards()) != 0 {
+		t.Errorf("expected the shard to be unsubscribed, got %v", sub.subscribed)
+	}
+}
+
+func TestHubDelivery(t *testing.T) {
+	sub := &fakePubSub{subscribed: map[string]bool{}, messages: make(chan *redis.Message)}
+	defer close(sub.messages)
+	h := newHub(sub, newMemoryLog(), 4)
+
+	s, cancel, _ := h.Subscribe("a")
+	defer cancel()
+	for _, id := range []string{"b", "a"} {
+		data, _ := json.Marshal(Location{DriverID: id, Lat: 1, Lng: 2})
+		sub.messages <- &redis.Message{Channel: channel(Shard(id, 4)), Payload: string(data)}
+	}
+
+	<-s.Ready()
+	l, ok, err := s.Next()
+	if !ok || err != nil || l.DriverID != "a" || l.Lat != 1 || l.Lng != 2 {
+		t.Errorf("unexpected update %+v %v %v", l, ok, err)
+	}
+	if l, ok, _ := s.Next(); ok {
+		t.Errorf("unexpected update of another driver %+v", l)
+	}
+}
+
+// memoryLog is a resume log in memory.
+type memoryLog struct {
+	lists map[string][][]byte
+}
+
+func newMemoryLog() *memoryLog {
+	return &memoryLog{lists: map[string][][]byte{}}
+}
+
+func (m *memoryLog) Push(key string, data []byte) (int64, error) {
+	m.lists[key] = append(m.lists[key], data)
+	return int64(len(m.lists[key])), nil
+}
+
+func (m *memoryLog) Pop(key string, n int) ([][]byte, error) {
+	items := m.lists[key]
+	if n > len(items) {
+		n = len(items)
+	}
+	m.lists[key] = items[n:]
+	if len(m.lists[key]) == 0 {
+		// Redis removes the empty lists.
+		delete(m.lists, key)
+	}
+	return items[:n], nil
+}
+
+func (m *memoryLog) Delete(key string) error {
+	delete(m.lists, key)
+	return nil
+}
+
+func TestSubscriptionSpill(t *testing.T) {
+	log := newMemoryLog()
+	s := newSubscription("s", log, 2, 100)
+	for i := 0; i < 5; i++ {
+		s.push(Location{DriverID: "a", Lat: float64(i)})
+	}
+	if len(log.lists[spillKey("s")]) != 3 {
+		t.Fatalf("expected 3 spilled updates, got %d", len(log.lists[spillKey("s")]))
+	}
+
+	// The updates are read in order, first the buffer and then the resume log.
+	for i := 0; i < 5; i++ {
+		if i == 3 {
+			// A new update waits behind the spilled ones.
+			s.push(Location{DriverID: "a", Lat: 5})
+		}
+		l, ok, err := s.Next()
+		if !ok || err != nil || l.Lat != float64(i) {
+			t.Fatalf("expected update %d, got %+v %v %v", i, l, ok, err)
+		}
+	}
+	if l, ok, _ := s.Next(); !ok || l.Lat != 5 {
+		t.Errorf("expected the last update, got %+v %v", l, ok)
+	}
+	if _, ok, err := s.Next(); ok || err != nil {
+		t.Errorf("expected no updates, got %v %v", ok, err)
+	}
+}
+
+func TestSubscriptionOverflow(t *testing.T) {
+	log := newMemoryLog()
+	s := newSubscription("s", log, 1, 2)
+	for i := 0; i < 5; i++ {
+		s.push(Location{DriverID: "a", Lat: float64(i)})
+	}
+
+	// The kept updates are read before the error.
+	var read int
+	for {
+		_, ok, err := s.Next()
+		if err != nil {
+			if err != ErrOverflow {
+				t.Fatalf("expected ErrOverflow, got %v", err)
+			}
+			break
+		}
+		if !ok {
+			t.Fatal("expected the overflow error")
+		}
+		read++
+	}
+	if read != 4 {
+		t.Errorf("expected 4 updates before the error, got %d", read)
+	}
+	if err := s.close(); err != nil || len(log.lists) != 0 {
+		t.Errorf("expected the resume log to be removed, got %v %v", log.lists, err)
+	}
+}
+
+func TestShard(t *testing.T) {
+	for _, id := range []string{"a", "driver-1", "42"} {
+		s := Shard(id, 8)
+		if s < 0 || s >= 8 || s != Shard(id, 8) {
+			t.Errorf("unexpected shard %d for %s", s, id)
+		}
+	}
+}
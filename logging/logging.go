@@ -0,0 +1,61 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// Header is the HTTP header that carries the correlation ID, if the client sends it we keep it.
+const Header = "X-Request-ID"
+
+type ctxKey struct{}
+
+// Logger is the structured logger of the service.
+var Logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+// NewID returns a random correlation ID.
+func NewID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// WithCorrelationID returns a copy of ctx that carries id.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+// CorrelationID returns the correlation ID of ctx or an empty string.
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKey{}).(string)
+	return id
+}
+
+// FromContext returns the logger with the correlation ID of ctx.
+func FromContext(ctx context.Context) *slog.Logger {
+	return With(CorrelationID(ctx))
+}
+
+// With returns the logger with the correlation ID, it is used where there is no context like in the tasks.
+func With(correlationID string) *slog.Logger {
+	if correlationID == "" {
+		return Logger
+	}
+	return Logger.With("correlation_id", correlationID)
+}
+
+// Middleware attaches a correlation ID to each request and returns it in the response header.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(Header)
+		if id == "" {
+			id = NewID()
+		}
+		w.Header().Set(Header, id)
+		next.ServeHTTP(w, r.WithContext(WithCorrelationID(r.Context(), id)))
+	})
+}
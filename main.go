@@ -1,25 +1,369 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
+	"github.com/douglasmakey/tracking/bus"
+	"github.com/douglasmakey/tracking/callbacks"
+	"github.com/douglasmakey/tracking/capacity"
+	"github.com/douglasmakey/tracking/commands"
+	"github.com/douglasmakey/tracking/config"
+	"github.com/douglasmakey/tracking/consistency"
+	"github.com/douglasmakey/tracking/drivers"
+	"github.com/douglasmakey/tracking/eta"
+	"github.com/douglasmakey/tracking/fairness"
+	"github.com/douglasmakey/tracking/features"
+	"github.com/douglasmakey/tracking/geofence"
 	"github.com/douglasmakey/tracking/handler"
+	"github.com/douglasmakey/tracking/heat"
+	"github.com/douglasmakey/tracking/idcodec"
+	"github.com/douglasmakey/tracking/live"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/maintenance"
+	"github.com/douglasmakey/tracking/matching"
+	"github.com/douglasmakey/tracking/nearby"
+	"github.com/douglasmakey/tracking/notify"
+	"github.com/douglasmakey/tracking/recovery"
+	"github.com/douglasmakey/tracking/retry"
+	"github.com/douglasmakey/tracking/statuspage"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/douglasmakey/tracking/storages/memory"
+	"github.com/douglasmakey/tracking/storages/postgis"
+	"github.com/douglasmakey/tracking/storages/tile38"
+	"github.com/douglasmakey/tracking/stream"
+	"github.com/douglasmakey/tracking/supply"
+	"github.com/douglasmakey/tracking/tasks"
+	"github.com/douglasmakey/tracking/telematics"
+	"github.com/douglasmakey/tracking/tracing"
+	"github.com/douglasmakey/tracking/trips"
+	"github.com/douglasmakey/tracking/workflow"
+	_ "github.com/lib/pq"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
+	cfg := config.Get()
+	// The standard logger also writes structured logs.
+	slog.SetDefault(logging.Logger)
+
+	// Connect to the Redis server, the Sentinels or the cluster.
+	redisOptions := storages.Options{
+		Addrs:      cfg.RedisAddrs,
+		MasterName: cfg.RedisMasterName,
+		Cluster:    cfg.RedisCluster,
+		Password:   cfg.RedisPassword,
+		DB:         cfg.RedisDB,
+
+		BreakerThreshold: cfg.RedisBreakerThreshold,
+		ReconnectMax:     cfg.RedisReconnectMax,
+
+		PoolSize:     cfg.RedisPoolSize,
+		MinIdleConns: cfg.RedisMinIdleConns,
+		DialTimeout:  cfg.RedisDialTimeout,
+		ReadTimeout:  cfg.RedisReadTimeout,
+		WriteTimeout: cfg.RedisWriteTimeout,
+		PoolTimeout:  cfg.RedisPoolTimeout,
+		IdleTimeout:  cfg.RedisIdleTimeout,
+		MaxRedirects: cfg.RedisMaxRedirects,
+	}
+	storages.Configure(redisOptions)
+	// One client, and so one pool of connections, is shared by the whole service.
+	rClient := storages.NewRedisClient(redisOptions)
+	storages.SetRedisClient(rClient)
+	// The service starts without Redis, the health check reports it unavailable until it answers.
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.RedisConnectTimeout)
+	if err := rClient.Connect(ctx); err != nil {
+		log.Printf("redis is not available yet: %v", err)
+	}
+	cancel()
+
+	// Shard the channels of the live locations.
+	if cfg.LiveShards > 0 {
+		live.SetShards(cfg.LiveShards)
+	}
+
+	// Boost the drivers that speak a language of the rider.
+	matching.SetLanguageBoost(cfg.LanguageBoost)
+	matching.SetWeights(cfg.MatchWeightDistance, cfg.MatchWeightRating, cfg.MatchWeightAcceptance)
+
+	// Export the match decisions as NDJSON if a file is configured.
+	if cfg.FeaturesFile != "" {
+		f, err := os.OpenFile(cfg.FeaturesFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatalf("could not open features file: %v", err)
+		}
+		defer f.Close()
+		features.SetSink(features.NewNDJSONSink(f))
+	}
+
+	// Export the traces to the OpenTelemetry collector.
+	shutdown, err := tracing.Init(context.Background(), cfg.OTLPEndpoint, cfg.OTLPInsecure)
+	if err != nil {
+		log.Fatalf("could not init tracing: %v", err)
+	}
+	defer shutdown(context.Background())
+
+	// Override the retry policies of the integrations.
+	for name, p := range cfg.RetryPolicies {
+		policy := retry.For(name)
+		policy.Attempts, policy.Initial, policy.Max = p.Attempts, p.Initial, p.Max
+		retry.Configure(name, policy)
+	}
+
+	// Estimate the ETA with the real routes if an OSRM server is configured.
+	if cfg.OSRMURL != "" {
+		eta.SetProvider(eta.NewOSRM(cfg.OSRMURL), cfg.AverageSpeed)
+	} else {
+		eta.SetProvider(eta.Haversine{Speed: cfg.AverageSpeed}, cfg.AverageSpeed)
+	}
+
+	// Split the search index of the drivers by region.
+	r, err := regionResolver(cfg)
+	if err != nil {
+		log.Fatalf("could not configure regions: %v", err)
+	}
+	storages.SetRegionResolver(r)
+
+	// Search the drivers in the process, Tile38 or PostGIS instead of Redis.
+	switch cfg.LocationStore {
+	case "redis":
+	case "memory":
+		storages.SetLocationStore(memory.New())
+	case "tile38":
+		storages.SetLocationStore(tile38.New(cfg.Tile38Addr))
+	case "postgis":
+		db, err := sql.Open("postgres", cfg.PostgresDSN)
+		if err != nil {
+			log.Fatalf("could not open postgres: %v", err)
+		}
+		if err := postgis.Migrate(context.Background(), db); err != nil {
+			log.Fatalf("could not migrate postgis: %v", err)
+		}
+		storages.SetLocationStore(postgis.New(db))
+	default:
+		log.Fatalf("unknown location store %q", cfg.LocationStore)
+	}
+	// Write the locations in batches, the buffer is flushed on shutdown.
+	var buffer *storages.Buffer
+	if cfg.LocationFlushInterval > 0 {
+		buffer = storages.NewBuffer(storages.Locations(), rClient, cfg.LocationFlushInterval, cfg.LocationFlushSize)
+		storages.SetLocationStore(buffer)
+	}
+
+	// Remove the drivers that stopped sending their location.
+	storages.StartJanitor(cfg.DriverTTL, cfg.JanitorInterval, drivers.MarkOffline)
+
+	// Follow the maintenance windows, they pause the background jobs below and the new requests.
+	maintenance.Watch(cfg.MaintenanceRefresh)
+
+	// Check that the search index agrees with the state of the drivers.
+	consistency.Checker{Interval: cfg.ConsistencyInterval, AutoRepair: cfg.ConsistencyRepair}.Start()
+
+	// Encrypt the public identifiers.
+	if cfg.IDSecret != "" {
+		c, err := idcodec.NewEncrypted(cfg.IDSecret)
+		if err != nil {
+			log.Fatalf("could not configure id codec: %v", err)
+		}
+		idcodec.SetCodec(c)
+	}
+
+	// Deliver the messages to the users through the configured channel.
+	n, err := notifier(cfg)
+	if err != nil {
+		log.Fatalf("could not configure notifier: %v", err)
+	}
+	notify.SetNotifier(n)
+
+	// Deliver the state transitions to the workflow engines of the tenants.
+	workflow.Start()
+
+	// Publish the events of the requests, the trips and the locations to the bus.
+	switch cfg.Bus {
+	case "kafka":
+		bus.SetPublisher(bus.NewKafka(cfg.KafkaBrokers, cfg.BusTopic))
+	case "nats":
+		p, err := bus.NewNATS(cfg.NATSURL, cfg.BusTopic)
+		if err != nil {
+			log.Fatalf("could not connect to nats: %v", err)
+		}
+		bus.SetPublisher(p)
+	case "redis":
+		bus.SetPublisher(bus.RedisStream{Client: rClient, Stream: cfg.BusTopic, MaxLen: int64(cfg.BusStreamMaxLen)})
+	case "":
+	default:
+		log.Fatalf("unknown bus %q", cfg.Bus)
+	}
+	bus.Start()
+
+	// Post the events of the requests to their callback URLs.
+	callbacks.NewDispatcher(cfg.CallbackSecret, cfg.CallbackAttempts).Start()
+
+	// Audit the fairness of the matches.
+	fairness.Auditor{
+		Interval:   cfg.FairnessInterval,
+		Window:     cfg.FairnessWindow,
+		Threshold:  cfg.FairnessThreshold,
+		AutoAdjust: cfg.FairnessAutoAdjust,
+		Step:       0.05,
+		MaxWeight:  0.6,
+	}.Start()
+
+	// Report the panics recovered in the handlers and the jobs.
+	if cfg.ErrorReportingDSN != "" {
+		reporter, err := recovery.NewSentry(cfg.ErrorReportingDSN)
+		if err != nil {
+			log.Fatalf("invalid error reporting dsn: %v", err)
+		}
+		recovery.SetReporter(reporter)
+	}
+
+	// Sign the URLs of the photos of the drivers with the object store of the operator.
+	if cfg.AssetSignerURL != "" {
+		drivers.SetSigner(drivers.NewHTTPSigner(cfg.AssetSignerURL, cfg.AssetURLTTL))
+	}
+
+	// Close the command channels of the drivers terminated through any instance.
+	commands.ListenKills()
+	// Send the commands of any instance to the drivers connected to this one.
+	commands.ListenCommands()
+
+	// Warn the drivers without permit that idle in the restricted zones.
+	geofence.Patrol{Interval: cfg.RestrictedZoneInterval, Grace: cfg.RestrictedZoneGrace}.Start()
+
+	// Search the drivers of the next legs of the relay trips before their handoffs.
+	trips.Relay{Interval: cfg.RelayInterval, Lead: cfg.RelayLead}.Start()
+
+	// Keep the outcomes of the requests for the status page.
+	statuspage.Snapshotter{Interval: cfg.StatusSnapshotInterval}.Start()
+
+	// Notify the riders subscribed to the drivers around a point.
+	nearby.Scanner{Interval: cfg.NearbyScanInterval, Limit: cfg.NearbyLimit}.Start()
+
+	// Plan the capacity of the zones with the demand of the last days.
+	capacity.Planner{
+		Interval: cfg.CapacityInterval,
+		Days:     cfg.CapacityDays,
+		Model:    capacity.Model{TripsPerHour: cfg.CapacityTripsPerHour, MaxWait: cfg.RequestTTL},
+	}.Start()
+
+	// Read the locations from Kafka too.
+	if len(cfg.KafkaBrokers) > 0 {
+		stream.NewConsumer(stream.Config{
+			Brokers:   cfg.KafkaBrokers,
+			Topic:     cfg.KafkaTopic,
+			GroupID:   cfg.KafkaGroup,
+			BatchSize: cfg.KafkaBatchSize,
+			BatchWait: cfg.KafkaBatchWait,
+		}).Start(context.Background())
+	}
+
+	// Read the locations of the GPS devices from MQTT too.
+	if cfg.MQTTBroker != "" {
+		l, err := telematics.NewListener(telematics.Config{
+			Broker:   cfg.MQTTBroker,
+			ClientID: cfg.MQTTClientID,
+			Username: cfg.MQTTUsername,
+			Password: cfg.MQTTPassword,
+			Topic:    cfg.MQTTTopic,
+			QoS:      byte(cfg.MQTTQoS),
+		})
+		if err != nil {
+			log.Fatalf("invalid mqtt topic: %v", err)
+		}
+		if err := l.Start(); err != nil {
+			log.Fatalf("could not connect to mqtt: %v", err)
+		}
+	}
+
+	// The searches that found nobody wait for the drivers that report in their area.
+	if cfg.MaxSkippedTicks > 0 {
+		supply.Start(cfg.SupplyPublishInterval)
+	}
+
+	// Generate the hourly heat datasets of the partners.
+	heat.Exporter{K: int64(cfg.HeatK), Retention: cfg.HeatRetention}.Start()
+
+	// Launch the workers that search drivers for the requests.
+	tasks.StartWorkers(cfg.SearchWorkers, cfg.SearchInterval)
+
 	// We create a simple httpserver
 	server := http.Server{
-		Addr:    ":8000",
+		Addr:    cfg.Addr,
 		Handler: handler.NewHandler(),
 	}
 
+	// Stop the server on SIGINT or SIGTERM, the requests in progress finish before the buffered locations are flushed.
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("could not shut down the server: %v", err)
+		}
+		close(stopped)
+	}()
+
 	// Run server
 	log.Printf("Starting HTTP Server. Listening at %q", server.Addr)
-	if err := server.ListenAndServe(); err != nil {
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
 		log.Printf("%v", err)
 	} else {
+		<-stopped
 		log.Println("Server closed ! ")
 	}
+	if buffer != nil {
+		buffer.Close()
+	}
 
 }
+
+// notifier returns the notifier configured, the channels with external services are retried.
+func notifier(cfg *config.Config) (notify.Notifier, error) {
+	var n notify.Notifier
+	switch cfg.Notifier {
+	case "", "log":
+		return notify.Log{}, nil
+	case "webhook":
+		n = notify.NewWebhook(cfg.NotifyWebhookURL)
+	case "firebase":
+		n = notify.NewFirebase(cfg.FirebaseServerKey)
+	case "twilio":
+		n = notify.NewTwilio(cfg.TwilioAccountSID, cfg.TwilioAuthToken, cfg.TwilioFrom)
+	default:
+		return nil, fmt.Errorf("unknown notifier %q", cfg.Notifier)
+	}
+	// NOTIFY_ATTEMPTS is kept for the deployments that do not use RETRY_POLICIES.
+	policy := retry.For(retry.Notify)
+	if _, ok := cfg.RetryPolicies[retry.Notify]; !ok {
+		policy.Attempts = cfg.NotifyAttempts
+	}
+	return notify.Retrying{Notifier: n, Policy: policy}, nil
+}
+
+// regionResolver returns the resolver of the regions of the drivers configured.
+func regionResolver(cfg *config.Config) (storages.RegionResolver, error) {
+	switch cfg.RegionResolver {
+	case "":
+		return storages.SingleRegion{}, nil
+	case "geohash":
+		if cfg.RegionPrecision < 1 || cfg.RegionPrecision > 12 {
+			return nil, fmt.Errorf("invalid region precision %d", cfg.RegionPrecision)
+		}
+		return storages.GeohashRegions{Precision: cfg.RegionPrecision}, nil
+	case "cities":
+		return storages.LoadCities(cfg.RegionCitiesFile)
+	default:
+		return nil, fmt.Errorf("unknown region resolver %q", cfg.RegionResolver)
+	}
+}
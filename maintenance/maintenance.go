@@ -0,0 +1,144 @@
+// Package maintenance keeps the maintenance window of the service. During the window the new ride requests are rejected
+// and the non-essential background jobs are paused, the searches and trips in progress complete as usual.
+// The window is saved in Redis with an expiration at its end, so every instance sees it and it ends by itself.
+package maintenance
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// windowKey keeps the current window as JSON, it expires at the end of the window.
+const windowKey = "maintenance"
+
+// ErrEnded is returned when the end of a window is not in the future.
+var ErrEnded = errors.New("the end of the window must be in the future")
+
+// Window is a maintenance window.
+type Window struct {
+	Reason  string    `json:"reason,omitempty"`
+	Started time.Time `json:"started_at"`
+	Until   time.Time `json:"until"`
+}
+
+// Start begins the window now, it replaces the current one.
+func Start(reason string, until time.Time) (Window, error) {
+	now := time.Now().UTC()
+	if !until.After(now) {
+		return Window{}, ErrEnded
+	}
+	w := Window{Reason: reason, Started: now, Until: until.UTC()}
+	data, err := json.Marshal(w)
+	if err != nil {
+		return Window{}, err
+	}
+	if err := storages.Classify(storages.GetRedisClient().Set(windowKey, data, until.Sub(now)).Err()); err != nil {
+		return Window{}, err
+	}
+	set(w, true)
+	return w, nil
+}
+
+// End finishes the current window before its end.
+func End() error {
+	if err := storages.Classify(storages.GetRedisClient().Del(windowKey).Err()); err != nil {
+		return err
+	}
+	set(Window{}, false)
+	return nil
+}
+
+// Get reads the current window from Redis, false if the service is not in maintenance.
+func Get() (Window, bool, error) {
+	var data string
+	err := storages.WithRetry(func() (err error) {
+		data, err = storages.GetRedisClient().Get(windowKey).Result()
+		return err
+	})
+	if err == redis.Nil {
+		return Window{}, false, nil
+	}
+	if err != nil {
+		return Window{}, false, err
+	}
+	var w Window
+	if err := json.Unmarshal([]byte(data), &w); err != nil {
+		return Window{}, false, fmt.Errorf("invalid maintenance window: %w", err)
+	}
+	return w, true, nil
+}
+
+var (
+	mu      sync.RWMutex
+	current Window
+	active  bool
+)
+
+func set(w Window, ok bool) {
+	mu.Lock()
+	current, active = w, ok
+	mu.Unlock()
+}
+
+// Active returns the window of the instance, it is refreshed by Watch and ends by itself at the end of the window.
+func Active() (Window, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	if !active || !time.Now().Before(current.Until) {
+		return Window{}, false
+	}
+	return current, true
+}
+
+// Paused returns true while the non-essential background jobs must not run.
+func Paused() bool {
+	_, ok := Active()
+	return ok
+}
+
+// Watch refreshes the window of the instance every interval, so the windows started by other instances are seen.
+func Watch(interval time.Duration) {
+	refresh()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			refresh()
+		}
+	}()
+}
+
+func refresh() {
+	w, ok, err := Get()
+	if err != nil {
+		// The last known window is kept, it still ends at its end.
+		logging.Logger.Warn("could not refresh maintenance window", "error", err)
+		return
+	}
+	set(w, ok)
+}
+
+// Middleware rejects the requests during the window with 503 and Retry-After at the end of the window.
+func Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		window, ok := Active()
+		if !ok {
+			next(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(window.Until).Seconds()))))
+		httputil.WriteError(w, httputil.CodeMaintenance, "the service is in maintenance until "+window.Until.Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,36 @@
+package maintenance
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMiddleware(t *testing.T) {
+	defer set(Window{}, false)
+	next := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	h := Middleware(next)
+
+	rr := httptest.NewRecorder()
+	h(rr, httptest.NewRequest(http.MethodPost, "/search", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected the request to pass outside maintenance, got %d", rr.Code)
+	}
+
+	set(Window{Until: time.Now().Add(time.Minute)}, true)
+	if !Paused() {
+		t.Error("expected the jobs to be paused during maintenance")
+	}
+	rr = httptest.NewRecorder()
+	h(rr, httptest.NewRequest(http.MethodPost, "/search", nil))
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") != "60" {
+		t.Errorf("expected 503 with Retry-After 60, got %d %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+
+	// The window ends by itself even if it was not refreshed.
+	set(Window{Until: time.Now().Add(-time.Second)}, true)
+	if _, ok := Active(); ok {
+		t.Error("expected the window to end at its end")
+	}
+}
@@ -0,0 +1,103 @@
+package matching
+
+import "math"
+
+// Assign solves the assignment problem of the cost matrix with the Hungarian algorithm: cost[i][j] is the cost of giving
+// the driver j to the request i and the result has the driver of each request, -1 if it does not get one.
+// The pairs with an infinite cost are never assigned, the rest of the requests get a driver while there are drivers.
+func Assign(cost [][]float64) []int {
+	n := len(cost)
+	assigned := make([]int, n)
+	for i := range assigned {
+		assigned[i] = -1
+	}
+	if n == 0 || len(cost[0]) == 0 {
+		return assigned
+	}
+	m := len(cost[0])
+	// The algorithm needs at least as many columns as rows, with more requests than drivers the drivers choose.
+	if n > m {
+		transposed := make([][]float64, m)
+		for j := range transposed {
+			transposed[j] = make([]float64, n)
+			for i := range cost {
+				transposed[j][i] = cost[i][j]
+			}
+		}
+		for j, i := range Assign(transposed) {
+			if i >= 0 {
+				assigned[i] = j
+			}
+		}
+		return assigned
+	}
+
+	// The forbidden pairs cost more than any assignment of allowed pairs, so they are only used when a row has no other choice.
+	var max float64
+	for _, row := range cost {
+		for _, c := range row {
+			if !math.IsInf(c, 1) && c > max {
+				max = c
+			}
+		}
+	}
+	forbidden := (max + 1) * float64(n+1)
+	at := func(i, j int) float64 {
+		if math.IsInf(cost[i][j], 1) {
+			return forbidden
+		}
+		return cost[i][j]
+	}
+
+	// u and v are the potentials of the rows and the columns, p[j] is the row of the column j and way the path of the augmentation.
+	// The indexes start at 1, the column 0 is the free row being assigned.
+	u := make([]float64, n+1)
+	v := make([]float64, m+1)
+	p := make([]int, m+1)
+	way := make([]int, m+1)
+	for i := 1; i <= n; i++ {
+		p[0] = i
+		j0 := 0
+		minv := make([]float64, m+1)
+		used := make([]bool, m+1)
+		for j := range minv {
+			minv[j] = math.Inf(1)
+		}
+		for p[j0] != 0 {
+			used[j0] = true
+			i0, delta, j1 := p[j0], math.Inf(1), 0
+			for j := 1; j <= m; j++ {
+				if used[j] {
+					continue
+				}
+				if cur := at(i0-1, j-1) - u[i0] - v[j]; cur < minv[j] {
+					minv[j], way[j] = cur, j0
+				}
+				if minv[j] < delta {
+					delta, j1 = minv[j], j
+				}
+			}
+			for j := 0; j <= m; j++ {
+				if used[j] {
+					u[p[j]] += delta
+					v[j] -= delta
+				} else {
+					minv[j] -= delta
+				}
+			}
+			j0 = j1
+		}
+		for j0 != 0 {
+			j1 := way[j0]
+			p[j0] = p[j1]
+			j0 = j1
+		}
+	}
+
+	for j := 1; j <= m; j++ {
+		if i := p[j] - 1; i >= 0 && !math.IsInf(cost[i][j-1], 1) {
+			assigned[i] = j - 1
+		}
+	}
+	return assigned
+}
@@ -0,0 +1,53 @@
+package matching
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestAssign(t *testing.T) {
+	inf := math.Inf(1)
+	tests := []struct {
+		name string
+		cost [][]float64
+		want []int
+	}{
+		{
+			// The greedy matching gives the driver 0 to the request 0 and the far driver 1 to the request 1.
+			name: "better than greedy",
+			cost: [][]float64{{1, 2}, {2, 10}},
+			want: []int{1, 0},
+		},
+		{
+			name: "more drivers than requests",
+			cost: [][]float64{{5, 1, 3}, {1, 4, 6}},
+			want: []int{1, 0},
+		},
+		{
+			name: "more requests than drivers",
+			cost: [][]float64{{3}, {1}, {2}},
+			want: []int{-1, 0, -1},
+		},
+		{
+			name: "forbidden pairs",
+			cost: [][]float64{{1, inf}, {2, inf}},
+			want: []int{0, -1},
+		},
+		{
+			name: "only forbidden pairs",
+			cost: [][]float64{{inf}},
+			want: []int{-1},
+		},
+		{
+			name: "no drivers",
+			cost: [][]float64{{}},
+			want: []int{-1},
+		},
+	}
+	for _, tt := range tests {
+		if got := Assign(tt.cost); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
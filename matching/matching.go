@@ -0,0 +1,273 @@
+// Package matching chooses the driver of a request between the candidates found around the picking point.
+package matching
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/douglasmakey/tracking/drivers"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// These are the names of the strategies, the requests choose one of them by name.
+const (
+	StrategyNearest              = "nearest"
+	StrategyLeastRecentlyMatched = "least_recently_matched"
+	StrategyHighestRating        = "highest_rating"
+	StrategyWeighted             = "weighted"
+)
+
+// lastMatchKey is a sorted set with the unix time of the last match of each driver.
+const lastMatchKey = "drivers:lastmatch"
+
+// Candidate is a driver found around the picking point.
+// LastMatch, Rating and Acceptance are loaded by the strategies that need them, Language is the language shared with the rider, if any.
+// Score is set by the weighted strategy.
+type Candidate struct {
+	DriverID   string
+	Distance   float64
+	LastMatch  time.Time
+	Rating     float64
+	Acceptance float64
+	Language   string
+	Score      float64
+}
+
+// Strategy sorts the candidates from the best to the worst.
+type Strategy interface {
+	Rank(candidates []Candidate) error
+}
+
+var strategies = map[string]func() Strategy{
+	StrategyNearest:              func() Strategy { return NearestDriver{} },
+	StrategyLeastRecentlyMatched: func() Strategy { return LeastRecentlyMatched{} },
+	StrategyHighestRating:        func() Strategy { return HighestRating{} },
+	StrategyWeighted:             func() Strategy { return weights() },
+}
+
+// Get returns the strategy with the name, an empty name is the nearest driver.
+func Get(name string) (Strategy, error) {
+	if name == "" {
+		name = StrategyNearest
+	}
+	s, ok := strategies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown matching strategy %q", name)
+	}
+	return s(), nil
+}
+
+// RecordMatch keeps the time of the match of the driver, it is used by LeastRecentlyMatched.
+func RecordMatch(driverID string, t time.Time) error {
+	rClient := storages.GetRedisClient()
+	return storages.Classify(rClient.ZAdd(lastMatchKey, redis.Z{Score: float64(t.Unix()), Member: driverID}).Err())
+}
+
+// NearestDriver chooses the nearest candidate, it is the behavior of GEORADIUS.
+type NearestDriver struct{}
+
+func (NearestDriver) Rank(candidates []Candidate) error {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Distance < candidates[j].Distance
+	})
+	return nil
+}
+
+// LeastRecentlyMatched chooses the candidate that has waited longer since its last match, the drivers never matched go first.
+type LeastRecentlyMatched struct{}
+
+func (LeastRecentlyMatched) Rank(candidates []Candidate) error {
+	if err := loadLastMatch(candidates); err != nil {
+		return err
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].LastMatch.Before(candidates[j].LastMatch)
+	})
+	return nil
+}
+
+// HighestRating chooses the candidate with the best rating, the ties are broken by distance.
+type HighestRating struct{}
+
+func (HighestRating) Rank(candidates []Candidate) error {
+	if err := loadRatings(candidates); err != nil {
+		return err
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Rating != candidates[j].Rating {
+			return candidates[i].Rating > candidates[j].Rating
+		}
+		return candidates[i].Distance < candidates[j].Distance
+	})
+	return nil
+}
+
+// WeightedScore mixes the distance, the idle time, the rating and the acceptance rate of the candidates, each of them normalized
+// between 0 and 1. Language is a boost added to the score of the candidates that share a language with the rider.
+type WeightedScore struct {
+	Distance, Idle, Rating, Acceptance float64
+	Language                           float64
+	// MaxDistance is the distance in km that scores 0, MaxIdle is the idle time that scores 1.
+	MaxDistance float64
+	MaxIdle     time.Duration
+}
+
+// DefaultWeights is the weighted strategy used by the requests, the idle weight is the fairness weight
+// and it can be changed at runtime by the fairness auditor.
+var DefaultWeights = WeightedScore{Distance: 0.5, Idle: 0.25, Rating: 0.15, Acceptance: 0.1, Language: 0.1, MaxDistance: 10, MaxIdle: time.Hour}
+
+var (
+	mu      sync.RWMutex
+	current = DefaultWeights
+)
+
+func weights() WeightedScore {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+// FairnessWeight returns the current weight of the idle time in the weighted strategy.
+func FairnessWeight() float64 {
+	return weights().Idle
+}
+
+// SetFairnessWeight changes the weight of the idle time in the weighted strategy, the weights of the distance,
+// the rating and the acceptance rate are scaled to keep the sum of the weights.
+func SetFairnessWeight(w float64) {
+	mu.Lock()
+	defer mu.Unlock()
+	total := current.Distance + current.Idle + current.Rating + current.Acceptance
+	rest := current.Distance + current.Rating + current.Acceptance
+	if rest > 0 && w < total {
+		scale := (total - w) / rest
+		current.Distance *= scale
+		current.Rating *= scale
+		current.Acceptance *= scale
+	}
+	current.Idle = w
+}
+
+// SetWeights changes the weights of the distance, the rating and the acceptance rate in the weighted strategy,
+// the weight of the idle time is the fairness weight.
+func SetWeights(distance, rating, acceptance float64) {
+	mu.Lock()
+	defer mu.Unlock()
+	current.Distance = distance
+	current.Rating = rating
+	current.Acceptance = acceptance
+}
+
+// SetLanguageBoost changes the boost of the candidates that share a language with the rider in the weighted strategy.
+func SetLanguageBoost(b float64) {
+	mu.Lock()
+	defer mu.Unlock()
+	current.Language = b
+}
+
+func (w WeightedScore) Rank(candidates []Candidate) error {
+	if err := loadLastMatch(candidates); err != nil {
+		return err
+	}
+	if err := loadRatings(candidates); err != nil {
+		return err
+	}
+	if err := loadAcceptance(candidates); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for i := range candidates {
+		candidates[i].Score = w.score(candidates[i], now)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Score > candidates[j].Score
+	})
+	return nil
+}
+
+// score returns the score of the candidate, higher is better.
+func (w WeightedScore) score(c Candidate, now time.Time) float64 {
+	distance := 1 - clamp(c.Distance/w.MaxDistance)
+	idle := 1.0
+	if !c.LastMatch.IsZero() {
+		idle = clamp(float64(now.Sub(c.LastMatch)) / float64(w.MaxIdle))
+	}
+	rating := clamp(c.Rating / 5)
+	score := w.Distance*distance + w.Idle*idle + w.Rating*rating + w.Acceptance*clamp(c.Acceptance)
+	if c.Language != "" {
+		score += w.Language
+	}
+	return score
+}
+
+func clamp(v float64) float64 {
+	if v < 0 {
+		return 0
+	}
+	if v > 1 {
+		return 1
+	}
+	return v
+}
+
+func ids(candidates []Candidate) []string {
+	ids := make([]string, len(candidates))
+	for i, c := range candidates {
+		ids[i] = c.DriverID
+	}
+	return ids
+}
+
+func loadLastMatch(candidates []Candidate) error {
+	rClient := storages.GetRedisClient()
+	cmds := make([]*redis.FloatCmd, len(candidates))
+	err := storages.WithRetry(func() error {
+		_, err := rClient.Pipelined(func(pipe redis.Pipeliner) error {
+			for i, c := range candidates {
+				cmds[i] = pipe.ZScore(lastMatchKey, c.DriverID)
+			}
+			return nil
+		})
+		// The drivers never matched are not in the set.
+		if err == redis.Nil {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range candidates {
+		if score, err := cmds[i].Result(); err == nil {
+			candidates[i].LastMatch = time.Unix(int64(score), 0)
+		}
+	}
+	return nil
+}
+
+func loadRatings(candidates []Candidate) error {
+	ratings, err := drivers.Ratings(ids(candidates))
+	if err != nil {
+		return err
+	}
+	for i := range candidates {
+		candidates[i].Rating = ratings[candidates[i].DriverID]
+	}
+	return nil
+}
+
+func loadAcceptance(candidates []Candidate) error {
+	rates, err := drivers.AcceptanceRates(ids(candidates))
+	if err != nil {
+		return err
+	}
+	for i := range candidates {
+		candidates[i].Acceptance = rates[candidates[i].DriverID]
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package matching
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNearestDriver(t *testing.T) {
+	candidates := []Candidate{
+		{DriverID: "far", Distance: 4},
+		{DriverID: "near", Distance: 1},
+		{DriverID: "middle", Distance: 2},
+	}
+	if err := (NearestDriver{}).Rank(candidates); err != nil {
+		t.Fatalf("could not rank: %v", err)
+	}
+	if candidates[0].DriverID != "near" || candidates[2].DriverID != "far" {
+		t.Errorf("unexpected order %v", candidates)
+	}
+}
+
+func TestWeightedScore(t *testing.T) {
+	now := time.Now()
+	w := WeightedScore{Distance: 0.5, Idle: 0.5, MaxDistance: 10, MaxIdle: time.Hour}
+
+	busy := Candidate{DriverID: "busy", Distance: 1, LastMatch: now.Add(-time.Minute)}
+	idle := Candidate{DriverID: "idle", Distance: 2, LastMatch: now.Add(-time.Hour)}
+	if w.score(idle, now) <= w.score(busy, now) {
+		t.Errorf("the idle driver must score higher, idle %f busy %f", w.score(idle, now), w.score(busy, now))
+	}
+
+	// A driver never matched has the max idle score.
+	never := Candidate{DriverID: "never", Distance: 2}
+	if w.score(never, now) != w.score(idle, now) {
+		t.Errorf("unexpected score for a driver never matched %f", w.score(never, now))
+	}
+}
+
+func TestWeightedScoreLanguage(t *testing.T) {
+	now := time.Now()
+	w := WeightedScore{Distance: 1, Language: 0.2, MaxDistance: 10, MaxIdle: time.Hour}
+
+	near := Candidate{DriverID: "near", Distance: 1}
+	speaks := Candidate{DriverID: "speaks", Distance: 2, Language: "es"}
+	if w.score(speaks, now) <= w.score(near, now) {
+		t.Errorf("the driver that shares a language must score higher, speaks %f near %f", w.score(speaks, now), w.score(near, now))
+	}
+	w.Language = 0
+	if w.score(speaks, now) >= w.score(near, now) {
+		t.Error("without boost the nearest driver must score higher")
+	}
+}
+
+func TestWeightedScoreAcceptance(t *testing.T) {
+	now := time.Now()
+	w := WeightedScore{Distance: 0.5, Acceptance: 0.5, MaxDistance: 10, MaxIdle: time.Hour}
+
+	near := Candidate{DriverID: "near", Distance: 1, Acceptance: 0.2}
+	reliable := Candidate{DriverID: "reliable", Distance: 2, Acceptance: 0.9}
+	if w.score(reliable, now) <= w.score(near, now) {
+		t.Errorf("the driver that accepts more offers must score higher, reliable %f near %f", w.score(reliable, now), w.score(near, now))
+	}
+}
+
+func TestGet(t *testing.T) {
+	if s, err := Get(""); err != nil || s != (NearestDriver{}) {
+		t.Errorf("the default strategy must be the nearest driver, got %v %v", s, err)
+	}
+	if _, err := Get("unknown"); err == nil {
+		t.Error("expected error for an unknown strategy")
+	}
+}
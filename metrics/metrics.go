@@ -0,0 +1,219 @@
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// RequestDuration is the latency of the HTTP requests by route, method and status.
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tracking_http_request_duration_seconds",
+		Help:    "Latency of the HTTP requests.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	// RedisDuration is the latency of the Redis commands by command name.
+	RedisDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tracking_redis_command_duration_seconds",
+		Help:    "Latency of the Redis commands.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"command"})
+
+	// RedisBreakerOpen is 1 while the circuit breaker of Redis is open.
+	RedisBreakerOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tracking_redis_breaker_open",
+		Help: "Whether the circuit breaker of Redis is open.",
+	})
+
+	// ActiveSearchTasks is the number of requests that are searching a driver.
+	ActiveSearchTasks = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tracking_active_search_tasks",
+		Help: "Number of requests searching a driver.",
+	})
+
+	// Matches is the number of requests that found a driver, use rate() to get the matches per minute.
+	Matches = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tracking_matches_total",
+		Help: "Number of requests matched with a driver.",
+	})
+
+	// SearchOutcomes is the number of finished requests by lane (standard, accessible or sandbox) and terminal state of the request,
+	// the match rate of each lane is matched over the total.
+	SearchOutcomes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tracking_search_outcomes_total",
+		Help: "Number of finished requests by lane and outcome.",
+	}, []string{"lane", "outcome"})
+
+	// StaleDrivers is the number of drivers removed because they stopped sending their location.
+	StaleDrivers = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tracking_stale_drivers_total",
+		Help: "Number of drivers removed for not sending their location.",
+	})
+
+	// MatchGini is the Gini coefficient of the matches per active driver of each zone, the zone "all" has all the drivers.
+	MatchGini = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tracking_match_gini",
+		Help: "Gini coefficient of the matches per active driver.",
+	}, []string{"zone"})
+
+	// FairnessWeight is the weight of the idle time in the weighted matching strategy.
+	FairnessWeight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tracking_matching_fairness_weight",
+		Help: "Weight of the idle time in the weighted matching strategy.",
+	})
+
+	// ShardFailovers is the number of dead shards whose tasks were recovered, RecoveredTasks the number of tasks recovered
+	// and FailoverLatency the time between the last heartbeat of the dead shard and the recovery.
+	ShardFailovers = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tracking_shard_failovers_total",
+		Help: "Number of dead worker shards recovered.",
+	})
+	RecoveredTasks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tracking_recovered_tasks_total",
+		Help: "Number of tasks recovered from dead worker shards.",
+	})
+	FailoverLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tracking_failover_latency_seconds",
+		Help:    "Time between the last heartbeat of a dead shard and the recovery of its tasks.",
+		Buckets: []float64{1, 5, 10, 15, 30, 60, 120, 300},
+	})
+
+	// Retries is the number of calls to the storage and the external services by integration and outcome:
+	// success, retry, permanent, exhausted or budget_exhausted.
+	Retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tracking_retries_total",
+		Help: "Number of retried calls by integration and outcome.",
+	}, []string{"integration", "outcome"})
+
+	// IndexDiscrepancies is the number of discrepancies between the GEO index and the state of the drivers found by the last check,
+	// by kind, and IndexRepairs the number of discrepancies repaired.
+	IndexDiscrepancies = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tracking_index_discrepancies",
+		Help: "Number of discrepancies between the GEO index and the state of the drivers found by the last check.",
+	}, []string{"kind"})
+	IndexRepairs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tracking_index_repairs_total",
+		Help: "Number of discrepancies between the GEO index and the state of the drivers repaired.",
+	}, []string{"kind"})
+
+	// LocationUpdates is the number of driver locations received.
+	LocationUpdates = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tracking_location_updates_total",
+		Help: "Number of driver locations received.",
+	})
+
+	// StreamMessages is the number of location messages read from Kafka by result: saved, invalid or stale_device.
+	StreamMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tracking_stream_messages_total",
+		Help: "Number of location messages read from Kafka by result.",
+	}, []string{"result"})
+	// TelematicsMessages is the number of location messages received over MQTT by result: saved, invalid, stale_device or failed.
+	TelematicsMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tracking_telematics_messages_total",
+		Help: "Number of location messages received over MQTT by result.",
+	}, []string{"result"})
+	// BusEvents is the number of events of the message bus by type and result: published, failed or dropped.
+	BusEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tracking_bus_events_total",
+		Help: "Number of events of the message bus by type and result.",
+	}, []string{"type", "result"})
+	// SkippedSearches is the number of ticks of the searches that skipped the GEO query, nobody reported in their area since their last empty search.
+	SkippedSearches = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tracking_skipped_searches_total",
+		Help: "Number of search ticks that skipped the GEO query because the supply of the area did not change.",
+	})
+	// NearbyNotifications is the number of notifications sent to the riders subscribed to the drivers around a point.
+	NearbyNotifications = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tracking_nearby_notifications_total",
+		Help: "Number of notifications of the drivers around the subscribed points.",
+	})
+	// OfferResponses is the number of offers to the drivers by response: accepted, declined or expired.
+	OfferResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tracking_offer_responses_total",
+		Help: "Number of offers to the drivers by response.",
+	}, []string{"response"})
+	// LiveSpilledUpdates is the number of location updates of the live subscribers that did not fit in their buffer and spilled to Redis.
+	LiveSpilledUpdates = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tracking_live_spilled_updates_total",
+		Help: "Number of live location updates spilled to the resume log of slow subscribers.",
+	})
+	// ClusterRetries is the number of writes retried because the slots of the Redis Cluster were moving, by error:
+	// moved, ask, clusterdown or tryagain.
+	ClusterRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tracking_redis_cluster_retries_total",
+		Help: "Number of Redis writes retried during a reshard or a failover of the cluster by error.",
+	}, []string{"error"})
+	// CommandSessions is the number of command channels of the drivers open in this instance.
+	CommandSessions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tracking_command_sessions",
+		Help: "Number of command channels of the drivers open in this instance.",
+	})
+	// Panics is the number of panics recovered by where they happened: the route of the handler or the background job.
+	Panics = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tracking_panics_total",
+		Help: "Number of panics recovered by where they happened.",
+	}, []string{"where"})
+)
+
+func init() {
+	prometheus.MustRegister(RequestDuration, RedisDuration, RedisBreakerOpen, ActiveSearchTasks, Matches, SearchOutcomes, StaleDrivers, MatchGini, FairnessWeight,
+		ShardFailovers, RecoveredTasks, FailoverLatency, Retries, IndexDiscrepancies, IndexRepairs, LocationUpdates, StreamMessages,
+		TelematicsMessages, Panics, BusEvents, NearbyNotifications,
+		SkippedSearches, OfferResponses, LiveSpilledUpdates, ClusterRetries, CommandSessions)
+}
+
+// Handler returns the handler for the /metrics endpoint.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// statusRecorder keeps the status code written by the handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Hijack is needed by the WebSocket connections.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	return h.Hijack()
+}
+
+// Flush is needed by the streaming responses.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the original writer, e.g. to enable full duplex.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Middleware measures the latency of each request, route returns the label for the request,
+// it must be the registered pattern and not the path to keep the number of series bounded.
+func Middleware(next http.Handler, route func(*http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		RequestDuration.WithLabelValues(route(r), r.Method, strconv.Itoa(rec.status)).Observe(time.Since(start).Seconds())
+	})
+}
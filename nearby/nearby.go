@@ -0,0 +1,209 @@
+// Package nearby notifies the riders that wait at a point about the drivers around it, e.g. "3 drivers within 1km".
+// A scanner counts the drivers of the GEO index around each subscription and notifies the rider when the count changes.
+package nearby
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/douglasmakey/tracking/callbacks"
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/maintenance"
+	"github.com/douglasmakey/tracking/metrics"
+	"github.com/douglasmakey/tracking/notify"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// subscriptionsKey is a hash with the subscriptions as JSON by ID, lockKey lets only one instance scan them on each tick.
+const (
+	subscriptionsKey = "nearby:subscriptions"
+	lockKey          = "nearby:lock"
+)
+
+// EventNearby is the event of the callbacks of the subscriptions.
+const EventNearby = "nearby_drivers"
+
+// ErrNotFound is returned when the subscription does not exist or expired.
+var ErrNotFound = errors.New("subscription not found")
+
+// Subscription is the interest of a rider in the drivers within Radius km of a point until Expires.
+// Count is the number of drivers of the last notification, -1 before the first scan.
+type Subscription struct {
+	ID      string    `json:"id"`
+	UserID  string    `json:"user_id"`
+	Point   geo.Point `json:"point"`
+	Radius  float64   `json:"radius_km"`
+	Expires time.Time `json:"expires"`
+	Count   int       `json:"count"`
+}
+
+// Subscribe saves a subscription of the user for ttl, the callback URL, if any, also receives the changes as signed events.
+func Subscribe(userID string, p geo.Point, radius float64, ttl time.Duration, callbackURL string) (Subscription, error) {
+	s := Subscription{
+		ID:      logging.NewID(),
+		UserID:  userID,
+		Point:   p,
+		Radius:  radius,
+		Expires: time.Now().Add(ttl),
+		Count:   -1,
+	}
+	if callbackURL != "" {
+		// The events of the subscription use its ID as the request ID.
+		if err := callbacks.Register(s.ID, callbackURL, ttl); err != nil {
+			return Subscription{}, err
+		}
+	}
+	return s, save(s)
+}
+
+func save(s Subscription) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	rClient := storages.GetRedisClient()
+	return storages.Classify(rClient.HSet(subscriptionsKey, s.ID, data).Err())
+}
+
+// updateScript replaces the subscription ARGV[1] of the hash KEYS[1] only if it still exists,
+// a scan must not bring back a subscription removed during it.
+var updateScript = redis.NewScript(`
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 1 then
+	redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// update saves the subscription if it was not removed, it returns false if it was.
+func update(s Subscription) (bool, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return false, err
+	}
+	rClient := storages.GetRedisClient()
+	n, err := updateScript.Run(rClient, []string{subscriptionsKey}, s.ID, data).Int64()
+	return n == 1, storages.Classify(err)
+}
+
+// Get returns the subscription, ErrNotFound if it does not exist.
+func Get(id string) (Subscription, error) {
+	rClient := storages.GetRedisClient()
+	var data string
+	err := storages.WithRetry(func() (err error) {
+		data, err = rClient.HGet(subscriptionsKey, id).Result()
+		return err
+	})
+	if err == redis.Nil {
+		return Subscription{}, ErrNotFound
+	}
+	if err != nil {
+		return Subscription{}, err
+	}
+	var s Subscription
+	err = json.Unmarshal([]byte(data), &s)
+	return s, err
+}
+
+// Unsubscribe removes the subscription, ErrNotFound if it does not exist.
+func Unsubscribe(id string) error {
+	rClient := storages.GetRedisClient()
+	n, err := rClient.HDel(subscriptionsKey, id).Result()
+	if err != nil {
+		return storages.Classify(err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Text returns the text of the notification, e.g. "3 drivers within 1km".
+func Text(count int, radius float64) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("No drivers within %gkm", radius)
+	case 1:
+		return fmt.Sprintf("1 driver within %gkm", radius)
+	}
+	return fmt.Sprintf("%d drivers within %gkm", count, radius)
+}
+
+// Scanner counts the drivers around the subscriptions every Interval, at most Limit drivers are counted.
+type Scanner struct {
+	Interval time.Duration
+	Limit    int
+}
+
+// Start launches the scanner in a goroutine.
+func (s Scanner) Start() {
+	go func() {
+		ticker := time.NewTicker(s.Interval)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			if maintenance.Paused() {
+				continue
+			}
+			s.run(now)
+		}
+	}()
+}
+
+func (s Scanner) run(now time.Time) {
+	rClient := storages.GetRedisClient()
+	// Every instance runs the scanner, only the first one of each tick scans the subscriptions.
+	ok, err := rClient.SetNX(lockKey, 1, s.Interval/2).Result()
+	if err != nil || !ok {
+		return
+	}
+
+	subs, err := rClient.HGetAll(subscriptionsKey).Result()
+	if err != nil {
+		logging.Logger.Error("could not get nearby subscriptions", "error", err)
+		return
+	}
+	for id, data := range subs {
+		var sub Subscription
+		if err := json.Unmarshal([]byte(data), &sub); err != nil || now.After(sub.Expires) {
+			rClient.HDel(subscriptionsKey, id)
+			continue
+		}
+		if err := s.scan(sub); err != nil {
+			logging.Logger.Warn("could not scan nearby subscription", "subscription_id", id, "error", err)
+		}
+	}
+}
+
+// scan counts the drivers around the subscription and notifies the rider if the count changed.
+func (s Scanner) scan(sub Subscription) error {
+	ctx := context.Background()
+	found, err := storages.Locations().SearchDrivers(ctx, s.Limit, sub.Point.Lat, sub.Point.Lng, sub.Radius)
+	if err != nil {
+		return err
+	}
+	if len(found) == sub.Count {
+		return nil
+	}
+	sub.Count = len(found)
+	if ok, err := update(sub); err != nil || !ok {
+		return err
+	}
+
+	metrics.NearbyNotifications.Inc()
+	data := map[string]string{
+		"subscription_id": sub.ID,
+		"drivers":         fmt.Sprint(sub.Count),
+		"radius_km":       fmt.Sprint(sub.Radius),
+	}
+	err = notify.Send(ctx, notify.Message{UserID: sub.UserID, Kind: notify.KindNearbyDrivers, Text: Text(sub.Count, sub.Radius), Data: data})
+	if err != nil {
+		logging.Logger.Warn("could not notify user", "user_id", sub.UserID, "kind", notify.KindNearbyDrivers, "error", err)
+	}
+	return callbacks.Trigger(sub.ID, callbacks.Event{Event: EventNearby, RequestID: sub.ID, Data: data})
+}
@@ -0,0 +1,20 @@
+package nearby
+
+import "testing"
+
+func TestText(t *testing.T) {
+	cases := []struct {
+		count  int
+		radius float64
+		want   string
+	}{
+		{0, 1, "No drivers within 1km"},
+		{1, 0.5, "1 driver within 0.5km"},
+		{3, 1, "3 drivers within 1km"},
+	}
+	for _, c := range cases {
+		if got := Text(c.count, c.radius); got != c.want {
+			t.Errorf("Text(%d, %g) = %q, want %q", c.count, c.radius, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// defaultTimeout is the timeout of the HTTP clients of the channels.
+const defaultTimeout = time.Second * 5
+
+func newClient() *http.Client {
+	return &http.Client{Timeout: defaultTimeout}
+}
+
+// do sends the request and fails if the status is not 2xx.
+func do(client *http.Client, req *http.Request) error {
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", req.URL.Host, res.Status)
+	}
+	return nil
+}
+
+// Webhook posts the messages as JSON to an URL.
+type Webhook struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewWebhook create and return a pointer to Webhook.
+func NewWebhook(url string) *Webhook {
+	return &Webhook{URL: url, Client: newClient()}
+}
+
+func (wh *Webhook) Notify(ctx context.Context, m Message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return do(wh.Client, req)
+}
+
+// firebaseURL is the endpoint of the Firebase Cloud Messaging legacy HTTP API.
+const firebaseURL = "https://fcm.googleapis.com/fcm/send"
+
+// Firebase sends push notifications to the push token of the user.
+type Firebase struct {
+	ServerKey string
+	URL       string
+	Client    *http.Client
+}
+
+// NewFirebase create and return a pointer to Firebase.
+func NewFirebase(serverKey string) *Firebase {
+	return &Firebase{ServerKey: serverKey, URL: firebaseURL, Client: newClient()}
+}
+
+func (f *Firebase) Notify(ctx context.Context, m Message) error {
+	contact, err := GetContact(m.UserID)
+	if err != nil {
+		return err
+	}
+	if contact.PushToken == "" {
+		return ErrNoContact
+	}
+
+	data := map[string]string{"request_id": m.RequestID, "kind": m.Kind}
+	for k, v := range m.Data {
+		data[k] = v
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"to":           contact.PushToken,
+		"notification": map[string]string{"body": m.Text},
+		"data":         data,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "key="+f.ServerKey)
+	return do(f.Client, req)
+}
+
+// Twilio sends the messages as SMS to the phone of the user.
+type Twilio struct {
+	AccountSID, AuthToken string
+	// From is the phone number of the messages.
+	From   string
+	URL    string
+	Client *http.Client
+}
+
+// NewTwilio create and return a pointer to Twilio.
+func NewTwilio(accountSID, authToken, from string) *Twilio {
+	return &Twilio{
+		AccountSID: accountSID,
+		AuthToken:  authToken,
+		From:       from,
+		URL:        fmt.Sprintf("https://api.twilio.com/2010-04-01/Accounts/%s/Messages.json", accountSID),
+		Client:     newClient(),
+	}
+}
+
+func (t *Twilio) Notify(ctx context.Context, m Message) error {
+	contact, err := GetContact(m.UserID)
+	if err != nil {
+		return err
+	}
+	if contact.Phone == "" {
+		return ErrNoContact
+	}
+
+	form := url.Values{"To": {contact.Phone}, "From": {t.From}, "Body": {m.Text}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(t.AccountSID, t.AuthToken)
+	return do(t.Client, req)
+}
@@ -0,0 +1,127 @@
+// Package notify delivers the messages of the requests to the users through the configured channel.
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/retry"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// These are the kinds of messages.
+const (
+	KindDriverFound    = "driver_found"
+	KindNoDriver       = "no_driver"
+	KindSearchExpanded = "search_expanded"
+	KindNearbyDrivers  = "nearby_drivers"
+	// KindOffer is sent to the driver reserved for a request, the driver must accept or decline it.
+	KindOffer = "offer"
+)
+
+// ErrNoContact is returned when the user does not have the contact needed by the channel, e.g. a phone number for SMS.
+var ErrNoContact = errors.New("user does not have a contact for the channel")
+
+// Message is a message for the user about a request.
+type Message struct {
+	UserID    string            `json:"user_id"`
+	RequestID string            `json:"request_id"`
+	Kind      string            `json:"kind"`
+	Text      string            `json:"text"`
+	Data      map[string]string `json:"data,omitempty"`
+}
+
+// Notifier delivers the messages through a channel.
+type Notifier interface {
+	Notify(ctx context.Context, m Message) error
+}
+
+// Log writes the messages to the log, it is the default notifier.
+type Log struct{}
+
+func (Log) Notify(ctx context.Context, m Message) error {
+	logging.FromContext(ctx).Info("message to user", "user_id", m.UserID, "request_id", m.RequestID, "kind", m.Kind, "message", m.Text)
+	return nil
+}
+
+// Retrying retries the notifier with the policy, the messages without contact are not retried.
+type Retrying struct {
+	Notifier Notifier
+	Policy   retry.Policy
+}
+
+func (r Retrying) Notify(ctx context.Context, m Message) error {
+	return r.Policy.Do(ctx, retry.Notify, func() error {
+		err := r.Notifier.Notify(ctx, m)
+		if errors.Is(err, ErrNoContact) {
+			return retry.Permanent(err)
+		}
+		return err
+	})
+}
+
+var (
+	mu       sync.RWMutex
+	notifier Notifier = Log{}
+)
+
+// SetNotifier sets the notifier used by Send.
+func SetNotifier(n Notifier) {
+	mu.Lock()
+	notifier = n
+	mu.Unlock()
+}
+
+// Send delivers the message with the configured notifier.
+func Send(ctx context.Context, m Message) error {
+	mu.RLock()
+	n := notifier
+	mu.RUnlock()
+	return n.Notify(ctx, m)
+}
+
+// Contact is how the user is reached by the push and SMS channels.
+type Contact struct {
+	PushToken string `json:"push_token,omitempty"`
+	Phone     string `json:"phone,omitempty"`
+}
+
+// contactKey is a hash with the contact of the user.
+func contactKey(userID string) string {
+	return fmt.Sprintf("user:%s:contact", userID)
+}
+
+// SetContact saves the contact of the user, the empty fields are not changed.
+func SetContact(userID string, c Contact) error {
+	fields := make(map[string]interface{})
+	if c.PushToken != "" {
+		fields["push_token"] = c.PushToken
+	}
+	if c.Phone != "" {
+		fields["phone"] = c.Phone
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	rClient := storages.GetRedisClient()
+	return storages.Classify(rClient.HMSet(contactKey(userID), fields).Err())
+}
+
+// GetContact returns the contact of the user.
+func GetContact(userID string) (Contact, error) {
+	rClient := storages.GetRedisClient()
+	var values map[string]string
+	err := storages.WithRetry(func() (err error) {
+		values, err = rClient.HGetAll(contactKey(userID)).Result()
+		return err
+	})
+	if err != nil && err != redis.Nil {
+		return Contact{}, err
+	}
+	return Contact{PushToken: values["push_token"], Phone: values["phone"]}, nil
+}
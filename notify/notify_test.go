@@ -0,0 +1,52 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/douglasmakey/tracking/retry"
+)
+
+type failing struct {
+	calls int
+	err   error
+}
+
+func (f *failing) Notify(context.Context, Message) error {
+	f.calls++
+	return f.err
+}
+
+func TestRetrying(t *testing.T) {
+	f := &failing{err: errors.New("unavailable")}
+	err := Retrying{Notifier: f, Policy: retry.Policy{Attempts: 3}}.Notify(context.Background(), Message{})
+	if err == nil || f.calls != 3 {
+		t.Errorf("expected 3 attempts and an error, got %d attempts and %v", f.calls, err)
+	}
+
+	// The messages without contact are not retried.
+	f = &failing{err: ErrNoContact}
+	if err := (Retrying{Notifier: f, Policy: retry.Policy{Attempts: 3}}).Notify(context.Background(), Message{}); !errors.Is(err, ErrNoContact) || f.calls != 1 {
+		t.Errorf("expected 1 attempt and ErrNoContact, got %d attempts and %v", f.calls, err)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	var got Message
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer server.Close()
+
+	m := Message{UserID: "1", RequestID: "2", Kind: KindDriverFound, Text: "Driver found"}
+	if err := NewWebhook(server.URL).Notify(context.Background(), m); err != nil {
+		t.Fatalf("could not notify: %v", err)
+	}
+	if got.RequestID != "2" || got.Kind != KindDriverFound {
+		t.Errorf("unexpected message %+v", got)
+	}
+}
@@ -0,0 +1,134 @@
+// Package payload limits the size of the request bodies and compresses the bodies with gzip: the mobile clients send the batches
+// of locations compressed and the large search results are compressed for the clients that accept it.
+package payload
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/douglasmakey/tracking/httputil"
+)
+
+// minGzipSize is the min size of a response body that is compressed, the smaller bodies fit in a packet.
+const minGzipSize = 1400
+
+// Middleware rejects the POST requests with a body larger than max bytes and decompresses the bodies sent with Content-Encoding gzip,
+// the handlers read the plain body. The decompressed body is limited too. A body without Content-Length that is too large fails
+// to decode in the handler. The requests for which unlimited returns true are not limited, e.g. the streams kept open.
+func Middleware(next http.Handler, max int64, unlimited func(*http.Request) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := r.Method == http.MethodPost && max > 0 && !unlimited(r)
+		if limit {
+			if r.ContentLength > max {
+				httputil.WriteError(w, httputil.CodePayloadTooLarge, fmt.Sprintf("the body must have at most %d bytes", max))
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, max)
+		}
+
+		if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				httputil.WriteError(w, httputil.CodeInvalidRequest, "could not decompress body")
+				return
+			}
+			defer zr.Close()
+			r.Body = zr
+			if limit {
+				r.Body = http.MaxBytesReader(w, r.Body, max)
+			}
+			// The handlers see the request as if it was sent without compression.
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// gzipWriter buffers the body until it is large enough to be compressed, the smaller bodies are written as they are on Close.
+type gzipWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+	zw     *gzip.Writer
+}
+
+func (g *gzipWriter) WriteHeader(status int) {
+	if g.status == 0 {
+		g.status = status
+	}
+}
+
+func (g *gzipWriter) Write(b []byte) (int, error) {
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	if g.zw != nil {
+		return g.zw.Write(b)
+	}
+	g.buf.Write(b)
+	if g.buf.Len() < minGzipSize {
+		return len(b), nil
+	}
+
+	h := g.ResponseWriter.Header()
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	g.ResponseWriter.WriteHeader(g.status)
+	g.zw = gzip.NewWriter(g.ResponseWriter)
+	if _, err := g.zw.Write(g.buf.Bytes()); err != nil {
+		return 0, err
+	}
+	g.buf.Reset()
+	return len(b), nil
+}
+
+// Close writes the rest of the body.
+func (g *gzipWriter) Close() error {
+	if g.zw != nil {
+		return g.zw.Close()
+	}
+	if g.status != 0 {
+		g.ResponseWriter.WriteHeader(g.status)
+	}
+	_, err := g.ResponseWriter.Write(g.buf.Bytes())
+	return err
+}
+
+// Unwrap lets http.ResponseController reach the original writer.
+func (g *gzipWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// Gzip compresses the responses of the handler with gzip when the client accepts it and the body has at least minGzipSize bytes.
+// The response is buffered until then, it must not be used for the streaming responses.
+func Gzip(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The caches must keep a response for each encoding.
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w}
+		defer gw.Close()
+		next(gw, r)
+	}
+}
+
+// acceptsGzip returns true when the Accept-Encoding of the request has gzip without a zero quality.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		q := strings.ReplaceAll(params, " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
+}
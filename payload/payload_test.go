@@ -0,0 +1,114 @@
+package payload
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func gzipped(t *testing.T, s string) *bytes.Buffer {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	zw.Close()
+	return &buf
+}
+
+func TestMiddleware(t *testing.T) {
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write(body)
+	})
+	never := func(*http.Request) bool { return false }
+	h := Middleware(echo, 40, never)
+
+	// The compressed body reaches the handler decompressed.
+	req := httptest.NewRequest(http.MethodPost, "/tracking", gzipped(t, `{"lat":1}`))
+	req.Header.Set("Content-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"lat":1}` {
+		t.Errorf("unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+
+	// A body larger than the limit is rejected before the handler.
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/tracking", strings.NewReader(strings.Repeat("a", 41))))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413, got %d", rec.Code)
+	}
+
+	// The decompressed body is limited too.
+	req = httptest.NewRequest(http.MethodPost, "/tracking", gzipped(t, strings.Repeat("a", 200)))
+	req.Header.Set("Content-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected the handler to fail reading, got %d", rec.Code)
+	}
+
+	// An invalid compressed body is rejected.
+	req = httptest.NewRequest(http.MethodPost, "/tracking", strings.NewReader("not gzip"))
+	req.Header.Set("Content-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rec.Code)
+	}
+
+	// The unlimited requests are not limited.
+	h = Middleware(echo, 40, func(*http.Request) bool { return true })
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/tracking/stream", strings.NewReader(strings.Repeat("a", 41))))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", rec.Code)
+	}
+}
+
+func TestGzip(t *testing.T) {
+	large := strings.Repeat(`{"name":"driver"},`, 200)
+	h := Gzip(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(large))
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/search", nil)
+	req.Header.Set("Accept-Encoding", "br, gzip")
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	if rec.Code != http.StatusCreated || rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected a compressed response, got %d %v", rec.Code, rec.Header())
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(zr)
+	if string(body) != large {
+		t.Errorf("unexpected body of %d bytes", len(body))
+	}
+
+	// The small responses and the clients without gzip get the body as it is.
+	small := Gzip(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("[]")) })
+	rec = httptest.NewRecorder()
+	small(rec, req)
+	if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != "[]" {
+		t.Errorf("unexpected small response %v %q", rec.Header(), rec.Body.String())
+	}
+	req.Header.Set("Accept-Encoding", "gzip;q=0")
+	rec = httptest.NewRecorder()
+	h(rec, req)
+	if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != large {
+		t.Errorf("expected an uncompressed response, got %v", rec.Header())
+	}
+}
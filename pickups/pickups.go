@@ -0,0 +1,137 @@
+// Package pickups learns the points where the drivers actually pick up the riders from the completed trips, so a rider can be
+// suggested the nearest popular pickup point without a dataset of points of interest.
+package pickups
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/douglasmakey/tracking/config"
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// spotPrecision is the geohash precision of the pickup points, the pickups in a cell of about 38m x 19m are the same point.
+const spotPrecision = 8
+
+// spotsKey is a GEO set with the pickup points of the zone at the center of their cells, the members are their geohashes.
+func spotsKey(zone string) string {
+	return fmt.Sprintf("pickups:%s", zone)
+}
+
+// countsKey is a hash with the number of trips picked up in each pickup point of the zone.
+func countsKey(zone string) string {
+	return fmt.Sprintf("pickups:%s:counts", zone)
+}
+
+// Suggestion is a popular pickup point near the picking point of a rider.
+type Suggestion struct {
+	geo.Point
+	// Distance is the distance in km from the picking point and Trips the number of trips picked up in the point.
+	Distance float64 `json:"distance_km"`
+	Trips    int64   `json:"trips"`
+}
+
+// Record counts a trip picked up at p.
+func Record(p geo.Point) error {
+	spot := geo.Geohash(p, spotPrecision)
+	center, zone := geo.GeohashCenter(spot), geo.Zone(p)
+	rClient := storages.GetRedisClient()
+	_, err := rClient.Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.GeoAdd(spotsKey(zone), &redis.GeoLocation{Name: spot, Longitude: center.Lng, Latitude: center.Lat})
+		pipe.HIncrBy(countsKey(zone), spot, 1)
+		return nil
+	})
+	return storages.Classify(err)
+}
+
+// Suggest returns the nearest pickup point to p with at least PickupMinTrips trips in PickupSuggestRadius km, nil if there is none.
+// It is an idempotent read, transient errors are retried.
+func Suggest(p geo.Point) (*Suggestion, error) {
+	cfg := config.Get()
+	zones := zonesAround(p, cfg.PickupSuggestRadius)
+
+	// The zones are read with pipelines, their keys can be in different slots of a cluster.
+	rClient := storages.GetRedisClient()
+	spots := make([]*redis.GeoLocationCmd, len(zones))
+	counts := make([]*redis.SliceCmd, len(zones))
+	err := storages.WithRetry(func() error {
+		_, err := rClient.Pipelined(func(pipe redis.Pipeliner) error {
+			for i, zone := range zones {
+				spots[i] = pipe.GeoRadius(spotsKey(zone), p.Lng, p.Lat, &redis.GeoRadiusQuery{
+					Radius: cfg.PickupSuggestRadius, Unit: "km", WithCoord: true, WithDist: true,
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		_, err = rClient.Pipelined(func(pipe redis.Pipeliner) error {
+			for i, zone := range zones {
+				names := make([]string, len(spots[i].Val()))
+				for j, l := range spots[i].Val() {
+					names[j] = l.Name
+				}
+				if len(names) > 0 {
+					counts[i] = pipe.HMGet(countsKey(zone), names...)
+				}
+			}
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []Suggestion
+	for i := range zones {
+		if counts[i] == nil {
+			continue
+		}
+		for j, l := range spots[i].Val() {
+			s, _ := counts[i].Val()[j].(string)
+			n, _ := strconv.ParseInt(s, 10, 64)
+			candidates = append(candidates, Suggestion{Point: geo.Point{Lat: l.Latitude, Lng: l.Longitude}, Distance: l.Dist, Trips: n})
+		}
+	}
+	return nearest(candidates, int64(cfg.PickupMinTrips)), nil
+}
+
+// nearest returns the nearest candidate with at least min trips, the most popular one between the candidates at the same distance.
+func nearest(candidates []Suggestion, min int64) *Suggestion {
+	var best *Suggestion
+	for i := range candidates {
+		c := &candidates[i]
+		if c.Trips < min {
+			continue
+		}
+		if best == nil || c.Distance < best.Distance || (c.Distance == best.Distance && c.Trips > best.Trips) {
+			best = c
+		}
+	}
+	return best
+}
+
+// zonesAround returns the zones that can have pickup points within radius km of p: the zone of p and the zones of the corners of
+// the box around p. The radius is smaller than a zone.
+func zonesAround(p geo.Point, radius float64) []string {
+	dLat := radius / 111.32
+	dLng := radius / (111.32 * math.Cos(p.Lat*math.Pi/180))
+	seen := map[string]bool{geo.Zone(p): true}
+	for _, lat := range []float64{p.Lat - dLat, p.Lat + dLat} {
+		for _, lng := range []float64{p.Lng - dLng, p.Lng + dLng} {
+			seen[geo.Zone(geo.Point{Lat: lat, Lng: lng})] = true
+		}
+	}
+	zones := make([]string, 0, len(seen))
+	for z := range seen {
+		zones = append(zones, z)
+	}
+	sort.Strings(zones)
+	return zones
+}
@@ -0,0 +1,39 @@
+package pickups
+
+import (
+	"testing"
+
+	"github.com/douglasmakey/tracking/geo"
+)
+
+func TestNearest(t *testing.T) {
+	candidates := []Suggestion{
+		{Distance: 0.02, Trips: 2},
+		{Distance: 0.08, Trips: 7},
+		{Distance: 0.05, Trips: 5},
+		{Distance: 0.05, Trips: 9},
+	}
+
+	got := nearest(candidates, 5)
+	if got == nil || got.Distance != 0.05 || got.Trips != 9 {
+		t.Errorf("unexpected suggestion %+v", got)
+	}
+	if got := nearest(candidates, 10); got != nil {
+		t.Errorf("expected no suggestion, got %+v", got)
+	}
+}
+
+func TestZonesAround(t *testing.T) {
+	p := geo.Point{Lat: -33.448890, Lng: -70.669265}
+	zones := zonesAround(p, 0.15)
+	found := false
+	for _, z := range zones {
+		found = found || z == geo.Zone(p)
+	}
+	if !found {
+		t.Errorf("the zone of the point is missing in %v", zones)
+	}
+	if len(zones) > 4 {
+		t.Errorf("expected at most 4 zones, got %v", zones)
+	}
+}
@@ -0,0 +1,87 @@
+// Package presence keeps the last heartbeat of each driver, the drivers with a recent heartbeat are online.
+// The heartbeat says that the app is running even when the driver is not moving and does not send locations.
+package presence
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// pingsKey is a sorted set with the unix time in milliseconds of the last heartbeat of each driver.
+const pingsKey = "drivers:presence"
+
+func millis(t time.Time) float64 {
+	return float64(t.UnixNano() / int64(time.Millisecond))
+}
+
+// Ping records the heartbeat of the driver at t.
+func Ping(driverID string, t time.Time) error {
+	rClient := storages.GetRedisClient()
+	return storages.Classify(rClient.ZAdd(pingsKey, redis.Z{Score: millis(t), Member: driverID}).Err())
+}
+
+// LastPing returns the time of the last heartbeat of the driver, zero if it never sent one.
+func LastPing(driverID string) (time.Time, error) {
+	rClient := storages.GetRedisClient()
+	var score float64
+	err := storages.WithRetry(func() (err error) {
+		score, err = rClient.ZScore(pingsKey, driverID).Result()
+		return err
+	})
+	if err == redis.Nil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, int64(score)*int64(time.Millisecond)), nil
+}
+
+// OnlineCount returns the number of drivers with a heartbeat since since.
+func OnlineCount(since time.Time) (int64, error) {
+	rClient := storages.GetRedisClient()
+	var n int64
+	err := storages.WithRetry(func() (err error) {
+		n, err = rClient.ZCount(pingsKey, strconv.FormatFloat(millis(since), 'f', 0, 64), "+inf").Result()
+		return err
+	})
+	return n, err
+}
+
+// Online returns the drivers of ids with a heartbeat since since, in the same order.
+func Online(ids []string, since time.Time) ([]string, error) {
+	rClient := storages.GetRedisClient()
+	cmds := make([]*redis.FloatCmd, len(ids))
+	err := storages.WithRetry(func() error {
+		_, err := rClient.Pipelined(func(pipe redis.Pipeliner) error {
+			for i, id := range ids {
+				cmds[i] = pipe.ZScore(pingsKey, id)
+			}
+			return nil
+		})
+		if err == redis.Nil {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var online []string
+	for i, id := range ids {
+		if score, err := cmds[i].Result(); err == nil && score >= millis(since) {
+			online = append(online, id)
+		}
+	}
+	return online, nil
+}
+
+// Remove forgets the heartbeat of the driver, it is offline until its next heartbeat.
+func Remove(driverID string) error {
+	rClient := storages.GetRedisClient()
+	return storages.Classify(rClient.ZRem(pingsKey, driverID).Err())
+}
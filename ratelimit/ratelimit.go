@@ -0,0 +1,111 @@
+// Package ratelimit limits the requests of each client to a route with a token bucket kept in Redis,
+// so the limit is shared by all the instances of the service.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/douglasmakey/tracking/auth"
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// Limit is a token bucket, Rate is the number of tokens added per second and Burst is the size of the bucket.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// bucketScript refills the bucket in KEYS[1] with the time elapsed since the last request and takes a token.
+// ARGV is rate and burst. It returns 1 and 0 if the request is allowed, otherwise 0 and the milliseconds until the next token.
+// It runs in Redis so all the instances share the same bucket, and the time is the clock of Redis so the clocks of the
+// instances do not need to agree. The effects are replicated because TIME is not deterministic.
+var bucketScript = redis.NewScript(`
+redis.replicate_commands()
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+
+tokens = math.min(burst, tokens + (now - ts) / 1000 * rate)
+
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+
+redis.call("HMSET", KEYS[1], "tokens", tokens, "ts", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000))
+return {allowed, wait}
+`)
+
+// Allow takes a token of the bucket with the key, when there are no tokens it returns false and the time to wait.
+func Allow(key string, l Limit) (bool, time.Duration, error) {
+	rClient := storages.GetRedisClient()
+	res, err := bucketScript.Run(rClient, []string{key}, l.Rate, l.Burst).Result()
+	if err != nil {
+		return false, 0, storages.Classify(err)
+	}
+
+	values, ok := res.([]interface{})
+	if !ok || len(values) != 2 {
+		return false, 0, fmt.Errorf("unexpected result of rate limit script: %v", res)
+	}
+	allowed, _ := values[0].(int64)
+	wait, _ := values[1].(int64)
+
+	return allowed == 1, time.Duration(wait) * time.Millisecond, nil
+}
+
+// ClientKey identifies the client of the request: the subject of the API key or the IP when the request is not authenticated.
+func ClientKey(r *http.Request) string {
+	if p := auth.FromContext(r.Context()); p != nil {
+		return p.Role + ":" + p.Subject
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return "ip:" + ip
+}
+
+// Middleware limits the requests of each client to the route, the requests over the limit receive 429 and Retry-After.
+// If Redis is not available the requests are allowed, the limiter must not take down the service.
+func Middleware(route string, l Limit, next http.HandlerFunc) http.HandlerFunc {
+	if l.Rate <= 0 || l.Burst <= 0 {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := fmt.Sprintf("ratelimit:%s:%s", route, ClientKey(r))
+		allowed, wait, err := Allow(key, l)
+		if err != nil {
+			logging.FromContext(r.Context()).Warn("could not check rate limit", "route", route, "error", err)
+			next(w, r)
+			return
+		}
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			httputil.WriteError(w, httputil.CodeRateLimited, "too many requests")
+			return
+		}
+
+		next(w, r)
+	}
+}
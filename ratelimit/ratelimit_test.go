@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/douglasmakey/tracking/storages"
+)
+
+func TestMiddleware(t *testing.T) {
+	if err := storages.GetRedisClient().Ping().Err(); err != nil {
+		t.Skipf("redis is not available: %v", err)
+	}
+
+	route := fmt.Sprintf("/test-%d", time.Now().UnixNano())
+	defer storages.GetRedisClient().Del(fmt.Sprintf("ratelimit:%s:ip:192.0.2.1", route))
+	calls := 0
+	h := Middleware(route, Limit{Rate: 0.1, Burst: 2}, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// The burst is allowed, the next request waits for a token, about 10 seconds at 0.1 tokens per second.
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(http.MethodGet, route, nil))
+		if i < 2 {
+			if rec.Code != http.StatusOK {
+				t.Errorf("request %d: expected 200, got %d", i, rec.Code)
+			}
+			continue
+		}
+		if rec.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected 429, got %d", rec.Code)
+		}
+		if after := rec.Header().Get("Retry-After"); after != "10" && after != "9" {
+			t.Errorf("unexpected Retry-After %q", after)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("expected the handler to run twice, it ran %d times", calls)
+	}
+}
+
+func TestMiddlewareDisabled(t *testing.T) {
+	next := func(w http.ResponseWriter, r *http.Request) {}
+	h := Middleware("/test", Limit{}, next)
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, "/test", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected the route without limit to pass, got %d", rec.Code)
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	if key := ClientKey(req); key != "ip:192.0.2.1" {
+		t.Errorf("unexpected key %q", key)
+	}
+}
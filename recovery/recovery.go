@@ -0,0 +1,106 @@
+// Package recovery turns the panics of the handlers and the background goroutines into logged errors, so a bug in a request
+// or a job does not crash the whole process. The panics are logged with their stack, counted and sent to the reporter if one is set.
+package recovery
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/douglasmakey/tracking/httputil"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/metrics"
+)
+
+// restartPause is the wait before a goroutine of Go runs again after a panic.
+const restartPause = time.Second
+
+// Panic is a recovered panic.
+type Panic struct {
+	// Where is the handler or the goroutine that panicked, e.g. the route or "search".
+	Where         string
+	Value         interface{}
+	Stack         []byte
+	CorrelationID string
+	Time          time.Time
+}
+
+// Error returns the value of the panic as a message.
+func (p Panic) Error() string {
+	return fmt.Sprintf("panic in %s: %v", p.Where, p.Value)
+}
+
+// Reporter receives the recovered panics, e.g. an error tracking service. Report must not block.
+type Reporter interface {
+	Report(p Panic)
+}
+
+var (
+	mu       sync.RWMutex
+	reporter Reporter
+)
+
+// SetReporter sets the reporter of the panics, nil only logs them.
+func SetReporter(r Reporter) {
+	mu.Lock()
+	defer mu.Unlock()
+	reporter = r
+}
+
+// handle logs, counts and reports the value of a recovered panic.
+func handle(ctx context.Context, where string, v interface{}) {
+	p := Panic{Where: where, Value: v, Stack: debug.Stack(), CorrelationID: logging.CorrelationID(ctx), Time: time.Now().UTC()}
+	logging.FromContext(ctx).Error("panic recovered", "where", where, "panic", fmt.Sprint(v), "stack", string(p.Stack))
+	metrics.Panics.WithLabelValues(where).Inc()
+
+	mu.RLock()
+	r := reporter
+	mu.RUnlock()
+	if r != nil {
+		r.Report(p)
+	}
+}
+
+// Middleware recovers the panics of the handlers and replies 500, the label of the panic is the route of the request.
+// The http.ErrAbortHandler panics abort the response on purpose, they are not recovered.
+func Middleware(next http.Handler, route func(r *http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			handle(r.Context(), route(r), v)
+			// If the handler already wrote the headers this only completes the body, the client sees a broken response.
+			httputil.WriteError(w, httputil.CodeInternal, "internal error")
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Guard calls fn and recovers its panic, it returns true if fn panicked.
+func Guard(where string, fn func()) (panicked bool) {
+	defer func() {
+		if v := recover(); v != nil {
+			handle(context.Background(), where, v)
+			panicked = true
+		}
+	}()
+	fn()
+	return false
+}
+
+// Go runs fn in a goroutine, fn runs again after a pause if it panics. It is meant for the loops of the background jobs.
+func Go(where string, fn func()) {
+	go func() {
+		for Guard(where, fn) {
+			time.Sleep(restartPause)
+		}
+	}()
+}
@@ -0,0 +1,85 @@
+package recovery
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// reporterFunc reports the panics with a function.
+type reporterFunc func(p Panic)
+
+func (f reporterFunc) Report(p Panic) { f(p) }
+
+func TestMiddleware(t *testing.T) {
+	var reported []Panic
+	SetReporter(reporterFunc(func(p Panic) { reported = append(reported, p) }))
+	defer SetReporter(nil)
+
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}), func(r *http.Request) string { return "/search" })
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/search", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", w.Code)
+	}
+	if len(reported) != 1 || reported[0].Where != "/search" || reported[0].Value != "boom" || len(reported[0].Stack) == 0 {
+		t.Errorf("unexpected reported panics %+v", reported)
+	}
+}
+
+func TestMiddlewareAbort(t *testing.T) {
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}), func(r *http.Request) string { return "" })
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("expected the abort panic, got %v", v)
+		}
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+func TestGuard(t *testing.T) {
+	if Guard("test", func() {}) {
+		t.Error("expected no panic")
+	}
+	if !Guard("test", func() { panic("boom") }) {
+		t.Error("expected a panic")
+	}
+}
+
+func TestSentry(t *testing.T) {
+	if _, err := NewSentry("https://sentry.example.com/1"); err == nil {
+		t.Error("expected an error for a dsn without key")
+	}
+
+	received := make(chan sentryEvent, 1)
+	var auth, path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth, path = r.Header.Get("X-Sentry-Auth"), r.URL.Path
+		var ev sentryEvent
+		json.NewDecoder(r.Body).Decode(&ev)
+		received <- ev
+	}))
+	defer srv.Close()
+
+	s, err := NewSentry("http://key@" + srv.Listener.Addr().String() + "/42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Report(Panic{Where: "search", Value: "boom", Stack: []byte("stack"), Time: time.Now()})
+
+	select {
+	case ev := <-received:
+		if path != "/api/42/store/" || auth == "" || ev.Tags["where"] != "search" || ev.Extra["stack"] != "stack" {
+			t.Errorf("unexpected event %+v at %s with auth %q", ev, path, auth)
+		}
+	case <-time.After(time.Second):
+		t.Error("the panic was not sent")
+	}
+}
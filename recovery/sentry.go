@@ -0,0 +1,112 @@
+package recovery
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/douglasmakey/tracking/logging"
+)
+
+// sentryQueue is the number of panics waiting to be sent, the panics are dropped when it is full.
+const sentryQueue = 100
+
+// Sentry sends the panics to the store endpoint of a Sentry compatible service, e.g. Sentry or GlitchTip.
+type Sentry struct {
+	// Endpoint is the store URL of the project and Key the public key of the DSN.
+	Endpoint string
+	Key      string
+	Client   *http.Client
+	queue    chan Panic
+}
+
+// NewSentry returns a reporter for the DSN of a project, https://{key}@{host}/{project}, it sends the panics in a goroutine.
+func NewSentry(dsn string) (*Sentry, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	project := strings.Trim(u.Path, "/")
+	if u.User == nil || u.User.Username() == "" || project == "" {
+		return nil, fmt.Errorf("invalid sentry dsn, the format is https://{key}@{host}/{project}")
+	}
+	s := &Sentry{
+		Endpoint: fmt.Sprintf("%s://%s/api/%s/store/", u.Scheme, u.Host, project),
+		Key:      u.User.Username(),
+		Client:   &http.Client{Timeout: time.Second * 5},
+		queue:    make(chan Panic, sentryQueue),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Report queues the panic, it does not wait for the service.
+func (s *Sentry) Report(p Panic) {
+	select {
+	case s.queue <- p:
+	default:
+		logging.Logger.Warn("sentry queue full, panic not reported", "where", p.Where)
+	}
+}
+
+func (s *Sentry) run() {
+	for p := range s.queue {
+		if err := s.send(p); err != nil {
+			logging.Logger.Warn("could not report panic to sentry", "where", p.Where, "error", err)
+		}
+	}
+}
+
+// sentryEvent is the payload of the store endpoint.
+type sentryEvent struct {
+	EventID   string            `json:"event_id"`
+	Timestamp string            `json:"timestamp"`
+	Level     string            `json:"level"`
+	Platform  string            `json:"platform"`
+	Message   string            `json:"message"`
+	Tags      map[string]string `json:"tags"`
+	Extra     map[string]string `json:"extra"`
+}
+
+func (s *Sentry) send(p Panic) error {
+	id := make([]byte, 16)
+	rand.Read(id)
+	ev := sentryEvent{
+		EventID:   hex.EncodeToString(id),
+		Timestamp: p.Time.Format(time.RFC3339),
+		Level:     "fatal",
+		Platform:  "go",
+		Message:   p.Error(),
+		Tags:      map[string]string{"where": p.Where},
+		Extra:     map[string]string{"stack": string(p.Stack)},
+	}
+	if p.CorrelationID != "" {
+		ev.Tags["correlation_id"] = p.CorrelationID
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=tracking/1.0, sentry_key=%s", s.Key))
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sentry responded %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+// Package retry retries the calls to the storage and the external services with exponential backoff and jitter.
+// Each integration has its own policy and retry budget, so an outage of a service does not multiply its load.
+package retry
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/douglasmakey/tracking/metrics"
+)
+
+// These are the integrations that retry their calls.
+const (
+	Storage   = "storage"
+	Callbacks = "callbacks"
+	Notify    = "notify"
+	Workflow  = "workflow"
+	Routing   = "routing"
+	Bus       = "bus"
+)
+
+// Policy is how the calls of an integration are retried, the wait before the attempt n is Initial * 2^(n-1) up to Max.
+// Jitter is the fraction of the wait that is random, so the clients that failed at the same time do not retry at the same time.
+type Policy struct {
+	Attempts int
+	Initial  time.Duration
+	Max      time.Duration
+	Jitter   float64
+	// Budget limits the retries when most of the calls fail, nil does not limit them.
+	Budget *Budget
+}
+
+// Backoff returns the wait before the retry attempt, the first retry is the attempt 1.
+func (p Policy) Backoff(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	d := p.Initial << uint(attempt-1)
+	if d <= 0 || (p.Max > 0 && d > p.Max) {
+		d = p.Max
+	}
+	if p.Jitter > 0 {
+		spread := float64(d) * p.Jitter
+		d = time.Duration(float64(d) - spread + rand.Float64()*spread)
+	}
+	return d
+}
+
+// Do calls fn until it succeeds, it returns a permanent error, the attempts are exhausted or the budget does not allow more retries,
+// the last error is returned. The waits are interrupted when ctx is done, name is the integration for the metrics.
+func (p Policy) Do(ctx context.Context, name string, fn func() error) error {
+	attempts := p.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	for i := 0; i < attempts; i++ {
+		if err = fn(); err == nil {
+			p.Budget.success()
+			metrics.Retries.WithLabelValues(name, "success").Inc()
+			return nil
+		}
+		var perm *permanentError
+		if errors.As(err, &perm) {
+			metrics.Retries.WithLabelValues(name, "permanent").Inc()
+			return perm.err
+		}
+		p.Budget.failure()
+		if i == attempts-1 {
+			break
+		}
+		if !p.Budget.allow() {
+			metrics.Retries.WithLabelValues(name, "budget_exhausted").Inc()
+			return err
+		}
+
+		metrics.Retries.WithLabelValues(name, "retry").Inc()
+		select {
+		case <-time.After(p.Backoff(i + 1)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	metrics.Retries.WithLabelValues(name, "exhausted").Inc()
+	return err
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps an error that must not be retried, e.g. a 4xx response. Do returns the original error.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// Budget is a token bucket shared by the calls of an integration: each failure takes a token and each success
+// returns Ratio tokens, the retries are allowed while the bucket is more than half full.
+type Budget struct {
+	Max   float64
+	Ratio float64
+
+	mu     sync.Mutex
+	tokens float64
+	init   bool
+}
+
+// NewBudget returns a full budget.
+func NewBudget(max, ratio float64) *Budget {
+	return &Budget{Max: max, Ratio: ratio, tokens: max, init: true}
+}
+
+func (b *Budget) success() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.Max, b.tokens+b.Ratio)
+}
+
+func (b *Budget) failure() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = max(0, b.tokens-1)
+}
+
+func (b *Budget) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens > b.Max/2
+}
+
+var (
+	mu       sync.RWMutex
+	policies = map[string]Policy{
+		Storage:   {Attempts: 3, Initial: time.Millisecond * 50, Max: time.Millisecond * 500, Jitter: 0.5},
+		Callbacks: {Attempts: 8, Initial: time.Second, Max: time.Minute * 5, Jitter: 0.2},
+		Notify:    {Attempts: 3, Initial: time.Millisecond * 200, Max: time.Second * 5, Jitter: 0.5, Budget: NewBudget(100, 0.1)},
+		Workflow:  {Attempts: 5, Initial: time.Second, Max: time.Second * 30, Jitter: 0.5, Budget: NewBudget(100, 0.1)},
+		Routing:   {Attempts: 2, Initial: time.Millisecond * 100, Max: time.Millisecond * 100, Jitter: 0.5, Budget: NewBudget(50, 0.1)},
+		Bus:       {Attempts: 5, Initial: time.Millisecond * 200, Max: time.Second * 5, Jitter: 0.5, Budget: NewBudget(100, 0.1)},
+	}
+)
+
+// Configure sets the policy of the integration, the budget of the current policy is kept.
+func Configure(name string, p Policy) {
+	mu.Lock()
+	defer mu.Unlock()
+	if p.Budget == nil {
+		p.Budget = policies[name].Budget
+	}
+	policies[name] = p
+}
+
+// For returns the policy of the integration, the unknown integrations are not retried.
+func For(name string) Policy {
+	mu.RLock()
+	defer mu.RUnlock()
+	if p, ok := policies[name]; ok {
+		return p
+	}
+	return Policy{Attempts: 1}
+}
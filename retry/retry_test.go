@@ -0,0 +1,101 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	p := Policy{Initial: time.Second, Max: time.Second * 10}
+	for attempt, want := range map[int]time.Duration{1: time.Second, 3: time.Second * 4, 100: time.Second * 10} {
+		if d := p.Backoff(attempt); d != want {
+			t.Errorf("expected %s for attempt %d, got %s", want, attempt, d)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := p.Backoff(2); d < time.Second || d > time.Second*2 {
+			t.Fatalf("the jittered backoff must be between 1s and 2s, got %s", d)
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+	p := Policy{Attempts: 3, Initial: time.Millisecond}
+	var calls int
+	err := p.Do(context.Background(), "test", func() error {
+		calls++
+		return errors.New("unavailable")
+	})
+	if err == nil || calls != 3 {
+		t.Errorf("expected 3 attempts and an error, got %d attempts and %v", calls, err)
+	}
+
+	calls = 0
+	err = p.Do(context.Background(), "test", func() error {
+		calls++
+		if calls < 2 {
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Errorf("expected success on the second attempt, got %d attempts and %v", calls, err)
+	}
+
+	// The permanent errors are not retried and they are returned unwrapped.
+	calls = 0
+	errRejected := errors.New("rejected")
+	err = p.Do(context.Background(), "test", func() error {
+		calls++
+		return Permanent(errRejected)
+	})
+	if err != errRejected || calls != 1 {
+		t.Errorf("expected 1 attempt and the original error, got %d attempts and %v", calls, err)
+	}
+}
+
+func TestDoContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p := Policy{Attempts: 3, Initial: time.Hour}
+	err := p.Do(ctx, "test", func() error { return errors.New("unavailable") })
+	if err != context.Canceled {
+		t.Errorf("expected the wait to be interrupted, got %v", err)
+	}
+}
+
+func TestBudget(t *testing.T) {
+	b := NewBudget(4, 1)
+	p := Policy{Attempts: 10, Initial: time.Millisecond, Budget: b}
+	var calls int
+	p.Do(context.Background(), "test", func() error {
+		calls++
+		return errors.New("unavailable")
+	})
+	// Each failure takes a token, the retries stop when the bucket is half empty.
+	if calls != 2 {
+		t.Errorf("expected the budget to stop the retries after 2 attempts, got %d", calls)
+	}
+
+	// The successes refill the budget.
+	p.Do(context.Background(), "test", func() error { return nil })
+	p.Do(context.Background(), "test", func() error { return nil })
+	if !b.allow() {
+		t.Error("the budget must allow retries after the successes")
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	budget := For(Routing).Budget
+	Configure(Routing, Policy{Attempts: 5, Initial: time.Second})
+	if p := For(Routing); p.Attempts != 5 || p.Budget != budget {
+		t.Errorf("the policy must be replaced keeping the budget, got %+v", p)
+	}
+	if p := For("unknown"); p.Attempts != 1 {
+		t.Errorf("the unknown integrations must not be retried, got %+v", p)
+	}
+}
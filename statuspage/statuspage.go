@@ -0,0 +1,341 @@
+// Package statuspage summarizes the health of the service over the last day, week and month for the public status page.
+// Each instance counts the outcomes of its requests in memory and a snapshotter adds them to hourly buckets in Redis,
+// so the summary covers every instance without a Redis call per request.
+package statuspage
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// These are the states of the service.
+const (
+	StatusOperational = "operational"
+	StatusDegraded    = "degraded"
+	StatusMaintenance = "maintenance"
+)
+
+const (
+	// episodesKey is a sorted set of the degraded episodes by start, the member is "start:end" in unix seconds.
+	episodesKey = "statuspage:episodes"
+	// retention is the time that the buckets and the episodes are kept, it covers the longest window.
+	retention = time.Hour * 24 * 31
+	// summaryTTL is the time that an instance reuses its summary, the status page is polled by many clients.
+	summaryTTL = time.Second * 30
+)
+
+// Windows are the periods of the summary.
+var Windows = []struct {
+	Name     string
+	Duration time.Duration
+}{
+	{"24h", time.Hour * 24},
+	{"7d", time.Hour * 24 * 7},
+	{"30d", time.Hour * 24 * 30},
+}
+
+// matchBuckets are the upper bounds in seconds of the buckets of the time to match, the median is the bound of its bucket.
+var matchBuckets = []float64{5, 10, 15, 20, 30, 45, 60, 90, 120, 180, 240, 300, 600}
+
+func bucketKey(t time.Time) string {
+	return fmt.Sprintf("statuspage:%s", t.UTC().Format("2006010215"))
+}
+
+// counts are the outcomes of the requests not snapshotted yet.
+var counts = struct {
+	sync.Mutex
+	fields map[string]int64
+}{fields: make(map[string]int64)}
+
+// Observe counts the outcome of a request created at created, the time to match is counted for the matched requests.
+// The canceled requests are not observed, the rider gave up before the outcome.
+func Observe(matched bool, created time.Time) {
+	counts.Lock()
+	defer counts.Unlock()
+	counts.fields["requests"]++
+	if !matched {
+		return
+	}
+	counts.fields["matched"]++
+	if !created.IsZero() {
+		counts.fields[matchField(time.Since(created))]++
+	}
+}
+
+// matchField returns the field of the bucket of the time to match d.
+func matchField(d time.Duration) string {
+	for _, le := range matchBuckets {
+		if d.Seconds() <= le {
+			return "ttm:" + strconv.FormatFloat(le, 'f', -1, 64)
+		}
+	}
+	return "ttm:+Inf"
+}
+
+// Snapshotter adds the counts of the instance to the bucket of the current hour every Interval and records the episodes
+// while the circuit breaker of Redis was open.
+type Snapshotter struct {
+	Interval time.Duration
+}
+
+// Start launches the snapshotter in a goroutine.
+func (s Snapshotter) Start() {
+	go func() {
+		ticker := time.NewTicker(s.Interval)
+		defer ticker.Stop()
+
+		var degradedSince time.Time
+		for now := range ticker.C {
+			// The episode is recorded when it ends, Redis is unavailable while the breaker is open.
+			open, since := storages.GetBreaker().State()
+			if open {
+				degradedSince = since
+				continue
+			}
+			if !degradedSince.IsZero() {
+				if err := recordEpisode(degradedSince, now); err != nil {
+					logging.Logger.Warn("could not record degraded episode", "error", err)
+					continue
+				}
+				degradedSince = time.Time{}
+			}
+			snapshot(now)
+		}
+	}()
+}
+
+// snapshot moves the counts of the instance to the bucket of the hour of now, they are kept for the next snapshot if Redis fails.
+func snapshot(now time.Time) {
+	counts.Lock()
+	fields := counts.fields
+	counts.fields = make(map[string]int64)
+	counts.Unlock()
+	if len(fields) == 0 {
+		return
+	}
+
+	key := bucketKey(now)
+	rClient := storages.GetRedisClient()
+	_, err := rClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		for f, n := range fields {
+			pipe.HIncrBy(key, f, n)
+		}
+		pipe.Expire(key, retention)
+		return nil
+	})
+	if err != nil {
+		logging.Logger.Warn("could not snapshot status counts", "error", storages.Classify(err))
+		counts.Lock()
+		for f, n := range fields {
+			counts.fields[f] += n
+		}
+		counts.Unlock()
+	}
+}
+
+func recordEpisode(from, to time.Time) error {
+	rClient := storages.GetRedisClient()
+	member := fmt.Sprintf("%d:%d", from.Unix(), to.Unix())
+	_, err := rClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(episodesKey, redis.Z{Score: float64(from.Unix()), Member: member})
+		pipe.ZRemRangeByScore(episodesKey, "-inf", strconv.FormatInt(time.Now().Add(-retention).Unix(), 10))
+		return nil
+	})
+	return storages.Classify(err)
+}
+
+// Episode is a period while the service was degraded.
+type Episode struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// WindowSummary is the health of the service during a window.
+type WindowSummary struct {
+	Window   string `json:"window"`
+	Requests int64  `json:"requests"`
+	// Uptime is the fraction of the window out of the degraded episodes.
+	Uptime float64 `json:"uptime"`
+	// MatchSuccessRate is the fraction of the requests that found a driver, nil without requests.
+	MatchSuccessRate *float64 `json:"match_success_rate"`
+	// MedianTimeToMatch is the upper bound of the bucket of the median time to match, nil without matches.
+	MedianTimeToMatch *float64 `json:"median_time_to_match_seconds"`
+	DegradedEpisodes  int      `json:"degraded_episodes"`
+}
+
+var summaries = struct {
+	sync.Mutex
+	list []WindowSummary
+	at   time.Time
+}{}
+
+// Summary returns the health of the service over each of the Windows, the summary is reused for a few seconds.
+func Summary() ([]WindowSummary, error) {
+	summaries.Lock()
+	defer summaries.Unlock()
+	if summaries.list != nil && time.Since(summaries.at) < summaryTTL {
+		return summaries.list, nil
+	}
+
+	now := time.Now()
+	longest := Windows[len(Windows)-1].Duration
+	buckets, err := loadBuckets(now, longest)
+	if err != nil {
+		return nil, err
+	}
+	episodes, err := loadEpisodes(now.Add(-longest))
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]WindowSummary, len(Windows))
+	for i, w := range Windows {
+		hours := int(w.Duration / time.Hour)
+		list[i] = summarize(w.Name, w.Duration, buckets[:hours], clip(episodes, now.Add(-w.Duration), now))
+	}
+	summaries.list, summaries.at = list, now
+	return list, nil
+}
+
+// loadBuckets returns the hourly buckets of the period before now, the newest first.
+func loadBuckets(now time.Time, period time.Duration) ([]map[string]string, error) {
+	hours := int(period / time.Hour)
+	rClient := storages.GetRedisClient()
+	var cmds []redis.Cmder
+	err := storages.WithRetry(func() (err error) {
+		cmds, err = rClient.Pipelined(func(pipe redis.Pipeliner) error {
+			for i := 0; i < hours; i++ {
+				pipe.HGetAll(bucketKey(now.Add(-time.Hour * time.Duration(i))))
+			}
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := make([]map[string]string, len(cmds))
+	for i, cmd := range cmds {
+		buckets[i], _ = cmd.(*redis.StringStringMapCmd).Result()
+	}
+	return buckets, nil
+}
+
+// loadEpisodes returns the episodes that ended after since, merged when they overlap, e.g. the same outage seen by every instance.
+func loadEpisodes(since time.Time) ([]Episode, error) {
+	rClient := storages.GetRedisClient()
+	var members []string
+	err := storages.WithRetry(func() (err error) {
+		members, err = rClient.ZRange(episodesKey, 0, -1).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var episodes []Episode
+	for _, m := range members {
+		var from, to int64
+		if _, err := fmt.Sscanf(m, "%d:%d", &from, &to); err != nil || time.Unix(to, 0).Before(since) {
+			continue
+		}
+		episodes = append(episodes, Episode{Start: time.Unix(from, 0), End: time.Unix(to, 0)})
+	}
+	return Merge(episodes), nil
+}
+
+// Merge returns the episodes sorted by start with the overlapping ones joined.
+func Merge(episodes []Episode) []Episode {
+	sort.Slice(episodes, func(i, j int) bool { return episodes[i].Start.Before(episodes[j].Start) })
+	var merged []Episode
+	for _, e := range episodes {
+		if n := len(merged); n > 0 && !e.Start.After(merged[n-1].End) {
+			if e.End.After(merged[n-1].End) {
+				merged[n-1].End = e.End
+			}
+			continue
+		}
+		merged = append(merged, e)
+	}
+	return merged
+}
+
+// clip returns the parts of the episodes inside [from, to].
+func clip(episodes []Episode, from, to time.Time) []Episode {
+	var clipped []Episode
+	for _, e := range episodes {
+		if e.End.Before(from) || e.Start.After(to) {
+			continue
+		}
+		if e.Start.Before(from) {
+			e.Start = from
+		}
+		if e.End.After(to) {
+			e.End = to
+		}
+		clipped = append(clipped, e)
+	}
+	return clipped
+}
+
+// summarize builds the summary of a window from its hourly buckets and its degraded episodes.
+func summarize(name string, window time.Duration, buckets []map[string]string, episodes []Episode) WindowSummary {
+	s := WindowSummary{Window: name, DegradedEpisodes: len(episodes)}
+	var degraded time.Duration
+	for _, e := range episodes {
+		degraded += e.End.Sub(e.Start)
+	}
+	s.Uptime = math.Round((1-degraded.Seconds()/window.Seconds())*1e5) / 1e5
+
+	var matched int64
+	ttm := make(map[string]int64)
+	for _, b := range buckets {
+		for f, v := range b {
+			n, _ := strconv.ParseInt(v, 10, 64)
+			switch f {
+			case "requests":
+				s.Requests += n
+			case "matched":
+				matched += n
+			default:
+				ttm[f] += n
+			}
+		}
+	}
+	if s.Requests > 0 {
+		rate := math.Round(float64(matched)/float64(s.Requests)*1e4) / 1e4
+		s.MatchSuccessRate = &rate
+	}
+	s.MedianTimeToMatch = median(ttm)
+	return s
+}
+
+// median returns the upper bound of the bucket of the median of the time to match buckets, nil if they are empty.
+// The matches slower than the last bucket have the last bound.
+func median(ttm map[string]int64) *float64 {
+	var total int64
+	for _, n := range ttm {
+		total += n
+	}
+	if total == 0 {
+		return nil
+	}
+	var seen int64
+	for _, le := range matchBuckets {
+		seen += ttm["ttm:"+strconv.FormatFloat(le, 'f', -1, 64)]
+		if seen*2 >= total {
+			return &le
+		}
+	}
+	last := matchBuckets[len(matchBuckets)-1]
+	return &last
+}
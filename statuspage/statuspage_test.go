@@ -0,0 +1,53 @@
+package statuspage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMerge(t *testing.T) {
+	at := func(m int) time.Time { return time.Date(2020, 1, 1, 0, m, 0, 0, time.UTC) }
+	// Two instances saw the same outage and a later one.
+	merged := Merge([]Episode{{at(30), at(35)}, {at(0), at(10)}, {at(2), at(12)}})
+	if len(merged) != 2 || !merged[0].Start.Equal(at(0)) || !merged[0].End.Equal(at(12)) || !merged[1].Start.Equal(at(30)) {
+		t.Errorf("unexpected episodes %v", merged)
+	}
+
+	clipped := clip(merged, at(5), at(32))
+	if len(clipped) != 2 || !clipped[0].Start.Equal(at(5)) || !clipped[1].End.Equal(at(32)) {
+		t.Errorf("unexpected clipped episodes %v", clipped)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	buckets := []map[string]string{
+		{"requests": "6", "matched": "4", "ttm:10": "1", "ttm:30": "2"},
+		{"requests": "4", "matched": "4", "ttm:30": "1", "ttm:+Inf": "3"},
+	}
+	episodes := []Episode{{Start: time.Unix(0, 0), End: time.Unix(0, 0).Add(time.Hour)}}
+	s := summarize("24h", time.Hour*24, buckets, episodes)
+	if s.Requests != 10 || *s.MatchSuccessRate != 0.8 || s.DegradedEpisodes != 1 {
+		t.Errorf("unexpected summary %+v", s)
+	}
+	if s.Uptime != 0.95833 {
+		t.Errorf("expected uptime 0.95833, got %v", s.Uptime)
+	}
+	// The 4th of 7 matches is in the 30s bucket.
+	if *s.MedianTimeToMatch != 30 {
+		t.Errorf("expected median 30, got %v", *s.MedianTimeToMatch)
+	}
+
+	empty := summarize("24h", time.Hour*24, nil, nil)
+	if empty.Uptime != 1 || empty.MatchSuccessRate != nil || empty.MedianTimeToMatch != nil {
+		t.Errorf("unexpected empty summary %+v", empty)
+	}
+}
+
+func TestMatchField(t *testing.T) {
+	if f := matchField(time.Second * 12); f != "ttm:15" {
+		t.Errorf("expected ttm:15, got %s", f)
+	}
+	if f := matchField(time.Hour); f != "ttm:+Inf" {
+		t.Errorf("expected ttm:+Inf, got %s", f)
+	}
+}
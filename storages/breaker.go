@@ -0,0 +1,84 @@
+package storages
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/metrics"
+	"github.com/douglasmakey/tracking/retry"
+)
+
+// ErrUnavailable is returned by the reads without calling Redis while the circuit breaker is open.
+var ErrUnavailable = errors.New("redis is unavailable")
+
+// Breaker is the circuit breaker of Redis, it opens after Threshold consecutive transient errors. While it is open
+// the reads fail without calling Redis and a probe pings Redis with the Reconnect backoff until it answers.
+type Breaker struct {
+	Threshold int
+	Reconnect retry.Policy
+
+	mu       sync.Mutex
+	failures int
+	open     bool
+	since    time.Time
+}
+
+// Record counts the result of a call to Redis, ping is used by the probe when the breaker opens.
+// Any answer of Redis closes the breaker, e.g. a missing key.
+func (b *Breaker) Record(err error, ping func() error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !IsTransient(err) {
+		b.failures = 0
+		if b.open {
+			b.open = false
+			metrics.RedisBreakerOpen.Set(0)
+			logging.Logger.Info("redis is available again", "unavailable_for", time.Since(b.since).String())
+		}
+		return
+	}
+
+	b.failures++
+	if b.open || b.failures < b.Threshold {
+		return
+	}
+	b.open = true
+	b.since = time.Now()
+	metrics.RedisBreakerOpen.Set(1)
+	logging.Logger.Error("redis is unavailable, opening the circuit breaker", "failures", b.failures, "error", err)
+	go b.probe(ping)
+}
+
+// probe pings Redis with exponential backoff until the breaker closes.
+func (b *Breaker) probe(ping func() error) {
+	for attempt := 1; b.Open(); attempt++ {
+		time.Sleep(b.Reconnect.Backoff(attempt))
+		ping()
+	}
+}
+
+// Open returns true while Redis is unavailable.
+func (b *Breaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
+
+// State returns whether the breaker is open and since when.
+func (b *Breaker) State() (bool, time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open, b.since
+}
+
+var breaker = &Breaker{
+	Threshold: 5,
+	Reconnect: retry.Policy{Initial: time.Millisecond * 100, Max: time.Second * 10, Jitter: 0.2},
+}
+
+// GetBreaker returns the circuit breaker of Redis.
+func GetBreaker() *Breaker {
+	return breaker
+}
@@ -0,0 +1,63 @@
+package storages
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/douglasmakey/tracking/retry"
+)
+
+func TestBreaker(t *testing.T) {
+	b := &Breaker{Threshold: 3, Reconnect: retry.Policy{Initial: time.Millisecond, Max: time.Millisecond}}
+	pings := make(chan struct{}, 10)
+	ping := func() error {
+		pings <- struct{}{}
+		b.Record(nil, nil)
+		return nil
+	}
+
+	b.Record(timeoutError{}, ping)
+	b.Record(timeoutError{}, ping)
+	// A command error is an answer of Redis, it resets the failures.
+	b.Record(errors.New("ERR wrong number of arguments"), ping)
+	b.Record(timeoutError{}, ping)
+	b.Record(timeoutError{}, ping)
+	if b.Open() {
+		t.Fatal("expected the breaker to be closed before the threshold")
+	}
+
+	b.Record(timeoutError{}, ping)
+	if open, since := b.State(); !open || since.IsZero() {
+		t.Fatal("expected the breaker to be open after the threshold")
+	}
+
+	select {
+	case <-pings:
+	case <-time.After(time.Second):
+		t.Fatal("expected the probe to ping redis")
+	}
+	if b.Open() {
+		t.Error("expected the breaker to close when redis answers")
+	}
+}
+
+func TestWithRetryBreakerOpen(t *testing.T) {
+	breaker.mu.Lock()
+	breaker.open = true
+	breaker.mu.Unlock()
+	defer func() {
+		breaker.mu.Lock()
+		breaker.open = false
+		breaker.mu.Unlock()
+	}()
+
+	var calls int
+	err := WithRetry(func() error {
+		calls++
+		return nil
+	})
+	if calls != 0 || !IsTransient(err) || !errors.Is(err, ErrUnavailable) {
+		t.Errorf("expected ErrUnavailable without calls, got %d calls and %v", calls, err)
+	}
+}
@@ -0,0 +1,143 @@
+package storages
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/go-redis/redis"
+)
+
+// Buffer is a LocationStore that keeps the locations in memory and writes them to its store in batches, every interval or when
+// size drivers are waiting, so thousands of drivers reporting every few seconds take a few pipelines instead of a round trip each.
+// Only the latest location of each driver is written. The other methods go straight to the store.
+type Buffer struct {
+	LocationStore
+	interval time.Duration
+	size     int
+	// reserved returns the reserved drivers, it is replaced in the tests.
+	reserved func(ids []string) (map[string]bool, error)
+
+	mu      sync.Mutex
+	pending map[string]*redis.GeoLocation
+	full    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// NewBuffer returns a buffer of the store and starts its flusher, the reservations are read with the client. Close flushes the last locations.
+func NewBuffer(store LocationStore, client *RedisClient, interval time.Duration, size int) *Buffer {
+	b := &Buffer{
+		LocationStore: store,
+		interval:      interval,
+		size:          size,
+		reserved:      func(ids []string) (map[string]bool, error) { return client.Reserved(ids) },
+		pending:       make(map[string]*redis.GeoLocation),
+		full:          make(chan struct{}, 1),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// AddDriverLocations queues the locations, they are written by the next flush. The errors of the store are logged by the flush.
+func (b *Buffer) AddDriverLocations(_ context.Context, locations []*redis.GeoLocation) error {
+	b.mu.Lock()
+	for _, l := range locations {
+		b.pending[l.Name] = l
+	}
+	full := len(b.pending) >= b.size
+	b.mu.Unlock()
+
+	if full {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// RemoveDriverLocation drops the queued location of the driver too, so a flush does not put it back in the search.
+func (b *Buffer) RemoveDriverLocation(id string) error {
+	b.mu.Lock()
+	delete(b.pending, id)
+	b.mu.Unlock()
+	return b.LocationStore.RemoveDriverLocation(id)
+}
+
+func (b *Buffer) run() {
+	defer close(b.stopped)
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.full:
+		case <-b.done:
+			b.Flush()
+			return
+		}
+		b.Flush()
+	}
+}
+
+// Flush writes the queued locations. The locations of the reserved drivers are dropped, a location queued before the reservation
+// must not put the driver back in the search. When the write fails the locations are queued again unless the driver sent a newer one.
+func (b *Buffer) Flush() error {
+	b.mu.Lock()
+	if len(b.pending) == 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	batch := b.pending
+	b.pending = make(map[string]*redis.GeoLocation, len(batch))
+	b.mu.Unlock()
+
+	ids := make([]string, 0, len(batch))
+	for id := range batch {
+		ids = append(ids, id)
+	}
+	reserved, err := b.reserved(ids)
+	if err != nil {
+		b.requeue(batch)
+		logging.Logger.Error("could not flush driver locations", "locations", len(batch), "error", err)
+		return err
+	}
+	locations := make([]*redis.GeoLocation, 0, len(batch))
+	for id, l := range batch {
+		if !reserved[id] {
+			locations = append(locations, l)
+		}
+	}
+	if len(locations) == 0 {
+		return nil
+	}
+
+	if err := b.LocationStore.AddDriverLocations(context.Background(), locations); err != nil {
+		b.requeue(batch)
+		logging.Logger.Error("could not flush driver locations", "locations", len(locations), "error", err)
+		return err
+	}
+	return nil
+}
+
+// requeue queues the locations of the failed flush again, the newer locations of the same drivers win.
+func (b *Buffer) requeue(batch map[string]*redis.GeoLocation) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, l := range batch {
+		if _, ok := b.pending[id]; !ok {
+			b.pending[id] = l
+		}
+	}
+}
+
+// Close stops the flusher after writing the queued locations, it is called on shutdown.
+func (b *Buffer) Close() {
+	close(b.done)
+	<-b.stopped
+}
@@ -0,0 +1,85 @@
+package storages
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// fakeStore keeps the written locations, it fails while err is set.
+type fakeStore struct {
+	LocationStore
+	err     error
+	written [][]*redis.GeoLocation
+	removed []string
+}
+
+func (s *fakeStore) AddDriverLocations(_ context.Context, locations []*redis.GeoLocation) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.written = append(s.written, locations)
+	return nil
+}
+
+func (s *fakeStore) RemoveDriverLocation(id string) error {
+	s.removed = append(s.removed, id)
+	return nil
+}
+
+func TestBufferFlush(t *testing.T) {
+	store := &fakeStore{}
+	b := NewBuffer(store, nil, time.Hour, 100)
+	b.reserved = func(ids []string) (map[string]bool, error) { return map[string]bool{"3": true}, nil }
+
+	b.AddDriverLocations(context.Background(), []*redis.GeoLocation{{Name: "1", Latitude: 1}, {Name: "2"}})
+	// Only the latest location of a driver is written and the reserved drivers are dropped.
+	b.AddDriverLocations(context.Background(), []*redis.GeoLocation{{Name: "1", Latitude: 2}, {Name: "3"}})
+	// The removed drivers are not written.
+	b.AddDriverLocations(context.Background(), []*redis.GeoLocation{{Name: "4"}})
+	b.RemoveDriverLocation("4")
+
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.written) != 1 || len(store.written[0]) != 2 {
+		t.Fatalf("expected one batch with 2 locations, got %v", store.written)
+	}
+	for _, l := range store.written[0] {
+		if l.Name == "1" && l.Latitude != 2 {
+			t.Errorf("expected the latest location of 1, got %v", l.Latitude)
+		}
+	}
+	if len(store.removed) != 1 {
+		t.Errorf("expected the driver removed from the store, got %v", store.removed)
+	}
+	b.Close()
+}
+
+func TestBufferRequeue(t *testing.T) {
+	store := &fakeStore{err: errors.New("unavailable")}
+	b := NewBuffer(store, nil, time.Hour, 100)
+	b.reserved = func(ids []string) (map[string]bool, error) { return nil, nil }
+
+	b.AddDriverLocations(context.Background(), []*redis.GeoLocation{{Name: "1", Latitude: 1}, {Name: "2", Latitude: 1}})
+	if err := b.Flush(); err == nil {
+		t.Fatal("expected the error of the store")
+	}
+	// The newer location queued after the failure wins over the failed one.
+	b.AddDriverLocations(context.Background(), []*redis.GeoLocation{{Name: "1", Latitude: 2}})
+
+	store.err = nil
+	// Close flushes the queued locations.
+	b.Close()
+	if len(store.written) != 1 || len(store.written[0]) != 2 {
+		t.Fatalf("expected one batch with 2 locations, got %v", store.written)
+	}
+	for _, l := range store.written[0] {
+		if l.Name == "1" && l.Latitude != 2 {
+			t.Errorf("expected the newer location of 1, got %v", l.Latitude)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package storages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/douglasmakey/tracking/metrics"
+	"github.com/douglasmakey/tracking/retry"
+	"github.com/go-redis/redis"
+)
+
+// Kind classifies the errors returned by the storage.
+type Kind int
+
+const (
+	// KindCommand is an error returned by Redis for a command, retrying does not help.
+	KindCommand Kind = iota
+	// KindTimeout means that Redis did not answer in time.
+	KindTimeout
+	// KindUnavailable means that the connection was refused or lost.
+	KindUnavailable
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindTimeout:
+		return "timeout"
+	case KindUnavailable:
+		return "unavailable"
+	default:
+		return "command"
+	}
+}
+
+const (
+	// RetryAfter is the time that clients should wait before retrying after a transient error.
+	RetryAfter = time.Second
+)
+
+// Error is an storage error with its classification.
+type Error struct {
+	Kind Kind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("storage %s: %v", e.Kind, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Transient returns true if the operation could succeed if it is retried later.
+func (e *Error) Transient() bool {
+	return e.Kind == KindTimeout || e.Kind == KindUnavailable
+}
+
+// Classify wraps err in an *Error with its kind, nil is returned as is.
+func Classify(err error) error {
+	if err == nil {
+		return nil
+	}
+	// redis.Nil is not an error of the storage but a missing key, the callers compare it directly.
+	if _, ok := err.(*Error); ok || err == redis.Nil {
+		return err
+	}
+
+	return &Error{Kind: kindOf(err), Err: err}
+}
+
+func kindOf(err error) Kind {
+	if err == ErrUnavailable {
+		return KindUnavailable
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return KindTimeout
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return KindUnavailable
+	}
+	var oe *net.OpError
+	if errors.As(err, &oe) {
+		return KindUnavailable
+	}
+	// go-redis returns this error when there is no free connection in the pool.
+	if strings.Contains(err.Error(), "pool timeout") {
+		return KindUnavailable
+	}
+	// These are returned while a replica is promoted or a node of the cluster is down, the next attempt can reach the new primary.
+	for _, prefix := range []string{"READONLY ", "LOADING ", "MASTERDOWN "} {
+		if strings.HasPrefix(err.Error(), prefix) {
+			return KindUnavailable
+		}
+	}
+	if clusterError(err) != "" {
+		return KindUnavailable
+	}
+
+	return KindCommand
+}
+
+// clusterError returns the error of a Redis Cluster whose slots are moving: moved and ask are the redirections that the client
+// could not follow within its max redirects, clusterdown and tryagain are returned while a slot has no primary or is being migrated.
+// It returns empty for the other errors.
+func clusterError(err error) string {
+	if err == nil {
+		return ""
+	}
+	for _, prefix := range []string{"MOVED ", "ASK ", "CLUSTERDOWN ", "TRYAGAIN "} {
+		if strings.HasPrefix(err.Error(), prefix) {
+			return strings.ToLower(strings.TrimSpace(prefix))
+		}
+	}
+	return ""
+}
+
+// IsTransient returns true if err is a storage error that could succeed if it is retried later.
+func IsTransient(err error) bool {
+	e, ok := Classify(err).(*Error)
+	return ok && e.Transient()
+}
+
+// HTTPStatus maps err to the status that the handlers must return, transient errors are 503 and the client should retry after RetryAfter.
+func HTTPStatus(err error) int {
+	if IsTransient(err) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// WithClusterRetry runs the idempotent write fn again while it fails because the slots of the cluster are moving, with the storage
+// retry policy, so a brief reshard does not drop the write. The other errors are returned at once. The returned error is classified.
+func WithClusterRetry(fn func() error) error {
+	err := retry.For(retry.Storage).Do(context.Background(), retry.Storage, func() error {
+		err := fn()
+		if e := clusterError(err); e != "" {
+			metrics.ClusterRetries.WithLabelValues(e).Inc()
+			return err
+		}
+		return retry.Permanent(err)
+	})
+	return Classify(err)
+}
+
+// WithRetry runs the idempotent read fn with the storage retry policy until it succeeds, it fails with a non transient error
+// or the attempts are exhausted. The returned error is classified.
+// While the circuit breaker is open it returns ErrUnavailable without calling fn.
+func WithRetry(fn func() error) error {
+	// The reads fail fast while Redis is unavailable, the probe of the breaker finds when it is back.
+	if breaker.Open() {
+		return Classify(ErrUnavailable)
+	}
+	// A missing key is a successful read, it is returned as is without being counted as a failure.
+	var missing bool
+	err := retry.For(retry.Storage).Do(context.Background(), retry.Storage, func() error {
+		err := Classify(fn())
+		if err == redis.Nil {
+			missing = true
+			return nil
+		}
+		if err != nil && !IsTransient(err) {
+			return retry.Permanent(err)
+		}
+		return err
+	})
+	if err == nil && missing {
+		return redis.Nil
+	}
+	return err
+}
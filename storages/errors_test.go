@@ -0,0 +1,97 @@
+package storages
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/douglasmakey/tracking/retry"
+	"github.com/go-redis/redis"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassify(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	tests := []struct {
+		err    error
+		kind   Kind
+		status int
+	}{
+		{timeoutError{}, KindTimeout, http.StatusServiceUnavailable},
+		{refused, KindUnavailable, http.StatusServiceUnavailable},
+		{errors.New("ERR wrong number of arguments"), KindCommand, http.StatusInternalServerError},
+		{errors.New("READONLY You can't write against a read only replica."), KindUnavailable, http.StatusServiceUnavailable},
+		{errors.New("CLUSTERDOWN The cluster is down"), KindUnavailable, http.StatusServiceUnavailable},
+		{errors.New("MOVED 3999 127.0.0.1:6381"), KindUnavailable, http.StatusServiceUnavailable},
+		{errors.New("ASK 3999 127.0.0.1:6381"), KindUnavailable, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		e, ok := Classify(tt.err).(*Error)
+		if !ok {
+			t.Fatalf("expected *Error for %v", tt.err)
+		}
+		if e.Kind != tt.kind {
+			t.Errorf("unexpected kind %s for %v", e.Kind, tt.err)
+		}
+		if status := HTTPStatus(tt.err); status != tt.status {
+			t.Errorf("unexpected status %d for %v", status, tt.err)
+		}
+	}
+
+	if Classify(redis.Nil) != redis.Nil {
+		t.Error("redis.Nil must not be wrapped")
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	var calls int
+	err := WithRetry(func() error {
+		calls++
+		return timeoutError{}
+	})
+	attempts := retry.For(retry.Storage).Attempts
+	if !IsTransient(err) || calls != attempts {
+		t.Errorf("expected %d attempts and a transient error, got %d and %v", attempts, calls, err)
+	}
+
+	calls = 0
+	WithRetry(func() error {
+		calls++
+		return errors.New("ERR syntax error")
+	})
+	if calls != 1 {
+		t.Errorf("command errors must not be retried, got %d attempts", calls)
+	}
+}
+
+func TestWithClusterRetry(t *testing.T) {
+	var calls int
+	err := WithClusterRetry(func() error {
+		calls++
+		if calls == 1 {
+			return errors.New("MOVED 3999 127.0.0.1:6381")
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Errorf("expected the write to succeed on the second attempt, got %d attempts and %v", calls, err)
+	}
+
+	calls = 0
+	err = WithClusterRetry(func() error {
+		calls++
+		return timeoutError{}
+	})
+	if !IsTransient(err) || calls != 1 {
+		t.Errorf("only the cluster errors must be retried, got %d attempts and %v", calls, err)
+	}
+}
@@ -0,0 +1,65 @@
+package storages
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/metrics"
+	"github.com/go-redis/redis"
+)
+
+// expireScript removes the drivers that were not seen since ARGV[1] from the last seen set KEYS[1] and the GEO sets of the regions,
+// the rest of the keys, and returns them. It runs in Redis so a driver that sends its location while the janitor is running is not removed.
+var expireScript = redis.NewScript(`
+local stale = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
+for _, id in ipairs(stale) do
+	for i = 1, #KEYS do
+		redis.call("ZREM", KEYS[i], id)
+	end
+end
+return stale
+`)
+
+// ExpireDrivers removes the drivers whose last location is older than ttl and returns them.
+func (c *RedisClient) ExpireDrivers(ttl time.Duration) ([]string, error) {
+	cutoff := strconv.FormatInt(time.Now().Add(-ttl).Unix(), 10)
+	geoKeys, err := c.geoKeys()
+	if err != nil {
+		return nil, err
+	}
+	res, err := expireScript.Run(c, append([]string{c.prefix + lastSeenKey}, geoKeys...), cutoff).Result()
+	if err != nil {
+		return nil, Classify(err)
+	}
+	values, _ := res.([]interface{})
+	ids := make([]string, len(values))
+	for i, v := range values {
+		ids[i], _ = v.(string)
+	}
+	return ids, nil
+}
+
+// StartJanitor removes the stale drivers every interval, so the search does not return drivers who closed the app.
+// Every instance can run it, the script is atomic. onExpired receives the removed drivers, it can be nil.
+func StartJanitor(ttl, interval time.Duration, onExpired func(ids []string) error) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			ids, err := Locations().ExpireDrivers(ttl)
+			if err != nil {
+				logging.Logger.Warn("could not expire stale drivers", "error", err)
+				continue
+			}
+			metrics.StaleDrivers.Add(float64(len(ids)))
+			if onExpired == nil || len(ids) == 0 {
+				continue
+			}
+			if err := onExpired(ids); err != nil {
+				logging.Logger.Warn("could not handle stale drivers", "count", len(ids), "error", err)
+			}
+		}
+	}()
+}
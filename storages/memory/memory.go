@@ -0,0 +1,143 @@
+// Package memory is a LocationStore that keeps the drivers in the process, for the tests and the local development.
+// The search scans every driver, it is not meant for a real fleet and it is not shared between instances. The reservations
+// are kept in Redis like for every store.
+package memory
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+type driver struct {
+	point geo.Point
+	seen  time.Time
+}
+
+// Store keeps the last location of each driver in a map.
+type Store struct {
+	mu      sync.RWMutex
+	drivers map[string]driver
+	// now returns the current time, it is replaced in the tests.
+	now func() time.Time
+}
+
+// New returns an empty store.
+func New() *Store {
+	return &Store{drivers: make(map[string]driver), now: time.Now}
+}
+
+// AddDriverLocations saves the locations of the drivers and marks them as seen now.
+func (s *Store) AddDriverLocations(_ context.Context, locations []*redis.GeoLocation) error {
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, l := range locations {
+		s.drivers[l.Name] = driver{point: geo.Point{Lat: l.Latitude, Lng: l.Longitude}, seen: now}
+	}
+	return nil
+}
+
+// RemoveDriverLocation removes the driver from the search.
+func (s *Store) RemoveDriverLocation(id string) error {
+	s.mu.Lock()
+	delete(s.drivers, id)
+	s.mu.Unlock()
+	return nil
+}
+
+// ReserveDriver removes the driver from the search and reserves it for the request during ttl, it returns false if the driver
+// is not in the search or another request reserved it first. The reservation is kept in Redis, it decides which request gets the driver.
+func (s *Store) ReserveDriver(_ context.Context, driverID, requestID string, ttl time.Duration) (bool, error) {
+	s.mu.RLock()
+	d, ok := s.drivers[driverID]
+	s.mu.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	return storages.Reserve(s, driverID, requestID, d.point, ttl)
+}
+
+// LastSeen returns the time of the last location of each driver, the drivers that are not in the search are missing.
+func (s *Store) LastSeen(ids []string) (map[string]time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	seen := make(map[string]time.Time, len(ids))
+	for _, id := range ids {
+		if d, ok := s.drivers[id]; ok {
+			seen[id] = d.seen
+		}
+	}
+	return seen, nil
+}
+
+// SearchDrivers returns up to limit drivers within r km of the point sorted by distance, like GEORADIUS with WITHDIST and WITHCOORD.
+func (s *Store) SearchDrivers(_ context.Context, limit int, lat, lng, r float64) ([]redis.GeoLocation, error) {
+	center := geo.Point{Lat: lat, Lng: lng}
+	var res []redis.GeoLocation
+	s.mu.RLock()
+	for id, d := range s.drivers {
+		if dist := geo.Distance(center, d.point); dist <= r {
+			res = append(res, redis.GeoLocation{Name: id, Latitude: d.point.Lat, Longitude: d.point.Lng, Dist: dist})
+		}
+	}
+	s.mu.RUnlock()
+
+	// The map has no order, the ties are sorted by name so the results are stable.
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Dist != res[j].Dist {
+			return res[i].Dist < res[j].Dist
+		}
+		return res[i].Name < res[j].Name
+	})
+	if limit > 0 && len(res) > limit {
+		res = res[:limit]
+	}
+	return res, nil
+}
+
+// DriversInBox returns the drivers inside the box.
+func (s *Store) DriversInBox(_ context.Context, minLat, minLng, maxLat, maxLng float64) ([]redis.GeoLocation, error) {
+	var res []redis.GeoLocation
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for id, d := range s.drivers {
+		if d.point.Lat >= minLat && d.point.Lat <= maxLat && d.point.Lng >= minLng && d.point.Lng <= maxLng {
+			res = append(res, redis.GeoLocation{Name: id, Latitude: d.point.Lat, Longitude: d.point.Lng})
+		}
+	}
+	return res, nil
+}
+
+// ExpireDrivers removes the drivers whose last location is older than ttl and returns them.
+func (s *Store) ExpireDrivers(ttl time.Duration) ([]string, error) {
+	cutoff := s.now().Add(-ttl)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var stale []string
+	for id, d := range s.drivers {
+		if d.seen.Before(cutoff) {
+			stale = append(stale, id)
+			delete(s.drivers, id)
+		}
+	}
+	sort.Strings(stale)
+	return stale, nil
+}
+
+// Located returns the drivers that are in the search.
+func (s *Store) Located() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ids := make([]string, 0, len(s.drivers))
+	for id := range s.drivers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
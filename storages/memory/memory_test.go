@@ -0,0 +1,66 @@
+package memory
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+var _ storages.LocationStore = (*Store)(nil)
+
+func TestSearchDrivers(t *testing.T) {
+	s := New()
+	ctx := context.Background()
+	s.AddDriverLocations(ctx, []*redis.GeoLocation{
+		{Name: "far", Latitude: -33.40, Longitude: -70.60},
+		{Name: "near", Latitude: -33.4401, Longitude: -70.6501},
+		{Name: "nearer", Latitude: -33.44, Longitude: -70.65},
+		{Name: "out", Latitude: -34.50, Longitude: -71.00},
+	})
+
+	res, err := s.SearchDrivers(ctx, 2, -33.44, -70.65, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, d := range res {
+		names = append(names, d.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"nearer", "near"}) {
+		t.Errorf("expected the two nearest drivers, got %v", names)
+	}
+
+	res, _ = s.SearchDrivers(ctx, 10, -33.44, -70.65, 10)
+	if len(res) != 3 {
+		t.Errorf("expected 3 drivers within 10 km, got %d", len(res))
+	}
+
+	res, _ = s.DriversInBox(ctx, -33.45, -70.66, -33.43, -70.64)
+	if len(res) != 2 {
+		t.Errorf("expected 2 drivers in the box, got %d", len(res))
+	}
+}
+
+func TestExpireDrivers(t *testing.T) {
+	s := New()
+	now := time.Now()
+	s.now = func() time.Time { return now.Add(-time.Hour) }
+	s.AddDriverLocations(context.Background(), []*redis.GeoLocation{{Name: "stale"}})
+	s.now = func() time.Time { return now }
+	s.AddDriverLocations(context.Background(), []*redis.GeoLocation{{Name: "fresh"}})
+
+	stale, _ := s.ExpireDrivers(time.Minute)
+	if !reflect.DeepEqual(stale, []string{"stale"}) {
+		t.Errorf("expected the stale driver to expire, got %v", stale)
+	}
+	if located, _ := s.Located(); !reflect.DeepEqual(located, []string{"fresh"}) {
+		t.Errorf("expected only the fresh driver, got %v", located)
+	}
+	if seen, _ := s.LastSeen([]string{"fresh", "stale"}); len(seen) != 1 || !seen["fresh"].Equal(now) {
+		t.Errorf("unexpected last seen %v", seen)
+	}
+}
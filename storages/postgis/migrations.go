@@ -0,0 +1,69 @@
+package postgis
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// migrations are the versions of the schema, the version of a migration is its index plus one.
+// The applied migrations must not change, a change of the schema is a new migration.
+var migrations = []string{
+	// 1: the current location of each driver, the search uses the GiST index and the janitor the index of seen_at.
+	`CREATE EXTENSION IF NOT EXISTS postgis;
+CREATE TABLE driver_locations (
+	driver_id TEXT PRIMARY KEY,
+	location GEOGRAPHY(POINT, 4326) NOT NULL,
+	seen_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX driver_locations_location_idx ON driver_locations USING GIST (location);
+CREATE INDEX driver_locations_seen_at_idx ON driver_locations (seen_at);`,
+
+	// 2: every location received, for the analytics. It is not read by the service.
+	`CREATE TABLE driver_location_history (
+	driver_id TEXT NOT NULL,
+	location GEOGRAPHY(POINT, 4326) NOT NULL,
+	recorded_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX driver_location_history_driver_idx ON driver_location_history (driver_id, recorded_at);`,
+}
+
+// Migrate applies the migrations that are missing in the database, each one in its own transaction.
+// The instances can run it at the same time, the lock serializes them.
+func Migrate(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INT PRIMARY KEY, applied_at TIMESTAMPTZ NOT NULL DEFAULT now())`); err != nil {
+		return fmt.Errorf("could not create schema_migrations: %w", err)
+	}
+	for i, m := range migrations {
+		if err := migrate(ctx, db, i+1, m); err != nil {
+			return fmt.Errorf("could not apply migration %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func migrate(ctx context.Context, db *sql.DB, version int, migration string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `LOCK TABLE schema_migrations IN EXCLUSIVE MODE`); err != nil {
+		return err
+	}
+	var applied bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, version).Scan(&applied); err != nil {
+		return err
+	}
+	if applied {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, migration); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
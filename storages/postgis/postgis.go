@@ -0,0 +1,179 @@
+// Package postgis is a LocationStore backed by PostgreSQL with PostGIS, the locations survive a restart and every location
+// is kept in a history table for the analytics in SQL. The schema is created by Migrate.
+package postgis
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+	"github.com/lib/pq"
+)
+
+// point is the geography of the longitude $n and the latitude $n+1.
+func point(n int) string {
+	return fmt.Sprintf("ST_SetSRID(ST_MakePoint($%d, $%d), 4326)::geography", n, n+1)
+}
+
+// Store keeps the locations of the drivers in PostGIS.
+type Store struct {
+	db *sql.DB
+}
+
+// New returns a store for the database, the schema must be migrated.
+func New(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// AddDriverLocations saves the locations of the drivers in a transaction and marks them as seen now.
+func (s *Store) AddDriverLocations(ctx context.Context, locations []*redis.GeoLocation) error {
+	now := time.Now()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return storages.Classify(err)
+	}
+	defer tx.Rollback()
+
+	for _, l := range locations {
+		_, err := tx.ExecContext(ctx, `INSERT INTO driver_locations (driver_id, location, seen_at) VALUES ($1, `+point(2)+`, $4)
+ON CONFLICT (driver_id) DO UPDATE SET location = excluded.location, seen_at = excluded.seen_at`, l.Name, l.Longitude, l.Latitude, now)
+		if err != nil {
+			return storages.Classify(err)
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO driver_location_history (driver_id, location, recorded_at) VALUES ($1, `+point(2)+`, $4)`,
+			l.Name, l.Longitude, l.Latitude, now)
+		if err != nil {
+			return storages.Classify(err)
+		}
+	}
+	return storages.Classify(tx.Commit())
+}
+
+// RemoveDriverLocation removes the driver from the search, its history is kept.
+func (s *Store) RemoveDriverLocation(id string) error {
+	_, err := s.db.Exec(`DELETE FROM driver_locations WHERE driver_id = $1`, id)
+	return storages.Classify(err)
+}
+
+// ReserveDriver removes the driver from the search and reserves it for the request during ttl, it returns false if the driver
+// is not in the search or another request reserved it first. The reservation is kept in Redis, it decides which request gets the driver.
+func (s *Store) ReserveDriver(ctx context.Context, driverID, requestID string, ttl time.Duration) (bool, error) {
+	var p geo.Point
+	err := s.db.QueryRowContext(ctx, `SELECT ST_Y(location::geometry), ST_X(location::geometry) FROM driver_locations WHERE driver_id = $1`,
+		driverID).Scan(&p.Lat, &p.Lng)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, storages.Classify(err)
+	}
+	return storages.Reserve(s, driverID, requestID, p, ttl)
+}
+
+// LastSeen returns the time of the last location of each driver, the drivers that are not in the search are missing.
+func (s *Store) LastSeen(ids []string) (map[string]time.Time, error) {
+	rows, err := s.db.Query(`SELECT driver_id, seen_at FROM driver_locations WHERE driver_id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return nil, storages.Classify(err)
+	}
+	defer rows.Close()
+
+	seen := make(map[string]time.Time, len(ids))
+	for rows.Next() {
+		var id string
+		var t time.Time
+		if err := rows.Scan(&id, &t); err != nil {
+			return nil, storages.Classify(err)
+		}
+		seen[id] = t
+	}
+	return seen, storages.Classify(rows.Err())
+}
+
+// SearchDrivers returns up to limit drivers within r km of the point sorted by distance.
+func (s *Store) SearchDrivers(ctx context.Context, limit int, lat, lng, r float64) ([]redis.GeoLocation, error) {
+	return s.query(ctx, `SELECT driver_id, ST_Y(location::geometry), ST_X(location::geometry), ST_Distance(location, `+point(1)+`) / 1000
+FROM driver_locations WHERE ST_DWithin(location, `+point(1)+`, $3) ORDER BY 4 LIMIT $4`, lng, lat, r*1000, limit)
+}
+
+// DriversInBox returns the drivers inside the box.
+func (s *Store) DriversInBox(ctx context.Context, minLat, minLng, maxLat, maxLng float64) ([]redis.GeoLocation, error) {
+	return s.query(ctx, `SELECT driver_id, ST_Y(location::geometry), ST_X(location::geometry), 0
+FROM driver_locations WHERE location::geometry && ST_MakeEnvelope($1, $2, $3, $4, 4326)`, minLng, minLat, maxLng, maxLat)
+}
+
+// DriversInPolygon returns the drivers inside the polygon, it is closed between the last point and the first one.
+// It is not part of LocationStore, the other stores do not support polygons.
+func (s *Store) DriversInPolygon(ctx context.Context, polygon []geo.Point) ([]redis.GeoLocation, error) {
+	if len(polygon) < 3 {
+		return nil, fmt.Errorf("a polygon needs at least 3 points, got %d", len(polygon))
+	}
+	return s.query(ctx, `SELECT driver_id, ST_Y(location::geometry), ST_X(location::geometry), 0
+FROM driver_locations WHERE ST_Covers(ST_GeogFromText($1), location)`, wkt(polygon))
+}
+
+// wkt returns the polygon in the well-known text format, e.g. POLYGON((lng lat, ...)).
+func wkt(polygon []geo.Point) string {
+	points := make([]string, 0, len(polygon)+1)
+	for _, p := range polygon {
+		points = append(points, fmt.Sprintf("%g %g", p.Lng, p.Lat))
+	}
+	// The ring of WKT ends with its first point.
+	points = append(points, points[0])
+	return "SRID=4326;POLYGON((" + strings.Join(points, ", ") + "))"
+}
+
+// query returns the drivers of a query that selects the id, the latitude, the longitude and the distance in km.
+func (s *Store) query(ctx context.Context, query string, args ...interface{}) ([]redis.GeoLocation, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, storages.Classify(err)
+	}
+	defer rows.Close()
+
+	var drivers []redis.GeoLocation
+	for rows.Next() {
+		var d redis.GeoLocation
+		if err := rows.Scan(&d.Name, &d.Latitude, &d.Longitude, &d.Dist); err != nil {
+			return nil, storages.Classify(err)
+		}
+		drivers = append(drivers, d)
+	}
+	return drivers, storages.Classify(rows.Err())
+}
+
+// ExpireDrivers removes the drivers whose last location is older than ttl and returns them, the delete is atomic.
+func (s *Store) ExpireDrivers(ttl time.Duration) ([]string, error) {
+	rows, err := s.db.Query(`DELETE FROM driver_locations WHERE seen_at < $1 RETURNING driver_id`, time.Now().Add(-ttl))
+	if err != nil {
+		return nil, storages.Classify(err)
+	}
+	return scanIDs(rows)
+}
+
+// Located returns the drivers that are in the search.
+func (s *Store) Located() ([]string, error) {
+	rows, err := s.db.Query(`SELECT driver_id FROM driver_locations`)
+	if err != nil {
+		return nil, storages.Classify(err)
+	}
+	return scanIDs(rows)
+}
+
+func scanIDs(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, storages.Classify(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, storages.Classify(rows.Err())
+}
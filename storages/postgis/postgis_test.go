@@ -0,0 +1,18 @@
+package postgis
+
+import (
+	"testing"
+
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/storages"
+)
+
+var _ storages.LocationStore = (*Store)(nil)
+
+func TestWKT(t *testing.T) {
+	polygon := []geo.Point{{Lat: -33.4, Lng: -70.6}, {Lat: -33.5, Lng: -70.6}, {Lat: -33.5, Lng: -70.7}}
+	want := "SRID=4326;POLYGON((-70.6 -33.4, -70.6 -33.5, -70.7 -33.5, -70.6 -33.4))"
+	if got := wkt(polygon); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
@@ -0,0 +1,231 @@
+package storages
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/go-redis/redis"
+)
+
+// ErrRebuildMismatch is returned when the shadow index does not have the drivers written to it, the live index is kept.
+var ErrRebuildMismatch = errors.New("rebuilt index does not match the drivers")
+
+// rebuildBatch is the number of locations written to the shadow index by each pipeline.
+const rebuildBatch = 1000
+
+// shadowKey returns the key where the live key is rebuilt.
+func shadowKey(live string) string {
+	return live + ":rebuild"
+}
+
+// RebuildReport is the result of a rebuild of the GEO index.
+type RebuildReport struct {
+	// Drivers is the number of drivers written to the shadow index and Regions the drivers of each region.
+	Drivers int            `json:"drivers"`
+	Regions map[string]int `json:"regions"`
+	// Kept are the drivers whose position was taken from the live index, e.g. they sent a location during the rebuild.
+	Kept int `json:"kept"`
+	// Removed are the drivers removed from the search during the rebuild, they are not in the rebuilt index.
+	Removed int `json:"removed"`
+}
+
+// swapScript replaces the live keys with their shadow keys, KEYS are the pairs of live and shadow keys. ARGV[1] is the number of
+// GEO sets, the pair after them is the hash of the regions of the drivers. ARGV[2] is the number of drivers, after the counts, that
+// keep their position of the live index and the rest of ARGV are the drivers to remove. A live key without shadow is deleted.
+// It returns the number of drivers that kept their position. All the keys have the namespace of the client, in a cluster they are
+// under its hash tag and in the same slot.
+var swapScript = redis.NewScript(`
+local n = tonumber(ARGV[1])
+local m = tonumber(ARGV[2])
+local regions = #KEYS > 2 * n
+local kept = 0
+for i = 3, 2 + m do
+	local id = ARGV[i]
+	for j = 1, n do
+		redis.call("ZREM", KEYS[2 * j], id)
+	end
+	for j = 1, n do
+		local score = redis.call("ZSCORE", KEYS[2 * j - 1], id)
+		if score then
+			redis.call("ZADD", KEYS[2 * j], score, id)
+			kept = kept + 1
+			break
+		end
+	end
+	if regions then
+		local region = redis.call("HGET", KEYS[2 * n + 1], id)
+		if region then
+			redis.call("HSET", KEYS[2 * n + 2], id, region)
+		else
+			redis.call("HDEL", KEYS[2 * n + 2], id)
+		end
+	end
+end
+for i = 3 + m, #ARGV do
+	for j = 1, n do
+		redis.call("ZREM", KEYS[2 * j], ARGV[i])
+	end
+	if regions then
+		redis.call("HDEL", KEYS[2 * n + 2], ARGV[i])
+	end
+end
+for j = 1, #KEYS / 2 do
+	if redis.call("EXISTS", KEYS[2 * j]) == 1 then
+		redis.call("RENAME", KEYS[2 * j], KEYS[2 * j - 1])
+	else
+		redis.call("DEL", KEYS[2 * j - 1])
+	end
+end
+return kept
+`)
+
+// RebuildIndex replaces the GEO index of the drivers with the locations without downtime: the locations are written to shadow keys,
+// their counts are verified and a script swaps the shadow keys with the live ones atomically. The searches use the live index until
+// the swap. The drivers in keep and the drivers that sent a location after since keep their position of the live index, the drivers
+// removed from the search after since are not indexed.
+func (c *RedisClient) RebuildIndex(locations []*redis.GeoLocation, keep []string, since time.Time) (RebuildReport, error) {
+	byName := make(map[string]*redis.GeoLocation, len(locations))
+	byRegion := make(map[string][]*redis.GeoLocation)
+	for _, l := range locations {
+		if _, ok := byName[l.Name]; ok {
+			continue
+		}
+		byName[l.Name] = l
+		region := regionOf(geo.Point{Lat: l.Latitude, Lng: l.Longitude})
+		byRegion[region] = append(byRegion[region], l)
+	}
+
+	// The shadow keys of a failed rebuild are removed first.
+	live, err := c.geoKeys()
+	if err != nil {
+		return RebuildReport{}, err
+	}
+	regionsHash := c.prefix + driverRegionsKey
+	if err := c.dropShadows(append(live, regionsHash)); err != nil {
+		return RebuildReport{}, err
+	}
+
+	report := RebuildReport{Regions: make(map[string]int, len(byRegion))}
+	for region, list := range byRegion {
+		shadow := shadowKey(c.prefix + regionKey(region))
+		for start := 0; start < len(list); start += rebuildBatch {
+			end := start + rebuildBatch
+			if end > len(list) {
+				end = len(list)
+			}
+			batch := list[start:end]
+			_, err := c.Pipelined(func(pipe redis.Pipeliner) error {
+				pipe.GeoAdd(shadow, batch...)
+				if sharded() {
+					fields := make(map[string]interface{}, len(batch))
+					for _, l := range batch {
+						fields[l.Name] = region
+					}
+					pipe.HMSet(shadowKey(regionsHash), fields)
+					pipe.SAdd(c.prefix+regionsKey, region)
+				}
+				return nil
+			})
+			if err != nil {
+				return RebuildReport{}, Classify(err)
+			}
+		}
+		report.Regions[region] = len(list)
+		report.Drivers += len(list)
+	}
+
+	// Each shadow key must have the drivers written to it.
+	counts := make(map[string]*redis.IntCmd, len(byRegion))
+	_, err = c.Pipelined(func(pipe redis.Pipeliner) error {
+		for region := range byRegion {
+			counts[region] = pipe.ZCard(shadowKey(c.prefix + regionKey(region)))
+		}
+		return nil
+	})
+	if err != nil {
+		return RebuildReport{}, Classify(err)
+	}
+	for region, cmd := range counts {
+		if cmd.Val() != int64(report.Regions[region]) {
+			c.dropShadows(append(live, regionsHash))
+			return RebuildReport{}, ErrRebuildMismatch
+		}
+	}
+
+	// The drivers that sent a location or left the search while the shadow index was written are taken from the live index.
+	moved, err := c.SeenSince(since)
+	if err != nil {
+		return RebuildReport{}, err
+	}
+	ids := make([]string, 0, len(byName))
+	for id := range byName {
+		ids = append(ids, id)
+	}
+	seen, err := c.LastSeen(ids)
+	if err != nil {
+		return RebuildReport{}, err
+	}
+	var removed []string
+	for _, id := range ids {
+		if _, ok := seen[id]; !ok {
+			removed = append(removed, id)
+		}
+	}
+
+	// The regions created during the rebuild are swapped too.
+	if live, err = c.geoKeys(); err != nil {
+		return RebuildReport{}, err
+	}
+	isLive := make(map[string]bool, len(live))
+	for _, k := range live {
+		isLive[k] = true
+	}
+	for region := range byRegion {
+		if k := c.prefix + regionKey(region); !isLive[k] {
+			live = append(live, k)
+		}
+	}
+	var keys []string
+	for _, k := range live {
+		keys = append(keys, k, shadowKey(k))
+	}
+	if sharded() {
+		keys = append(keys, regionsHash, shadowKey(regionsHash))
+	}
+	kept := append(moved, keep...)
+	args := []interface{}{len(live), len(kept)}
+	for _, id := range kept {
+		args = append(args, id)
+	}
+	for _, id := range removed {
+		args = append(args, id)
+	}
+	n, err := swapScript.Run(c, keys, args...).Int64()
+	if err != nil {
+		return RebuildReport{}, Classify(err)
+	}
+	report.Kept, report.Removed = int(n), len(removed)
+	return report, nil
+}
+
+// dropShadows deletes the shadow keys of the live keys.
+func (c *RedisClient) dropShadows(live []string) error {
+	shadows := make([]string, len(live))
+	for i, k := range live {
+		shadows[i] = shadowKey(k)
+	}
+	return Classify(c.Del(shadows...).Err())
+}
+
+// SeenSince returns the drivers whose last location is newer than since.
+// It is an idempotent read, transient errors are retried.
+func (c *RedisClient) SeenSince(since time.Time) ([]string, error) {
+	var ids []string
+	err := WithRetry(func() (err error) {
+		ids, err = c.ZRangeByScore(c.prefix+lastSeenKey, redis.ZRangeBy{Min: strconv.FormatInt(since.Unix(), 10), Max: "+inf"}).Result()
+		return err
+	})
+	return ids, err
+}
@@ -1,50 +1,305 @@
 package storages
 
 import (
+	"context"
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/metrics"
+	"github.com/douglasmakey/tracking/tracing"
 	"github.com/go-redis/redis"
-	"log"
+	"go.opentelemetry.io/otel/attribute"
+	"math"
+	"sort"
 	"sync"
+	"time"
 )
 
 type RedisClient struct {
-	*redis.Client
+	redis.UniversalClient
+	// prefix is the namespace of the keys of the drivers, it isolates the sandbox from the real supply.
+	prefix string
 }
 
-var redisClient *RedisClient
-var once sync.Once
+var (
+	clientMu    sync.RWMutex
+	redisClient *RedisClient
+)
 
-const key = "drivers"
+// key is the GEO set with the location of the drivers and lastSeenKey is a sorted set with the unix time of the last location of each driver.
+const (
+	key         = "drivers"
+	lastSeenKey = "drivers:lastseen"
+)
 
-func GetRedisClient() *RedisClient {
-	once.Do(func() {
-		client := redis.NewClient(&redis.Options{
-			Addr:     "localhost:6379",
-			Password: "", // no password set
-			DB:       0,  // use default DB
+// Options is the connection to Redis: a single server by default, with MasterName the addresses are the Sentinels
+// that monitor the master and with Cluster the addresses are nodes of a Redis Cluster.
+type Options struct {
+	Addrs      []string
+	MasterName string
+	Cluster    bool
+	Password   string
+	DB         int
+	// BreakerThreshold is the number of consecutive transient errors that open the circuit breaker and ReconnectMax
+	// the max wait between two pings while it is open, zero keeps the defaults.
+	BreakerThreshold int
+	ReconnectMax     time.Duration
+	// PoolSize is the max number of connections of each node and MinIdleConns the connections kept open, zero keeps the defaults
+	// of the client (10 connections per CPU). The timeouts are for opening a connection, reading and writing a reply, waiting
+	// for a free connection of the pool and closing the idle connections.
+	PoolSize     int
+	MinIdleConns int
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	PoolTimeout  time.Duration
+	IdleTimeout  time.Duration
+	// MaxRedirects is the number of MOVED and ASK redirections that the cluster client follows for a command, zero keeps the default.
+	MaxRedirects int
+}
+
+var options = Options{Addrs: []string{"localhost:6379"}}
+
+// Configure sets the connection to Redis, it must be called before the first NewRedisClient or GetRedisClient.
+func Configure(o Options) {
+	options = o
+	if o.BreakerThreshold > 0 {
+		breaker.Threshold = o.BreakerThreshold
+	}
+	if o.ReconnectMax > 0 {
+		breaker.Reconnect.Max = o.ReconnectMax
+	}
+}
+
+// newClient returns the client of the connection, the Sentinel client follows the master after a failover
+// and the cluster client follows the slots of the keys.
+func newClient(o Options) redis.UniversalClient {
+	switch {
+	case o.Cluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        o.Addrs,
+			MaxRedirects: o.MaxRedirects,
+			Password:     o.Password,
+			PoolSize:     o.PoolSize,
+			MinIdleConns: o.MinIdleConns,
+			DialTimeout:  o.DialTimeout,
+			ReadTimeout:  o.ReadTimeout,
+			WriteTimeout: o.WriteTimeout,
+			PoolTimeout:  o.PoolTimeout,
+			IdleTimeout:  o.IdleTimeout,
+		})
+	case o.MasterName != "":
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    o.MasterName,
+			SentinelAddrs: o.Addrs,
+			Password:      o.Password,
+			DB:            o.DB,
+			PoolSize:      o.PoolSize,
+			MinIdleConns:  o.MinIdleConns,
+			DialTimeout:   o.DialTimeout,
+			ReadTimeout:   o.ReadTimeout,
+			WriteTimeout:  o.WriteTimeout,
+			PoolTimeout:   o.PoolTimeout,
+			IdleTimeout:   o.IdleTimeout,
 		})
+	default:
+		return redis.NewClient(&redis.Options{
+			Addr:         o.Addrs[0],
+			Password:     o.Password,
+			DB:           o.DB,
+			PoolSize:     o.PoolSize,
+			MinIdleConns: o.MinIdleConns,
+			DialTimeout:  o.DialTimeout,
+			ReadTimeout:  o.ReadTimeout,
+			WriteTimeout: o.WriteTimeout,
+			PoolTimeout:  o.PoolTimeout,
+			IdleTimeout:  o.IdleTimeout,
+		})
+	}
+}
 
-		redisClient = &RedisClient{client}
-		_, err := redisClient.Ping().Result()
-		if err != nil {
-			log.Fatalf("Could not connect to redis %v", err)
+// namespace returns the prefix of the keys of the drivers. In a cluster the prefix is a hash tag, so the keys of the drivers
+// are in the same slot and the scripts can use them together.
+func namespace(prefix string) string {
+	if !options.Cluster {
+		return prefix
+	}
+	if prefix == "" {
+		prefix = "tracking:"
+	}
+	return "{" + prefix + "}"
+}
+
+// Tag returns id as a hash tag in a cluster, the keys built with it are in the same slot, e.g. the keys of a driver used by a script.
+func Tag(id string) string {
+	if !options.Cluster {
+		return id
+	}
+	return "{" + id + "}"
+}
+
+// NewRedisClient returns a client of the connection, the connections are opened by the first commands and shared by the copies
+// of the client, e.g. the sandbox clients. The duration of the commands is measured and their errors open the circuit breaker.
+// It never fails, the commands return the errors while Redis is unavailable.
+func NewRedisClient(o Options) *RedisClient {
+	client := newClient(o)
+	ping := func() error { return client.Ping().Err() }
+
+	client.WrapProcess(func(old func(cmd redis.Cmder) error) func(cmd redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			start := time.Now()
+			err := old(cmd)
+			metrics.RedisDuration.WithLabelValues(cmd.Name()).Observe(time.Since(start).Seconds())
+			breaker.Record(cmd.Err(), ping)
+			return err
 		}
 	})
+	client.WrapProcessPipeline(func(old func(cmds []redis.Cmder) error) func(cmds []redis.Cmder) error {
+		return func(cmds []redis.Cmder) error {
+			err := old(cmds)
+			breaker.Record(err, ping)
+			return err
+		}
+	})
+
+	return &RedisClient{UniversalClient: client, prefix: namespace("")}
+}
 
+// SetRedisClient sets the client shared by the packages, main creates it with NewRedisClient and the tests can set their own.
+func SetRedisClient(c *RedisClient) {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	redisClient = c
+}
+
+// GetRedisClient returns the shared client, a client of the configured connection is created if none was set.
+// It is only a read of the client, nothing is sent to Redis.
+func GetRedisClient() *RedisClient {
+	clientMu.RLock()
+	c := redisClient
+	clientMu.RUnlock()
+	if c != nil {
+		return c
+	}
+
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	if redisClient == nil {
+		redisClient = NewRedisClient(options)
+	}
 	return redisClient
 }
 
-func (c *RedisClient) AddDriverLocation(lng, lat float64, id string) {
-	c.GeoAdd(
-		key,
-		&redis.GeoLocation{Longitude: lng, Latitude: lat, Name: id},
-	)
+// Connect pings Redis with exponential backoff until it answers or ctx is done, it is used to wait for Redis at the start.
+func (c *RedisClient) Connect(ctx context.Context) error {
+	for attempt := 1; ; attempt++ {
+		err := c.Ping().Err()
+		if err == nil {
+			return nil
+		}
+		logging.Logger.Warn("waiting for redis", "attempt", attempt, "error", err)
+		select {
+		case <-time.After(breaker.Reconnect.Backoff(attempt)):
+		case <-ctx.Done():
+			return Classify(err)
+		}
+	}
 }
 
-func (c *RedisClient) RemoveDriverLocation(id string) {
-	c.ZRem(key, id)
+func (c *RedisClient) AddDriverLocation(ctx context.Context, lng, lat float64, id string) error {
+	return c.AddDriverLocations(ctx, []*redis.GeoLocation{{Longitude: lng, Latitude: lat, Name: id}})
 }
 
-func (c *RedisClient) SearchDrivers(limit int, lat, lng, r float64) []redis.GeoLocation {
+// AddDriverLocations adds the locations of many drivers with a single pipeline, the drivers are marked as seen now.
+// Each location is saved in the GEO set of its region, the drivers that moved to another region are removed from the previous one.
+func (c *RedisClient) AddDriverLocations(ctx context.Context, locations []*redis.GeoLocation) error {
+	_, span := tracing.Start(ctx, "redis.GEOADD", attribute.Int("locations", len(locations)))
+	now := float64(time.Now().Unix())
+	ids := make([]string, len(locations))
+	for i, l := range locations {
+		ids[i] = l.Name
+	}
+	current, err := c.driverRegions(ids)
+	if err != nil {
+		tracing.End(span, err)
+		return err
+	}
+
+	// The commands are idempotent, they are sent again when the slots of the cluster move during a reshard.
+	err = WithClusterRetry(func() error {
+		// Each attempt starts from the regions read before the first one.
+		prevs := make(map[string]string, len(current))
+		for id, r := range current {
+			prevs[id] = r
+		}
+		_, err := c.Pipelined(func(pipe redis.Pipeliner) error {
+			for _, l := range locations {
+				region := regionOf(geo.Point{Lat: l.Latitude, Lng: l.Longitude})
+				if prev, ok := prevs[l.Name]; ok && prev != region {
+					pipe.ZRem(c.prefix+regionKey(prev), l.Name)
+				}
+				pipe.GeoAdd(c.prefix+regionKey(region), l)
+				pipe.ZAdd(c.prefix+lastSeenKey, redis.Z{Score: now, Member: l.Name})
+				if sharded() {
+					prevs[l.Name] = region
+					pipe.HSet(c.prefix+driverRegionsKey, l.Name, region)
+					pipe.SAdd(c.prefix+regionsKey, region)
+				}
+			}
+			return nil
+		})
+		return err
+	})
+	tracing.End(span, err)
+	return err
+}
+
+func (c *RedisClient) RemoveDriverLocation(id string) error {
+	geoKey, err := c.driverKey(id)
+	if err != nil {
+		return err
+	}
+	return WithClusterRetry(func() error {
+		_, err := c.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.ZRem(geoKey, id)
+			pipe.ZRem(c.prefix+lastSeenKey, id)
+			pipe.HDel(c.prefix+driverRegionsKey, id)
+			return nil
+		})
+		return err
+	})
+}
+
+// LastSeen returns the time of the last location of each driver, the drivers that are not in the search are missing.
+// It is an idempotent read, transient errors are retried.
+func (c *RedisClient) LastSeen(ids []string) (map[string]time.Time, error) {
+	cmds := make([]*redis.FloatCmd, len(ids))
+	err := WithRetry(func() error {
+		_, err := c.Pipelined(func(pipe redis.Pipeliner) error {
+			for i, id := range ids {
+				cmds[i] = pipe.ZScore(c.prefix+lastSeenKey, id)
+			}
+			return nil
+		})
+		if err == redis.Nil {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]time.Time, len(ids))
+	for i, id := range ids {
+		if score, err := cmds[i].Result(); err == nil {
+			seen[id] = time.Unix(int64(score), 0)
+		}
+	}
+	return seen, nil
+}
+
+// SearchDrivers is an idempotent read, transient errors are retried.
+func (c *RedisClient) SearchDrivers(ctx context.Context, limit int, lat, lng, r float64) ([]redis.GeoLocation, error) {
 	/*
 		WITHDIST: Also return the distance of the returned items from the
 		specified center. The distance is returned in the same unit as the unit
@@ -55,7 +310,8 @@ func (c *RedisClient) SearchDrivers(limit int, lat, lng, r float64) []redis.GeoL
 		hacks or debugging and is otherwise of little interest for the general user.
 	*/
 
-	res, _ := c.GeoRadius(key, lng, lat, &redis.GeoRadiusQuery{
+	_, span := tracing.Start(ctx, "redis.GEORADIUS", attribute.Float64("radius", r), attribute.Int("limit", limit))
+	query := &redis.GeoRadiusQuery{
 		Radius:      r,
 		Unit:        "km",
 		WithGeoHash: true,
@@ -63,7 +319,58 @@ func (c *RedisClient) SearchDrivers(limit int, lat, lng, r float64) []redis.GeoL
 		WithDist:    true,
 		Count:       limit,
 		Sort:        "ASC",
-	}).Result()
+	}
+	res, err := c.geoRadius(coverRegions(geo.Point{Lat: lat, Lng: lng}, r), lng, lat, query)
+	// The nearest drivers of all the regions.
+	if len(res) > limit {
+		sort.SliceStable(res, func(i, j int) bool { return res[i].Dist < res[j].Dist })
+		res = res[:limit]
+	}
+	span.SetAttributes(attribute.Int("results", len(res)))
+	tracing.End(span, err)
+
+	return res, err
+}
 
-	return res
+// geoRadius runs the query in the GEO sets of the regions and returns all the results, it is an idempotent read.
+func (c *RedisClient) geoRadius(regions []string, lng, lat float64, query *redis.GeoRadiusQuery) ([]redis.GeoLocation, error) {
+	var res []redis.GeoLocation
+	for _, region := range regions {
+		var found []redis.GeoLocation
+		err := WithRetry(func() (err error) {
+			found, err = c.GeoRadius(c.prefix+regionKey(region), lng, lat, query).Result()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, found...)
+	}
+	return res, nil
+}
+
+// DriversInBox returns the drivers inside the box, it is an idempotent read.
+func (c *RedisClient) DriversInBox(ctx context.Context, minLat, minLng, maxLat, maxLng float64) ([]redis.GeoLocation, error) {
+	// GEORADIUS does not support boxes, we search the circle that contains the box and filter it.
+	center := geo.Point{Lat: (minLat + maxLat) / 2, Lng: (minLng + maxLng) / 2}
+	radius := math.Max(geo.Distance(center, geo.Point{Lat: minLat, Lng: minLng}), geo.Distance(center, geo.Point{Lat: maxLat, Lng: maxLng}))
+
+	_, span := tracing.Start(ctx, "redis.GEORADIUS", attribute.Float64("radius", radius))
+	res, err := c.geoRadius(coverRegions(center, radius), center.Lng, center.Lat, &redis.GeoRadiusQuery{
+		Radius:    radius,
+		Unit:      "km",
+		WithCoord: true,
+	})
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	inside := res[:0]
+	for _, d := range res {
+		if d.Latitude >= minLat && d.Latitude <= maxLat && d.Longitude >= minLng && d.Longitude <= maxLng {
+			inside = append(inside, d)
+		}
+	}
+	return inside, nil
 }
@@ -0,0 +1,229 @@
+package storages
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/go-redis/redis"
+)
+
+// RegionResolver returns the region of a point, the drivers of each region are kept in their own GEO set
+// so the searches only read the regions around the picking point.
+type RegionResolver interface {
+	Region(p geo.Point) string
+}
+
+// SingleRegion keeps all the drivers in one GEO set, it is the default.
+type SingleRegion struct{}
+
+// Region returns the only region.
+func (SingleRegion) Region(geo.Point) string {
+	return ""
+}
+
+// GeohashRegions uses the geohash cell of the point with Precision characters as region, e.g. 3 is a cell of about 156km x 156km.
+type GeohashRegions struct {
+	Precision int
+}
+
+// Region returns the geohash cell of p.
+func (g GeohashRegions) Region(p geo.Point) string {
+	return geo.Geohash(p, g.Precision)
+}
+
+// City is a region delimited by a polygon.
+type City struct {
+	Name    string      `json:"name"`
+	Polygon []geo.Point `json:"polygon"`
+}
+
+// CityRegions uses the city that contains the point as region, the points outside the cities are in the default region.
+type CityRegions []City
+
+// Region returns the name of the first city that contains p.
+func (cities CityRegions) Region(p geo.Point) string {
+	for _, c := range cities {
+		if geo.InPolygon(p, c.Polygon) {
+			return c.Name
+		}
+	}
+	return ""
+}
+
+// LoadCities reads the cities from a JSON file with a list of {"name", "polygon"}.
+func LoadCities(path string) (CityRegions, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cities CityRegions
+	if err := json.Unmarshal(data, &cities); err != nil {
+		return nil, fmt.Errorf("invalid cities file %s: %w", path, err)
+	}
+	return cities, nil
+}
+
+var (
+	regionsMu sync.RWMutex
+	resolver  RegionResolver = SingleRegion{}
+)
+
+// SetRegionResolver sets the resolver of the regions of the drivers, it must be set before the first location is saved.
+func SetRegionResolver(r RegionResolver) {
+	regionsMu.Lock()
+	resolver = r
+	regionsMu.Unlock()
+}
+
+func regionOf(p geo.Point) string {
+	regionsMu.RLock()
+	r := resolver
+	regionsMu.RUnlock()
+	return r.Region(p)
+}
+
+// sharded returns true if the drivers are split in regions.
+func sharded() bool {
+	regionsMu.RLock()
+	_, single := resolver.(SingleRegion)
+	regionsMu.RUnlock()
+	return !single
+}
+
+// coverRegions returns the regions of the circle of radius km around center, they are the regions of the center and of
+// the corners and the middle of the sides of the box of the circle. The regions must be larger than the circles.
+func coverRegions(center geo.Point, radius float64) []string {
+	// The degrees of latitude and longitude of the radius.
+	dLat := radius / 111.32
+	dLng := dLat
+	if c := math.Cos(center.Lat * math.Pi / 180); c > 0.01 {
+		dLng = dLat / c
+	}
+
+	seen := map[string]bool{}
+	var regions []string
+	for _, lat := range []float64{center.Lat - dLat, center.Lat, center.Lat + dLat} {
+		for _, lng := range []float64{center.Lng - dLng, center.Lng, center.Lng + dLng} {
+			r := regionOf(geo.Point{Lat: lat, Lng: lng})
+			if !seen[r] {
+				seen[r] = true
+				regions = append(regions, r)
+			}
+		}
+	}
+	return regions
+}
+
+// regionKey returns the GEO set of the region, the default region uses the original key.
+func regionKey(region string) string {
+	if region == "" {
+		return key
+	}
+	return key + ":region:" + region
+}
+
+// driverRegionsKey is a hash with the region of each driver, the driver is removed from it when it moves to another region.
+// regionsKey is the set of the regions with drivers.
+const (
+	driverRegionsKey = "drivers:region"
+	regionsKey       = "drivers:regions"
+)
+
+// geoKeys returns the GEO sets of all the regions of the client.
+func (c *RedisClient) geoKeys() ([]string, error) {
+	keys := []string{c.prefix + regionKey("")}
+	if !sharded() {
+		return keys, nil
+	}
+
+	var regions []string
+	err := WithRetry(func() (err error) {
+		regions, err = c.SMembers(c.prefix + regionsKey).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range regions {
+		if r != "" {
+			keys = append(keys, c.prefix+regionKey(r))
+		}
+	}
+	return keys, nil
+}
+
+// driverRegions returns the current region of the drivers that have one.
+func (c *RedisClient) driverRegions(ids []string) (map[string]string, error) {
+	regions := make(map[string]string, len(ids))
+	if !sharded() || len(ids) == 0 {
+		return regions, nil
+	}
+
+	var values []interface{}
+	err := WithRetry(func() (err error) {
+		values, err = c.HMGet(c.prefix+driverRegionsKey, ids...).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range values {
+		if r, ok := v.(string); ok {
+			regions[ids[i]] = r
+		}
+	}
+	return regions, nil
+}
+
+// driverKey returns the GEO set of the region of the driver.
+func (c *RedisClient) driverKey(driverID string) (string, error) {
+	regions, err := c.driverRegions([]string{driverID})
+	if err != nil {
+		return "", err
+	}
+	return c.prefix + regionKey(regions[driverID]), nil
+}
+
+// RegionDrivers returns the drivers in the GEO set of each region of the client, the default region is "".
+// It is an idempotent read, transient errors are retried.
+func (c *RedisClient) RegionDrivers() (map[string][]string, error) {
+	regions := []string{""}
+	if sharded() {
+		var members []string
+		err := WithRetry(func() (err error) {
+			members, err = c.SMembers(c.prefix + regionsKey).Result()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range members {
+			if r != "" {
+				regions = append(regions, r)
+			}
+		}
+	}
+
+	cmds := make([]*redis.StringSliceCmd, len(regions))
+	err := WithRetry(func() error {
+		_, err := c.Pipelined(func(pipe redis.Pipeliner) error {
+			for i, r := range regions {
+				cmds[i] = pipe.ZRange(c.prefix+regionKey(r), 0, -1)
+			}
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	drivers := make(map[string][]string, len(regions))
+	for i, r := range regions {
+		drivers[r] = cmds[i].Val()
+	}
+	return drivers, nil
+}
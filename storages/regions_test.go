@@ -0,0 +1,43 @@
+package storages
+
+import (
+	"testing"
+
+	"github.com/douglasmakey/tracking/geo"
+)
+
+func TestCityRegions(t *testing.T) {
+	cities := CityRegions{
+		{Name: "ccs", Polygon: []geo.Point{{Lat: 10, Lng: -67}, {Lat: 10, Lng: -66}, {Lat: 11, Lng: -66}, {Lat: 11, Lng: -67}}},
+	}
+	if r := cities.Region(geo.Point{Lat: 10.5, Lng: -66.9}); r != "ccs" {
+		t.Errorf("inside: got %q, want ccs", r)
+	}
+	if r := cities.Region(geo.Point{Lat: 12, Lng: -66.9}); r != "" {
+		t.Errorf("outside: got %q, want the default region", r)
+	}
+}
+
+func TestCoverRegions(t *testing.T) {
+	defer SetRegionResolver(SingleRegion{})
+
+	SetRegionResolver(SingleRegion{})
+	if got := coverRegions(geo.Point{Lat: 10.5, Lng: -66.9}, 5); len(got) != 1 || got[0] != "" {
+		t.Errorf("single region: got %v", got)
+	}
+
+	SetRegionResolver(CityRegions{
+		{Name: "west", Polygon: []geo.Point{{Lat: 10, Lng: -67}, {Lat: 10, Lng: -66.5}, {Lat: 11, Lng: -66.5}, {Lat: 11, Lng: -67}}},
+		{Name: "east", Polygon: []geo.Point{{Lat: 10, Lng: -66.5}, {Lat: 10, Lng: -66}, {Lat: 11, Lng: -66}, {Lat: 11, Lng: -66.5}}},
+	})
+	// The circle crosses the border of the two cities.
+	got := coverRegions(geo.Point{Lat: 10.5, Lng: -66.52}, 5)
+	if len(got) != 2 || got[0] != "west" || got[1] != "east" {
+		t.Errorf("border: got %v, want [west east]", got)
+	}
+	// The circle is inside one city.
+	got = coverRegions(geo.Point{Lat: 10.5, Lng: -66.8}, 5)
+	if len(got) != 1 || got[0] != "west" {
+		t.Errorf("inside: got %v, want [west]", got)
+	}
+}
@@ -0,0 +1,215 @@
+package storages
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/tracing"
+	"github.com/go-redis/redis"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// reservationKey keeps the request that reserved the driver.
+func reservationKey(driverID string) string {
+	return fmt.Sprintf("driver:%s:reservation", driverID)
+}
+
+// holdsKey is a hash with the geohash of the location of each reserved driver when it was reserved,
+// it is used to release the reservations of a zone. The entries of the expired reservations are removed by the flushes.
+const holdsKey = "drivers:holds"
+
+// reserveScript claims the driver for a request, the driver is available while it is in the GEO set and not reserved.
+// Checking and removing the driver in the same script makes sure that only one request gets the driver, a location sent
+// during the reservation can put the driver back in the GEO set but not take it from its request.
+var reserveScript = redis.NewScript(`
+if not redis.call("ZSCORE", KEYS[1], ARGV[1]) or redis.call("EXISTS", KEYS[3]) == 1 then
+	return 0
+end
+local hash = redis.call("GEOHASH", KEYS[1], ARGV[1])[1]
+redis.call("ZREM", KEYS[1], ARGV[1])
+redis.call("ZREM", KEYS[2], ARGV[1])
+redis.call("SET", KEYS[3], ARGV[2], "PX", ARGV[3])
+if hash then
+	redis.call("HSET", KEYS[4], ARGV[1], hash)
+end
+return 1
+`)
+
+// ReserveDriver removes the driver from the search and reserves it for the request during ttl,
+// it returns false if the driver is not available anymore, e.g. another request reserved it first.
+func (c *RedisClient) ReserveDriver(ctx context.Context, driverID, requestID string, ttl time.Duration) (bool, error) {
+	_, span := tracing.Start(ctx, "redis.reserve", attribute.String("driver.id", driverID))
+	geoKey, err := c.driverKey(driverID)
+	if err != nil {
+		tracing.End(span, err)
+		return false, err
+	}
+	keys := []string{geoKey, c.prefix + lastSeenKey, c.prefix + reservationKey(driverID), c.prefix + holdsKey}
+	n, err := reserveScript.Run(c, keys,
+		driverID, requestID, ttl.Milliseconds()).Int64()
+	err = Classify(err)
+	tracing.End(span, err)
+	return n == 1, err
+}
+
+// claimScript reserves the driver ARGV[1] for the request ARGV[2] during ARGV[3] milliseconds if it is not reserved, KEYS[1] is
+// the reservation and KEYS[2] the hash of the holds where ARGV[4] is the geohash of the driver. It returns 1 when it reserves the driver.
+var claimScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+redis.call("HSET", KEYS[2], ARGV[1], ARGV[4])
+return 1
+`)
+
+// ClaimDriver reserves the driver at p for the request during ttl, it returns false if another request reserved it first.
+// Unlike ReserveDriver it does not change the GEO index, the stores other than Redis keep their reservations here.
+func (c *RedisClient) ClaimDriver(driverID, requestID string, p geo.Point, ttl time.Duration) (bool, error) {
+	keys := []string{c.prefix + reservationKey(driverID), c.prefix + holdsKey}
+	n, err := claimScript.Run(c, keys, driverID, requestID, ttl.Milliseconds(), geo.Geohash(p, 11)).Int64()
+	return n == 1, Classify(err)
+}
+
+// Reserve reserves the driver at p for the request during ttl and removes it from the search of the store, it returns false if
+// another request reserved it first. It is the ReserveDriver of the stores other than Redis, the reservations of every store
+// are kept in Redis so the instances share them. The reservation is released if the driver can not be removed.
+func Reserve(store LocationStore, driverID, requestID string, p geo.Point, ttl time.Duration) (bool, error) {
+	rClient := GetRedisClient()
+	ok, err := rClient.ClaimDriver(driverID, requestID, p, ttl)
+	if err != nil || !ok {
+		return false, err
+	}
+	if err := store.RemoveDriverLocation(driverID); err != nil {
+		rClient.ReleaseDriver(driverID)
+		return false, err
+	}
+	return true, nil
+}
+
+// Reservation returns the request that reserved the driver, empty if it is not reserved.
+func (c *RedisClient) Reservation(driverID string) (string, error) {
+	var requestID string
+	err := WithRetry(func() (err error) {
+		requestID, err = c.Get(c.prefix + reservationKey(driverID)).Result()
+		return err
+	})
+	if err == redis.Nil {
+		return "", nil
+	}
+	return requestID, err
+}
+
+// Reserved returns the drivers of ids that are reserved.
+func (c *RedisClient) Reserved(ids []string) (map[string]bool, error) {
+	cmds := make([]*redis.IntCmd, len(ids))
+	err := WithRetry(func() error {
+		_, err := c.Pipelined(func(pipe redis.Pipeliner) error {
+			for i, id := range ids {
+				cmds[i] = pipe.Exists(c.prefix + reservationKey(id))
+			}
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	reserved := make(map[string]bool)
+	for i, id := range ids {
+		if cmds[i].Val() == 1 {
+			reserved[id] = true
+		}
+	}
+	return reserved, nil
+}
+
+// WithoutReserved returns the locations of the drivers that are not reserved, a reserved driver is back in the search
+// with its first location after the reservation ends.
+func (c *RedisClient) WithoutReserved(locations []*redis.GeoLocation) ([]*redis.GeoLocation, error) {
+	ids := make([]string, len(locations))
+	for i, l := range locations {
+		ids[i] = l.Name
+	}
+	reserved, err := c.Reserved(ids)
+	if err != nil || len(reserved) == 0 {
+		return locations, err
+	}
+	available := make([]*redis.GeoLocation, 0, len(locations))
+	for _, l := range locations {
+		if !reserved[l.Name] {
+			available = append(available, l)
+		}
+	}
+	return available, nil
+}
+
+// ReleaseDriver removes the reservation of the driver, e.g. a driver stuck with a request that never finished.
+// It returns false if the driver was not reserved.
+func (c *RedisClient) ReleaseDriver(driverID string) (bool, error) {
+	var del *redis.IntCmd
+	_, err := c.TxPipelined(func(pipe redis.Pipeliner) error {
+		del = pipe.Del(c.prefix + reservationKey(driverID))
+		pipe.HDel(c.prefix+holdsKey, driverID)
+		return nil
+	})
+	if err != nil {
+		return false, Classify(err)
+	}
+	return del.Val() == 1, nil
+}
+
+// FlushReservations removes the reservations of the drivers that were reserved in the zone, a geohash prefix,
+// and returns the released drivers. The holds of the expired reservations are cleaned in any zone.
+func (c *RedisClient) FlushReservations(zone string) ([]string, error) {
+	var holds map[string]string
+	err := WithRetry(func() (err error) {
+		holds, err = c.HGetAll(c.prefix + holdsKey).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(holds))
+	for id := range holds {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	dels := make([]*redis.IntCmd, len(ids))
+	_, err = c.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, id := range ids {
+			if strings.HasPrefix(holds[id], zone) {
+				dels[i] = pipe.Del(c.prefix + reservationKey(id))
+			} else {
+				dels[i] = pipe.Exists(c.prefix + reservationKey(id))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, Classify(err)
+	}
+
+	released := []string{}
+	var stale []string
+	for i, id := range ids {
+		inZone := strings.HasPrefix(holds[id], zone)
+		if inZone && dels[i].Val() == 1 {
+			released = append(released, id)
+		}
+		if inZone || dels[i].Val() == 0 {
+			stale = append(stale, id)
+		}
+	}
+	if len(stale) > 0 {
+		if err := c.HDel(c.prefix+holdsKey, stale...).Err(); err != nil {
+			return released, Classify(err)
+		}
+	}
+	return released, nil
+}
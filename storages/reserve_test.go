@@ -0,0 +1,65 @@
+package storages
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+func TestReserveDriverRace(t *testing.T) {
+	c := GetSandboxClient("reserve-test")
+	if err := c.Ping().Err(); err != nil {
+		t.Skipf("redis is not available: %v", err)
+	}
+	defer c.ClearDrivers()
+	defer c.ReleaseDriver("1")
+
+	ctx := context.Background()
+	location := &redis.GeoLocation{Name: "1", Latitude: -33.448890, Longitude: -70.669265}
+	if err := c.AddDriverLocations(ctx, []*redis.GeoLocation{location}); err != nil {
+		t.Fatalf("could not add driver: %v", err)
+	}
+
+	// Two tasks race for the same driver, only one of them gets it.
+	var wg sync.WaitGroup
+	won := make([]bool, 2)
+	for i, requestID := range []string{"a", "b"} {
+		wg.Add(1)
+		go func(i int, requestID string) {
+			defer wg.Done()
+			ok, err := c.ReserveDriver(ctx, "1", requestID, time.Minute)
+			if err != nil {
+				t.Errorf("could not reserve driver: %v", err)
+			}
+			won[i] = ok
+		}(i, requestID)
+	}
+	wg.Wait()
+	if won[0] == won[1] {
+		t.Fatalf("expected exactly one reservation, got %v", won)
+	}
+	winner, err := c.Reservation("1")
+	if err != nil {
+		t.Fatalf("could not get reservation: %v", err)
+	}
+
+	// The location of the reserved driver is not saved.
+	available, err := c.WithoutReserved([]*redis.GeoLocation{location})
+	if err != nil || len(available) != 0 {
+		t.Errorf("expected the reserved driver to be dropped, got %v %v", available, err)
+	}
+	// A location written anyway puts the driver back in the search, it still can not be reserved again.
+	if err := c.AddDriverLocations(ctx, []*redis.GeoLocation{location}); err != nil {
+		t.Fatalf("could not add driver: %v", err)
+	}
+	ok, err := c.ReserveDriver(ctx, "1", "c", time.Minute)
+	if err != nil || ok {
+		t.Errorf("expected the reserved driver to be unavailable, got %v %v", ok, err)
+	}
+	if got, _ := c.Reservation("1"); got != winner {
+		t.Errorf("the reservation of %s was overwritten by %s", winner, got)
+	}
+}
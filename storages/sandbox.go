@@ -0,0 +1,56 @@
+package storages
+
+import (
+	"context"
+)
+
+// SandboxNamespace returns the namespace of the sandbox keys of the tenant, each sandbox has its own drivers and requests.
+func SandboxNamespace(tenant string) string {
+	return "sandbox:" + tenant + ":"
+}
+
+type sandboxCtxKey struct{}
+
+// WithSandbox returns a context for a request of a sandbox client of the tenant.
+func WithSandbox(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, sandboxCtxKey{}, tenant)
+}
+
+// Sandbox returns the tenant of the sandbox and true if the context belongs to a sandbox client.
+func Sandbox(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(sandboxCtxKey{}).(string)
+	return tenant, ok
+}
+
+// IsSandbox returns true if the context belongs to a sandbox client.
+func IsSandbox(ctx context.Context) bool {
+	_, ok := Sandbox(ctx)
+	return ok
+}
+
+// GetSandboxClient returns the client for the sandbox of the tenant, it shares the connection with GetRedisClient
+// but the drivers and their reservations are kept in the namespace of the sandbox.
+func GetSandboxClient(tenant string) *RedisClient {
+	return &RedisClient{UniversalClient: GetRedisClient().UniversalClient, prefix: namespace(SandboxNamespace(tenant))}
+}
+
+// ClientFor returns the sandbox client for the sandbox contexts and the real one for the others.
+func ClientFor(ctx context.Context) *RedisClient {
+	if tenant, ok := Sandbox(ctx); ok {
+		return GetSandboxClient(tenant)
+	}
+	return GetRedisClient()
+}
+
+// ClearDrivers removes all the drivers of a sandbox client, the real drivers can not be cleared.
+func (c *RedisClient) ClearDrivers() error {
+	if c == GetRedisClient() {
+		return nil
+	}
+	keys, err := c.geoKeys()
+	if err != nil {
+		return err
+	}
+	keys = append(keys, c.prefix+lastSeenKey, c.prefix+driverRegionsKey, c.prefix+regionsKey)
+	return Classify(c.Del(keys...).Err())
+}
@@ -0,0 +1,64 @@
+package storages
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// LocationStore keeps the last location of the drivers and searches them, RedisClient is the default one.
+// The distances are in kilometers.
+type LocationStore interface {
+	// AddDriverLocations saves the locations of the drivers and marks them as seen now.
+	AddDriverLocations(ctx context.Context, locations []*redis.GeoLocation) error
+	// RemoveDriverLocation removes the driver from the search.
+	RemoveDriverLocation(id string) error
+	// ReserveDriver removes the driver from the search and reserves it for the request during ttl, it returns false if the driver
+	// is not in the search or another request reserved it first. The reservations of every store are kept in Redis.
+	ReserveDriver(ctx context.Context, driverID, requestID string, ttl time.Duration) (bool, error)
+	// LastSeen returns the time of the last location of each driver, the drivers that are not in the search are missing.
+	LastSeen(ids []string) (map[string]time.Time, error)
+	// SearchDrivers returns up to limit drivers within r of the point sorted by distance.
+	SearchDrivers(ctx context.Context, limit int, lat, lng, r float64) ([]redis.GeoLocation, error)
+	// DriversInBox returns the drivers inside the box.
+	DriversInBox(ctx context.Context, minLat, minLng, maxLat, maxLng float64) ([]redis.GeoLocation, error)
+	// ExpireDrivers removes the drivers whose last location is older than ttl and returns them.
+	ExpireDrivers(ttl time.Duration) ([]string, error)
+	// Located returns the drivers that are in the search.
+	Located() ([]string, error)
+}
+
+var _ LocationStore = (*RedisClient)(nil)
+
+var (
+	storeMu sync.RWMutex
+	store   LocationStore
+)
+
+// SetLocationStore replaces the store of the locations, nil restores the Redis one.
+func SetLocationStore(s LocationStore) {
+	storeMu.Lock()
+	store = s
+	storeMu.Unlock()
+}
+
+// Locations returns the store of the locations of the drivers.
+func Locations() LocationStore {
+	storeMu.RLock()
+	s := store
+	storeMu.RUnlock()
+	if s == nil {
+		return GetRedisClient()
+	}
+	return s
+}
+
+// LocationsFor returns the store of the sandbox for the sandbox contexts and Locations for the others.
+func LocationsFor(ctx context.Context) LocationStore {
+	if tenant, ok := Sandbox(ctx); ok {
+		return GetSandboxClient(tenant)
+	}
+	return Locations()
+}
@@ -0,0 +1,315 @@
+// Package tile38 is a LocationStore backed by Tile38, it speaks the Redis protocol so it uses the Redis client
+// with the Tile38 commands. Tile38 also offers geofences and roaming detection on the same collection.
+package tile38
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/retry"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// collection keeps a point for each driver with the field seen, the unix time of its last location.
+const collection = "drivers"
+
+// pageSize is the number of objects read by each SCAN or WITHIN, the results are paged with the cursor.
+const pageSize = 1000
+
+// Store keeps the locations of the drivers in a Tile38 collection.
+type Store struct {
+	client *redis.Client
+}
+
+// New returns a store for the Tile38 server at addr.
+func New(addr string) *Store {
+	return &Store{client: redis.NewClient(&redis.Options{Addr: addr})}
+}
+
+// read retries the transient errors of an idempotent read, Tile38 is not behind the breaker of Redis.
+func read(fn func() error) error {
+	var missing bool
+	err := retry.For(retry.Storage).Do(context.Background(), retry.Storage, func() error {
+		err := storages.Classify(fn())
+		if err == redis.Nil {
+			missing = true
+			return nil
+		}
+		if err != nil && !storages.IsTransient(err) {
+			return retry.Permanent(err)
+		}
+		return err
+	})
+	if err == nil && missing {
+		return redis.Nil
+	}
+	return err
+}
+
+// AddDriverLocations saves the locations of the drivers with a single pipeline and marks them as seen now.
+func (s *Store) AddDriverLocations(_ context.Context, locations []*redis.GeoLocation) error {
+	now := time.Now().Unix()
+	_, err := s.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, l := range locations {
+			pipe.Do("SET", collection, l.Name, "FIELD", "seen", now, "POINT", l.Latitude, l.Longitude)
+		}
+		return nil
+	})
+	return storages.Classify(err)
+}
+
+// RemoveDriverLocation removes the driver from the search.
+func (s *Store) RemoveDriverLocation(id string) error {
+	return storages.Classify(s.client.Do("DEL", collection, id).Err())
+}
+
+// ReserveDriver removes the driver from the search and reserves it for the request during ttl, it returns false if the driver
+// is not in the search or another request reserved it first. The reservation is kept in Redis, it decides which request gets the driver.
+func (s *Store) ReserveDriver(_ context.Context, driverID, requestID string, ttl time.Duration) (bool, error) {
+	var res interface{}
+	err := read(func() (err error) {
+		res, err = s.client.Do("GET", collection, driverID, "POINT").Result()
+		return err
+	})
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	point, _ := res.([]interface{})
+	if len(point) < 2 {
+		return false, fmt.Errorf("unexpected tile38 point %v", res)
+	}
+	lat, err := toFloat(point[0])
+	if err != nil {
+		return false, err
+	}
+	lng, err := toFloat(point[1])
+	if err != nil {
+		return false, err
+	}
+	return storages.Reserve(s, driverID, requestID, geo.Point{Lat: lat, Lng: lng}, ttl)
+}
+
+// LastSeen returns the time of the last location of each driver, the drivers that are not in the search are missing.
+func (s *Store) LastSeen(ids []string) (map[string]time.Time, error) {
+	cmds := make([]*redis.Cmd, len(ids))
+	err := read(func() error {
+		_, err := s.client.Pipelined(func(pipe redis.Pipeliner) error {
+			for i, id := range ids {
+				cmds[i] = pipe.Do("GET", collection, id, "WITHFIELDS", "POINT")
+			}
+			return nil
+		})
+		if err == redis.Nil {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]time.Time, len(ids))
+	for i, id := range ids {
+		res, err := cmds[i].Result()
+		if err != nil {
+			continue
+		}
+		// The reply is the point followed by the fields.
+		values, _ := res.([]interface{})
+		if len(values) < 2 {
+			continue
+		}
+		if fields, ok := fieldsOf(values[1]); ok {
+			seen[id] = time.Unix(int64(fields["seen"]), 0)
+		}
+	}
+	return seen, nil
+}
+
+// SearchDrivers returns up to limit drivers within r km of the point sorted by distance.
+func (s *Store) SearchDrivers(_ context.Context, limit int, lat, lng, r float64) ([]redis.GeoLocation, error) {
+	var res interface{}
+	err := read(func() (err error) {
+		res, err = s.client.Do("NEARBY", collection, "LIMIT", limit, "DISTANCE", "POINTS", "POINT", lat, lng, r*1000).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, drivers, err := parsePoints(res)
+	return drivers, err
+}
+
+// DriversInBox returns the drivers inside the box.
+func (s *Store) DriversInBox(_ context.Context, minLat, minLng, maxLat, maxLng float64) ([]redis.GeoLocation, error) {
+	var drivers []redis.GeoLocation
+	for cursor := int64(0); ; {
+		var res interface{}
+		err := read(func() (err error) {
+			res, err = s.client.Do("WITHIN", collection, "CURSOR", cursor, "LIMIT", pageSize, "POINTS", "BOUNDS", minLat, minLng, maxLat, maxLng).Result()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		next, found, err := parsePoints(res)
+		if err != nil {
+			return nil, err
+		}
+		drivers = append(drivers, found...)
+		if next == 0 {
+			return drivers, nil
+		}
+		cursor = next
+	}
+}
+
+// ExpireDrivers removes the drivers whose last location is older than ttl and returns them.
+// Unlike the Redis script it is not atomic, a driver that sends its location between the scan and the delete is removed
+// and it is back with its next location.
+func (s *Store) ExpireDrivers(ttl time.Duration) ([]string, error) {
+	cutoff := time.Now().Add(-ttl).Unix()
+	stale, err := s.scan("WHERE", "seen", "-inf", cutoff)
+	if err != nil || len(stale) == 0 {
+		return nil, err
+	}
+	_, err = s.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, id := range stale {
+			pipe.Do("DEL", collection, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, storages.Classify(err)
+	}
+	return stale, nil
+}
+
+// Located returns the drivers that are in the search.
+func (s *Store) Located() ([]string, error) {
+	return s.scan()
+}
+
+// scan returns the ids of the collection that match the options, e.g. WHERE seen -inf 100.
+func (s *Store) scan(options ...interface{}) ([]string, error) {
+	var ids []string
+	for cursor := int64(0); ; {
+		args := append([]interface{}{"SCAN", collection, "CURSOR", cursor, "LIMIT", pageSize}, options...)
+		var res interface{}
+		err := read(func() (err error) {
+			res, err = s.client.Do(append(args, "IDS")...).Result()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		next, items, err := page(res)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			if id, ok := item.(string); ok {
+				ids = append(ids, id)
+			}
+		}
+		if next == 0 {
+			return ids, nil
+		}
+		cursor = next
+	}
+}
+
+// page splits a reply of Tile38 in the cursor of the next page, 0 if it is the last one, and the items.
+func page(res interface{}) (int64, []interface{}, error) {
+	values, ok := res.([]interface{})
+	if !ok || len(values) < 2 {
+		return 0, nil, fmt.Errorf("unexpected tile38 reply %v", res)
+	}
+	cursor, err := toFloat(values[0])
+	if err != nil {
+		return 0, nil, fmt.Errorf("unexpected tile38 cursor %v", values[0])
+	}
+	items, _ := values[len(values)-1].([]interface{})
+	return int64(cursor), items, nil
+}
+
+// parsePoints parses a reply of POINTS, each item is the id, the point, the fields if the object has them and the distance
+// in meters if it was requested.
+func parsePoints(res interface{}) (int64, []redis.GeoLocation, error) {
+	cursor, items, err := page(res)
+	if err != nil {
+		return 0, nil, err
+	}
+	drivers := make([]redis.GeoLocation, 0, len(items))
+	for _, item := range items {
+		values, ok := item.([]interface{})
+		if !ok || len(values) < 2 {
+			return 0, nil, fmt.Errorf("unexpected tile38 object %v", item)
+		}
+		d := redis.GeoLocation{}
+		d.Name, _ = values[0].(string)
+		point, _ := values[1].([]interface{})
+		if len(point) < 2 {
+			return 0, nil, fmt.Errorf("unexpected tile38 point %v", values[1])
+		}
+		if d.Latitude, err = toFloat(point[0]); err != nil {
+			return 0, nil, err
+		}
+		if d.Longitude, err = toFloat(point[1]); err != nil {
+			return 0, nil, err
+		}
+		for _, v := range values[2:] {
+			// The fields are an array, the distance is a number.
+			if _, ok := v.([]interface{}); ok {
+				continue
+			}
+			meters, err := toFloat(v)
+			if err != nil {
+				return 0, nil, err
+			}
+			d.Dist = meters / 1000
+		}
+		drivers = append(drivers, d)
+	}
+	return cursor, drivers, nil
+}
+
+// fieldsOf parses the fields of an object, they are a flat array of names and values.
+func fieldsOf(v interface{}) (map[string]float64, bool) {
+	values, ok := v.([]interface{})
+	if !ok || len(values)%2 != 0 {
+		return nil, false
+	}
+	fields := make(map[string]float64, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		name, ok := values[i].(string)
+		if !ok {
+			return nil, false
+		}
+		value, err := toFloat(values[i+1])
+		if err != nil {
+			return nil, false
+		}
+		fields[name] = value
+	}
+	return fields, true
+}
+
+// toFloat parses a number of a reply, Tile38 sends them as integers or strings.
+func toFloat(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), nil
+	case string:
+		return strconv.ParseFloat(n, 64)
+	default:
+		return 0, fmt.Errorf("unexpected tile38 number %v", v)
+	}
+}
@@ -0,0 +1,56 @@
+package tile38
+
+import (
+	"testing"
+
+	"github.com/douglasmakey/tracking/storages"
+)
+
+var _ storages.LocationStore = (*Store)(nil)
+
+func TestParsePoints(t *testing.T) {
+	res := []interface{}{
+		int64(0),
+		[]interface{}{
+			[]interface{}{"1", []interface{}{"-33.44", "-70.65"}, []interface{}{"seen", "1700000000"}, "120.5"},
+			[]interface{}{"2", []interface{}{"-33.45", "-70.66"}, "1500"},
+		},
+	}
+	cursor, drivers, err := parsePoints(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor != 0 || len(drivers) != 2 {
+		t.Fatalf("expected 2 drivers in the last page, got %d drivers and cursor %d", len(drivers), cursor)
+	}
+	if d := drivers[0]; d.Name != "1" || d.Latitude != -33.44 || d.Longitude != -70.65 || d.Dist != 0.1205 {
+		t.Errorf("unexpected driver %+v", d)
+	}
+	if d := drivers[1]; d.Name != "2" || d.Dist != 1.5 {
+		t.Errorf("unexpected driver %+v", d)
+	}
+
+	if _, _, err := parsePoints("OK"); err == nil {
+		t.Error("expected an error for an unexpected reply")
+	}
+}
+
+func TestPage(t *testing.T) {
+	cursor, items, err := page([]interface{}{"1000", []interface{}{"1", "2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor != 1000 || len(items) != 2 {
+		t.Errorf("expected the next cursor and 2 ids, got %d and %v", cursor, items)
+	}
+}
+
+func TestFieldsOf(t *testing.T) {
+	fields, ok := fieldsOf([]interface{}{"seen", int64(1700000000)})
+	if !ok || fields["seen"] != 1700000000 {
+		t.Errorf("unexpected fields %v", fields)
+	}
+	if _, ok := fieldsOf([]interface{}{"seen"}); ok {
+		t.Error("expected an odd array not to be fields")
+	}
+}
@@ -0,0 +1,122 @@
+package storages
+
+import (
+	"sort"
+
+	"github.com/go-redis/redis"
+)
+
+// IndexReport is the result of the verification of the GEO index of the drivers.
+type IndexReport struct {
+	Drivers int `json:"drivers"`
+	// WithoutLastSeen are in the GEO set but not in the last seen set, the janitor never removes them.
+	WithoutLastSeen []string `json:"without_last_seen"`
+	// WithoutLocation are in the last seen set but not in the GEO set.
+	WithoutLocation []string `json:"without_location"`
+	// Reserved are searchable while they have a reservation.
+	Reserved []string `json:"reserved"`
+}
+
+// Consistent returns true if the report did not find any discrepancy.
+func (r IndexReport) Consistent() bool {
+	return len(r.WithoutLastSeen) == 0 && len(r.WithoutLocation) == 0 && len(r.Reserved) == 0
+}
+
+// VerifyIndex checks that the GEO set and the last seen set have the same drivers and that the reserved drivers are not searchable.
+// It only reads, the discrepancies are reported.
+func (c *RedisClient) VerifyIndex() (IndexReport, error) {
+	located, err := c.Located()
+	if err != nil {
+		return IndexReport{}, err
+	}
+	var seen []string
+	var holds map[string]string
+	err = WithRetry(func() error {
+		var seenCmd *redis.StringSliceCmd
+		var holdsCmd *redis.StringStringMapCmd
+		_, err := c.Pipelined(func(pipe redis.Pipeliner) error {
+			seenCmd = pipe.ZRange(c.prefix+lastSeenKey, 0, -1)
+			holdsCmd = pipe.HGetAll(c.prefix + holdsKey)
+			return nil
+		})
+		seen, holds = seenCmd.Val(), holdsCmd.Val()
+		return err
+	})
+	if err != nil {
+		return IndexReport{}, err
+	}
+
+	report := IndexReport{Drivers: len(located), WithoutLastSeen: []string{}, WithoutLocation: []string{}, Reserved: []string{}}
+	isLocated := make(map[string]bool, len(located))
+	for _, id := range located {
+		isLocated[id] = true
+	}
+	isSeen := make(map[string]bool, len(seen))
+	for _, id := range seen {
+		isSeen[id] = true
+		if !isLocated[id] {
+			report.WithoutLocation = append(report.WithoutLocation, id)
+		}
+	}
+	for _, id := range located {
+		if !isSeen[id] {
+			report.WithoutLastSeen = append(report.WithoutLastSeen, id)
+		}
+	}
+
+	// The holds can be of expired reservations, only the live ones are discrepancies.
+	var held []string
+	for id := range holds {
+		if isLocated[id] {
+			held = append(held, id)
+		}
+	}
+	sort.Strings(held)
+	if len(held) > 0 {
+		cmds := make([]*redis.IntCmd, len(held))
+		err := WithRetry(func() error {
+			_, err := c.Pipelined(func(pipe redis.Pipeliner) error {
+				for i, id := range held {
+					cmds[i] = pipe.Exists(c.prefix + reservationKey(id))
+				}
+				return nil
+			})
+			return err
+		})
+		if err != nil {
+			return IndexReport{}, err
+		}
+		for i, id := range held {
+			if cmds[i].Val() == 1 {
+				report.Reserved = append(report.Reserved, id)
+			}
+		}
+	}
+	return report, nil
+}
+
+// Located returns the drivers that are in the GEO sets of all the regions.
+func (c *RedisClient) Located() ([]string, error) {
+	keys, err := c.geoKeys()
+	if err != nil {
+		return nil, err
+	}
+	cmds := make([]*redis.StringSliceCmd, len(keys))
+	err = WithRetry(func() error {
+		_, err := c.Pipelined(func(pipe redis.Pipeliner) error {
+			for i, k := range keys {
+				cmds[i] = pipe.ZRange(k, 0, -1)
+			}
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, cmd := range cmds {
+		ids = append(ids, cmd.Val()...)
+	}
+	return ids, nil
+}
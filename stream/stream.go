@@ -0,0 +1,171 @@
+// Package stream ingests the locations of the drivers from a Kafka topic, they are stored the same as the locations of /tracking.
+// The instances read the topic with a consumer group, so the partitions are shared between them and each location is stored once.
+// The messages are JSON locations, the key is the ID of the driver so the locations of a driver keep their order.
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/douglasmakey/tracking/ingest"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/metrics"
+	"github.com/douglasmakey/tracking/retry"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/segmentio/kafka-go"
+)
+
+// Config is the topic and the consumer group, the locations are saved in batches of up to BatchSize or every BatchWait.
+type Config struct {
+	Brokers   []string
+	Topic     string
+	GroupID   string
+	BatchSize int
+	BatchWait time.Duration
+}
+
+// reader is the consumer of the topic, it is a *kafka.Reader.
+type reader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// Consumer saves the locations of the topic.
+type Consumer struct {
+	cfg    Config
+	reader reader
+	// accept and save are the steps of the ingestion, they are replaced in the tests.
+	accept func(l ingest.Location, dryRun bool) error
+	save   func(ctx context.Context, locations ...ingest.Location) error
+}
+
+// NewConsumer returns a consumer of the group, it does not read until Run.
+func NewConsumer(cfg Config) *Consumer {
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: cfg.Brokers,
+		Topic:   cfg.Topic,
+		GroupID: cfg.GroupID,
+		MaxWait: cfg.BatchWait,
+	})
+	return newConsumer(cfg, r)
+}
+
+func newConsumer(cfg Config, r reader) *Consumer {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 1
+	}
+	return &Consumer{cfg: cfg, reader: r, accept: ingest.Accept, save: ingest.Save}
+}
+
+// Start runs the consumer in a goroutine until ctx is done.
+func (c *Consumer) Start(ctx context.Context) {
+	go c.Run(ctx)
+}
+
+// Run reads the topic until ctx is done, the offsets of a batch are committed after its locations are saved.
+func (c *Consumer) Run(ctx context.Context) {
+	defer c.reader.Close()
+	for ctx.Err() == nil {
+		msgs, err := c.fetch(ctx)
+		if err != nil {
+			logging.Logger.Error("could not read locations from kafka", "topic", c.cfg.Topic, "error", err)
+			time.Sleep(time.Second)
+		}
+		if len(msgs) == 0 {
+			continue
+		}
+		if err := c.handle(ctx, msgs); err != nil {
+			// The batch is read again after a restart or a rebalance, the locations are idempotent.
+			logging.Logger.Error("could not save locations from kafka", "topic", c.cfg.Topic, "error", err)
+			continue
+		}
+		if err := c.reader.CommitMessages(ctx, msgs...); err != nil {
+			logging.Logger.Warn("could not commit kafka offsets", "topic", c.cfg.Topic, "error", err)
+		}
+	}
+}
+
+// fetch reads up to BatchSize messages, it returns the messages read when BatchWait elapses.
+func (c *Consumer) fetch(ctx context.Context) ([]kafka.Message, error) {
+	var msgs []kafka.Message
+	batchCtx, cancel := context.WithTimeout(ctx, c.cfg.BatchWait)
+	defer cancel()
+	for len(msgs) < c.cfg.BatchSize {
+		m, err := c.reader.FetchMessage(batchCtx)
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+			return msgs, nil
+		}
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+// handle saves the valid locations of the messages, the invalid ones and the ones of stale devices are dropped.
+// The transient errors of the storage are retried until ctx is done, so the offsets are not committed before the locations are saved.
+func (c *Consumer) handle(ctx context.Context, msgs []kafka.Message) error {
+	locations := make([]ingest.Location, 0, len(msgs))
+	for _, m := range msgs {
+		l, err := decode(m)
+		if err != nil {
+			metrics.StreamMessages.WithLabelValues("invalid").Inc()
+			logging.Logger.Warn("invalid location from kafka", "partition", m.Partition, "offset", m.Offset, "error", err)
+			continue
+		}
+		locations = append(locations, l)
+	}
+
+	policy := retry.For(retry.Storage)
+	for attempt := 1; ; attempt++ {
+		err := c.store(ctx, locations)
+		if err == nil || !storages.IsTransient(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(policy.Backoff(attempt)):
+		}
+	}
+}
+
+// store checks the devices of the locations and saves the accepted ones.
+func (c *Consumer) store(ctx context.Context, locations []ingest.Location) error {
+	accepted := make([]ingest.Location, 0, len(locations))
+	for _, l := range locations {
+		err := c.accept(l, false)
+		if err == ingest.ErrStaleDevice {
+			metrics.StreamMessages.WithLabelValues("stale_device").Inc()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		accepted = append(accepted, l)
+	}
+	if len(accepted) == 0 {
+		return nil
+	}
+	if err := c.save(ctx, accepted...); err != nil {
+		return err
+	}
+	metrics.StreamMessages.WithLabelValues("saved").Add(float64(len(accepted)))
+	return nil
+}
+
+// decode returns the location of the message, the key is the driver when the location does not have one.
+func decode(m kafka.Message) (ingest.Location, error) {
+	var l ingest.Location
+	if err := json.Unmarshal(m.Value, &l); err != nil {
+		return l, err
+	}
+	if l.ID == "" {
+		l.ID = string(m.Key)
+	}
+	return l, ingest.Validate(l)
+}
@@ -0,0 +1,84 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/douglasmakey/tracking/ingest"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeReader returns its messages and then waits until the context is done.
+type fakeReader struct {
+	msgs      []kafka.Message
+	committed []kafka.Message
+}
+
+func (r *fakeReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	if len(r.msgs) == 0 {
+		<-ctx.Done()
+		return kafka.Message{}, ctx.Err()
+	}
+	m := r.msgs[0]
+	r.msgs = r.msgs[1:]
+	return m, nil
+}
+
+func (r *fakeReader) CommitMessages(_ context.Context, msgs ...kafka.Message) error {
+	r.committed = append(r.committed, msgs...)
+	return nil
+}
+
+func (r *fakeReader) Close() error { return nil }
+
+func TestHandle(t *testing.T) {
+	r := &fakeReader{msgs: []kafka.Message{
+		{Key: []byte("1"), Value: []byte(`{"lat": -33.44, "lng": -70.65}`)},
+		{Key: []byte("2"), Value: []byte(`{"lat": 100, "lng": -70.65}`)},
+		{Key: []byte("3"), Value: []byte(`{"id": "3", "lat": -33.45, "lng": -70.66, "device_id": "old"}`)},
+		{Value: []byte(`not json`)},
+	}}
+	c := newConsumer(Config{BatchSize: 10, BatchWait: 10 * time.Millisecond}, r)
+	c.accept = func(l ingest.Location, _ bool) error {
+		if l.DeviceID == "old" {
+			return ingest.ErrStaleDevice
+		}
+		return nil
+	}
+	failures := 1
+	var saved []ingest.Location
+	c.save = func(_ context.Context, locations ...ingest.Location) error {
+		// The first attempt fails with a transient error, the batch is retried.
+		if failures > 0 {
+			failures--
+			return storages.Classify(storages.ErrUnavailable)
+		}
+		saved = append(saved, locations...)
+		return nil
+	}
+
+	msgs, err := c.fetch(context.Background())
+	if err != nil || len(msgs) != 4 {
+		t.Fatalf("expected the 4 messages, got %d and %v", len(msgs), err)
+	}
+	if err := c.handle(context.Background(), msgs); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0].ID != "1" {
+		t.Errorf("expected only the valid location of the driver 1 to be saved, got %+v", saved)
+	}
+}
+
+func TestHandlePermanentError(t *testing.T) {
+	c := newConsumer(Config{BatchWait: time.Millisecond}, &fakeReader{})
+	c.accept = func(ingest.Location, bool) error { return nil }
+	c.save = func(context.Context, ...ingest.Location) error { return errors.New("invalid") }
+
+	err := c.handle(context.Background(), []kafka.Message{{Key: []byte("1"), Value: []byte(`{"lat": 1, "lng": 1}`)}})
+	if err == nil {
+		t.Error("expected the permanent error not to be retried")
+	}
+}
@@ -0,0 +1,185 @@
+// Package supply tells the searches when drivers report in an area, so a search that found nobody can skip its next ticks
+// until a driver enters the area instead of running the same empty GEO query.
+// The cells with new locations are published by the instance that saves them and every instance counts the changes of each cell.
+package supply
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/storages"
+)
+
+const (
+	// channel is the Redis channel of the cells with new locations, the payload is the cells separated by commas.
+	channel = "supply:cells"
+	// precision is the precision of the geohash of the cells, about 5km x 5km.
+	precision = 5
+	// cellSize is the size in degrees of latitude of the side of a cell, used to sample the cells of a circle.
+	cellSize = 0.044
+	// maxRadius is the max radius in km of a watched area, the larger areas are always searched.
+	maxRadius = 25
+)
+
+// Cell returns the cell of the point.
+func Cell(p geo.Point) string {
+	return geo.Geohash(p, precision)
+}
+
+// Cover returns the cells that cover the circle of radius km around center, nil if the circle is too large to be watched.
+func Cover(center geo.Point, radius float64) []string {
+	if radius > maxRadius {
+		return nil
+	}
+	// The degrees of latitude and longitude of the radius, sampled every half cell.
+	dLat := radius / 111.32
+	dLng := dLat
+	if c := math.Cos(center.Lat * math.Pi / 180); c > 0.01 {
+		dLng = dLat / c
+	}
+	step := cellSize / 2
+
+	seen := map[string]bool{}
+	var cells []string
+	for lat := center.Lat - dLat; lat <= center.Lat+dLat+step; lat += step {
+		for lng := center.Lng - dLng; lng <= center.Lng+dLng+step; lng += step {
+			c := Cell(geo.Point{Lat: lat, Lng: lng})
+			if !seen[c] {
+				seen[c] = true
+				cells = append(cells, c)
+			}
+		}
+	}
+	return cells
+}
+
+var (
+	mu sync.Mutex
+	// instance identifies the counters of this instance, the marks taken by other instances are always changed.
+	// versions is the number of changes received of each cell, generation changes when the changes can not be followed.
+	instance   string
+	versions   = make(map[string]uint64)
+	generation uint64
+	watching   bool
+	// pending are the cells with new locations not published yet, they are only recorded after Start.
+	pending = make(map[string]struct{})
+	started bool
+)
+
+// Record queues the cells of the points to be published, it does not block.
+func Record(points ...geo.Point) {
+	mu.Lock()
+	defer mu.Unlock()
+	if !started {
+		return
+	}
+	for _, p := range points {
+		pending[Cell(p)] = struct{}{}
+	}
+}
+
+// Mark is the state of the cells of an area at a moment in an instance, see Changed.
+// It is saved with the task of the search, the task can run its next tick in another instance.
+type Mark struct {
+	Instance   string            `json:"instance"`
+	Generation uint64            `json:"generation"`
+	Versions   map[string]uint64 `json:"versions"`
+}
+
+// Watch returns the mark of the cells, ok is false when the changes are not followed, the area must be searched.
+func Watch(cells []string) (Mark, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	if !watching || len(cells) == 0 {
+		return Mark{}, false
+	}
+	m := Mark{Instance: instance, Generation: generation, Versions: make(map[string]uint64, len(cells))}
+	for _, c := range cells {
+		m.Versions[c] = versions[c]
+	}
+	return m, true
+}
+
+// Changed returns true if a driver reported in the cells of the mark after it was taken, or if the changes were not followed.
+func Changed(m Mark) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	if !watching || m.Instance != instance || m.Generation != generation {
+		return true
+	}
+	for c, v := range m.Versions {
+		if versions[c] != v {
+			return true
+		}
+	}
+	return false
+}
+
+// Start publishes the recorded cells every interval and follows the cells published by all the instances.
+// The changes sent while the subscription reconnects are lost, the searches bound the ticks that they skip.
+func Start(interval time.Duration) {
+	mu.Lock()
+	instance = logging.NewID()
+	started = true
+	mu.Unlock()
+
+	rClient := storages.GetRedisClient()
+	sub := rClient.Subscribe(channel)
+	if _, err := sub.Receive(); err != nil {
+		// Without the subscription the instance never skips a search.
+		logging.Logger.Warn("could not subscribe to supply changes", "error", err)
+	} else {
+		mu.Lock()
+		watching = true
+		mu.Unlock()
+	}
+
+	go func() {
+		for msg := range sub.Channel() {
+			received(strings.Split(msg.Payload, ","))
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			publish()
+		}
+	}()
+}
+
+func received(cells []string) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, c := range cells {
+		versions[c]++
+	}
+}
+
+// publish sends the pending cells in one message, the cells are lost if it fails so the marks of the instance are invalidated.
+func publish() {
+	mu.Lock()
+	if len(pending) == 0 {
+		mu.Unlock()
+		return
+	}
+	cells := make([]string, 0, len(pending))
+	for c := range pending {
+		cells = append(cells, c)
+	}
+	pending = make(map[string]struct{})
+	mu.Unlock()
+
+	rClient := storages.GetRedisClient()
+	if err := rClient.Publish(channel, strings.Join(cells, ",")).Err(); err != nil {
+		logging.Logger.Warn("could not publish supply changes", "cells", len(cells), "error", err)
+		mu.Lock()
+		generation++
+		mu.Unlock()
+	}
+}
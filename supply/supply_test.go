@@ -0,0 +1,58 @@
+package supply
+
+import (
+	"testing"
+
+	"github.com/douglasmakey/tracking/geo"
+)
+
+func TestCover(t *testing.T) {
+	center := geo.Point{Lat: -33.44, Lng: -70.65}
+	cells := Cover(center, 3)
+	covered := map[string]bool{}
+	for _, c := range cells {
+		covered[c] = true
+	}
+	// The points of the circle are in the cells.
+	for _, p := range []geo.Point{center, {Lat: -33.467, Lng: -70.65}, {Lat: -33.44, Lng: -70.618}, {Lat: -33.413, Lng: -70.682}} {
+		if !covered[Cell(p)] {
+			t.Errorf("expected the cell of %+v to be covered", p)
+		}
+	}
+	if Cover(center, maxRadius+1) != nil {
+		t.Error("expected no cells for a large radius")
+	}
+}
+
+func TestChanged(t *testing.T) {
+	mu.Lock()
+	instance, watching = "a", true
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		instance, watching = "", false
+		mu.Unlock()
+	}()
+
+	mark, ok := Watch([]string{"66jc9", "66jcc"})
+	if !ok {
+		t.Fatal("expected a mark")
+	}
+	if Changed(mark) {
+		t.Error("expected no change")
+	}
+	received([]string{"66jcd"})
+	if Changed(mark) {
+		t.Error("expected no change outside the area")
+	}
+	received([]string{"66jcc"})
+	if !Changed(mark) {
+		t.Error("expected a change in the area")
+	}
+
+	mark, _ = Watch([]string{"66jc9"})
+	mark.Instance = "b"
+	if !Changed(mark) {
+		t.Error("expected the marks of other instances to be changed")
+	}
+}
@@ -0,0 +1,93 @@
+package tasks
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// These are the policies for a search of a user that already has an active request.
+const (
+	// DuplicatesReject rejects the new search.
+	DuplicatesReject = "reject"
+	// DuplicatesExisting returns the active request instead of creating a new one.
+	DuplicatesExisting = "existing"
+	// DuplicatesAllow lets the user search several drivers at once.
+	DuplicatesAllow = "allow"
+)
+
+// activeKey keeps the request of the user that is searching a driver.
+func activeKey(userID string) string {
+	return fmt.Sprintf("user:%s:active", userID)
+}
+
+// claimAttempts is the number of times that the active request is read again when it finished while the request was claimed.
+const claimAttempts = 3
+
+// errClaim is returned when the active request of the user kept changing while the request was claimed.
+var errClaim = errors.New("could not claim the active request")
+
+// claimScript makes ARGV[2] the active request of the user in KEYS[1] for ARGV[3] milliseconds if the active request is still
+// ARGV[1], empty when the user has none, and returns ARGV[2]. Otherwise it returns the current active request.
+// The active request and the request keys are in different slots of a cluster, so the script does not read the request key.
+var claimScript = redis.NewScript(`
+local active = redis.call("GET", KEYS[1]) or ""
+if active ~= ARGV[1] then
+	return active
+end
+redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+return ARGV[2]
+`)
+
+// ClaimActive makes the request the active request of the user during ttl, it returns the active request of the user
+// when it already has one that is still searching: its key exists and it was not canceled. Then the request is not claimed.
+func ClaimActive(userID, requestID string, ttl time.Duration) (string, error) {
+	rClient := storages.GetRedisClient()
+	for i := 0; i < claimAttempts; i++ {
+		active, err := rClient.Get(activeKey(userID)).Result()
+		if err != nil && err != redis.Nil {
+			return "", storages.Classify(err)
+		}
+		if active != "" {
+			value, err := rClient.Get(active).Result()
+			if err != nil && err != redis.Nil {
+				return "", storages.Classify(err)
+			}
+			if err == nil && value != "0" && value != "false" {
+				return active, nil
+			}
+		}
+
+		claimed, err := claimScript.Run(rClient, []string{activeKey(userID)}, active, requestID, ttl.Milliseconds()).String()
+		if err != nil {
+			return "", storages.Classify(err)
+		}
+		switch claimed {
+		case requestID:
+			return "", nil
+		case "":
+			// The active request was released since it was read, it is read again.
+		default:
+			// Another search of the user claimed its request since the active request was read.
+			return claimed, nil
+		}
+	}
+	return "", errClaim
+}
+
+// releaseScript removes the active request of the user in KEYS[1] if it is ARGV[1].
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// releaseActive lets the user search again once the request finished.
+func releaseActive(userID, requestID string) error {
+	rClient := storages.GetRedisClient()
+	return storages.Classify(releaseScript.Run(rClient, []string{activeKey(userID)}, requestID).Err())
+}
@@ -0,0 +1,111 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/douglasmakey/tracking/config"
+	"github.com/douglasmakey/tracking/eta"
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// These are the events of the matched driver on its way to the pickup, they follow the matched event of the request.
+const (
+	EventDriverApproaching = "driver_approaching"
+	EventDriverAtPickup    = "driver_at_pickup"
+)
+
+// atPickupRadius is the distance in km to the pickup where the driver is at the pickup.
+const atPickupRadius = 0.05
+
+// approachKey is the request that the driver is going to pick up, it expires after the approach window.
+func approachKey(driverID string) string {
+	return fmt.Sprintf("tasks:approach:%s", driverID)
+}
+
+// approachThrottleKey exists while the last update of the approach of the driver is recent.
+func approachThrottleKey(driverID string) string {
+	return fmt.Sprintf("tasks:approach:%s:throttle", driverID)
+}
+
+// approach is the pickup of the request that the driver goes to.
+type approach struct {
+	RequestID string    `json:"request_id"`
+	Pickup    geo.Point `json:"pickup"`
+}
+
+// followApproach sends the distance and the ETA of the matched driver to the pickup to the rider with the next locations of the driver.
+func (r *RequestDriverTask) followApproach() error {
+	data, err := json.Marshal(approach{RequestID: r.ID, Pickup: geo.Point{Lat: r.Lat, Lng: r.Lng}})
+	if err != nil {
+		return err
+	}
+	rClient := storages.GetRedisClient()
+	return storages.Classify(rClient.Set(approachKey(r.DriverID), data, config.Get().ApproachTTL).Err())
+}
+
+// Approach publishes the distance and the ETA to the pickup of the drivers that go to pick up a rider, positions are the current
+// positions of the drivers by ID. Each driver is updated at most once every ApproachInterval, the updates end when the driver
+// is at the pickup or the approach window ends.
+func Approach(ctx context.Context, positions map[string]geo.Point) error {
+	if len(positions) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(positions))
+	for id := range positions {
+		ids = append(ids, id)
+	}
+
+	// The drivers are read with a pipeline, their keys can be in different slots of a cluster.
+	rClient := storages.GetRedisClient()
+	cmds := make([]*redis.StringCmd, len(ids))
+	_, err := rClient.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, id := range ids {
+			cmds[i] = pipe.Get(approachKey(id))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return storages.Classify(err)
+	}
+	interval := config.Get().ApproachInterval
+	for i, cmd := range cmds {
+		var a approach
+		if err := json.Unmarshal([]byte(cmd.Val()), &a); cmd.Err() != nil || err != nil {
+			continue
+		}
+		driverID, p := ids[i], positions[ids[i]]
+		distance := geo.Distance(p, a.Pickup)
+		atPickup := distance <= atPickupRadius
+		if !atPickup {
+			// Every instance receives locations, only the first one of each interval publishes the update.
+			ok, err := rClient.SetNX(approachThrottleKey(driverID), 1, interval).Result()
+			if err != nil {
+				return storages.Classify(err)
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		ev := Event{Type: EventDriverApproaching, DriverID: driverID, Distance: distance, ETA: eta.Estimate(ctx, p, a.Pickup).Seconds()}
+		if atPickup {
+			// Only the instance that ends the approach publishes the arrival.
+			n, err := rClient.Del(approachKey(driverID)).Result()
+			if err != nil {
+				return storages.Classify(err)
+			}
+			if n == 0 {
+				continue
+			}
+			ev = Event{Type: EventDriverAtPickup, DriverID: driverID}
+		}
+		if err := publishEvent(a.RequestID, ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package tasks
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// areasKey is the set of the zones with an index of searching requests.
+const areasKey = "zones:requests"
+
+// areaRequestsKey is the set with the searching requests picked up in the zone.
+func areaRequestsKey(zone string) string {
+	return fmt.Sprintf("zone:%s:requests", zone)
+}
+
+// zone returns the zone of the picking point of the request.
+func (r *RequestDriverTask) zone() string {
+	return geo.Zone(geo.Point{Lat: r.Lat, Lng: r.Lng})
+}
+
+// addAreaRequest adds the request to the index of its zone.
+func addAreaRequest(pipe redis.Pipeliner, r *RequestDriverTask) {
+	zone := r.zone()
+	pipe.SAdd(areaRequestsKey(zone), r.ID)
+	pipe.SAdd(areasKey, zone)
+}
+
+// removeAreaRequest removes the finished request from the index of its zone.
+func removeAreaRequest(r *RequestDriverTask) error {
+	rClient := storages.GetRedisClient()
+	return storages.Classify(rClient.SRem(areaRequestsKey(r.zone()), r.ID).Err())
+}
+
+// AreaRequests returns the searching requests picked up in the zone.
+func AreaRequests(zone string) ([]string, error) {
+	rClient := storages.GetRedisClient()
+	var ids []string
+	err := storages.WithRetry(func() (err error) {
+		ids, err = rClient.SMembers(areaRequestsKey(zone)).Result()
+		return err
+	})
+	return ids, err
+}
+
+// areaDemand returns the number of searching requests picked up in the zone.
+func areaDemand(zone string) (int64, error) {
+	rClient := storages.GetRedisClient()
+	var n int64
+	err := storages.WithRetry(func() (err error) {
+		n, err = rClient.SCard(areaRequestsKey(zone)).Result()
+		return err
+	})
+	return n, err
+}
+
+// RebuildAreaIndex replaces the index of the searching requests by zone with the tasks that are in the queues,
+// the scheduled set and the in-flight lists of the shards, they are the log of every searching request.
+// It returns the number of requests of each zone.
+func RebuildAreaIndex() (map[string]int, error) {
+	rClient := storages.GetRedisClient()
+	var jobs []string
+	var zones []string
+	err := storages.WithRetry(func() error {
+		shards, err := rClient.ZRange(heartbeatsKey, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		lists := []string{jobsKey(), priorityJobsKey()}
+		for _, s := range shards {
+			lists = append(lists, inflightKey(s))
+		}
+
+		cmds := make([]*redis.StringSliceCmd, 0, len(lists)+1)
+		var zonesCmd *redis.StringSliceCmd
+		_, err = rClient.Pipelined(func(pipe redis.Pipeliner) error {
+			for _, l := range lists {
+				cmds = append(cmds, pipe.LRange(l, 0, -1))
+			}
+			cmds = append(cmds, pipe.ZRange(scheduledKey(), 0, -1))
+			zonesCmd = pipe.SMembers(areasKey)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		jobs = jobs[:0]
+		for _, c := range cmds {
+			jobs = append(jobs, c.Val()...)
+		}
+		zones = zonesCmd.Val()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[string][]interface{})
+	for _, job := range jobs {
+		var r RequestDriverTask
+		if err := json.Unmarshal([]byte(job), &r); err != nil {
+			continue
+		}
+		zone := r.zone()
+		index[zone] = append(index[zone], r.ID)
+	}
+
+	_, err = rClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, zone := range zones {
+			pipe.Del(areaRequestsKey(zone))
+		}
+		pipe.Del(areasKey)
+		for zone, ids := range index {
+			pipe.SAdd(areaRequestsKey(zone), ids...)
+			pipe.SAdd(areasKey, zone)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, storages.Classify(err)
+	}
+
+	counts := make(map[string]int, len(index))
+	for zone, ids := range index {
+		counts[zone] = len(ids)
+	}
+	return counts, nil
+}
@@ -0,0 +1,132 @@
+package tasks
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/matching"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/douglasmakey/tracking/tracing"
+	"github.com/go-redis/redis"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// batchCellPrecision is the geohash precision of the cells of the batches, the cells are about 1.2 km wide.
+const batchCellPrecision = 6
+
+// collectPause is the wait between two pops of a batch when the queue is empty.
+const collectPause = 20 * time.Millisecond
+
+// collect pops up to max more jobs during the window, they are moved to the in-flight list like the first job.
+func collect(rClient *storages.RedisClient, inflight string, window time.Duration, max int) []string {
+	var jobs []string
+	deadline := time.Now().Add(window)
+	for len(jobs) < max && time.Now().Before(deadline) {
+		job, err := rClient.RPopLPush(jobsKey(), inflight).Result()
+		if err == redis.Nil {
+			time.Sleep(collectPause)
+			continue
+		}
+		if err != nil {
+			break
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// batchable returns true if the request can be assigned with other requests, the scheduled rides follow their own candidates
+// and the sandbox and priority requests are matched alone. The requests waiting for the response of a driver are not searching.
+func (r *RequestDriverTask) batchable() bool {
+	return r.PickupAt.IsZero() && r.OfferDeadline.IsZero() && !r.Sandbox && !r.Accessible && !r.Priority
+}
+
+// batches groups the requests by the cell of their picking point, only the cells with more than one request are a batch.
+func batches(tasks []*RequestDriverTask) [][]*RequestDriverTask {
+	cells := make(map[string][]*RequestDriverTask)
+	var order []string
+	for _, r := range tasks {
+		if !r.batchable() {
+			continue
+		}
+		cell := geo.Geohash(geo.Point{Lat: r.Lat, Lng: r.Lng}, batchCellPrecision)
+		if _, ok := cells[cell]; !ok {
+			order = append(order, cell)
+		}
+		cells[cell] = append(cells[cell], r)
+	}
+
+	var groups [][]*RequestDriverTask
+	for _, cell := range order {
+		if len(cells[cell]) > 1 {
+			groups = append(groups, cells[cell])
+		}
+	}
+	return groups
+}
+
+// assignBatch searches the candidates of the requests of the batch and assigns a driver to each one minimizing the sum of the
+// distances to the picking points, instead of the first request taking the nearest driver of another one.
+// The distance stands for the ETA, the ETA provider is not called for every pair. Each request still ranks and reserves
+// its candidates when it runs, the assigned driver is ranked first.
+func assignBatch(batch []*RequestDriverTask) {
+	_, span := tracing.Start(context.Background(), "search.batch", attribute.Int("requests", len(batch)))
+	defer span.End()
+
+	column := make(map[string]int)
+	var drivers []string
+	for _, r := range batch {
+		// The invalid requests are finished when they run.
+		if err := r.validateRequest(); err != nil {
+			continue
+		}
+		found, err := r.candidates(context.Background(), r.limit(), r.Radius())
+		if err != nil {
+			r.logger().Warn("could not search drivers for the batch", "error", err)
+			continue
+		}
+		r.found = &found
+		for _, d := range found.drivers {
+			if _, ok := column[d.Name]; !ok {
+				column[d.Name] = len(drivers)
+				drivers = append(drivers, d.Name)
+			}
+		}
+	}
+	if len(drivers) == 0 {
+		return
+	}
+
+	cost := make([][]float64, len(batch))
+	for i, r := range batch {
+		cost[i] = make([]float64, len(drivers))
+		for j := range cost[i] {
+			cost[i][j] = math.Inf(1)
+		}
+		if r.found == nil {
+			continue
+		}
+		for _, d := range r.found.drivers {
+			cost[i][column[d.Name]] = d.Dist
+		}
+	}
+	for i, j := range matching.Assign(cost) {
+		if j >= 0 {
+			batch[i].assigned = drivers[j]
+		}
+	}
+}
+
+// promote moves the driver to the front of ranked, ranked is not changed if the driver is not in it.
+func promote(ranked []string, driverID string) []string {
+	for i, id := range ranked {
+		if id == driverID {
+			copy(ranked[1:i+1], ranked[:i])
+			ranked[0] = driverID
+			break
+		}
+	}
+	return ranked
+}
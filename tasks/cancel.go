@@ -0,0 +1,175 @@
+package tasks
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// These are the outcomes of a cancellation.
+const (
+	OutcomeCanceled        = "canceled"
+	OutcomeAlreadyCanceled = "already_canceled"
+	OutcomeExpired         = "expired"
+	// OutcomeAlreadyFinished is the outcome of the requests that were matched or expired before the cancellation.
+	OutcomeAlreadyFinished = "already_finished"
+)
+
+// canceledTTL is the time that a canceled request is kept, so the task can see that it was canceled.
+const canceledTTL = time.Minute
+
+// userRequestsKey is the set with the open requests of the user.
+func userRequestsKey(userID string) string {
+	return fmt.Sprintf("user:%s:requests", userID)
+}
+
+// openScript removes the requests in ARGV that are still open from the index of the user in KEYS[1] and returns them,
+// without request IDs it removes and returns all the requests of the index. The task removes its request when it finishes,
+// so only the requests that are still searching are returned.
+var openScript = redis.NewScript(`
+if #ARGV == 0 then
+	local ids = redis.call("SMEMBERS", KEYS[1])
+	redis.call("DEL", KEYS[1])
+	return ids
+end
+local open = {}
+for _, id in ipairs(ARGV) do
+	if redis.call("SREM", KEYS[1], id) == 1 then
+		table.insert(open, id)
+	end
+end
+return open
+`)
+
+// cancelScript cancels the request of the key KEYS[1] and saves the canceled status in KEYS[2], ARGV[1] is the TTL of the
+// canceled request, ARGV[2] the time of the change and ARGV[3] the TTL of the status. A finished request is never canceled,
+// its terminal status is kept. It returns the outcome and the new status.
+var cancelScript = redis.NewScript(`
+local value = redis.call("GET", KEYS[1])
+if not value then
+	return {"expired", ""}
+end
+if value == "0" or value == "false" then
+	return {"already_canceled", ""}
+end
+local data = redis.call("GET", KEYS[2])
+local status = {}
+if data then
+	status = cjson.decode(data)
+end
+if status.state and status.state ~= "searching" then
+	return {"already_finished", ""}
+end
+status.state = "canceled"
+status.radius_km = nil
+status.updated_at = ARGV[2]
+data = cjson.encode(status)
+redis.call("SET", KEYS[1], "false", "EX", ARGV[1])
+redis.call("SET", KEYS[2], data, "EX", ARGV[3])
+return {"canceled", data}
+`)
+
+// AddUserRequest adds the request to the index of open requests of the user.
+func AddUserRequest(userID, requestID string, ttl time.Duration) error {
+	rClient := storages.GetRedisClient()
+	_, err := rClient.Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.SAdd(userRequestsKey(userID), requestID)
+		// The index lives as long as the last request of the user.
+		pipe.Expire(userRequestsKey(userID), ttl)
+		return nil
+	})
+	return storages.Classify(err)
+}
+
+// removeUserRequest removes the finished request from the index of the user.
+func removeUserRequest(userID, requestID string) error {
+	rClient := storages.GetRedisClient()
+	return storages.Classify(rClient.SRem(userRequestsKey(userID), requestID).Err())
+}
+
+// Cancel cancels the requests of the user and returns the outcome of each one.
+func Cancel(userID string, requestIDs ...string) (map[string]string, error) {
+	if len(requestIDs) == 0 {
+		return map[string]string{}, nil
+	}
+	return runCancel(userID, requestIDs)
+}
+
+// CancelAll cancels all the open requests of the user, it is used when an account is suspended.
+func CancelAll(userID string) (map[string]string, error) {
+	return runCancel(userID, nil)
+}
+
+func runCancel(userID string, requestIDs []string) (map[string]string, error) {
+	args := make([]interface{}, 0, len(requestIDs))
+	for _, id := range requestIDs {
+		args = append(args, id)
+	}
+
+	rClient := storages.GetRedisClient()
+	res, err := openScript.Run(rClient, []string{userRequestsKey(userID)}, args...).Result()
+	if err != nil {
+		return nil, storages.Classify(err)
+	}
+
+	open, _ := res.([]interface{})
+	outcomes := make(map[string]string, len(requestIDs))
+	for _, v := range open {
+		id := fmt.Sprint(v)
+		outcome, err := cancelRequest(id)
+		if err != nil {
+			return outcomes, err
+		}
+		outcomes[id] = outcome
+	}
+	// The requests that are not open anymore are only reported.
+	for _, id := range requestIDs {
+		if _, ok := outcomes[id]; ok {
+			continue
+		}
+		value, err := rClient.Get(id).Result()
+		switch {
+		case err == redis.Nil:
+			outcomes[id] = OutcomeExpired
+		case err != nil:
+			return outcomes, storages.Classify(err)
+		case value == "0" || value == "false":
+			outcomes[id] = OutcomeAlreadyCanceled
+		default:
+			outcomes[id] = OutcomeAlreadyFinished
+		}
+	}
+	return outcomes, nil
+}
+
+// cancelRequest cancels the open request and publishes its canceled status, it returns the outcome.
+func cancelRequest(requestID string) (string, error) {
+	rClient := storages.GetRedisClient()
+	args := []interface{}{int(canceledTTL.Seconds()), time.Now().UTC().Format(time.RFC3339Nano), int(statusTTL.Seconds())}
+	res, err := cancelScript.Run(rClient, []string{requestID, statusKey(requestID)}, args...).Result()
+	if err != nil {
+		return "", storages.Classify(err)
+	}
+	values, _ := res.([]interface{})
+	if len(values) != 2 {
+		return "", fmt.Errorf("unexpected cancel result %v", res)
+	}
+	if outcome := fmt.Sprint(values[0]); outcome != OutcomeCanceled {
+		return outcome, nil
+	}
+
+	var s Status
+	if err := json.Unmarshal([]byte(fmt.Sprint(values[1])), &s); err != nil {
+		return "", err
+	}
+	publishStatus(requestID, s)
+	// The task sees the cancellation in its next attempt anyway.
+	if err := interrupt(requestID); err != nil {
+		logging.Logger.Warn("could not interrupt canceled request", "request_id", requestID, "error", err)
+	}
+	return OutcomeCanceled, nil
+}
@@ -0,0 +1,48 @@
+package tasks
+
+import (
+	"context"
+	"time"
+
+	"github.com/douglasmakey/tracking/eta"
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/go-redis/redis"
+)
+
+// DeliveryWindow is the promised window of a delivery, the order must be dropped off between From and To.
+// A driver that arrives before From waits, only the end of the window can be violated.
+type DeliveryWindow struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// Risk returns the share of the time left until the end of the window that the delivery takes, from 0 to 1, with the time of
+// the driver to the picking point and the time of the route to the dropoff. It returns false if the driver can not drop off before the end.
+func (w DeliveryWindow) Risk(now time.Time, pickup, route time.Duration) (float64, bool) {
+	left := w.To.Sub(now)
+	needed := pickup + route
+	if left <= 0 || needed > left {
+		return 1, false
+	}
+	return needed.Seconds() / left.Seconds(), true
+}
+
+// withinWindow returns the drivers that can plausibly complete the delivery within the window of the request and their risk of violating it.
+// The times are estimated with the ETA provider, the route to the dropoff is the same for all of them.
+func (r *RequestDriverTask) withinWindow(ctx context.Context, drivers []redis.GeoLocation) ([]redis.GeoLocation, map[string]float64) {
+	now := time.Now()
+	pickup := geo.Point{Lat: r.Lat, Lng: r.Lng}
+	route := eta.Estimate(ctx, pickup, *r.Dropoff)
+
+	risks := make(map[string]float64, len(drivers))
+	kept := drivers[:0]
+	for _, d := range drivers {
+		risk, ok := r.Window.Risk(now, eta.Estimate(ctx, geo.Point{Lat: d.Latitude, Lng: d.Longitude}, pickup), route)
+		if !ok {
+			continue
+		}
+		risks[d.Name] = risk
+		kept = append(kept, d)
+	}
+	return kept, risks
+}
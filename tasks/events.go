@@ -0,0 +1,64 @@
+package tasks
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// These are the progress events of a search, the last event of a request is its terminal state (e.g. matched or expired).
+const (
+	EventTick          = "tick_started"
+	EventRadiusWidened = "radius_widened"
+	EventCandidates    = "candidates_found"
+	// EventShadowCandidate is the best candidate of a scheduled ride before it is reserved.
+	EventShadowCandidate = "shadow_candidate"
+)
+
+// Event is a step of the search of a request, it is published while the request is searching so the clients can follow it.
+type Event struct {
+	Type       string    `json:"type"`
+	Attempt    int       `json:"attempt,omitempty"`
+	Radius     float64   `json:"radius_km,omitempty"`
+	Candidates int       `json:"candidates,omitempty"`
+	DriverID   string    `json:"driver_id,omitempty"`
+	Time       time.Time `json:"time"`
+	// Distance is the distance in km of the matched driver to the pickup and ETA its estimated time to arrive in seconds.
+	Distance float64 `json:"distance_km,omitempty"`
+	ETA      float64 `json:"eta_seconds,omitempty"`
+}
+
+// IsTerminal returns true if the state or the event ends the search.
+func IsTerminal(state string) bool {
+	switch state {
+	case StateMatched, StateExpired, StateCanceled, StateBeyondMaxDistance:
+		return true
+	}
+	return false
+}
+
+// eventsChannel is the Redis channel of the events of the request, the task and the subscriber can be in different instances.
+func eventsChannel(requestID string) string {
+	return fmt.Sprintf("request:%s:events", requestID)
+}
+
+// publishEvent sends the event to the subscribers of the request, the events are not stored
+// so the subscribers must read the status first.
+func publishEvent(requestID string, ev Event) error {
+	ev.Time = time.Now().UTC()
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	rClient := storages.GetRedisClient()
+	return storages.Classify(rClient.Publish(eventsChannel(requestID), data).Err())
+}
+
+// SubscribeEvents subscribes to the events of the request, the caller must close the subscription.
+func SubscribeEvents(requestID string) *redis.PubSub {
+	rClient := storages.GetRedisClient()
+	return rClient.Subscribe(eventsChannel(requestID))
+}
@@ -0,0 +1,276 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/douglasmakey/tracking/commands"
+	"github.com/douglasmakey/tracking/config"
+	dr "github.com/douglasmakey/tracking/drivers"
+	"github.com/douglasmakey/tracking/fairness"
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/heat"
+	"github.com/douglasmakey/tracking/idcodec"
+	"github.com/douglasmakey/tracking/matching"
+	"github.com/douglasmakey/tracking/metrics"
+	"github.com/douglasmakey/tracking/notify"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// These are the responses of an offer, an offer is pending until the driver responds or its deadline passes.
+const (
+	OfferPending  = "pending"
+	OfferAccepted = "accepted"
+	OfferDeclined = "declined"
+	OfferExpired  = "expired"
+)
+
+// These are the reasons which a response to an offer is refused.
+var (
+	ErrOfferNotFound = errors.New("offer not found")
+	ErrOfferExpired  = errors.New("offer expired")
+	ErrOfferAnswered = errors.New("offer already answered")
+)
+
+// offerKey is a hash with the offer of the request to its reserved driver: the driver, the deadline in unix milliseconds and the response.
+func offerKey(requestID string) string {
+	return fmt.Sprintf("request:%s:offer", requestID)
+}
+
+// Offer is the offer of a request to the driver reserved for it, the driver has until Deadline to accept or decline it.
+type Offer struct {
+	RequestID string    `json:"request_id"`
+	DriverID  string    `json:"driver_id"`
+	Deadline  time.Time `json:"deadline"`
+	Response  string    `json:"response"`
+}
+
+// createOffer saves the pending offer, it is kept a while after the deadline so the late responses are refused as expired.
+func createOffer(requestID, driverID string, deadline time.Time) error {
+	rClient := storages.GetRedisClient()
+	_, err := rClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(offerKey(requestID))
+		pipe.HMSet(offerKey(requestID), map[string]interface{}{
+			"driver_id": driverID,
+			"deadline":  deadline.UnixNano() / int64(time.Millisecond),
+			"response":  OfferPending,
+		})
+		pipe.ExpireAt(offerKey(requestID), deadline.Add(statusTTL))
+		return nil
+	})
+	return storages.Classify(err)
+}
+
+// GetOffer returns the offer of the request, ErrOfferNotFound if the request does not have one.
+func GetOffer(requestID string) (Offer, error) {
+	rClient := storages.GetRedisClient()
+	var fields map[string]string
+	err := storages.WithRetry(func() (err error) {
+		fields, err = rClient.HGetAll(offerKey(requestID)).Result()
+		return err
+	})
+	if err != nil {
+		return Offer{}, err
+	}
+	if len(fields) == 0 {
+		return Offer{}, ErrOfferNotFound
+	}
+	ms, _ := strconv.ParseInt(fields["deadline"], 10, 64)
+	return Offer{
+		RequestID: requestID,
+		DriverID:  fields["driver_id"],
+		Deadline:  time.Unix(0, ms*int64(time.Millisecond)),
+		Response:  fields["response"],
+	}, nil
+}
+
+// respondScript saves the response ARGV[2] of the driver ARGV[1] if the offer is still pending at ARGV[3], the time in unix milliseconds.
+// It returns 1 when the response is saved, 0 if the offer is not for the driver, -1 if it was answered and -2 if it expired.
+var respondScript = redis.NewScript(`
+local offer = redis.call("HMGET", KEYS[1], "driver_id", "deadline", "response")
+if offer[1] ~= ARGV[1] then
+	return 0
+end
+if offer[3] ~= "pending" then
+	return -1
+end
+if tonumber(offer[2]) < tonumber(ARGV[3]) then
+	return -2
+end
+redis.call("HSET", KEYS[1], "response", ARGV[2])
+return 1
+`)
+
+// RespondOffer saves the response of the driver to the offer of the request, the task of the request follows it in its next attempt.
+// A driver can only respond once and before the deadline.
+func RespondOffer(requestID, driverID string, accept bool, now time.Time) error {
+	response := OfferDeclined
+	if accept {
+		response = OfferAccepted
+	}
+	rClient := storages.GetRedisClient()
+	n, err := respondScript.Run(rClient, []string{offerKey(requestID)}, driverID, response, now.UnixNano()/int64(time.Millisecond)).Int64()
+	if err != nil {
+		return storages.Classify(err)
+	}
+	switch n {
+	case 0:
+		return ErrOfferNotFound
+	case -1:
+		return ErrOfferAnswered
+	case -2:
+		return ErrOfferExpired
+	}
+	return nil
+}
+
+// closeScript expires the offer if it is still pending and returns its final response.
+var closeScript = redis.NewScript(`
+local response = redis.call("HGET", KEYS[1], "response")
+if response == "pending" then
+	redis.call("HSET", KEYS[1], "response", "expired")
+	return "expired"
+end
+return response
+`)
+
+// closeOffer refuses the responses from now on and returns the response of the offer, a missing offer is expired.
+func closeOffer(requestID string) (string, error) {
+	rClient := storages.GetRedisClient()
+	response, err := closeScript.Run(rClient, []string{offerKey(requestID)}).String()
+	if err == redis.Nil {
+		return OfferExpired, nil
+	}
+	return response, storages.Classify(err)
+}
+
+// offer sends the request to the reserved driver through its command channel and the notifier,
+// the rider is not notified until the driver accepts.
+func (r *RequestDriverTask) offer(ctx context.Context) {
+	r.OfferDeadline = time.Now().Add(config.Get().OfferTimeout)
+	if err := createOffer(r.ID, r.DriverID, r.OfferDeadline); err != nil {
+		// The driver can not respond, the offer expires and the request searches again.
+		r.logger().Warn("could not save offer", "driver_id", r.DriverID, "error", err)
+	}
+	r.notifyDriver(ctx)
+
+	data := map[string]string{
+		"request_id":  r.ID,
+		"eta_seconds": strconv.Itoa(int(r.ETA.Seconds())),
+		"deadline":    r.OfferDeadline.UTC().Format(time.RFC3339),
+	}
+	err := notify.Send(ctx, notify.Message{UserID: r.DriverID, RequestID: idcodec.Encode(idcodec.KindRequest, r.ID), Kind: notify.KindOffer,
+		Text: fmt.Sprintf("New request %d min away, respond in %d seconds", int(math.Ceil(r.ETA.Minutes())), int(config.Get().OfferTimeout.Seconds())), Data: data})
+	if err != nil {
+		r.logger().Warn("could not notify driver", "driver_id", r.DriverID, "kind", notify.KindOffer, "error", err)
+	}
+	r.logger().Info("driver offered", "driver_id", r.DriverID, "deadline", r.OfferDeadline)
+}
+
+// followOffer returns the response of the driver to the offer, pending while the driver can still respond.
+// The request gives up the driver that declines or does not respond in time.
+func (r *RequestDriverTask) followOffer(ctx context.Context) string {
+	o, err := GetOffer(r.ID)
+	switch {
+	case err == ErrOfferNotFound:
+		o.Response = OfferExpired
+	case err != nil:
+		r.logger().Warn("could not get offer", "driver_id", r.DriverID, "error", err)
+		return OfferPending
+	}
+	if o.Response == OfferPending {
+		if time.Now().Before(r.OfferDeadline) {
+			return OfferPending
+		}
+		// A response that arrives while the offer is closed is refused.
+		if o.Response, err = closeOffer(r.ID); err != nil {
+			r.logger().Warn("could not close offer", "driver_id", r.DriverID, "error", err)
+			return OfferPending
+		}
+	}
+
+	metrics.OfferResponses.WithLabelValues(o.Response).Inc()
+	if o.Response == OfferAccepted {
+		return OfferAccepted
+	}
+	r.logger().Info("driver did not accept the offer", "driver_id", r.DriverID, "response", o.Response)
+	r.Declined = append(r.Declined, r.DriverID)
+	if err := dr.RecordOffer(r.DriverID, false); err != nil {
+		r.logger().Warn("could not record offer", "driver_id", r.DriverID, "error", err)
+	}
+	r.withdraw(o.Response)
+	return o.Response
+}
+
+// withdraw releases the driver of the offer and forgets it, the reason is sent to the driver unless the driver declined.
+func (r *RequestDriverTask) withdraw(reason string) {
+	if reason != OfferDeclined {
+		payload := map[string]interface{}{"request_id": r.ID, "reason": reason}
+		if err := commands.Send(r.DriverID, commands.TypeCancel, payload); err != nil && err != commands.ErrNotConnected {
+			r.logger().Warn("could not send cancel to driver", "driver_id", r.DriverID, "error", err)
+		}
+	}
+	if _, err := r.client().ReleaseDriver(r.DriverID); err != nil {
+		r.logger().Warn("could not release driver", "driver_id", r.DriverID, "error", err)
+	}
+	if err := storages.Classify(storages.GetRedisClient().Del(offerKey(r.ID)).Err()); err != nil {
+		r.logger().Warn("could not remove offer", "error", err)
+	}
+	r.DriverID, r.OfferDeadline, r.DriverHome = "", time.Time{}, nil
+	r.ETA, r.PositionAge, r.Language, r.WindowRisk = 0, 0, "", 0
+}
+
+// matched finishes the request with the driver that accepted it and notifies the rider.
+func (r *RequestDriverTask) matched(ctx context.Context) {
+	if !r.Sandbox {
+		r.assign()
+	}
+	metrics.Matches.Inc()
+	if err := r.recordMatch(); err != nil {
+		r.logger().Warn("could not record match", "error", err)
+	}
+	r.finish(StateMatched)
+	if !r.Sandbox {
+		if err := r.followApproach(); err != nil {
+			r.logger().Warn("could not follow the approach of the driver", "driver_id", r.DriverID, "error", err)
+		}
+	}
+	driverID := idcodec.Encode(idcodec.KindDriver, r.DriverID)
+	data := map[string]string{
+		"driver_id":            driverID,
+		"eta_seconds":          strconv.Itoa(int(r.ETA.Seconds())),
+		"position_age_seconds": strconv.Itoa(int(r.PositionAge.Seconds())),
+	}
+	r.addAssets(ctx, data)
+	r.notifyUser(ctx, notify.KindDriverFound, fmt.Sprintf("Driver %s found, arriving in %d min", driverID, int(math.Ceil(r.ETA.Minutes()))), data)
+}
+
+// assign records the ride of the driver that accepted the request.
+func (r *RequestDriverTask) assign() {
+	driverID := r.DriverID
+	if r.DriverHome != nil {
+		if err := dr.StartLastRide(driverID, *r.DriverHome, r.ID); err != nil {
+			r.logger().Warn("could not record the last ride", "driver_id", driverID, "error", err)
+		}
+	}
+	if err := matching.RecordMatch(driverID, time.Now()); err != nil {
+		r.logger().Warn("could not record match", "driver_id", driverID, "error", err)
+	}
+	if err := dr.RecordOffer(driverID, true); err != nil {
+		r.logger().Warn("could not record offer", "driver_id", driverID, "error", err)
+	}
+	if _, err := dr.SetPeriod(driverID, dr.PeriodEnRoute, dr.PeriodAvailable); err != nil {
+		r.logger().Warn("could not record period", "driver_id", driverID, "error", err)
+	}
+	if err := heat.Record(heat.KindStart, geo.Point{Lat: r.Lat, Lng: r.Lng}); err != nil {
+		r.logger().Warn("could not record trip start", "error", err)
+	}
+	if err := fairness.RecordMatch(driverID, geo.Point{Lat: r.Lat, Lng: r.Lng}); err != nil {
+		r.logger().Warn("could not record match for the fairness audit", "driver_id", driverID, "error", err)
+	}
+}
@@ -0,0 +1,90 @@
+package tasks
+
+import (
+	"context"
+	"time"
+
+	"github.com/douglasmakey/tracking/config"
+	"github.com/douglasmakey/tracking/eta"
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/history"
+)
+
+// predictionWindow is the history of the candidate used to predict its position.
+const predictionWindow = time.Minute * 2
+
+// shadowMatch runs the pre-dispatch of a scheduled ride: it finds the best candidate without reserving it and predicts where
+// it will be at the next attempt. It returns true while the ride can wait, false when the candidate must be reserved now,
+// i.e. at the next attempt its predicted arrival plus the margin would be after the pickup time.
+// The rides without candidates start the search right away, the search widens the radius until a driver is found.
+func (r *RequestDriverTask) shadowMatch(ctx context.Context) bool {
+	if r.PickupAt.IsZero() {
+		return false
+	}
+	now := time.Now()
+	if !now.Before(r.PickupAt) {
+		return false
+	}
+
+	found, err := r.candidates(ctx, r.limit(), r.Radius())
+	if err != nil {
+		r.logger().Warn("could not search candidates", "error", err)
+		return false
+	}
+	if len(found.drivers) == 0 {
+		return false
+	}
+	ranked, err := r.rank(found.drivers)
+	if err != nil {
+		r.logger().Warn("could not rank candidates", "strategy", r.Strategy, "error", err)
+		return false
+	}
+	best := ranked[0]
+
+	next := now.Add(r.interval())
+	position, err := r.predict(best, found, next)
+	if err != nil {
+		r.logger().Warn("could not predict candidate position", "driver_id", best, "error", err)
+		return false
+	}
+	arrival := next.Add(eta.Estimate(ctx, position, geo.Point{Lat: r.Lat, Lng: r.Lng}))
+	if !arrival.Add(config.Get().PreDispatchMargin).Before(r.PickupAt) {
+		return false
+	}
+
+	if best != r.ShadowDriverID {
+		r.ShadowDriverID = best
+		r.publish(Event{Type: EventShadowCandidate, DriverID: best, Candidates: len(found.drivers)})
+	}
+	return true
+}
+
+// predict returns the position of the driver at t from its recent history, without history it is its current location.
+func (r *RequestDriverTask) predict(driverID string, found candidateSet, t time.Time) (geo.Point, error) {
+	var current geo.Point
+	for _, d := range found.drivers {
+		if d.Name == driverID {
+			current = geo.Point{Lat: d.Latitude, Lng: d.Longitude}
+		}
+	}
+	if r.Sandbox {
+		return current, nil
+	}
+
+	points, err := history.Range(driverID, time.Now().Add(-predictionWindow), time.Time{})
+	if err != nil {
+		return geo.Point{}, err
+	}
+	if len(points) < 2 {
+		return current, nil
+	}
+	return history.Predict(points, t), nil
+}
+
+// interval returns the time until the next attempt of the task.
+func (r *RequestDriverTask) interval() time.Duration {
+	if r.Interval > 0 {
+		return r.Interval
+	}
+	return config.Get().SearchInterval
+}
@@ -0,0 +1,124 @@
+package tasks
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/douglasmakey/tracking/config"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// ErrProfileNotFound is returned when the vehicle class does not have a profile.
+var ErrProfileNotFound = errors.New("class profile not found")
+
+// profilesKey is a hash with the profiles of the vehicle classes saved through the admin API, they override the configured ones.
+const profilesKey = "classes:profiles"
+
+// ClassProfile is the search of the requests of a vehicle class, it replaces the default TTL and search radii.
+type ClassProfile struct {
+	Class       string    `json:"class"`
+	SearchRadii []float64 `json:"search_radii"`
+	// Timeout is the TTL of the requests in seconds.
+	Timeout int `json:"timeout_seconds"`
+	// Source is config for the configured profiles and admin for the saved ones.
+	Source string `json:"source"`
+}
+
+// These are the sources of the profiles.
+const (
+	ProfileConfig = "config"
+	ProfileAdmin  = "admin"
+)
+
+// TTL returns the time that the requests of the class have to find a driver.
+func (p ClassProfile) TTL() time.Duration {
+	return time.Duration(p.Timeout) * time.Second
+}
+
+func configProfile(class string, p config.ClassProfile) ClassProfile {
+	return ClassProfile{Class: class, SearchRadii: p.SearchRadii, Timeout: int(p.RequestTTL.Seconds()), Source: ProfileConfig}
+}
+
+// GetClassProfile returns the profile of the vehicle class, the saved one or else the configured one.
+// It returns ErrProfileNotFound when the class uses the defaults.
+func GetClassProfile(class string) (ClassProfile, error) {
+	rClient := storages.GetRedisClient()
+	var data string
+	err := storages.WithRetry(func() (err error) {
+		data, err = rClient.HGet(profilesKey, class).Result()
+		return err
+	})
+	switch err {
+	case nil:
+		var p ClassProfile
+		if err := json.Unmarshal([]byte(data), &p); err != nil {
+			return ClassProfile{}, err
+		}
+		return p, nil
+	case redis.Nil:
+		if p, ok := config.Get().ClassProfiles[class]; ok {
+			return configProfile(class, p), nil
+		}
+		return ClassProfile{}, ErrProfileNotFound
+	default:
+		return ClassProfile{}, err
+	}
+}
+
+// ClassProfiles returns the profile of every vehicle class that has one, sorted by class.
+func ClassProfiles() ([]ClassProfile, error) {
+	rClient := storages.GetRedisClient()
+	var values map[string]string
+	err := storages.WithRetry(func() (err error) {
+		values, err = rClient.HGetAll(profilesKey).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := make(map[string]ClassProfile)
+	for class, p := range config.Get().ClassProfiles {
+		profiles[class] = configProfile(class, p)
+	}
+	for class, data := range values {
+		var p ClassProfile
+		if err := json.Unmarshal([]byte(data), &p); err == nil {
+			profiles[class] = p
+		}
+	}
+
+	list := make([]ClassProfile, 0, len(profiles))
+	for _, p := range profiles {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Class < list[j].Class })
+	return list, nil
+}
+
+// SaveClassProfile saves the profile of its class, the new requests of the class use it.
+func SaveClassProfile(p ClassProfile) error {
+	p.Source = ProfileAdmin
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	rClient := storages.GetRedisClient()
+	return storages.Classify(rClient.HSet(profilesKey, p.Class, data).Err())
+}
+
+// DeleteClassProfile removes the saved profile of the class, the class uses the configured profile again if it has one.
+func DeleteClassProfile(class string) error {
+	rClient := storages.GetRedisClient()
+	n, err := rClient.HDel(profilesKey, class).Result()
+	if err != nil {
+		return storages.Classify(err)
+	}
+	if n == 0 {
+		return ErrProfileNotFound
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package tasks
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/douglasmakey/tracking/config"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/metrics"
+	"github.com/douglasmakey/tracking/recovery"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// The tasks are shared between all the instances of the service through Redis:
+// jobsKey is a list with the tasks ready to run and scheduledKey is a sorted set with the tasks waiting for their next attempt,
+// the score is the unix time when the task must run. priorityJobsKey is the list of the accessible requests
+// and the requests of the priority zones, the workers always take its tasks first.
+// The keys of the queue share the searchTag, in a cluster they are in the same slot and the jobs move between them in one step.
+func jobsKey() string         { return searchTag() + ":jobs" }
+func priorityJobsKey() string { return searchTag() + ":jobs:priority" }
+func scheduledKey() string    { return searchTag() + ":scheduled" }
+
+// searchTag is the prefix of the keys of the queue.
+func searchTag() string {
+	return storages.Tag("search")
+}
+
+// queueKey returns the list where the task must be queued.
+func queueKey(r *RequestDriverTask) string {
+	if r.Accessible || r.Priority {
+		return priorityJobsKey()
+	}
+	return jobsKey()
+}
+
+// popTimeout is the time that a worker blocks waiting for a job, the priority list is checked again after each wait.
+const popTimeout = time.Second
+
+// Enqueue adds the task to the queue, it will be run by the first free worker. The scheduled rides are run when their pre-dispatch starts.
+// The task is in the registry from now on, so it can be canceled by the operators before its first attempt.
+func Enqueue(r *RequestDriverTask) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	var scheduled *time.Time
+	if start := r.PickupAt.Add(-config.Get().PreDispatchLead); time.Now().Before(start) {
+		scheduled = &start
+	}
+	info, err := r.summary(scheduled)
+	if err != nil {
+		return err
+	}
+
+	if err := setStatus(r.ID, Status{State: StateSearching, Radius: r.Radius(), UserID: r.UserID, Tenant: r.Tenant}); err != nil {
+		return err
+	}
+	rClient := storages.GetRedisClient()
+	_, err = rClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		// The scheduled rides wait in the scheduled set until their pre-dispatch starts.
+		if scheduled != nil {
+			pipe.ZAdd(scheduledKey(), redis.Z{Score: float64(scheduled.Unix()), Member: data})
+			pipe.HSet(scheduledJobsKey(), r.ID, data)
+		} else {
+			pipe.LPush(queueKey(r), data)
+		}
+		pipe.HSet(registryKey, r.ID, info)
+		addAreaRequest(pipe, r)
+		return nil
+	})
+	return storages.Classify(err)
+}
+
+// ActiveTasks returns the number of tasks that are searching a driver in all the instances: the queued and scheduled tasks
+// and the tasks of the attempts being run, they are in the in-flight lists of the shards.
+func ActiveTasks() int64 {
+	rClient := storages.GetRedisClient()
+	jobs, _ := rClient.LLen(jobsKey()).Result()
+	priorityJobs, _ := rClient.LLen(priorityJobsKey()).Result()
+	scheduled, _ := rClient.ZCard(scheduledKey()).Result()
+	var inflight int64
+	shards, _ := rClient.ZRange(heartbeatsKey, 0, -1).Result()
+	for _, shard := range shards {
+		n, _ := rClient.LLen(inflightKey(shard)).Result()
+		inflight += n
+	}
+	return jobs + priorityJobs + scheduled + inflight
+}
+
+// StartWorkers launches n workers that consume the queue and the scheduler that moves the tasks to the queue when it is their time.
+// Each task runs one attempt per interval, or per its own interval if it has one, so the number of goroutines does not grow with the number of requests.
+// The tasks being run are kept in the in-flight list of the shard, if the shard dies they are queued again by another shard.
+// The attempts of the canceled requests are stopped in every instance through the cancel channel.
+func StartWorkers(n int, interval time.Duration) {
+	shard := config.Get().ShardID
+	for i := 0; i < n; i++ {
+		recovery.Go("search_worker", func() { worker(shard, interval) })
+	}
+	recovery.Go("search_scheduler", scheduler)
+	recovery.Go("shard_monitor", func() { monitorShards(shard) })
+	recovery.Go("cancel_listener", listenCancels)
+}
+
+// worker pops tasks from the queue and runs them, the unfinished tasks are scheduled again.
+// The popped task is moved to the in-flight list of the shard until the attempt finishes.
+// With batch matching the worker keeps popping the jobs that arrive during the batch window, the requests of the same cell
+// are assigned together before they run.
+func worker(shard string, interval time.Duration) {
+	rClient := storages.GetRedisClient()
+	inflight := inflightKey(shard)
+	for {
+		// The priority tasks are taken first, they are not batched.
+		job, err := rClient.RPopLPush(priorityJobsKey(), inflight).Result()
+		priority := err == nil
+		if err == redis.Nil {
+			job, err = rClient.BRPopLPush(jobsKey(), inflight, popTimeout).Result()
+		}
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			logging.Logger.Error("could not pop search job", "error", err)
+			time.Sleep(popTimeout)
+			continue
+		}
+
+		jobs := []string{job}
+		if cfg := config.Get(); cfg.BatchMatching && !priority {
+			jobs = append(jobs, collect(rClient, inflight, cfg.BatchWindow, cfg.BatchSize-1)...)
+		}
+		tasks := make([]*RequestDriverTask, 0, len(jobs))
+		popped := make([]string, 0, len(jobs))
+		for _, job := range jobs {
+			var r RequestDriverTask
+			if err := json.Unmarshal([]byte(job), &r); err != nil {
+				logging.Logger.Error("invalid search job", "job", job, "error", err)
+				rClient.LRem(inflight, 1, job)
+				continue
+			}
+			tasks = append(tasks, &r)
+			popped = append(popped, job)
+		}
+		recovery.Guard("search_batch", func() {
+			for _, batch := range batches(tasks) {
+				assignBatch(batch)
+			}
+		})
+		for i, r := range tasks {
+			job := popped[i]
+			if recovery.Guard("search", func() { runJob(rClient, inflight, job, r, interval) }) {
+				// The job that panics is dropped, it would panic again on every attempt.
+				r.logger().Error("search job dropped after a panic")
+				rClient.LRem(inflight, 1, job)
+			}
+		}
+	}
+}
+
+// runJob runs an attempt of the popped job and removes it from the in-flight list, the unfinished task is scheduled again.
+func runJob(rClient *storages.RedisClient, inflight, job string, r *RequestDriverTask, interval time.Duration) {
+	if r.Run() {
+		if err := rClient.LRem(inflight, 1, job).Err(); err != nil {
+			r.logger().Error("could not remove in-flight request", "error", err)
+		}
+		return
+	}
+
+	// The task is saved again because the attempt can change it.
+	data, err := json.Marshal(r)
+	if err != nil {
+		r.logger().Error("could not encode request", "error", err)
+		return
+	}
+	next := interval
+	if r.Interval > 0 {
+		next = r.Interval
+	}
+	// The response of the driver to the offer is followed more often than the searches.
+	if poll := config.Get().OfferPollInterval; !r.OfferDeadline.IsZero() && poll < next {
+		next = poll
+	}
+	at := time.Now().Add(next).Unix()
+	_, err = rClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(scheduledKey(), redis.Z{Score: float64(at), Member: data})
+		pipe.HSet(scheduledJobsKey(), r.ID, data)
+		pipe.LRem(inflight, 1, job)
+		return nil
+	})
+	if err != nil {
+		r.logger().Error("could not schedule request", "error", err)
+	}
+}
+
+// scheduler moves the tasks whose time has come from the scheduled set to the queue.
+func scheduler() {
+	rClient := storages.GetRedisClient()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		metrics.ActiveSearchTasks.Set(float64(ActiveTasks()))
+
+		now := strconv.FormatInt(time.Now().Unix(), 10)
+		jobs, err := rClient.ZRangeByScore(scheduledKey(), redis.ZRangeBy{Min: "-inf", Max: now}).Result()
+		if err != nil {
+			logging.Logger.Error("could not get scheduled jobs", "error", err)
+			continue
+		}
+
+		for _, job := range jobs {
+			// The job is moved in one step and only by the instance that removes it from the set, so it is never queued twice or lost.
+			var r RequestDriverTask
+			key := jobsKey()
+			if err := json.Unmarshal([]byte(job), &r); err == nil {
+				key = queueKey(&r)
+			}
+			if err := wakeScript.Run(rClient, []string{scheduledKey(), key, scheduledJobsKey()}, job, r.ID).Err(); err != nil {
+				logging.Logger.Error("could not queue scheduled job", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package tasks
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/douglasmakey/tracking/config"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// ErrTaskNotFound is returned when the request does not have a searching task.
+var ErrTaskNotFound = errors.New("task not found")
+
+const (
+	// registryKey is a hash with the summary of each searching task, it is saved when the task is queued or scheduled,
+	// updated after every attempt and the task is removed when it finishes.
+	registryKey = "tasks:registry"
+	// matchesKey is a list with the last matches, the newest first.
+	matchesKey = "tasks:matches"
+	// maxMatches is the number of matches kept in the list.
+	maxMatches = 100
+	// registryStale is the time after the last attempt of a task, or the start of a scheduled one, when its summary is dropped,
+	// e.g. the task was dropped after a panic.
+	registryStale = time.Hour
+)
+
+// TaskInfo is the summary of a searching task for the operators.
+type TaskInfo struct {
+	RequestID     string    `json:"request_id"`
+	UserID        string    `json:"user_id"`
+	Tenant        string    `json:"tenant,omitempty"`
+	Lat           float64   `json:"lat"`
+	Lng           float64   `json:"lng"`
+	Zone          string    `json:"zone"`
+	Attempts      int       `json:"attempts"`
+	Radius        float64   `json:"radius"`
+	DriverID      string    `json:"driver_id,omitempty"`
+	OfferDeadline time.Time `json:"offer_deadline,omitempty"`
+	Sandbox       bool      `json:"sandbox,omitempty"`
+	// Scheduled is the time when the first attempt of a scheduled ride runs.
+	Scheduled *time.Time `json:"scheduled,omitempty"`
+	// Shard is the instance that ran the last attempt, or that queued the task before its first attempt.
+	Shard   string    `json:"shard"`
+	Updated time.Time `json:"updated"`
+}
+
+// stale returns true if the task did not run for registryStale, a scheduled ride is not stale before its start.
+func (info TaskInfo) stale(now time.Time) bool {
+	last := info.Updated
+	if info.Scheduled != nil && info.Scheduled.After(last) {
+		last = *info.Scheduled
+	}
+	return now.Sub(last) > registryStale
+}
+
+// MatchInfo is a request matched with a driver.
+type MatchInfo struct {
+	RequestID string    `json:"request_id"`
+	UserID    string    `json:"user_id"`
+	DriverID  string    `json:"driver_id"`
+	Zone      string    `json:"zone"`
+	Attempts  int       `json:"attempts"`
+	ETA       float64   `json:"eta_seconds"`
+	Matched   time.Time `json:"matched"`
+}
+
+// register saves the summary of the task after an attempt.
+func (r *RequestDriverTask) register() error {
+	data, err := r.summary(nil)
+	if err != nil {
+		return err
+	}
+	rClient := storages.GetRedisClient()
+	return storages.Classify(rClient.HSet(registryKey, r.ID, data).Err())
+}
+
+// summary returns the summary of the task for the registry, scheduled is the start of a scheduled ride that did not run yet.
+func (r *RequestDriverTask) summary(scheduled *time.Time) ([]byte, error) {
+	info := TaskInfo{
+		RequestID:     r.ID,
+		UserID:        r.UserID,
+		Tenant:        r.Tenant,
+		Lat:           r.Lat,
+		Lng:           r.Lng,
+		Zone:          r.zone(),
+		Attempts:      r.Attempts,
+		Radius:        r.Radius(),
+		DriverID:      r.DriverID,
+		OfferDeadline: r.OfferDeadline,
+		Sandbox:       r.Sandbox,
+		Scheduled:     scheduled,
+		Shard:         config.Get().ShardID,
+		Updated:       time.Now().UTC(),
+	}
+	return json.Marshal(info)
+}
+
+// unregister removes the summary of the finished task.
+func (r *RequestDriverTask) unregister() error {
+	rClient := storages.GetRedisClient()
+	return storages.Classify(rClient.HDel(registryKey, r.ID).Err())
+}
+
+// recordMatch adds the match of the request to the list of the last matches.
+func (r *RequestDriverTask) recordMatch() error {
+	data, err := json.Marshal(MatchInfo{
+		RequestID: r.ID,
+		UserID:    r.UserID,
+		DriverID:  r.DriverID,
+		Zone:      r.zone(),
+		Attempts:  r.Attempts,
+		ETA:       r.ETA.Seconds(),
+		Matched:   time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	rClient := storages.GetRedisClient()
+	_, err = rClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.LPush(matchesKey, data)
+		pipe.LTrim(matchesKey, 0, maxMatches-1)
+		return nil
+	})
+	return storages.Classify(err)
+}
+
+// ActiveTaskList returns the summaries of the searching tasks, the oldest updated first.
+// The summaries of the tasks that did not run for a while are removed.
+func ActiveTaskList() ([]TaskInfo, error) {
+	rClient := storages.GetRedisClient()
+	var values map[string]string
+	err := storages.WithRetry(func() (err error) {
+		values, err = rClient.HGetAll(registryKey).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	list := make([]TaskInfo, 0, len(values))
+	var stale []string
+	for id, v := range values {
+		var info TaskInfo
+		if err := json.Unmarshal([]byte(v), &info); err != nil || info.stale(now) {
+			stale = append(stale, id)
+			continue
+		}
+		list = append(list, info)
+	}
+	if len(stale) > 0 {
+		if err := rClient.HDel(registryKey, stale...).Err(); err != nil {
+			return nil, storages.Classify(err)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Updated.Before(list[j].Updated) })
+	return list, nil
+}
+
+// TaskOf returns the summary of the searching task of the request, ErrTaskNotFound if it is not searching.
+func TaskOf(requestID string) (TaskInfo, error) {
+	rClient := storages.GetRedisClient()
+	var v string
+	err := storages.WithRetry(func() (err error) {
+		v, err = rClient.HGet(registryKey, requestID).Result()
+		return err
+	})
+	if err == redis.Nil {
+		return TaskInfo{}, ErrTaskNotFound
+	}
+	if err != nil {
+		return TaskInfo{}, err
+	}
+	var info TaskInfo
+	if err := json.Unmarshal([]byte(v), &info); err != nil {
+		return TaskInfo{}, err
+	}
+	return info, nil
+}
+
+// RecentMatches returns up to n of the last matches, the newest first.
+func RecentMatches(n int) ([]MatchInfo, error) {
+	if n <= 0 || n > maxMatches {
+		n = maxMatches
+	}
+	rClient := storages.GetRedisClient()
+	var values []string
+	err := storages.WithRetry(func() (err error) {
+		values, err = rClient.LRange(matchesKey, 0, int64(n-1)).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]MatchInfo, 0, len(values))
+	for _, v := range values {
+		var m MatchInfo
+		if err := json.Unmarshal([]byte(v), &m); err == nil {
+			list = append(list, m)
+		}
+	}
+	return list, nil
+}
+
+// ForceCancel cancels the searching request on behalf of its user and returns the outcome, the task is interrupted to finish now.
+func ForceCancel(requestID string) (string, error) {
+	info, err := TaskOf(requestID)
+	if err != nil {
+		return "", err
+	}
+	outcomes, err := Cancel(info.UserID, requestID)
+	if err != nil {
+		return "", err
+	}
+	return outcomes[requestID], nil
+}
@@ -0,0 +1,130 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/douglasmakey/tracking/config"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// scheduledJobsKey is a hash with the job of each task in the scheduled set by request ID, so a task can be woken before its time.
+func scheduledJobsKey() string {
+	return searchTag() + ":scheduled:jobs"
+}
+
+// cancelChannel is the Redis channel of the canceled requests, the payload is the request ID.
+const cancelChannel = "request:cancel"
+
+// attempt is an attempt of a task running in this instance, cancel stops it.
+type attempt struct {
+	started time.Time
+	cancel  context.CancelFunc
+}
+
+// running are the attempts running in this instance by request ID.
+var running = struct {
+	sync.Mutex
+	attempts map[string]*attempt
+}{attempts: make(map[string]*attempt)}
+
+// RunningTask is an attempt of a task running in this instance.
+type RunningTask struct {
+	RequestID string    `json:"request_id"`
+	Shard     string    `json:"shard"`
+	Started   time.Time `json:"started"`
+}
+
+// track registers the attempt of the request, the returned context is canceled when the request is interrupted.
+// done must be called when the attempt finishes.
+func track(parent context.Context, requestID string) (ctx context.Context, done func()) {
+	ctx, cancel := context.WithCancel(parent)
+	a := &attempt{started: time.Now(), cancel: cancel}
+	running.Lock()
+	running.attempts[requestID] = a
+	running.Unlock()
+	return ctx, func() {
+		running.Lock()
+		if running.attempts[requestID] == a {
+			delete(running.attempts, requestID)
+		}
+		running.Unlock()
+		cancel()
+	}
+}
+
+// Running returns the attempts running in this instance, the oldest first.
+func Running() []RunningTask {
+	shard := config.Get().ShardID
+	running.Lock()
+	list := make([]RunningTask, 0, len(running.attempts))
+	for id, a := range running.attempts {
+		list = append(list, RunningTask{RequestID: id, Shard: shard, Started: a.started})
+	}
+	running.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+	return list
+}
+
+// interrupt stops the attempt of the request running in any instance and wakes the task waiting for its next attempt,
+// so a canceled request finishes now instead of on its next tick.
+func interrupt(requestID string) error {
+	stop(requestID)
+	rClient := storages.GetRedisClient()
+	if err := rClient.Publish(cancelChannel, requestID).Err(); err != nil {
+		return storages.Classify(err)
+	}
+	return wake(requestID)
+}
+
+// stop cancels the attempt of the request if it runs in this instance.
+func stop(requestID string) {
+	running.Lock()
+	if a, ok := running.attempts[requestID]; ok {
+		a.cancel()
+	}
+	running.Unlock()
+}
+
+// listenCancels stops the attempts of the canceled requests published by any instance. The cancellations published while
+// the subscription reconnects are lost, those attempts see the cancellation when they run again.
+func listenCancels() {
+	sub := storages.GetRedisClient().Subscribe(cancelChannel)
+	defer sub.Close()
+	for msg := range sub.Channel() {
+		stop(msg.Payload)
+	}
+}
+
+// wakeScript moves the job ARGV[1] of the request ARGV[2] from the scheduled set KEYS[1] to the queue KEYS[2] if it is still scheduled
+// and forgets it in the hash of the scheduled jobs KEYS[3], it returns 1 when the job is moved. The keys share the searchTag.
+var wakeScript = redis.NewScript(`
+redis.call("HDEL", KEYS[3], ARGV[2])
+if redis.call("ZREM", KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call("LPUSH", KEYS[2], ARGV[1])
+return 1
+`)
+
+// wake queues the scheduled task of the request now, nothing is done if it is not waiting.
+func wake(requestID string) error {
+	rClient := storages.GetRedisClient()
+	job, err := rClient.HGet(scheduledJobsKey(), requestID).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return storages.Classify(err)
+	}
+	var r RequestDriverTask
+	if err := json.Unmarshal([]byte(job), &r); err != nil {
+		return err
+	}
+	keys := []string{scheduledKey(), queueKey(&r), scheduledJobsKey()}
+	return storages.Classify(wakeScript.Run(rClient, keys, job, requestID).Err())
+}
@@ -1,13 +1,32 @@
 package tasks
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"strconv"
 	"time"
 
+	"github.com/douglasmakey/tracking/commands"
+	"github.com/douglasmakey/tracking/config"
+	dr "github.com/douglasmakey/tracking/drivers"
+	"github.com/douglasmakey/tracking/eta"
+	"github.com/douglasmakey/tracking/features"
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/idcodec"
+	"github.com/douglasmakey/tracking/languages"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/matching"
+	"github.com/douglasmakey/tracking/metrics"
+	"github.com/douglasmakey/tracking/notify"
+	"github.com/douglasmakey/tracking/presence"
+	"github.com/douglasmakey/tracking/statuspage"
 	"github.com/douglasmakey/tracking/storages"
+	"github.com/douglasmakey/tracking/supply"
+	"github.com/douglasmakey/tracking/tracing"
+	"github.com/go-redis/redis"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // These are the reasons which a request is invalid.
@@ -16,71 +35,302 @@ var (
 	ErrCanceled = errors.New("request canceled")
 )
 
+// candidatesLimit is the number of drivers that we fetch in each search, the nearest one is chosen and the others are kept as features of the decision.
+const candidatesLimit = 5
+
+// taggedCandidatesLimit is the number of drivers fetched for the accessible requests and the requests of a vehicle class
+// before filtering the drivers with the tag.
+const taggedCandidatesLimit = 50
+
 // RequestDriverTask is a simple struct that contains info about the user, request and driver, you can add more information if you want.
 type RequestDriverTask struct {
 	ID       string
 	UserID   string
 	Lat, Lng float64
+	// Dropoff is the destination of the rider, it is optional but the drivers going home are only offered the requests with a
+	// destination toward their home.
+	Dropoff  *geo.Point
 	DriverID string
+	// CorrelationID is the ID of the HTTP request that created the task, it is added to the logs to trace the request end to end.
+	CorrelationID string
+	// Accessible requests need a wheelchair accessible vehicle, they only match drivers with the WAV tag
+	// and they have a wider radius and priority in the queue.
+	Accessible bool
+	// VehicleClass is the class of vehicle requested, e.g. economy, xl, moto or delivery, only the drivers with the class in their tags are matched.
+	// Empty matches any driver.
+	VehicleClass string
+	// SearchRadii are the radii of the profile of the vehicle class, empty uses the configured radii.
+	SearchRadii []float64
+	// Priority requests are picked up in a priority zone, e.g. the airport, they have priority in the queue.
+	Priority bool
+	// RequiredTags are the tags that the drivers need to be matched, they come from the restricted zones of the picking point.
+	RequiredTags []string
+	// Surge is the fare multiplier of the zones of the picking point, one is no surge.
+	Surge float64
+	// MaxDistance is the max distance in km of the driver to the picking point, the drivers farther are never offered. Zero is no limit.
+	MaxDistance float64
+	// BeyondMaxDistance is true when the last search found drivers but all of them were farther than MaxDistance.
+	BeyondMaxDistance bool
+	// MaxPositionAge is the max age of the last position of the drivers, the drivers with older positions are not offered. Zero is no limit.
+	MaxPositionAge time.Duration
+	// PositionAge is the age of the last position of the matched driver when it was matched.
+	PositionAge time.Duration
+	// ETA is the estimated time of the matched driver to arrive to the picking point.
+	ETA time.Duration
+	// Interval is the time between two searches of the request, zero uses the interval of the workers.
+	Interval time.Duration
+	// Sandbox requests search the synthetic drivers of the sandbox, they are not recorded in the reports.
+	Sandbox bool
+	// Created is the time when the request was created, the time to match is measured from it.
+	Created time.Time
+	// Attempts is the number of searches done, the radius grows with them.
+	Attempts int
+	// Tenant is the enterprise of the user.
+	Tenant string
+	// Strategy is the name of the matching strategy that chooses the driver, empty uses the configured one.
+	Strategy string
+	// Languages are the languages preferred by the rider, the weighted strategy prefers the drivers that speak one of them.
+	// Language is the first of them spoken by the matched driver, empty if they do not share one.
+	Languages []string
+	Language  string
+	// PickupAt is the time of the pickup of a scheduled ride, zero is as soon as possible.
+	// ShadowDriverID is the best candidate of the pre-dispatch of the scheduled ride, it is not reserved.
+	PickupAt       time.Time
+	ShadowDriverID string
+	// Window is the promised window of a delivery, it needs a dropoff. Only the drivers that can drop off before its end are offered
+	// the request and WindowRisk is the risk of the matched driver of violating it, see DeliveryWindow.Risk.
+	Window     *DeliveryWindow
+	WindowRisk float64
+	// DryArea is the mark of the area of the last search when it found nobody and DryRadius its radius, the next ticks with
+	// the same radius skip the search until a driver reports in the area, up to the configured max. Skipped is the number of ticks skipped in a row.
+	DryArea   *supply.Mark
+	DryRadius float64
+	Skipped   int
+	// OfferDeadline is the time until the reserved driver can respond to the offer of the request, zero while it is searching.
+	// DriverHome is the go-home mode of the reserved driver, the request is its last ride if it accepts.
+	OfferDeadline time.Time
+	DriverHome    *dr.GoHome
+	// Declined are the drivers that declined the request or did not respond to its offer in time, they are not offered it again.
+	Declined []string
+	// Trace is the trace context of the HTTP request, the attempts of the task are spans of the same trace.
+	Trace map[string]string
+
+	// found and assigned are set when the request runs in a batch: found are the candidates searched by the batch
+	// and assigned is the driver of the assignment of the batch. They are only used by the next attempt and are not saved.
+	found    *candidateSet
+	assigned string
+	// fallback is set when the attempt searches again because the offered driver did not accept, the radius does not change.
+	fallback bool
 }
 
 // NewRequestDriverTask create and return a pointer to RequestDriverTask
 func NewRequestDriverTask(id, userID string, lat, lng float64) *RequestDriverTask {
 	return &RequestDriverTask{
-		ID:     id,
-		UserID: userID,
-		Lat:    lat,
-		Lng:    lng,
-	}
-}
-
-// Run is the function for executing the task, this task validating the request and launches another goroutine called 'doSearch' which does the search.
-func (r *RequestDriverTask) Run() {
-	// We create a new ticker with 30s time duration, this it means that each 30s the task executes the search for a driver.
-	ticker := time.NewTicker(time.Second * 30)
-
-	// With the done channel, we receive if the driver was found
-	done := make(chan struct{})
-
-	for {
-		// The select statement lets a goroutine wait on multiple communication operations.
-		select {
-		case <-ticker.C:
-			err := r.validateRequest()
-			switch err {
-			case nil:
-				log.Println(fmt.Sprintf("Search Driver - Request %s for Lat: %f and Lng: %f", r.ID, r.Lat, r.Lng))
-				go r.doSearch(done)
-			case ErrExpired:
-				// Notify to user that the request expired.
-				sendInfo(r, "Sorry, we did not find any driver.")
-				return
-			case ErrCanceled:
-				log.Printf("Request %s has been canceled. ", r.ID)
-				return
-			default: // defensive programming: expected the unexpected
-				log.Printf("unexpected error: %v", err)
-				return
-			}
+		ID:      id,
+		UserID:  userID,
+		Lat:     lat,
+		Lng:     lng,
+		Created: time.Now().UTC(),
+	}
+}
+
+// Run executes one attempt of the task, when the task finishes the request is removed from the open requests of the user,
+// of its zone and of the registry, and the user can search again. The unfinished task updates its summary in the registry.
+func (r *RequestDriverTask) Run() bool {
+	finished := r.run()
+	if !finished {
+		if err := r.register(); err != nil {
+			r.logger().Warn("could not register task", "error", err)
+		}
+		return false
+	}
+	if err := r.unregister(); err != nil {
+		r.logger().Warn("could not unregister task", "error", err)
+	}
+	if err := removeUserRequest(r.UserID, r.ID); err != nil {
+		r.logger().Warn("could not remove request from user index", "error", err)
+	}
+	if err := removeAreaRequest(r); err != nil {
+		r.logger().Warn("could not remove request from zone index", "error", err)
+	}
+	if err := releaseActive(r.UserID, r.ID); err != nil {
+		r.logger().Warn("could not release the active request of the user", "error", err)
+	}
+	return true
+}
+
+// run executes one attempt of the task, it validates the request and does the search.
+// It returns true when the task is finished, either because a driver was found or because the request is not valid anymore,
+// otherwise the task must be scheduled again.
+func (r *RequestDriverTask) run() bool {
+	// The attempt is stopped when the request is canceled while it runs.
+	parent, done := track(tracing.Extract(r.Trace), r.ID)
+	defer done()
+	ctx, span := tracing.Start(parent, "search.attempt", attribute.String("request.id", r.ID))
+	defer span.End()
 
-		case _, ok := <-done:
-			if !ok {
-				sendInfo(r, fmt.Sprintf("Driver %s found", r.DriverID))
-				ticker.Stop()
-				return
+	err := r.validateRequest()
+	switch err {
+	case nil:
+		// The reserved driver has until the deadline to respond, the request falls back to the next candidate if it does not accept.
+		if !r.OfferDeadline.IsZero() {
+			switch r.followOffer(ctx) {
+			case OfferAccepted:
+				if r.interrupted(ctx) {
+					return true
+				}
+				r.matched(ctx)
+				return true
+			case OfferPending:
+				return false
 			}
+			// The attempt that found the driver runs again without it.
+			r.Attempts--
+			r.fallback = true
+		}
+		// The scheduled rides follow their candidates until it is time to reserve one.
+		if r.shadowMatch(ctx) {
+			return false
+		}
+		r.logger().Info("search driver", "lat", r.Lat, "lng", r.Lng)
+		if r.doSearch(ctx) {
+			if r.interrupted(ctx) {
+				return true
+			}
+			// The drivers of the sandbox are synthetic, they accept without an offer.
+			if r.Sandbox {
+				r.matched(ctx)
+				return true
+			}
+			r.offer(ctx)
+		}
+		return false
+	case ErrExpired:
+		if !r.OfferDeadline.IsZero() {
+			r.withdraw(OfferExpired)
 		}
+		// Notify to user that the request expired.
+		if r.BeyondMaxDistance {
+			r.finish(StateBeyondMaxDistance)
+			r.notifyUser(ctx, notify.KindNoDriver, "Sorry, all the drivers were farther than your maximum distance.", map[string]string{"reason": StateBeyondMaxDistance})
+			break
+		}
+		r.finish(StateExpired)
+		r.notifyUser(ctx, notify.KindNoDriver, "Sorry, we did not find any driver.", map[string]string{"reason": StateExpired})
+	case ErrCanceled:
+		if !r.OfferDeadline.IsZero() {
+			r.withdraw(StateCanceled)
+		}
+		r.finish(StateCanceled)
+		r.logger().Info("request has been canceled")
+	default: // defensive programming: expected the unexpected
+		if storages.IsTransient(err) {
+			// Redis is not available right now, we try again in the next attempt.
+			r.logger().Warn("could not validate request", "error", err)
+			return false
+		}
+		r.logger().Error("unexpected error", "error", err)
 	}
+
+	return true
+}
+
+// interrupted finishes the request canceled during the attempt, the driver that it holds is released.
+func (r *RequestDriverTask) interrupted(ctx context.Context) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+	r.withdraw(StateCanceled)
+	r.finish(StateCanceled)
+	r.logger().Info("request has been canceled during the attempt")
+	return true
+}
+
+// finish records the terminal state of the request.
+func (r *RequestDriverTask) finish(state string) {
+	metrics.SearchOutcomes.WithLabelValues(r.lane(), state).Inc()
+	if !r.Sandbox && state != StateCanceled {
+		statuspage.Observe(state == StateMatched, r.Created)
+	}
+	if err := setStatus(r.ID, Status{State: state, DriverID: r.DriverID, PositionAge: r.PositionAge.Seconds()}); err != nil {
+		r.logger().Warn("could not save status", "state", state, "error", err)
+	}
+	r.publish(Event{Type: state, DriverID: r.DriverID})
+}
+
+// publish sends the progress event of the request, the failures are logged.
+func (r *RequestDriverTask) publish(ev Event) {
+	if err := publishEvent(r.ID, ev); err != nil {
+		r.logger().Warn("could not publish search event", "type", ev.Type, "error", err)
+	}
+}
+
+// Radius returns the radius in km of the next search, it grows with the attempts following the configured schedule.
+func (r *RequestDriverTask) Radius() float64 {
+	return r.radiusAt(r.Attempts)
+}
+
+func (r *RequestDriverTask) radiusAt(attempt int) float64 {
+	radii := config.Get().SearchRadii
+	switch {
+	case len(r.SearchRadii) > 0:
+		radii = r.SearchRadii
+	case r.Accessible:
+		radii = config.Get().AccessibleSearchRadii
+	}
+	if attempt < len(radii) {
+		return radii[attempt]
+	}
+	return radii[len(radii)-1]
+}
+
+// client returns the storage of the drivers of the request.
+func (r *RequestDriverTask) client() *storages.RedisClient {
+	if r.Sandbox {
+		return storages.GetSandboxClient(r.Tenant)
+	}
+	return storages.GetRedisClient()
+}
+
+// locations returns the store of the locations of the request, the sandbox drivers are always in the sandbox client.
+func (r *RequestDriverTask) locations() storages.LocationStore {
+	if r.Sandbox {
+		return storages.GetSandboxClient(r.Tenant)
+	}
+	return storages.Locations()
+}
+
+// lane returns the name of the lane of the request for the metrics.
+func (r *RequestDriverTask) lane() string {
+	if r.Sandbox {
+		return "sandbox"
+	}
+	if r.Accessible {
+		return "accessible"
+	}
+	return "standard"
+}
+
+// logger returns the logger with the correlation ID and the request ID of the task.
+func (r *RequestDriverTask) logger() *slog.Logger {
+	return logging.With(r.CorrelationID).With("request_id", r.ID)
 }
 
 // validateRequest validates if the request is valid and return an error like a reason in case not.
 func (r *RequestDriverTask) validateRequest() error {
 	rClient := storages.GetRedisClient()
-	keyValue, err := rClient.Get(r.ID).Result()
-	if err != nil {
+	var keyValue string
+	err := storages.WithRetry(func() (err error) {
+		keyValue, err = rClient.Get(r.ID).Result()
+		return err
+	})
+	if err == redis.Nil {
 		// Request has been expired.
 		return ErrExpired
 	}
+	if err != nil {
+		return err
+	}
 
 	isActive, _ := strconv.ParseBool(keyValue)
 	if !isActive {
@@ -91,23 +341,465 @@ func (r *RequestDriverTask) validateRequest() error {
 	return nil
 }
 
-// doSearch do search of driver and close to the channel.
-func (r *RequestDriverTask) doSearch(done chan struct{}) {
-	rClient := storages.GetRedisClient()
-	drivers := rClient.SearchDrivers(1, r.Lat, r.Lng, 5)
-	if len(drivers) == 1 {
-		// Driver found
-		// Remove driver location, we can send a message to the driver for that it does not send again its location to this service.
-		rClient.RemoveDriverLocation(drivers[0].Name)
-		r.DriverID = drivers[0].Name
-		close(done)
+// doSearch do search of driver and returns true if a driver was found.
+func (r *RequestDriverTask) doSearch(ctx context.Context) bool {
+	radius := r.Radius()
+	// Let the user know that the search scope grew.
+	if r.Attempts > 0 && !r.fallback && radius != r.radiusAt(r.Attempts-1) {
+		r.notifyUser(ctx, notify.KindSearchExpanded, fmt.Sprintf("Searching drivers within %gkm", radius),
+			map[string]string{"radius_km": strconv.FormatFloat(radius, 'g', -1, 64)})
+		if err := setStatus(r.ID, Status{State: StateSearching, Radius: radius}); err != nil {
+			r.logger().Warn("could not save status", "error", err)
+		}
+		r.publish(Event{Type: EventRadiusWidened, Attempt: r.Attempts + 1, Radius: radius})
+	}
+	r.Attempts++
+	r.publish(Event{Type: EventTick, Attempt: r.Attempts, Radius: radius})
+
+	// The batch already searched the candidates of this attempt.
+	var found candidateSet
+	if r.found != nil {
+		found = *r.found
+	} else {
+		if r.skip(radius) {
+			return false
+		}
+		// The mark is taken before the search, a driver that reports during it is a change.
+		mark, watched := supply.Watch(supply.Cover(geo.Point{Lat: r.Lat, Lng: r.Lng}, radius))
+		var err error
+		if found, err = r.candidates(ctx, r.limit(), radius); err != nil {
+			r.logger().Warn("could not search drivers", "error", err)
+			return false
+		}
+		r.DryArea, r.DryRadius, r.Skipped = nil, 0, 0
+		if len(found.drivers) == 0 && watched && !r.Sandbox {
+			r.DryArea, r.DryRadius = &mark, radius
+		}
+	}
+	drivers, seen, homes := found.drivers, found.seen, found.homes
+	if len(drivers) == 0 {
+		return false
+	}
+	r.publish(Event{Type: EventCandidates, Attempt: r.Attempts, Radius: radius, Candidates: len(drivers)})
+
+	ranked, err := r.rank(drivers)
+	if err != nil {
+		r.logger().Warn("could not rank drivers", "strategy", r.Strategy, "error", err)
+		return false
+	}
+	if r.assigned != "" {
+		ranked = promote(ranked, r.assigned)
+	}
+
+	// The request was canceled during the search, the next attempt finishes it without reserving a driver.
+	if ctx.Err() != nil {
+		return false
+	}
+
+	// Driver found
+	// Reserve the best driver that is still available, other requests can be searching the same drivers at the same time.
+	// The reservation removes the driver location, we can send a message to the driver for that it does not send again its location to this service.
+	driverID, err := r.reserve(ctx, ranked)
+	if err != nil {
+		r.logger().Warn("could not reserve driver", "error", err)
+		return false
+	}
+	if driverID == "" {
+		return false
+	}
+	r.DriverID = driverID
+	if r.Language, err = r.sharedLanguage(driverID); err != nil {
+		r.logger().Warn("could not get the shared language", "driver_id", driverID, "error", err)
+	}
+	if at, ok := seen[driverID]; ok {
+		r.PositionAge = time.Since(at)
+	}
+	r.WindowRisk = found.risks[driverID]
+	for _, d := range drivers {
+		if d.Name == driverID {
+			r.ETA = eta.Estimate(ctx, geo.Point{Lat: d.Latitude, Lng: d.Longitude}, geo.Point{Lat: r.Lat, Lng: r.Lng})
+		}
+	}
+	if g, ok := homes[driverID]; ok {
+		r.DriverHome = &g
 	}
+	if r.Sandbox {
+		return true
+	}
+	r.emitFeatures(ctx, drivers)
+	return true
+}
+
+// skip returns true if the search of the tick is not needed: the last search with the same radius found nobody
+// and no driver reported in its area since then. The searches are not skipped forever, the changes can be lost.
+func (r *RequestDriverTask) skip(radius float64) bool {
+	if r.DryArea == nil || radius != r.DryRadius || r.Skipped >= config.Get().MaxSkippedTicks || supply.Changed(*r.DryArea) {
+		return false
+	}
+	r.Skipped++
+	metrics.SkippedSearches.Inc()
+	return true
+}
 
-	return
+// candidateSet is the result of a search before the reservation: the drivers that can be offered the request,
+// the time of their last position, the go-home mode of the drivers going home and the risk of the drivers of violating the delivery window.
+type candidateSet struct {
+	drivers []redis.GeoLocation
+	seen    map[string]time.Time
+	homes   map[string]dr.GoHome
+	risks   map[string]float64
 }
 
-// sendInfo this func is only example, you can use another services, websocket or push notification for send data to user.
-func sendInfo(r *RequestDriverTask, message string) {
-	log.Println("Message to user:", r.UserID)
-	log.Println(message)
+// limit returns the number of drivers fetched in each search.
+// The drivers that declined the request are fetched on top of the limit, they are filtered.
+func (r *RequestDriverTask) limit() int {
+	if r.Accessible || r.VehicleClass != "" || len(r.RequiredTags) > 0 {
+		// Most of the drivers are not WAV or of the class, we fetch more candidates to filter them.
+		return taggedCandidatesLimit + len(r.Declined)
+	}
+	return candidatesLimit + len(r.Declined)
+}
+
+// candidates searches the drivers within radius that can be offered the request, it does not reserve them.
+func (r *RequestDriverTask) candidates(ctx context.Context, limit int, radius float64) (candidateSet, error) {
+	// Each attempt decides it again, the drivers beyond the max distance can come closer before the request expires.
+	r.BeyondMaxDistance = false
+	drivers, err := r.locations().SearchDrivers(ctx, limit, r.Lat, r.Lng, radius)
+	if err != nil {
+		return candidateSet{}, err
+	}
+	// The drivers that declined the request or let its offer expire are not offered it again.
+	if len(r.Declined) > 0 {
+		drivers = without(drivers, r.Declined)
+	}
+	if r.Accessible {
+		if drivers, err = filter(drivers, func(ids []string) ([]string, error) { return dr.WithTag(ids, dr.TagWAV) }); err != nil {
+			return candidateSet{}, fmt.Errorf("could not filter WAV drivers: %w", err)
+		}
+	}
+	if r.VehicleClass != "" {
+		if drivers, err = filter(drivers, func(ids []string) ([]string, error) { return dr.WithTag(ids, r.VehicleClass) }); err != nil {
+			return candidateSet{}, fmt.Errorf("could not filter drivers by vehicle class: %w", err)
+		}
+	}
+	// The restricted zones only admit the drivers with their permits.
+	if len(r.RequiredTags) > 0 {
+		if drivers, err = filter(drivers, func(ids []string) ([]string, error) { return dr.WithTags(ids, r.RequiredTags) }); err != nil {
+			return candidateSet{}, fmt.Errorf("could not filter drivers by required tags: %w", err)
+		}
+	}
+	// The paused drivers do not receive requests.
+	if drivers, err = filter(drivers, dr.Available); err != nil {
+		return candidateSet{}, fmt.Errorf("could not filter paused drivers: %w", err)
+	}
+	// Without a recent heartbeat the app of the driver can be closed even if its last location is still in the search.
+	if cfg := config.Get(); cfg.RequireHeartbeat && !r.Sandbox {
+		since := time.Now().Add(-cfg.PresenceTTL)
+		if drivers, err = filter(drivers, func(ids []string) ([]string, error) { return presence.Online(ids, since) }); err != nil {
+			return candidateSet{}, fmt.Errorf("could not filter offline drivers: %w", err)
+		}
+	}
+	// The drivers going home are only offered the rides toward their home.
+	homes, err := r.towardHome(drivers)
+	if err != nil {
+		return candidateSet{}, fmt.Errorf("could not filter drivers going home: %w", err)
+	}
+	if len(homes) > 0 {
+		drivers = withinCorridor(drivers, homes, r.Dropoff)
+	}
+	// The position is read before the reservation, it removes the driver from the search.
+	seen, err := r.lastSeen(drivers)
+	if err != nil {
+		return candidateSet{}, fmt.Errorf("could not get the last positions: %w", err)
+	}
+	if r.MaxPositionAge > 0 {
+		drivers = fresh(drivers, seen, time.Now().Add(-r.MaxPositionAge))
+	}
+	if r.MaxDistance > 0 {
+		found := len(drivers)
+		drivers = withinDistance(drivers, r.MaxDistance)
+		if found > 0 && len(drivers) == 0 {
+			r.BeyondMaxDistance = true
+		}
+	}
+	var risks map[string]float64
+	if r.Window != nil && r.Dropoff != nil {
+		drivers, risks = r.withinWindow(ctx, drivers)
+	}
+	return candidateSet{drivers: drivers, seen: seen, homes: homes, risks: risks}, nil
+}
+
+// rank returns the drivers sorted from the best to the worst for the matching strategy of the request.
+func (r *RequestDriverTask) rank(drivers []redis.GeoLocation) ([]string, error) {
+	name := r.Strategy
+	if name == "" {
+		name = config.Get().MatchingStrategy
+	}
+	strategy, err := matching.Get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make([]matching.Candidate, len(drivers))
+	for i, d := range drivers {
+		candidates[i] = matching.Candidate{DriverID: d.Name, Distance: d.Dist}
+	}
+	if len(r.Languages) > 0 {
+		spoken, err := languages.Drivers(matchingIDs(candidates))
+		if err != nil {
+			return nil, err
+		}
+		for i := range candidates {
+			candidates[i].Language = languages.Shared(r.Languages, spoken[candidates[i].DriverID])
+		}
+	}
+	if err := strategy.Rank(candidates); err != nil {
+		return nil, err
+	}
+
+	return matchingIDs(candidates), nil
+}
+
+func matchingIDs(candidates []matching.Candidate) []string {
+	ids := make([]string, len(candidates))
+	for i, c := range candidates {
+		ids[i] = c.DriverID
+	}
+	return ids
+}
+
+// sharedLanguage returns the first language of the rider spoken by the driver, the offer includes it so the apps can prepare their messages.
+func (r *RequestDriverTask) sharedLanguage(driverID string) (string, error) {
+	if len(r.Languages) == 0 {
+		return "", nil
+	}
+	spoken, err := languages.Drivers([]string{driverID})
+	if err != nil {
+		return "", err
+	}
+	return languages.Shared(r.Languages, spoken[driverID]), nil
+}
+
+// reserve reserves the first available driver of ranked and returns it, empty if all of them were reserved by other requests.
+func (r *RequestDriverTask) reserve(ctx context.Context, ranked []string) (string, error) {
+	ctx, span := tracing.Start(ctx, "match")
+	defer span.End()
+
+	// The drivers are reserved in the store where they were found, it removes them from its search.
+	store := r.locations()
+	for _, driverID := range ranked {
+		ok, err := store.ReserveDriver(ctx, driverID, r.ID, config.Get().RequestTTL)
+		if err != nil {
+			span.RecordError(err)
+			return "", err
+		}
+		if ok {
+			span.SetAttributes(attribute.String("driver.id", driverID))
+			return driverID, nil
+		}
+		r.logger().Info("driver already reserved", "driver_id", driverID)
+	}
+	return "", nil
+}
+
+// without returns the drivers that are not in ids.
+func without(drivers []redis.GeoLocation, ids []string) []redis.GeoLocation {
+	excluded := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		excluded[id] = true
+	}
+	kept := drivers[:0]
+	for _, d := range drivers {
+		if !excluded[d.Name] {
+			kept = append(kept, d)
+		}
+	}
+	return kept
+}
+
+// withinDistance returns the drivers that are at most max km from the picking point.
+func withinDistance(drivers []redis.GeoLocation, max float64) []redis.GeoLocation {
+	within := drivers[:0]
+	for _, d := range drivers {
+		if d.Dist <= max {
+			within = append(within, d)
+		}
+	}
+	return within
+}
+
+// towardHome returns the go-home mode of the drivers going home, the sandbox drivers never go home.
+func (r *RequestDriverTask) towardHome(drivers []redis.GeoLocation) (map[string]dr.GoHome, error) {
+	if r.Sandbox || len(drivers) == 0 {
+		return nil, nil
+	}
+	ids := make([]string, len(drivers))
+	for i, d := range drivers {
+		ids[i] = d.Name
+	}
+	return dr.GoingHome(ids)
+}
+
+// withinCorridor removes the drivers going home when the dropoff is not toward their home, without dropoff they are all removed.
+func withinCorridor(drivers []redis.GeoLocation, homes map[string]dr.GoHome, dropoff *geo.Point) []redis.GeoLocation {
+	width := config.Get().GoHomeCorridor
+	kept := drivers[:0]
+	for _, d := range drivers {
+		if g, ok := homes[d.Name]; ok {
+			if dropoff == nil || !g.TowardHome(geo.Point{Lat: d.Latitude, Lng: d.Longitude}, *dropoff, width) {
+				continue
+			}
+		}
+		kept = append(kept, d)
+	}
+	return kept
+}
+
+// lastSeen returns the time of the last position of the drivers.
+func (r *RequestDriverTask) lastSeen(drivers []redis.GeoLocation) (map[string]time.Time, error) {
+	ids := make([]string, len(drivers))
+	for i, d := range drivers {
+		ids[i] = d.Name
+	}
+	return r.locations().LastSeen(ids)
+}
+
+// fresh returns the drivers whose last position is not older than since.
+func fresh(drivers []redis.GeoLocation, seen map[string]time.Time, since time.Time) []redis.GeoLocation {
+	kept := drivers[:0]
+	for _, d := range drivers {
+		if at, ok := seen[d.Name]; ok && !at.Before(since) {
+			kept = append(kept, d)
+		}
+	}
+	return kept
+}
+
+// filter returns the drivers whose IDs are returned by keep, keeping the order.
+func filter(drivers []redis.GeoLocation, keep func(ids []string) ([]string, error)) ([]redis.GeoLocation, error) {
+	if len(drivers) == 0 {
+		return drivers, nil
+	}
+	ids := make([]string, len(drivers))
+	for i, d := range drivers {
+		ids[i] = d.Name
+	}
+
+	kept, err := keep(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	keepSet := make(map[string]bool, len(kept))
+	for _, id := range kept {
+		keepSet[id] = true
+	}
+	filtered := drivers[:0]
+	for _, d := range drivers {
+		if keepSet[d.Name] {
+			filtered = append(filtered, d)
+		}
+	}
+	return filtered, nil
+}
+
+// emitFeatures exports the match decision for offline training.
+// The features that can not be read are left empty, the decision is exported anyway.
+func (r *RequestDriverTask) emitFeatures(ctx context.Context, drivers []redis.GeoLocation) {
+	ids := make([]string, len(drivers))
+	for i, d := range drivers {
+		ids[i] = d.Name
+	}
+	ratings, err := dr.Ratings(ids)
+	if err != nil {
+		r.logger().Warn("could not get driver ratings", "error", err)
+	}
+	rates, err := dr.AcceptanceRates(ids)
+	if err != nil {
+		r.logger().Warn("could not get driver acceptance rates", "error", err)
+	}
+	candidates := make([]features.Candidate, 0, len(drivers))
+	for _, d := range drivers {
+		candidates = append(candidates, features.Candidate{DriverID: d.Name, Distance: d.Dist, Rating: ratings[d.Name], Acceptance: rates[d.Name]})
+	}
+
+	// The supply and the demand are counted in the zone of the picking point, the candidates are limited by the search.
+	zone := r.zone()
+	min, max := geo.GeohashBounds(zone)
+	var supply int
+	if inZone, err := r.locations().DriversInBox(ctx, min.Lat, min.Lng, max.Lat, max.Lng); err != nil {
+		r.logger().Warn("could not get zone drivers", "zone", zone, "error", err)
+	} else {
+		supply = len(inZone)
+	}
+	demand, err := areaDemand(zone)
+	if err != nil {
+		r.logger().Warn("could not count zone requests", "zone", zone, "error", err)
+	}
+
+	err = features.Emit(features.Vector{
+		RequestID:  r.ID,
+		DriverID:   r.DriverID,
+		Lat:        r.Lat,
+		Lng:        r.Lng,
+		Candidates: candidates,
+		Zone:       zone,
+		Supply:     supply,
+		Demand:     demand,
+	})
+	if err != nil {
+		r.logger().Warn("could not emit features", "error", err)
+	}
+}
+
+// notifyDriver pushes the offer of the request to the driver through its command channel.
+func (r *RequestDriverTask) notifyDriver(ctx context.Context) {
+	_, span := tracing.Start(ctx, "notify.driver", attribute.String("driver.id", r.DriverID))
+	defer span.End()
+
+	payload := map[string]interface{}{
+		"request_id":  r.ID,
+		"user_id":     r.UserID,
+		"lat":         r.Lat,
+		"lng":         r.Lng,
+		"eta_seconds": r.ETA.Seconds(),
+		"deadline":    r.OfferDeadline.UTC(),
+	}
+	if r.Language != "" {
+		payload["language"] = r.Language
+	}
+	if r.Window != nil {
+		payload["delivery_window"] = r.Window
+		payload["window_risk"] = r.WindowRisk
+	}
+	if err := commands.Send(r.DriverID, commands.TypeOffer, payload); err != nil {
+		span.RecordError(err)
+		r.logger().Warn("could not send offer to driver", "driver_id", r.DriverID, "error", err)
+	}
+}
+
+// addAssets adds the signed URLs of the photos of the driver to the data of the notification, e.g. photo_url.
+// The notification is sent without them when they can not be read or signed.
+func (r *RequestDriverTask) addAssets(ctx context.Context, data map[string]string) {
+	urls, err := dr.SignedAssets(ctx, r.DriverID)
+	if err != nil {
+		r.logger().Warn("could not get driver assets", "driver_id", r.DriverID, "error", err)
+		return
+	}
+	for kind, url := range urls {
+		data[kind+"_url"] = url
+	}
+}
+
+// notifyUser sends the message to the user through the configured notifier, the failures are logged.
+func (r *RequestDriverTask) notifyUser(ctx context.Context, kind, text string, data map[string]string) {
+	ctx, span := tracing.Start(ctx, "notify.user", attribute.String("user.id", r.UserID), attribute.String("kind", kind))
+	defer span.End()
+
+	ctx = logging.WithCorrelationID(ctx, r.CorrelationID)
+	err := notify.Send(ctx, notify.Message{UserID: r.UserID, RequestID: idcodec.Encode(idcodec.KindRequest, r.ID), Kind: kind, Text: text, Data: data})
+	if err != nil {
+		span.RecordError(err)
+		r.logger().Warn("could not notify user", "user_id", r.UserID, "kind", kind, "error", err)
+	}
 }
@@ -0,0 +1,45 @@
+package tasks
+
+import (
+	"context"
+	"testing"
+
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+func TestBeyondMaxDistance(t *testing.T) {
+	c := storages.GetSandboxClient("beyond-test")
+	if err := c.Ping().Err(); err != nil {
+		t.Skipf("redis is not available: %v", err)
+	}
+	defer c.ClearDrivers()
+
+	ctx := context.Background()
+	r := NewRequestDriverTask("beyond-1", "user-1", -33.448890, -70.669265)
+	r.Sandbox, r.Tenant, r.MaxDistance = true, "beyond-test", 1
+	move := func(lat, lng float64) {
+		if err := c.AddDriverLocations(ctx, []*redis.GeoLocation{{Name: "1", Latitude: lat, Longitude: lng}}); err != nil {
+			t.Fatalf("could not add driver: %v", err)
+		}
+	}
+
+	// The only driver is about 3km away.
+	move(-33.448890, -70.637000)
+	if _, err := r.candidates(ctx, r.limit(), 5); err != nil {
+		t.Fatalf("could not search drivers: %v", err)
+	}
+	if !r.BeyondMaxDistance {
+		t.Fatal("expected the driver to be beyond the max distance")
+	}
+
+	// The driver comes within the max distance, the request that expires after it is not beyond the max distance.
+	move(-33.449000, -70.670000)
+	found, err := r.candidates(ctx, r.limit(), 5)
+	if err != nil {
+		t.Fatalf("could not search drivers: %v", err)
+	}
+	if len(found.drivers) != 1 || r.BeyondMaxDistance {
+		t.Errorf("expected the driver within the max distance, got %v beyond %v", found.drivers, r.BeyondMaxDistance)
+	}
+}
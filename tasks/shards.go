@@ -0,0 +1,95 @@
+package tasks
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/douglasmakey/tracking/config"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/metrics"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// heartbeatsKey is a sorted set with the unix time in milliseconds of the last heartbeat of each shard.
+const heartbeatsKey = "search:shards"
+
+// heartbeatInterval is how often the shards send their heartbeat and look for dead shards.
+const heartbeatInterval = time.Second * 2
+
+// inflightKey is the list with the tasks that the shard is running.
+func inflightKey(shard string) string {
+	return fmt.Sprintf("%s:inflight:%s", searchTag(), shard)
+}
+
+// monitorShards sends the heartbeat of the shard and recovers the tasks of the dead shards.
+func monitorShards(shard string) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		rClient := storages.GetRedisClient()
+		err := rClient.ZAdd(heartbeatsKey, redis.Z{Score: float64(now.UnixNano() / int64(time.Millisecond)), Member: shard}).Err()
+		if err != nil {
+			logging.Logger.Error("could not send shard heartbeat", "shard", shard, "error", err)
+			continue
+		}
+
+		if err := recoverDeadShards(now, config.Get().ShardTimeout); err != nil {
+			logging.Logger.Error("could not recover dead shards", "error", err)
+		}
+	}
+}
+
+// recoverDeadShards queues again the in-flight tasks of the shards without heartbeat since timeout.
+// The tasks resume from the state saved before their last attempt.
+func recoverDeadShards(now time.Time, timeout time.Duration) error {
+	rClient := storages.GetRedisClient()
+	cutoff := strconv.FormatInt(now.Add(-timeout).UnixNano()/int64(time.Millisecond), 10)
+	dead, err := rClient.ZRangeByScoreWithScores(heartbeatsKey, redis.ZRangeBy{Min: "-inf", Max: cutoff}).Result()
+	if err != nil {
+		return storages.Classify(err)
+	}
+
+	for _, z := range dead {
+		shard := fmt.Sprint(z.Member)
+		// Only the shard that removes the dead one recovers its tasks.
+		if n, err := rClient.ZRem(heartbeatsKey, shard).Result(); err != nil || n == 0 {
+			continue
+		}
+
+		// Each job is moved to its queue in one step, it is never lost if the instance stops during the recovery.
+		// Only this instance takes jobs from the tail of the dead shard, so the tail is the job that was read.
+		recovered := 0
+		for {
+			job, err := rClient.LIndex(inflightKey(shard), -1).Result()
+			if err == redis.Nil {
+				break
+			}
+			if err != nil {
+				return storages.Classify(err)
+			}
+			key := jobsKey()
+			var r RequestDriverTask
+			if err := json.Unmarshal([]byte(job), &r); err == nil {
+				key = queueKey(&r)
+			}
+			if err := rClient.RPopLPush(inflightKey(shard), key).Err(); err != nil {
+				if err == redis.Nil {
+					break
+				}
+				return storages.Classify(err)
+			}
+			recovered++
+		}
+
+		lastSeen := time.Unix(0, int64(z.Score)*int64(time.Millisecond))
+		metrics.ShardFailovers.Inc()
+		metrics.RecoveredTasks.Add(float64(recovered))
+		metrics.FailoverLatency.Observe(now.Sub(lastSeen).Seconds())
+		logging.Logger.Warn("dead shard recovered", "shard", shard, "tasks", recovered, "last_heartbeat", lastSeen)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package tasks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/douglasmakey/tracking/bus"
+	"github.com/douglasmakey/tracking/callbacks"
+	"github.com/douglasmakey/tracking/idcodec"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/douglasmakey/tracking/workflow"
+	"github.com/go-redis/redis"
+)
+
+// These are the states of a request, all of them but searching are terminal.
+const (
+	StateSearching = "searching"
+	StateMatched   = "matched"
+	StateExpired   = "expired"
+	StateCanceled  = "canceled"
+	// StateBeyondMaxDistance means that the request expired but there were drivers, all of them farther than the max distance of the request.
+	StateBeyondMaxDistance = "supply_beyond_max_distance"
+)
+
+// busEvents are the events of the bus of the terminal states, a request beyond the max distance also expired.
+var busEvents = map[string]string{
+	StateMatched:           bus.DriverMatched,
+	StateExpired:           bus.RequestExpired,
+	StateBeyondMaxDistance: bus.RequestExpired,
+	StateCanceled:          bus.RequestCanceled,
+}
+
+// ErrStatusNotFound is returned when the request does not exist or its status expired.
+var ErrStatusNotFound = errors.New("request status not found")
+
+// statusTTL is the time that the status of a request is kept after its last change.
+const statusTTL = time.Hour * 24
+
+// Status is the state of a request, DriverID and PositionAge, the age in seconds of its last position, are set when the request is matched
+// and Radius is the radius in km of the search while it is searching.
+type Status struct {
+	State       string  `json:"state"`
+	DriverID    string  `json:"driver_id,omitempty"`
+	PositionAge float64 `json:"position_age_seconds,omitempty"`
+	Radius      float64 `json:"radius_km,omitempty"`
+	// UserID is the owner of the request and Tenant its enterprise, the workflow engine of the tenant receives the changes of state.
+	UserID    string    `json:"user_id,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// statusKey keeps the status of the request as JSON.
+func statusKey(requestID string) string {
+	// The request key is the ID, the status is in its slot so the cancellation can change both.
+	return fmt.Sprintf("request:%s:status", storages.Tag(requestID))
+}
+
+// setStatus saves the status of the request and publishes the change to the workflow engine of the tenant and the bus,
+// the owner and the tenant are kept from the previous status.
+func setStatus(requestID string, s Status) error {
+	if s.UserID == "" {
+		if prev, err := GetStatus(requestID); err == nil {
+			s.UserID, s.Tenant = prev.UserID, prev.Tenant
+		}
+	}
+	s.UpdatedAt = time.Now().UTC()
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	rClient := storages.GetRedisClient()
+	if err := storages.Classify(rClient.Set(statusKey(requestID), data, statusTTL).Err()); err != nil {
+		return err
+	}
+	publishStatus(requestID, s)
+	return nil
+}
+
+// publishStatus sends the saved status of the request to the workflow engine of the tenant, the bus and the callback of the client.
+func publishStatus(requestID string, s Status) {
+	publicID := idcodec.Encode(idcodec.KindRequest, requestID)
+	ev := workflow.Event{Tenant: s.Tenant, Entity: workflow.EntityRequest, ID: publicID, State: s.State}
+	if s.DriverID != "" {
+		ev.Data = map[string]string{"driver_id": idcodec.Encode(idcodec.KindDriver, s.DriverID)}
+	}
+	workflow.Publish(ev)
+	if t, ok := busEvents[s.State]; ok {
+		data := map[string]string{"request_id": publicID, "state": s.State}
+		if s.DriverID != "" {
+			data["driver_id"] = ev.Data["driver_id"]
+		}
+		bus.Emit(bus.Event{Type: t, Key: publicID, Tenant: s.Tenant, Data: data, Occurred: s.UpdatedAt})
+	}
+
+	// The client is called back when the request finishes.
+	if s.State != StateSearching {
+		cb := callbacks.Event{Event: s.State, RequestID: publicID, OccurredAt: s.UpdatedAt}
+		if s.DriverID != "" {
+			cb.DriverID = idcodec.Encode(idcodec.KindDriver, s.DriverID)
+		}
+		// The status is saved, a failure of the callback must not fail the change of state.
+		if err := callbacks.Trigger(requestID, cb); err != nil {
+			logging.Logger.Error("could not trigger callback", "request_id", requestID, "error", err)
+		}
+	}
+}
+
+// GetStatus returns the status of the request.
+func GetStatus(requestID string) (Status, error) {
+	rClient := storages.GetRedisClient()
+	var data []byte
+	err := storages.WithRetry(func() (err error) {
+		data, err = rClient.Get(statusKey(requestID)).Bytes()
+		return err
+	})
+	if err == redis.Nil {
+		return Status{}, ErrStatusNotFound
+	}
+	if err != nil {
+		return Status{}, err
+	}
+
+	var s Status
+	err = json.Unmarshal(data, &s)
+	return s, err
+}
@@ -0,0 +1,142 @@
+// Package telematics ingests the locations of the GPS devices of the fleet from an MQTT broker, they are stored the same as
+// the locations of /tracking. Each device publishes to its own topic, e.g. drivers/{id}/location, and the payload is a JSON location.
+package telematics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/douglasmakey/tracking/ingest"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/metrics"
+	"github.com/douglasmakey/tracking/retry"
+	"github.com/douglasmakey/tracking/storages"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// ErrTopic is returned when the topic filter does not have a single-level wildcard for the ID of the driver.
+var ErrTopic = errors.New("the topic must have a + level for the driver, e.g. drivers/+/location")
+
+// sharePrefix starts the filters of the shared subscriptions, $share/{group}/{filter}.
+const sharePrefix = "$share/"
+
+// Config is the broker and the topic filter of the locations.
+type Config struct {
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+	// Topic is the filter of the topics of the devices, its + level is the ID of the driver. Every instance receives all the
+	// messages of a filter, the brokers that support shared subscriptions split them with a filter like $share/tracking/drivers/+/location.
+	Topic string
+	QoS   byte
+}
+
+// Listener saves the locations published by the devices.
+type Listener struct {
+	cfg Config
+	// level is the index of the level of the topics with the ID of the driver.
+	level int
+	// accept and save are the steps of the ingestion, they are replaced in the tests.
+	accept func(l ingest.Location, dryRun bool) error
+	save   func(ctx context.Context, locations ...ingest.Location) error
+}
+
+// NewListener returns a listener of the topic, it does not connect until Start.
+func NewListener(cfg Config) (*Listener, error) {
+	// The published topics do not have the prefix of the shared subscription.
+	filter := cfg.Topic
+	if strings.HasPrefix(filter, sharePrefix) {
+		parts := strings.SplitN(filter, "/", 3)
+		if len(parts) < 3 {
+			return nil, ErrTopic
+		}
+		filter = parts[2]
+	}
+	level := -1
+	for i, part := range strings.Split(filter, "/") {
+		if part != "+" {
+			continue
+		}
+		if level >= 0 {
+			return nil, ErrTopic
+		}
+		level = i
+	}
+	if level < 0 {
+		return nil, ErrTopic
+	}
+	return &Listener{cfg: cfg, level: level, accept: ingest.Accept, save: ingest.Save}, nil
+}
+
+// Start connects to the broker and subscribes to the topic, the messages are handled in the goroutines of the client.
+// The client reconnects by itself and subscribes again on each connection, so the listener survives the restarts of the broker.
+func (l *Listener) Start() error {
+	opts := mqtt.NewClientOptions().
+		AddBroker(l.cfg.Broker).
+		SetClientID(l.cfg.ClientID).
+		SetUsername(l.cfg.Username).
+		SetPassword(l.cfg.Password).
+		SetAutoReconnect(true).
+		SetOnConnectHandler(func(c mqtt.Client) {
+			token := c.Subscribe(l.cfg.Topic, l.cfg.QoS, l.handle)
+			if token.Wait() && token.Error() != nil {
+				logging.Logger.Error("could not subscribe to mqtt topic", "topic", l.cfg.Topic, "error", token.Error())
+				return
+			}
+			logging.Logger.Info("subscribed to mqtt topic", "topic", l.cfg.Topic)
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			logging.Logger.Warn("mqtt connection lost", "broker", l.cfg.Broker, "error", err)
+		})
+
+	token := mqtt.NewClient(opts).Connect()
+	token.Wait()
+	return token.Error()
+}
+
+// handle saves the location of the message, the invalid ones and the ones of stale devices are dropped.
+// The transient errors of the storage are retried, the message is acknowledged when the handler returns.
+func (l *Listener) handle(_ mqtt.Client, m mqtt.Message) {
+	loc, err := l.decode(m.Topic(), m.Payload())
+	if err != nil {
+		metrics.TelematicsMessages.WithLabelValues("invalid").Inc()
+		logging.Logger.Warn("invalid location from mqtt", "topic", m.Topic(), "error", err)
+		return
+	}
+
+	err = l.accept(loc, false)
+	if err == ingest.ErrStaleDevice {
+		metrics.TelematicsMessages.WithLabelValues("stale_device").Inc()
+		return
+	}
+	if err == nil {
+		err = retry.For(retry.Storage).Do(context.Background(), retry.Storage, func() error {
+			err := l.save(context.Background(), loc)
+			if err != nil && !storages.IsTransient(err) {
+				return retry.Permanent(err)
+			}
+			return err
+		})
+	}
+	if err != nil {
+		metrics.TelematicsMessages.WithLabelValues("failed").Inc()
+		logging.Logger.Error("could not save location from mqtt", "driver", loc.ID, "error", err)
+		return
+	}
+	metrics.TelematicsMessages.WithLabelValues("saved").Inc()
+}
+
+// decode returns the location of the payload, the driver is always the one of the topic so a device can only report its driver.
+func (l *Listener) decode(topic string, payload []byte) (ingest.Location, error) {
+	var loc ingest.Location
+	if err := json.Unmarshal(payload, &loc); err != nil {
+		return loc, err
+	}
+	if parts := strings.Split(topic, "/"); l.level < len(parts) {
+		loc.ID = parts[l.level]
+	}
+	return loc, ingest.Validate(loc)
+}
@@ -0,0 +1,76 @@
+package telematics
+
+import (
+	"context"
+	"testing"
+
+	"github.com/douglasmakey/tracking/ingest"
+)
+
+// message is an MQTT message with a topic and a payload.
+type message struct {
+	topic   string
+	payload string
+}
+
+func (m message) Duplicate() bool   { return false }
+func (m message) Qos() byte         { return 1 }
+func (m message) Retained() bool    { return false }
+func (m message) Topic() string     { return m.topic }
+func (m message) MessageID() uint16 { return 0 }
+func (m message) Payload() []byte   { return []byte(m.payload) }
+func (m message) Ack()              {}
+
+func TestNewListener(t *testing.T) {
+	tests := []struct {
+		topic string
+		level int
+		err   error
+	}{
+		{"drivers/+/location", 1, nil},
+		{"fleet/acme/+/gps", 2, nil},
+		{"$share/tracking/drivers/+/location", 1, nil},
+		{"$share/tracking", 0, ErrTopic},
+		{"drivers/location", 0, ErrTopic},
+		{"drivers/+/+", 0, ErrTopic},
+	}
+	for _, tt := range tests {
+		l, err := NewListener(Config{Topic: tt.topic})
+		if err != tt.err {
+			t.Errorf("%s: expected error %v, got %v", tt.topic, tt.err, err)
+			continue
+		}
+		if err == nil && l.level != tt.level {
+			t.Errorf("%s: expected level %d, got %d", tt.topic, tt.level, l.level)
+		}
+	}
+}
+
+func TestHandle(t *testing.T) {
+	l, err := NewListener(Config{Topic: "drivers/+/location"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.accept = func(loc ingest.Location, _ bool) error {
+		if loc.DeviceID == "old" {
+			return ingest.ErrStaleDevice
+		}
+		return nil
+	}
+	var saved []ingest.Location
+	l.save = func(_ context.Context, locations ...ingest.Location) error {
+		saved = append(saved, locations...)
+		return nil
+	}
+
+	l.handle(nil, message{"drivers/1/location", `{"lat": -33.44, "lng": -70.65}`})
+	// The driver of the topic wins over the one of the payload.
+	l.handle(nil, message{"drivers/2/location", `{"id": "3", "lat": -33.45, "lng": -70.66}`})
+	l.handle(nil, message{"drivers/4/location", `{"lat": 100, "lng": -70.65}`})
+	l.handle(nil, message{"drivers/5/location", `{"lat": -33.45, "lng": -70.66, "device_id": "old"}`})
+	l.handle(nil, message{"drivers/6/location", `not json`})
+
+	if len(saved) != 2 || saved[0].ID != "1" || saved[1].ID != "2" {
+		t.Errorf("expected the locations of 1 and 2, got %+v", saved)
+	}
+}
@@ -0,0 +1,85 @@
+package trips
+
+import (
+	"math"
+
+	"github.com/douglasmakey/tracking/geo"
+)
+
+// Segment is the part of the plan that the rider is on board, from its pickup stop to its dropoff stop.
+type Segment struct {
+	RiderID string `json:"rider_id"`
+	// Pickup and Dropoff are the positions of the stops of the rider in the plan.
+	Pickup   int     `json:"pickup"`
+	Dropoff  int     `json:"dropoff"`
+	Distance float64 `json:"distance_km"`
+}
+
+// Receipt is the share of the fare of the trip paid by a rider.
+type Receipt struct {
+	RiderID  string  `json:"rider_id"`
+	Distance float64 `json:"distance_km"`
+	// Share is the fraction of the fare, Amount the share of the fare rounded to cents.
+	Share  float64 `json:"share"`
+	Amount float64 `json:"amount"`
+}
+
+// segments returns the segment of each rider of the stops in the order of the pickups.
+func segments(router Router, start geo.Point, stops []Stop) []Segment {
+	var segs []Segment
+	onBoard := map[string]int{}
+	prev := start
+	for i, s := range stops {
+		d := router.Distance(prev, s.Point)
+		prev = s.Point
+		// The leg to the stop is traveled by every rider on board.
+		for _, j := range onBoard {
+			segs[j].Distance += d
+		}
+
+		switch s.Type {
+		case StopPickup:
+			onBoard[s.RiderID] = len(segs)
+			segs = append(segs, Segment{RiderID: s.RiderID, Pickup: i})
+		case StopDropoff:
+			if j, ok := onBoard[s.RiderID]; ok {
+				segs[j].Dropoff = i
+				delete(onBoard, s.RiderID)
+			}
+		}
+	}
+	return segs
+}
+
+// Shares splits the fare between the riders of the segments proportionally to their on-board distance,
+// the amounts are rounded to cents and the rounding difference goes to the last rider so they add up to the fare.
+// If no rider traveled any distance the fare is split in equal parts.
+func Shares(segs []Segment, fare float64) []Receipt {
+	if len(segs) == 0 {
+		return nil
+	}
+
+	var total float64
+	for _, s := range segs {
+		total += s.Distance
+	}
+
+	receipts := make([]Receipt, len(segs))
+	var charged float64
+	for i, s := range segs {
+		share := 1 / float64(len(segs))
+		if total > 0 {
+			share = s.Distance / total
+		}
+		receipts[i] = Receipt{RiderID: s.RiderID, Distance: s.Distance, Share: share, Amount: cents(fare * share)}
+		charged += receipts[i].Amount
+	}
+	last := &receipts[len(receipts)-1]
+	last.Amount = cents(last.Amount + fare - charged)
+	return receipts
+}
+
+// cents rounds the amount to two decimals.
+func cents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
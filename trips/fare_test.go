@@ -0,0 +1,70 @@
+package trips
+
+import (
+	"math"
+	"testing"
+
+	"github.com/douglasmakey/tracking/geo"
+)
+
+// line is a Router for points on a meridian, the distance is the difference of the latitudes.
+type line struct{}
+
+func (line) Distance(a, b geo.Point) float64 {
+	return math.Abs(a.Lat - b.Lat)
+}
+
+func TestSegments(t *testing.T) {
+	// a is on board from 1 to 4 and b from 2 to 3.
+	stops := []Stop{
+		{RiderID: "a", Type: StopPickup, Point: geo.Point{Lat: 1}},
+		{RiderID: "b", Type: StopPickup, Point: geo.Point{Lat: 2}},
+		{RiderID: "b", Type: StopDropoff, Point: geo.Point{Lat: 3}},
+		{RiderID: "a", Type: StopDropoff, Point: geo.Point{Lat: 4}},
+	}
+
+	segs := segments(line{}, geo.Point{}, stops)
+	expected := []Segment{
+		{RiderID: "a", Pickup: 0, Dropoff: 3, Distance: 3},
+		{RiderID: "b", Pickup: 1, Dropoff: 2, Distance: 1},
+	}
+	if len(segs) != len(expected) {
+		t.Fatalf("expected %d segments, got %d", len(expected), len(segs))
+	}
+	for i, s := range segs {
+		if s != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], s)
+		}
+	}
+}
+
+func TestShares(t *testing.T) {
+	segs := []Segment{{RiderID: "a", Distance: 1}, {RiderID: "b", Distance: 1}, {RiderID: "c", Distance: 1}}
+	receipts := Shares(segs, 10)
+
+	var total float64
+	for _, rc := range receipts {
+		total += rc.Amount
+	}
+	if cents(total) != 10 {
+		t.Errorf("expected the amounts to add up to 10, got %v", total)
+	}
+	if receipts[0].Amount != 3.33 || receipts[2].Amount != 3.34 {
+		t.Errorf("unexpected amounts %+v", receipts)
+	}
+
+	receipts = Shares([]Segment{{RiderID: "a", Distance: 3}, {RiderID: "b", Distance: 1}}, 20)
+	if receipts[0].Amount != 15 || receipts[1].Amount != 5 {
+		t.Errorf("expected the fare to be split by distance, got %+v", receipts)
+	}
+
+	// Riders without distance pay equal parts.
+	receipts = Shares([]Segment{{RiderID: "a"}, {RiderID: "b"}}, 9)
+	if receipts[0].Amount != 4.5 || receipts[1].Amount != 4.5 {
+		t.Errorf("expected equal parts, got %+v", receipts)
+	}
+
+	if Shares(nil, 10) != nil {
+		t.Error("expected no receipts without riders")
+	}
+}
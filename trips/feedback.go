@@ -0,0 +1,164 @@
+package trips
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/douglasmakey/tracking/drivers"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+var (
+	// ErrNoDriver is returned when the feedback of a trip without driver is left.
+	ErrNoDriver = errors.New("trip has no driver")
+	// ErrNotRider is returned when the feedback is left by a user that was not a rider of the trip.
+	ErrNotRider = errors.New("user is not a rider of the trip")
+	// ErrFeedbackExists is returned when the rider already left the feedback or the tip of the trip.
+	ErrFeedbackExists = errors.New("feedback already left")
+)
+
+// These are the changes of a trip after it was completed.
+const (
+	StateFeedbackLeft = "feedback_left"
+	StateTipped       = "tipped"
+)
+
+// Feedback is the rating from 1 to 5 and the tags that a rider left about the driver of the trip.
+type Feedback struct {
+	RiderID string   `json:"rider_id"`
+	Rating  int      `json:"rating"`
+	Tags    []string `json:"tags"`
+}
+
+// Tip is the tip that a rider left to the driver of the trip.
+type Tip struct {
+	RiderID string  `json:"rider_id"`
+	Amount  float64 `json:"amount"`
+}
+
+// feedbackKey is a hash with the feedback of each rider of the trip and tipsKey a hash with the tip of each rider.
+func feedbackKey(id string) string {
+	return fmt.Sprintf("trip:%s:feedback", id)
+}
+
+func tipsKey(id string) string {
+	return fmt.Sprintf("trip:%s:tips", id)
+}
+
+// rated returns the trip if the rider can leave feedback about its driver: the trip is completed and the rider was on board.
+func rated(id, riderID string) (*Trip, error) {
+	t, err := Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if !t.Completed() {
+		return nil, ErrNotCompleted
+	}
+	if t.DriverID == "" {
+		return nil, ErrNoDriver
+	}
+	for _, r := range t.Riders {
+		if r.ID == riderID {
+			return t, nil
+		}
+	}
+	return nil, ErrNotRider
+}
+
+// LeaveFeedback saves the feedback of the rider and adds it to the totals of the driver, a rider leaves one feedback by trip.
+func LeaveFeedback(id string, f Feedback) error {
+	t, err := rated(id, f.RiderID)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	rClient := storages.GetRedisClient()
+	// HSETNX keeps the first feedback when a rider sends it twice at the same time.
+	added, err := rClient.HSetNX(feedbackKey(id), f.RiderID, data).Result()
+	if err != nil {
+		return storages.Classify(err)
+	}
+	if !added {
+		return ErrFeedbackExists
+	}
+
+	if err := drivers.AddFeedback(t.DriverID, f.Rating, f.Tags); err != nil {
+		return err
+	}
+	publish(t, StateFeedbackLeft, map[string]string{"rider_id": f.RiderID, "rating": strconv.Itoa(f.Rating)})
+	return nil
+}
+
+// LeaveTip saves the tip of the rider and adds it to the tips of the driver, a rider leaves one tip by trip.
+func LeaveTip(id string, tip Tip) error {
+	t, err := rated(id, tip.RiderID)
+	if err != nil {
+		return err
+	}
+
+	rClient := storages.GetRedisClient()
+	added, err := rClient.HSetNX(tipsKey(id), tip.RiderID, tip.Amount).Result()
+	if err != nil {
+		return storages.Classify(err)
+	}
+	if !added {
+		return ErrFeedbackExists
+	}
+
+	if err := drivers.AddTip(t.DriverID, tip.Amount); err != nil {
+		return err
+	}
+	publish(t, StateTipped, map[string]string{"rider_id": tip.RiderID, "amount": strconv.FormatFloat(tip.Amount, 'f', 2, 64)})
+	return nil
+}
+
+// TripFeedback is the feedback and the tips left by the riders of a trip.
+type TripFeedback struct {
+	Feedback []Feedback `json:"feedback"`
+	Tips     []Tip      `json:"tips"`
+}
+
+// GetFeedback returns the feedback and the tips of the trip sorted by rider.
+func GetFeedback(id string) (TripFeedback, error) {
+	if _, err := Get(id); err != nil {
+		return TripFeedback{}, err
+	}
+
+	rClient := storages.GetRedisClient()
+	var feedbackCmd, tipsCmd *redis.StringStringMapCmd
+	err := storages.WithRetry(func() error {
+		_, err := rClient.Pipelined(func(pipe redis.Pipeliner) error {
+			feedbackCmd = pipe.HGetAll(feedbackKey(id))
+			tipsCmd = pipe.HGetAll(tipsKey(id))
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return TripFeedback{}, err
+	}
+
+	res := TripFeedback{Feedback: []Feedback{}, Tips: []Tip{}}
+	for _, v := range feedbackCmd.Val() {
+		var f Feedback
+		if err := json.Unmarshal([]byte(v), &f); err != nil {
+			return TripFeedback{}, err
+		}
+		res.Feedback = append(res.Feedback, f)
+	}
+	for riderID, v := range tipsCmd.Val() {
+		amount, _ := strconv.ParseFloat(v, 64)
+		res.Tips = append(res.Tips, Tip{RiderID: riderID, Amount: amount})
+	}
+	sort.Slice(res.Feedback, func(i, j int) bool { return res.Feedback[i].RiderID < res.Feedback[j].RiderID })
+	sort.Slice(res.Tips, func(i, j int) bool { return res.Tips[i].RiderID < res.Tips[j].RiderID })
+	return res, nil
+}
@@ -0,0 +1,234 @@
+package trips
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/douglasmakey/tracking/drivers"
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/geofence"
+	"github.com/douglasmakey/tracking/storages"
+)
+
+var (
+	// ErrLegsPlanned is returned when the legs of a trip that already started its relay are planned again.
+	ErrLegsPlanned = errors.New("trip legs already planned")
+	// ErrNoHandoff is returned when a driver takes over a trip whose next leg does not have that driver.
+	ErrNoHandoff = errors.New("no handoff to the driver")
+	// ErrOutsideHandoff is returned when the handoff happens outside the handoff zone of the leg.
+	ErrOutsideHandoff = errors.New("driver is outside the handoff zone")
+)
+
+// These are the states of a leg: the next leg is searched when the current one nears its handoff zone,
+// it is matched until its driver takes over the trip in the zone.
+const (
+	LegPending   = "pending"
+	LegSearching = "searching"
+	LegMatched   = "matched"
+	LegActive    = "active"
+	LegCompleted = "completed"
+)
+
+// These are the changes of a trip with legs.
+const (
+	StateLegSearching = "leg_searching"
+	StateLegMatched   = "leg_matched"
+	StateHandoff      = "handoff"
+)
+
+// relaysKey is the set of the trips whose next leg still needs a driver or a handoff.
+const relaysKey = "trips:relays"
+
+// Leg is a part of a long trip driven by one driver, it ends in the handoff zone where the driver of the next leg takes over.
+// The last leg does not have a handoff zone.
+type Leg struct {
+	Handoff  string `json:"handoff_zone,omitempty"`
+	DriverID string `json:"driver_id,omitempty"`
+	// RequestID is the search of the driver of the leg.
+	RequestID string     `json:"request_id,omitempty"`
+	State     string     `json:"state"`
+	Started   *time.Time `json:"started_at,omitempty"`
+}
+
+// Next returns the index of the leg after the current one, ok is false on the last leg or without legs.
+func (t *Trip) Next() (int, bool) {
+	next := t.CurrentLeg + 1
+	return next, len(t.Legs) > 0 && next < len(t.Legs)
+}
+
+// PlanLegs splits the trip in legs that end in the handoff zones, in order, there is at least one zone. The driver of the trip
+// drives the first leg and the drivers of the next legs are searched while the trip is driven. The legs can be planned again
+// until the search of the second leg starts.
+func PlanLegs(id string, handoffs []string) (*Trip, error) {
+	for _, h := range handoffs {
+		if _, err := geofence.Get(h); err != nil {
+			return nil, err
+		}
+	}
+
+	t, err := update(id, func(t *Trip) error {
+		switch {
+		case t.NoShow:
+			return ErrNoShow
+		case t.Completed():
+			return ErrCompleted
+		case t.DriverID == "":
+			return ErrNoDriver
+		case len(t.Legs) > 1 && t.Legs[1].State != LegPending:
+			return ErrLegsPlanned
+		}
+
+		now := time.Now().UTC()
+		t.Legs = []Leg{{Handoff: handoffs[0], DriverID: t.DriverID, State: LegActive, Started: &now}}
+		for i := 1; i <= len(handoffs); i++ {
+			l := Leg{State: LegPending}
+			if i < len(handoffs) {
+				l.Handoff = handoffs[i]
+			}
+			t.Legs = append(t.Legs, l)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	rClient := storages.GetRedisClient()
+	if err := storages.Classify(rClient.SAdd(relaysKey, t.ID).Err()); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Relays returns the trips whose next leg still needs a driver or a handoff.
+func Relays() ([]string, error) {
+	rClient := storages.GetRedisClient()
+	var ids []string
+	err := storages.WithRetry(func() (err error) {
+		ids, err = rClient.SMembers(relaysKey).Result()
+		return err
+	})
+	return ids, err
+}
+
+// setLeg changes the state of the next leg of the trip if it is in one of the from states and publishes the change,
+// the change is only published by the request that saved it.
+func setLeg(id string, leg int, from []string, change func(l *Leg) string) (*Trip, error) {
+	var state string
+	t, err := update(id, func(t *Trip) error {
+		if next, ok := t.Next(); !ok || next != leg {
+			return ErrNoHandoff
+		}
+		if !contains(from, t.Legs[leg].State) {
+			return ErrNoHandoff
+		}
+		state = change(&t.Legs[leg])
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if state != "" {
+		l := t.Legs[leg]
+		publish(t, state, map[string]string{"leg": strconv.Itoa(leg), "request_id": l.RequestID, "driver_id": l.DriverID})
+	}
+	return t, nil
+}
+
+// SearchLeg records the search of the driver of the pending leg.
+func SearchLeg(id string, leg int, requestID string) (*Trip, error) {
+	return setLeg(id, leg, []string{LegPending}, func(l *Leg) string {
+		l.State, l.RequestID = LegSearching, requestID
+		return StateLegSearching
+	})
+}
+
+// RetryLeg moves the leg whose search did not find a driver back to pending, it is searched again.
+func RetryLeg(id string, leg int) (*Trip, error) {
+	return setLeg(id, leg, []string{LegSearching}, func(l *Leg) string {
+		l.State, l.RequestID = LegPending, ""
+		return ""
+	})
+}
+
+// MatchLeg records the driver found for the leg, the driver goes to the handoff zone.
+func MatchLeg(id string, leg int, driverID string) (*Trip, error) {
+	return setLeg(id, leg, []string{LegSearching}, func(l *Leg) string {
+		l.State, l.DriverID = LegMatched, driverID
+		return StateLegMatched
+	})
+}
+
+// Handoff passes the trip to the driver of its next leg, the driver must be at at, inside the handoff zone of the current leg.
+// The driver of the current leg returns to the available pool.
+// Only the request that saves the handoff moves the route and the drivers.
+func Handoff(id, driverID string, at geo.Point) (*Trip, error) {
+	vehicleID, err := drivers.ActiveVehicle(driverID)
+	if err != nil {
+		return nil, err
+	}
+
+	var prev string
+	var zone geofence.Zone
+	t, err := update(id, func(t *Trip) error {
+		if t.Completed() {
+			return ErrCompleted
+		}
+		next, ok := t.Next()
+		if !ok || t.Legs[next].State != LegMatched || t.Legs[next].DriverID != driverID {
+			return ErrNoHandoff
+		}
+		var err error
+		if zone, err = geofence.Get(t.Legs[t.CurrentLeg].Handoff); err != nil {
+			return err
+		}
+		if !zone.Contains(at) {
+			return ErrOutsideHandoff
+		}
+
+		prev = t.DriverID
+		now := time.Now().UTC()
+		t.Legs[t.CurrentLeg].State = LegCompleted
+		t.Legs[next].State, t.Legs[next].Started = LegActive, &now
+		t.CurrentLeg = next
+		t.DriverID, t.VehicleID = driverID, vehicleID
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	publish(t, StateHandoff, map[string]string{"leg": strconv.Itoa(t.CurrentLeg), "from_driver_id": prev, "driver_id": driverID, "zone": zone.Name})
+	// The route continues with the locations of the new driver.
+	if err := stopRoute(prev); err != nil {
+		return t, err
+	}
+	if err := startRoute(t, driverID); err != nil {
+		return t, err
+	}
+
+	if _, ok := t.Next(); !ok {
+		if err := storages.Classify(storages.GetRedisClient().SRem(relaysKey, t.ID).Err()); err != nil {
+			return t, err
+		}
+	}
+	// The previous driver sends its location again once the reservation is released.
+	if _, err := storages.GetRedisClient().ReleaseDriver(prev); err != nil {
+		return t, err
+	}
+	if _, err := drivers.SetPeriod(prev, drivers.PeriodAvailable, drivers.PeriodEnRoute, drivers.PeriodOnTrip); err != nil {
+		return t, err
+	}
+	if _, err := drivers.SetPeriod(driverID, drivers.PeriodOnTrip, drivers.PeriodEnRoute); err != nil {
+		return t, err
+	}
+	return t, nil
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
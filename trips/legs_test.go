@@ -0,0 +1,25 @@
+package trips
+
+import "testing"
+
+func TestTripNext(t *testing.T) {
+	legs := []Leg{{State: LegCompleted}, {State: LegActive}, {State: LegPending}}
+
+	cases := []struct {
+		name string
+		trip Trip
+		next int
+		ok   bool
+	}{
+		{"without legs", Trip{}, 1, false},
+		{"first leg", Trip{Legs: legs}, 1, true},
+		{"middle leg", Trip{Legs: legs, CurrentLeg: 1}, 2, true},
+		{"last leg", Trip{Legs: legs, CurrentLeg: 2}, 3, false},
+	}
+	for _, c := range cases {
+		next, ok := c.trip.Next()
+		if ok != c.ok || (ok && next != c.next) {
+			t.Errorf("%s: expected %d %t, got %d %t", c.name, c.next, c.ok, next, ok)
+		}
+	}
+}
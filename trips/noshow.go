@@ -0,0 +1,104 @@
+package trips
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/douglasmakey/tracking/drivers"
+	"github.com/douglasmakey/tracking/storages"
+)
+
+var (
+	// ErrNoShow is returned when the trip is changed after the riders did not show up.
+	ErrNoShow = errors.New("trip ended with a no-show")
+	// ErrNotArrived is returned when a no-show is marked before the driver arrived at the pickup.
+	ErrNotArrived = errors.New("driver has not arrived")
+	// ErrTooEarly is returned when a no-show is marked before the no-show wait elapsed.
+	ErrTooEarly = errors.New("no-show wait has not elapsed")
+)
+
+// These are the changes of a trip when the riders do not show up, the fee is published for each rider of the trip.
+const (
+	StateDriverArrived = "driver_arrived"
+	StateNoShow        = "no_show"
+	StateNoShowFee     = "no_show_fee"
+)
+
+// Arrive records that the driver arrived at the pickup, the no-show wait starts now.
+func Arrive(id string, now time.Time) (*Trip, error) {
+	t, err := Get(id)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case t.NoShow:
+		return nil, ErrNoShow
+	case t.Completed():
+		return nil, ErrCompleted
+	case t.DriverID == "":
+		return nil, ErrNoDriver
+	}
+
+	// The first arrival starts the wait, a repeated call does not extend it.
+	if t.Arrived != nil {
+		return t, nil
+	}
+	at := now.UTC()
+	t.Arrived = &at
+	if err := save(t); err != nil {
+		return nil, err
+	}
+	publish(t, StateDriverArrived, map[string]string{"driver_id": t.DriverID})
+	return t, nil
+}
+
+// canMarkNoShow returns why the no-show of the trip can not be marked at now, nil if it can.
+func canMarkNoShow(t *Trip, now time.Time, wait time.Duration) error {
+	switch {
+	case t.NoShow:
+		return ErrNoShow
+	case t.Completed():
+		return ErrCompleted
+	case t.DriverID == "":
+		return ErrNoDriver
+	case t.Arrived == nil:
+		return ErrNotArrived
+	case now.Before(t.Arrived.Add(wait)):
+		return ErrTooEarly
+	}
+	return nil
+}
+
+// MarkNoShow ends the trip whose riders did not board wait after the arrival of the driver, the fee is charged to each rider
+// and the driver returns to the available pool.
+func MarkNoShow(id string, now time.Time, wait time.Duration, fee float64) (*Trip, error) {
+	t, err := Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := canMarkNoShow(t, now, wait); err != nil {
+		return nil, err
+	}
+
+	t.NoShow = true
+	if err := save(t); err != nil {
+		return nil, err
+	}
+	if err := endRoute(t); err != nil {
+		return nil, err
+	}
+	publish(t, StateNoShow, map[string]string{"driver_id": t.DriverID})
+	for _, r := range t.Riders {
+		publish(t, StateNoShowFee, map[string]string{"rider_id": r.ID, "amount": strconv.FormatFloat(fee, 'f', 2, 64)})
+	}
+
+	// The driver sends its location again once the reservation is released.
+	if _, err := storages.GetRedisClient().ReleaseDriver(t.DriverID); err != nil {
+		return t, err
+	}
+	if _, err := drivers.SetPeriod(t.DriverID, drivers.PeriodAvailable, drivers.PeriodEnRoute, drivers.PeriodOnTrip); err != nil {
+		return t, err
+	}
+	return t, nil
+}
@@ -0,0 +1,30 @@
+package trips
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCanMarkNoShow(t *testing.T) {
+	arrived := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	wait := time.Minute * 5
+
+	cases := []struct {
+		name string
+		trip Trip
+		now  time.Time
+		err  error
+	}{
+		{"not arrived", Trip{DriverID: "d"}, arrived, ErrNotArrived},
+		{"too early", Trip{DriverID: "d", Arrived: &arrived}, arrived.Add(time.Minute), ErrTooEarly},
+		{"after the wait", Trip{DriverID: "d", Arrived: &arrived}, arrived.Add(wait), nil},
+		{"no driver", Trip{Arrived: &arrived}, arrived.Add(wait), ErrNoDriver},
+		{"completed", Trip{DriverID: "d", Arrived: &arrived, Receipts: []Receipt{}}, arrived.Add(wait), ErrCompleted},
+		{"already marked", Trip{DriverID: "d", Arrived: &arrived, NoShow: true}, arrived.Add(wait), ErrNoShow},
+	}
+	for _, c := range cases {
+		if err := canMarkNoShow(&c.trip, c.now, wait); err != c.err {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package trips
+
+import (
+	"math"
+
+	"github.com/douglasmakey/tracking/geo"
+)
+
+// Router returns the travel distance in km between two points, the default one is the straight line distance
+// but it can be replaced by a routing backend like OSRM.
+type Router interface {
+	Distance(a, b geo.Point) float64
+}
+
+// Haversine is a Router that uses the great-circle distance.
+type Haversine struct{}
+
+// Distance returns the great-circle distance between a and b.
+func (Haversine) Distance(a, b geo.Point) float64 {
+	return geo.Distance(a, b)
+}
+
+// These are the kinds of stops of a plan.
+const (
+	StopPickup  = "pickup"
+	StopDropoff = "dropoff"
+)
+
+// Stop is a point where the driver picks up or drops off a rider.
+type Stop struct {
+	RiderID string    `json:"rider_id"`
+	Type    string    `json:"type"`
+	Point   geo.Point `json:"point"`
+}
+
+// Plan is the ordered list of stops of a trip, the segments are the on-board distances of the riders.
+type Plan struct {
+	Stops    []Stop    `json:"stops"`
+	Distance float64   `json:"distance_km"`
+	Segments []Segment `json:"segments"`
+}
+
+// Optimize orders the pickups and dropoffs of the riders with the nearest insertion heuristic:
+// each rider is inserted in the positions of the current plan that add the minimum detour, keeping the pickup before the dropoff.
+func Optimize(router Router, start geo.Point, riders []Rider) Plan {
+	var stops []Stop
+	for _, rider := range riders {
+		stops = insert(router, start, stops, rider)
+	}
+
+	return Plan{Stops: stops, Distance: length(router, start, stops), Segments: segments(router, start, stops)}
+}
+
+// stopRadius is the max distance in km between the driver and a stop to count the stop as visited.
+const stopRadius = 0.1
+
+// Replan inserts the rider in the pending stops of the plan, the stops after the first done ones, with the detour measured
+// from the current position of the driver. The visited stops are kept in their order.
+func Replan(router Router, start, current geo.Point, plan Plan, done int, rider Rider) Plan {
+	if done > len(plan.Stops) {
+		done = len(plan.Stops)
+	}
+	pending := insert(router, current, plan.Stops[done:], rider)
+	stops := make([]Stop, 0, done+len(pending))
+	stops = append(stops, plan.Stops[:done]...)
+	stops = append(stops, pending...)
+
+	return Plan{Stops: stops, Distance: length(router, start, stops), Segments: segments(router, start, stops)}
+}
+
+// visited returns the number of stops visited by the driver, a stop is visited when a point of the route, after the point
+// that visited the previous stop, is within stopRadius of it.
+func visited(stops []Stop, route []geo.Point) int {
+	done := 0
+	for _, p := range route {
+		for done < len(stops) && geo.Distance(p, stops[done].Point) <= stopRadius {
+			done++
+		}
+	}
+	return done
+}
+
+// insert returns the stops with the pickup and dropoff of the rider in the best positions.
+func insert(router Router, start geo.Point, stops []Stop, rider Rider) []Stop {
+	pickup := Stop{RiderID: rider.ID, Type: StopPickup, Point: rider.Pickup}
+	dropoff := Stop{RiderID: rider.ID, Type: StopDropoff, Point: rider.Dropoff}
+
+	var best []Stop
+	bestLen := math.Inf(1)
+	for i := 0; i <= len(stops); i++ {
+		for j := i; j <= len(stops); j++ {
+			candidate := make([]Stop, 0, len(stops)+2)
+			candidate = append(candidate, stops[:i]...)
+			candidate = append(candidate, pickup)
+			candidate = append(candidate, stops[i:j]...)
+			candidate = append(candidate, dropoff)
+			candidate = append(candidate, stops[j:]...)
+
+			if l := length(router, start, candidate); l < bestLen {
+				best, bestLen = candidate, l
+			}
+		}
+	}
+
+	return best
+}
+
+// length returns the total distance to visit the stops in order from start.
+func length(router Router, start geo.Point, stops []Stop) float64 {
+	var total float64
+	prev := start
+	for _, s := range stops {
+		total += router.Distance(prev, s.Point)
+		prev = s.Point
+	}
+	return total
+}
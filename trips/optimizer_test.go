@@ -0,0 +1,62 @@
+package trips
+
+import (
+	"testing"
+
+	"github.com/douglasmakey/tracking/geo"
+)
+
+func TestOptimize(t *testing.T) {
+	start := geo.Point{Lat: -33.40, Lng: -70.60}
+	riders := []Rider{
+		{ID: "far", Pickup: geo.Point{Lat: -33.42, Lng: -70.60}, Dropoff: geo.Point{Lat: -33.50, Lng: -70.60}},
+		{ID: "near", Pickup: geo.Point{Lat: -33.41, Lng: -70.60}, Dropoff: geo.Point{Lat: -33.45, Lng: -70.60}},
+	}
+
+	plan := Optimize(Haversine{}, start, riders)
+	if len(plan.Stops) != 4 {
+		t.Fatalf("expected 4 stops, got %d", len(plan.Stops))
+	}
+
+	// All the stops are on the same line, so the best plan visits them from north to south.
+	expected := []string{"near", "far", "near", "far"}
+	for i, s := range plan.Stops {
+		if s.RiderID != expected[i] {
+			t.Errorf("unexpected rider %s at stop %d", s.RiderID, i)
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, s := range plan.Stops {
+		if s.Type == StopDropoff && !seen[s.RiderID] {
+			t.Errorf("dropoff of %s before its pickup", s.RiderID)
+		}
+		seen[s.RiderID] = true
+	}
+}
+
+func TestReplan(t *testing.T) {
+	start := geo.Point{Lat: -33.40, Lng: -70.60}
+	riders := []Rider{{ID: "first", Pickup: geo.Point{Lat: -33.41, Lng: -70.60}, Dropoff: geo.Point{Lat: -33.50, Lng: -70.60}}}
+	plan := Optimize(Haversine{}, start, riders)
+
+	// The driver picked up the first rider and is driving south, the new rider is behind the driver.
+	route := []geo.Point{start, riders[0].Pickup, {Lat: -33.44, Lng: -70.60}}
+	done := visited(plan.Stops, route)
+	if done != 1 {
+		t.Fatalf("expected 1 visited stop, got %d", done)
+	}
+
+	rider := Rider{ID: "second", Pickup: geo.Point{Lat: -33.42, Lng: -70.60}, Dropoff: geo.Point{Lat: -33.46, Lng: -70.60}}
+	plan = Replan(Haversine{}, start, route[len(route)-1], plan, done, rider)
+
+	expected := []string{"first:pickup", "second:pickup", "second:dropoff", "first:dropoff"}
+	if len(plan.Stops) != len(expected) {
+		t.Fatalf("expected %d stops, got %d", len(expected), len(plan.Stops))
+	}
+	for i, s := range plan.Stops {
+		if got := s.RiderID + ":" + s.Type; got != expected[i] {
+			t.Errorf("expected %s at stop %d, got %s", expected[i], i, got)
+		}
+	}
+}
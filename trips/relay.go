@@ -0,0 +1,135 @@
+package trips
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/douglasmakey/tracking/config"
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/geofence"
+	"github.com/douglasmakey/tracking/history"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/maintenance"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/douglasmakey/tracking/tasks"
+)
+
+// relayLockKey lets only one instance follow the relays on each tick.
+const relayLockKey = "trips:relays:lock"
+
+// Relay searches the driver of the next leg of the trips with legs every Interval. The search starts when the driver of the
+// current leg is within Lead km of its handoff zone, so the next driver arrives to the zone about the same time.
+type Relay struct {
+	Interval time.Duration
+	Lead     float64
+}
+
+// Start launches the relay in a goroutine.
+func (rl Relay) Start() {
+	go func() {
+		ticker := time.NewTicker(rl.Interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if maintenance.Paused() {
+				continue
+			}
+			rl.run()
+		}
+	}()
+}
+
+func (rl Relay) run() {
+	rClient := storages.GetRedisClient()
+	// Every instance runs the relay, only the first one of each tick follows the trips.
+	ok, err := rClient.SetNX(relayLockKey, 1, rl.Interval/2).Result()
+	if err != nil || !ok {
+		return
+	}
+
+	ids, err := Relays()
+	if err != nil {
+		logging.Logger.Error("could not get relays", "error", err)
+		return
+	}
+	for _, id := range ids {
+		if err := rl.follow(id); err != nil {
+			logging.Logger.Warn("could not follow relay", "trip_id", id, "error", err)
+		}
+	}
+}
+
+// follow moves the next leg of the trip: it is searched when the current driver nears the handoff zone
+// and matched when its search finds a driver, a search that finishes without a driver is started again.
+func (rl Relay) follow(id string) error {
+	t, err := Get(id)
+	if err == ErrNotFound {
+		return storages.Classify(storages.GetRedisClient().SRem(relaysKey, id).Err())
+	}
+	if err != nil {
+		return err
+	}
+	next, ok := t.Next()
+	if !ok || t.Completed() || t.NoShow {
+		return storages.Classify(storages.GetRedisClient().SRem(relaysKey, id).Err())
+	}
+
+	leg := t.Legs[next]
+	switch leg.State {
+	case LegPending:
+		zone, err := geofence.Get(t.Legs[t.CurrentLeg].Handoff)
+		if err != nil {
+			return err
+		}
+		center, _ := zone.Center()
+		p, ok, err := history.Last(t.DriverID)
+		if err != nil || !ok {
+			return err
+		}
+		if geo.Distance(geo.Point{Lat: p.Lat, Lng: p.Lng}, center) > rl.Lead {
+			return nil
+		}
+		requestID, err := searchLeg(t, center)
+		if err != nil {
+			return err
+		}
+		_, err = SearchLeg(t.ID, next, requestID)
+		return err
+	case LegSearching:
+		s, err := tasks.GetStatus(leg.RequestID)
+		if err != nil && err != tasks.ErrStatusNotFound {
+			return err
+		}
+		switch s.State {
+		case tasks.StateSearching:
+			return nil
+		case tasks.StateMatched:
+			_, err = MatchLeg(t.ID, next, s.DriverID)
+		default:
+			_, err = RetryLeg(t.ID, next)
+		}
+		return err
+	}
+	return nil
+}
+
+// searchLeg creates the request of the driver of the next leg picked up at the handoff point, like the requests of the riders.
+func searchLeg(t *Trip, handoff geo.Point) (string, error) {
+	rClient := storages.GetRedisClient()
+	n, err := rClient.Incr("request_id").Result()
+	if err != nil {
+		return "", storages.Classify(err)
+	}
+	requestID := strconv.FormatInt(n, 10)
+	if err := rClient.Set(requestID, true, config.Get().RequestTTL).Err(); err != nil {
+		return "", storages.Classify(err)
+	}
+
+	r := tasks.NewRequestDriverTask(requestID, fmt.Sprintf("trip_%s", t.ID), handoff.Lat, handoff.Lng)
+	r.Tenant = t.Tenant
+	if err := tasks.Enqueue(r); err != nil {
+		return "", err
+	}
+	return requestID, nil
+}
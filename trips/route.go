@@ -0,0 +1,162 @@
+package trips
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/douglasmakey/tracking/config"
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/history"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// maxRoutePoints is the approximate number of points kept in the route of a trip, older points are trimmed by Redis.
+const maxRoutePoints = 20000
+
+// driverTripKey is the active trip of the driver, its locations are appended to the route of the trip.
+func driverTripKey(driverID string) string {
+	return fmt.Sprintf("trips:driver:%s", driverID)
+}
+
+// routeKey is the Redis Stream with the locations of the drivers of the trip while it was active.
+func routeKey(id string) string {
+	return fmt.Sprintf("trip:%s:route", id)
+}
+
+// startRoute makes the trip the active trip of the driver, the locations of the driver are recorded in its route.
+func startRoute(t *Trip, driverID string) error {
+	rClient := storages.GetRedisClient()
+	return storages.Classify(rClient.Set(driverTripKey(driverID), t.ID, 0).Err())
+}
+
+// stopRoute stops recording the locations of the driver in the route of its trip.
+func stopRoute(driverID string) error {
+	rClient := storages.GetRedisClient()
+	return storages.Classify(rClient.Del(driverTripKey(driverID)).Err())
+}
+
+// endRoute stops recording the route of the finished trip, the route is kept for the receipts and the disputes.
+func endRoute(t *Trip) error {
+	if t.DriverID == "" {
+		return nil
+	}
+	rClient := storages.GetRedisClient()
+	_, err := rClient.Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(driverTripKey(t.DriverID))
+		pipe.Expire(routeKey(t.ID), config.Get().TripRouteRetention)
+		return nil
+	})
+	return storages.Classify(err)
+}
+
+// RecordRoute appends the locations of the driver to the route of its active trip, nothing is recorded without an active trip.
+func RecordRoute(driverID string, points []history.Point) error {
+	rClient := storages.GetRedisClient()
+	id, err := rClient.Get(driverTripKey(driverID)).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return storages.Classify(err)
+	}
+
+	// The entries have the format of the history of the drivers, the timestamp of the device is kept when it was sent.
+	_, err = rClient.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, p := range points {
+			values := map[string]interface{}{"lat": p.Lat, "lng": p.Lng, "driver_id": driverID}
+			if !p.Timestamp.IsZero() {
+				values["ts"] = p.Timestamp.UnixNano() / int64(time.Millisecond)
+			}
+			pipe.XAdd(&redis.XAddArgs{Stream: routeKey(id), MaxLenApprox: maxRoutePoints, Values: values})
+		}
+		return nil
+	})
+	return storages.Classify(err)
+}
+
+// arrivalPoint returns the position of the driver when it arrived at the pickup, the last point of the route recorded before
+// the arrival. It returns false if the arrival or the point was not recorded.
+func arrivalPoint(t *Trip) (geo.Point, bool, error) {
+	if t.Arrived == nil {
+		return geo.Point{}, false, nil
+	}
+	rClient := storages.GetRedisClient()
+	end := strconv.FormatInt(t.Arrived.UnixNano()/int64(time.Millisecond), 10)
+	var msgs []redis.XMessage
+	err := storages.WithRetry(func() (err error) {
+		msgs, err = rClient.XRevRangeN(routeKey(t.ID), end, "-", 1).Result()
+		return err
+	})
+	if err != nil || len(msgs) == 0 {
+		return geo.Point{}, false, err
+	}
+	hp, err := history.ParsePoint(msgs[0])
+	if err != nil {
+		return geo.Point{}, false, nil
+	}
+	return geo.Point{Lat: hp.Lat, Lng: hp.Lng}, true, nil
+}
+
+// routePoints returns the points of the route recorded for the trip in order, it is empty if no location was recorded.
+func routePoints(id string) ([]geo.Point, error) {
+	rClient := storages.GetRedisClient()
+	var msgs []redis.XMessage
+	err := storages.WithRetry(func() (err error) {
+		msgs, err = rClient.XRange(routeKey(id), "-", "+").Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	points := make([]geo.Point, 0, len(msgs))
+	for _, msg := range msgs {
+		hp, err := history.ParsePoint(msg)
+		if err != nil {
+			continue
+		}
+		points = append(points, geo.Point{Lat: hp.Lat, Lng: hp.Lng})
+	}
+	return points, nil
+}
+
+// Route is the path driven during a trip, the points are encoded as a polyline and Timestamps has the time of each point.
+type Route struct {
+	TripID     string      `json:"trip_id"`
+	Polyline   string      `json:"polyline"`
+	Timestamps []time.Time `json:"timestamps"`
+	// Distance is the length of the path in km.
+	Distance float64 `json:"distance_km"`
+}
+
+// GetRoute returns the route recorded for the trip, it is empty if no location was recorded.
+func GetRoute(id string) (*Route, error) {
+	rClient := storages.GetRedisClient()
+	var msgs []redis.XMessage
+	err := storages.WithRetry(func() (err error) {
+		msgs, err = rClient.XRange(routeKey(id), "-", "+").Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	points := make([]geo.Point, 0, len(msgs))
+	r := &Route{TripID: id, Timestamps: make([]time.Time, 0, len(msgs))}
+	for _, msg := range msgs {
+		hp, err := history.ParsePoint(msg)
+		if err != nil {
+			continue
+		}
+		p := geo.Point{Lat: hp.Lat, Lng: hp.Lng}
+		if n := len(points); n > 0 {
+			r.Distance += geo.Distance(points[n-1], p)
+		}
+		points = append(points, p)
+		r.Timestamps = append(r.Timestamps, hp.Timestamp)
+	}
+	r.Polyline = geo.EncodePolyline(points)
+	return r, nil
+}
@@ -0,0 +1,301 @@
+package trips
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/douglasmakey/tracking/bus"
+	"github.com/douglasmakey/tracking/config"
+	"github.com/douglasmakey/tracking/drivers"
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/heat"
+	"github.com/douglasmakey/tracking/idcodec"
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/pickups"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/douglasmakey/tracking/workflow"
+	"github.com/go-redis/redis"
+)
+
+var (
+	// ErrNotFound is returned when the trip does not exist.
+	ErrNotFound = errors.New("trip not found")
+	// ErrCompleted is returned when the trip is changed after it was completed.
+	ErrCompleted = errors.New("trip already completed")
+	// ErrNotCompleted is returned when the receipts of a trip are requested before it was completed.
+	ErrNotCompleted = errors.New("trip not completed")
+	// ErrConflict is returned when the trip was changed by another request after it was read.
+	ErrConflict = errors.New("trip changed concurrently")
+)
+
+// updateAttempts is the number of times that a change of a trip is applied again when another request changed the trip first.
+const updateAttempts = 5
+
+// DefaultRouter is used to compute the plans, it can be replaced by a routing backend.
+var DefaultRouter Router = Haversine{}
+
+// These are the changes of a trip.
+const (
+	StateCreated    = "created"
+	StateRiderAdded = "rider_added"
+	StateCompleted  = "completed"
+	// StateRiderBilled is published for each rider of a completed trip with its share of the fare.
+	StateRiderBilled = "rider_billed"
+)
+
+// Rider is a passenger of a pooled trip.
+type Rider struct {
+	ID      string    `json:"id"`
+	Pickup  geo.Point `json:"pickup"`
+	Dropoff geo.Point `json:"dropoff"`
+}
+
+// Trip is a pooled ride, the plan is computed again each time a rider is added.
+type Trip struct {
+	ID     string    `json:"id"`
+	Start  geo.Point `json:"start"`
+	Riders []Rider   `json:"riders"`
+	Plan   Plan      `json:"plan"`
+	// DriverID is the driver of the trip, the riders leave their feedback and tips about it.
+	DriverID string `json:"driver_id,omitempty"`
+	// VehicleID is the vehicle that the driver was driving when the trip was created.
+	VehicleID string `json:"vehicle_id,omitempty"`
+	// Tenant is the enterprise of the trip, its workflow engine receives the changes of the trip.
+	Tenant string `json:"tenant,omitempty"`
+	// Fare is the total fare of the trip and Receipts the share of each rider, they are set when the trip is completed.
+	Fare     float64   `json:"fare,omitempty"`
+	Receipts []Receipt `json:"receipts,omitempty"`
+	// Arrived is the time when the driver arrived at the pickup, NoShow is true when the riders did not board after the wait.
+	Arrived *time.Time `json:"arrived_at,omitempty"`
+	NoShow  bool       `json:"no_show,omitempty"`
+	// Legs are the legs of a trip driven by several drivers in relay, CurrentLeg is the one being driven. A trip without legs has one driver.
+	Legs       []Leg `json:"legs,omitempty"`
+	CurrentLeg int   `json:"current_leg,omitempty"`
+	// Version is increased by each save, a trip is only saved if nobody saved it since it was read.
+	Version int64 `json:"version,omitempty"`
+}
+
+// Completed returns whether the fare of the trip was already split between the riders.
+func (t *Trip) Completed() bool {
+	return t.Receipts != nil
+}
+
+func tripKey(id string) string {
+	return fmt.Sprintf("trip:%s", id)
+}
+
+// Create saves a new trip of the driver that starts at start and returns it.
+func Create(start geo.Point, driverID, tenant string) (*Trip, error) {
+	rClient := storages.GetRedisClient()
+	id, err := rClient.Incr("trip_id").Result()
+	if err != nil {
+		return nil, storages.Classify(err)
+	}
+
+	t := &Trip{ID: strconv.FormatInt(id, 10), Start: start, Riders: []Rider{}, DriverID: driverID, Tenant: tenant}
+	if driverID != "" {
+		if t.VehicleID, err = drivers.ActiveVehicle(driverID); err != nil {
+			return nil, err
+		}
+	}
+	if err := save(t); err != nil {
+		return nil, err
+	}
+	if driverID != "" {
+		if err := startRoute(t, driverID); err != nil {
+			return nil, err
+		}
+	}
+	var data map[string]string
+	if t.VehicleID != "" {
+		data = map[string]string{"vehicle_id": t.VehicleID}
+	}
+	publish(t, StateCreated, data)
+	return t, nil
+}
+
+// Get returns the trip with the id.
+func Get(id string) (*Trip, error) {
+	rClient := storages.GetRedisClient()
+	var data []byte
+	err := storages.WithRetry(func() (err error) {
+		data, err = rClient.Get(tripKey(id)).Bytes()
+		return err
+	})
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var t Trip
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// AddRider adds the rider to the trip and updates the plan, the rider is inserted in the stops that the driver has not visited yet
+// from the last recorded position of the driver.
+func AddRider(id string, rider Rider) (*Trip, error) {
+	route, err := routePoints(id)
+	if err != nil {
+		return nil, err
+	}
+	t, err := update(id, func(t *Trip) error {
+		if t.NoShow {
+			return ErrNoShow
+		}
+		if t.Completed() {
+			return ErrCompleted
+		}
+		current := t.Start
+		if n := len(route); n > 0 {
+			current = route[n-1]
+		}
+		t.Riders = append(t.Riders, rider)
+		t.Plan = Replan(DefaultRouter, t.Start, current, t.Plan, visited(t.Plan.Stops, route), rider)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	publish(t, StateRiderAdded, map[string]string{"rider_id": rider.ID})
+	// The heat export is best effort, the rider is already added.
+	for kind, p := range map[string]geo.Point{heat.KindStart: rider.Pickup, heat.KindEnd: rider.Dropoff} {
+		if err := heat.Record(kind, p); err != nil {
+			logging.Logger.Warn("could not record trip for the heat export", "trip_id", t.ID, "error", err)
+		}
+	}
+	return t, nil
+}
+
+// Complete splits the fare between the riders of the trip by their on-board distance and publishes a billing event for each rider.
+// Only the request that saves the completion bills the riders, the others get ErrCompleted.
+func Complete(id string, fare float64) (*Trip, error) {
+	t, err := update(id, func(t *Trip) error {
+		if t.NoShow {
+			return ErrNoShow
+		}
+		if t.Completed() {
+			return ErrCompleted
+		}
+		t.Fare = fare
+		t.Receipts = Shares(t.Plan.Segments, fare)
+		if t.Receipts == nil {
+			t.Receipts = []Receipt{}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(t.Legs) > 0 {
+		if err := storages.Classify(storages.GetRedisClient().SRem(relaysKey, t.ID).Err()); err != nil {
+			return nil, err
+		}
+	}
+	if err := endRoute(t); err != nil {
+		return nil, err
+	}
+	// The pickup points are learned from where the drivers arrived, it is best effort, the trip is already completed.
+	p, arrived, err := arrivalPoint(t)
+	if err == nil && arrived {
+		err = pickups.Record(p)
+	}
+	if err != nil {
+		logging.Logger.Warn("could not learn pickup point", "trip_id", t.ID, "error", err)
+	}
+	publish(t, StateCompleted, map[string]string{"fare": strconv.FormatFloat(fare, 'f', 2, 64)})
+	for _, rc := range t.Receipts {
+		publish(t, StateRiderBilled, map[string]string{
+			"rider_id":    rc.RiderID,
+			"amount":      strconv.FormatFloat(rc.Amount, 'f', 2, 64),
+			"distance_km": strconv.FormatFloat(rc.Distance, 'f', 3, 64),
+		})
+	}
+	return t, nil
+}
+
+// publish sends the change of the trip to the workflow engine of its tenant and the bus.
+func publish(t *Trip, state string, data map[string]string) {
+	id := idcodec.Encode(idcodec.KindTrip, t.ID)
+	workflow.Publish(workflow.Event{
+		Tenant: t.Tenant,
+		Entity: workflow.EntityTrip,
+		ID:     id,
+		State:  state,
+		Data:   data,
+	})
+
+	ev := bus.Event{Type: bus.TripEvent(state), Key: id, Tenant: t.Tenant, Data: map[string]string{"trip_id": id}}
+	for k, v := range data {
+		ev.Data[k] = v
+	}
+	bus.Emit(ev)
+}
+
+// saveScript saves the trip ARGV[2] in KEYS[1] for ARGV[3] milliseconds if the saved trip still has the version ARGV[1], a missing trip has the version 0.
+// It returns 0 if another request saved the trip first.
+var saveScript = redis.NewScript(`
+local data = redis.call("GET", KEYS[1])
+local version = 0
+if data then
+	version = cjson.decode(data).version or 0
+end
+if version ~= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+return 1
+`)
+
+// save saves the trip with the next version and keeps it TripRetention after its last change, it returns ErrConflict if the trip was saved by another request since it was read.
+func save(t *Trip) error {
+	read := t.Version
+	t.Version++
+	data, err := json.Marshal(t)
+	if err != nil {
+		t.Version = read
+		return err
+	}
+
+	rClient := storages.GetRedisClient()
+	saved, err := saveScript.Run(rClient, []string{tripKey(t.ID)}, read, data, config.Get().TripRetention.Nanoseconds()/int64(time.Millisecond)).Int64()
+	if err != nil {
+		t.Version = read
+		return storages.Classify(err)
+	}
+	if saved == 0 {
+		t.Version = read
+		return ErrConflict
+	}
+	return nil
+}
+
+// update applies the change to the trip and saves it, the change is applied again to the new trip when another request saved it first.
+// The error of the change is returned without saving.
+func update(id string, change func(t *Trip) error) (*Trip, error) {
+	for i := 0; i < updateAttempts; i++ {
+		t, err := Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if err := change(t); err != nil {
+			return nil, err
+		}
+		err = save(t)
+		if err == ErrConflict {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+	return nil, ErrConflict
+}
@@ -0,0 +1,115 @@
+// Package validation checks the input of the handlers and describes the invalid fields to the clients.
+package validation
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/douglasmakey/tracking/geo"
+	"github.com/douglasmakey/tracking/httputil"
+)
+
+// FieldError is an invalid field of the request, Field is the JSON name of the field, e.g. lat or riders[2].pickup.lng.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Errors are all the invalid fields of a request.
+type Errors []FieldError
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, f := range e {
+		msgs[i] = f.Field + ": " + f.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Validator collects the invalid fields, the zero value is ready to use.
+type Validator struct {
+	errs Errors
+}
+
+// Add adds an invalid field.
+func (v *Validator) Add(field, message string) {
+	v.errs = append(v.errs, FieldError{Field: field, Message: message})
+}
+
+// Check adds the invalid field when ok is false.
+func (v *Validator) Check(ok bool, field, message string) {
+	if !ok {
+		v.Add(field, message)
+	}
+}
+
+// Required checks that the value is not empty.
+func (v *Validator) Required(field, value string) {
+	v.Check(strings.TrimSpace(value) != "", field, "is required")
+}
+
+// Latitude checks that lat is in [-90, 90].
+func (v *Validator) Latitude(field string, lat float64) {
+	v.Check(lat >= -90 && lat <= 90, field, fmt.Sprintf("must be between -90 and 90, got %g", lat))
+}
+
+// Longitude checks that lng is in [-180, 180].
+func (v *Validator) Longitude(field string, lng float64) {
+	v.Check(lng >= -180 && lng <= 180, field, fmt.Sprintf("must be between -180 and 180, got %g", lng))
+}
+
+// Point checks the coordinates of p, the fields are prefix + lat and prefix + lng.
+func (v *Validator) Point(prefix string, p geo.Point) {
+	v.Latitude(prefix+"lat", p.Lat)
+	v.Longitude(prefix+"lng", p.Lng)
+}
+
+// Positive checks that n is greater than zero.
+func (v *Validator) Positive(field string, n float64) {
+	v.Check(n > 0, field, "must be positive")
+}
+
+// NotNegative checks that n is zero or greater.
+func (v *Validator) NotNegative(field string, n float64) {
+	v.Check(n >= 0, field, "must not be negative")
+}
+
+// Between checks that n is in [min, max].
+func (v *Validator) Between(field string, n, min, max float64) {
+	v.Check(n >= min && n <= max, field, fmt.Sprintf("must be between %g and %g", min, max))
+}
+
+// Merge adds the invalid fields of err with the prefix, e.g. the fields of an item of a list.
+// The errors that are not Errors are added with the prefix as field.
+func (v *Validator) Merge(prefix string, err error) {
+	if err == nil {
+		return
+	}
+	errs, ok := err.(Errors)
+	if !ok {
+		v.Add(strings.TrimSuffix(prefix, "."), err.Error())
+		return
+	}
+	for _, f := range errs {
+		v.Add(prefix+f.Field, f.Message)
+	}
+}
+
+// Err returns the invalid fields, nil if all of them are valid.
+func (v *Validator) Err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+// Write replies 400 with the invalid fields,
+// e.g. {"error": {"code": "validation_failed", "message": "...", "fields": [{"field": "lat", "message": "..."}]}}.
+func Write(w http.ResponseWriter, err error) {
+	errs, ok := err.(Errors)
+	if !ok {
+		errs = Errors{{Message: err.Error()}}
+	}
+	httputil.Write(w, httputil.Error{Code: httputil.CodeValidationFailed, Message: errs.Error(), Fields: errs})
+}
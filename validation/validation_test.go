@@ -0,0 +1,63 @@
+package validation
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/douglasmakey/tracking/geo"
+)
+
+func TestValidator(t *testing.T) {
+	var v Validator
+	v.Required("id", " ")
+	v.Point("", geo.Point{Lat: 91, Lng: -70})
+	v.Positive("limit", 0)
+	v.Between("rating", 3, 1, 5)
+
+	var item Validator
+	item.Longitude("lng", 181)
+	v.Merge("riders[1].", item.Err())
+
+	errs, ok := v.Err().(Errors)
+	if !ok {
+		t.Fatalf("expected Errors, got %v", v.Err())
+	}
+	want := []string{"id", "lat", "limit", "riders[1].lng"}
+	if len(errs) != len(want) {
+		t.Fatalf("expected %d errors, got %v", len(want), errs)
+	}
+	for i, f := range want {
+		if errs[i].Field != f {
+			t.Errorf("expected field %s, got %s", f, errs[i].Field)
+		}
+	}
+
+	var valid Validator
+	valid.Point("", geo.Point{Lat: -33.4, Lng: -70.6})
+	if err := valid.Err(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	rec := httptest.NewRecorder()
+	Write(rec, Errors{{Field: "lat", Message: "must be between -90 and 90"}})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rec.Code)
+	}
+
+	var body struct {
+		Error struct {
+			Code   string       `json:"code"`
+			Fields []FieldError `json:"fields"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error.Code != "validation_failed" || len(body.Error.Fields) != 1 || body.Error.Fields[0].Field != "lat" {
+		t.Errorf("unexpected error %+v", body.Error)
+	}
+}
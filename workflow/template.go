@@ -0,0 +1,89 @@
+package workflow
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// jsonType is the content type of the events, the templates that render it must produce valid JSON.
+const jsonType = "application/json"
+
+// ErrInvalidJSON is returned when a template with the JSON content type does not render valid JSON.
+var ErrInvalidJSON = errors.New("template does not render valid JSON")
+
+// funcs are the functions of the templates besides the builtins, e.g. {{json .Data.driver_id}} or {{unix .Occurred}}.
+var funcs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"upper":   strings.ToUpper,
+	"lower":   strings.ToLower,
+	"unix":    func(t time.Time) int64 { return t.Unix() },
+	"rfc3339": func(t time.Time) string { return t.UTC().Format(time.RFC3339) },
+}
+
+// SampleEvent is the event used to validate and preview the templates of the tenant.
+func SampleEvent(tenant string) Event {
+	return Event{
+		Tenant:   tenant,
+		Entity:   EntityRequest,
+		ID:       "req_sample",
+		State:    "matched",
+		Data:     map[string]string{"driver_id": "drv_sample"},
+		Occurred: time.Now().UTC().Truncate(time.Second),
+	}
+}
+
+// BodyType returns the content type of the body of the events of the engine.
+func (e Engine) BodyType() string {
+	if e.ContentType == "" {
+		return jsonType
+	}
+	return e.ContentType
+}
+
+// Render returns the body of the event for the engine, the event as JSON unless the engine has a template.
+func (e Engine) Render(ev Event) ([]byte, error) {
+	if e.Template == "" {
+		return json.Marshal(ev)
+	}
+	t, err := template.New("payload").Funcs(funcs).Option("missingkey=zero").Parse(e.Template)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, ev); err != nil {
+		return nil, fmt.Errorf("invalid template: %w", err)
+	}
+	if e.BodyType() == jsonType && !json.Valid(buf.Bytes()) {
+		return nil, ErrInvalidJSON
+	}
+	return buf.Bytes(), nil
+}
+
+// validateTemplate checks that the template of the engine renders the sample event.
+func (e Engine) validateTemplate(tenant string) error {
+	if e.Template == "" {
+		if e.ContentType != "" {
+			return errors.New("content type requires a template")
+		}
+		return nil
+	}
+	if e.Kind != EngineHTTP {
+		return fmt.Errorf("templates are only supported by the %s engine", EngineHTTP)
+	}
+	_, err := e.Render(SampleEvent(tenant))
+	return err
+}
+
+// Test delivers the event to the engine once, without retries, so the tenant can check that its system accepts the payload.
+func Test(ctx context.Context, e Engine, ev Event) error {
+	return send(ctx, e, ev)
+}
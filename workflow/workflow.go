@@ -0,0 +1,217 @@
+// Package workflow posts the state transitions of the requests and the trips to the workflow engines of the tenants,
+// so the enterprises can orchestrate their own processes after the match.
+package workflow
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/douglasmakey/tracking/logging"
+	"github.com/douglasmakey/tracking/retry"
+	"github.com/douglasmakey/tracking/storages"
+	"github.com/go-redis/redis"
+)
+
+// These are the kinds of engines.
+const (
+	// EngineHTTP posts the event as JSON to the URL.
+	EngineHTTP = "http"
+	// EngineTemporal signals the workflow of the entity through the HTTP API of Temporal,
+	// the workflow ID is "<entity>-<id>", e.g. request-42.
+	EngineTemporal = "temporal"
+)
+
+// These are the entities with states.
+const (
+	EntityRequest = "request"
+	EntityTrip    = "trip"
+)
+
+// ErrNotConfigured is returned when the tenant does not have a workflow engine.
+var ErrNotConfigured = errors.New("workflow engine not configured")
+
+// Event is a state transition of a request or a trip.
+type Event struct {
+	Tenant   string            `json:"tenant"`
+	Entity   string            `json:"entity"`
+	ID       string            `json:"id"`
+	State    string            `json:"state"`
+	Data     map[string]string `json:"data,omitempty"`
+	Occurred time.Time         `json:"occurred_at"`
+}
+
+// Engine is the workflow engine of a tenant.
+type Engine struct {
+	Kind string `json:"kind"`
+	URL  string `json:"url"`
+	// Namespace and Signal are used by Temporal.
+	Namespace string `json:"namespace,omitempty"`
+	Signal    string `json:"signal,omitempty"`
+	// Template is a Go template over the Event that renders the body of the http engine, e.g. for the legacy systems of a fleet,
+	// and ContentType the content type of the body, JSON by default. Without template the event is posted as JSON.
+	Template    string `json:"template,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// engineKey keeps the engine of the tenant as JSON.
+func engineKey(tenant string) string {
+	return fmt.Sprintf("tenant:%s:workflow", tenant)
+}
+
+// SetEngine saves the engine of the tenant.
+func SetEngine(tenant string, e Engine) error {
+	switch e.Kind {
+	case EngineHTTP:
+	case EngineTemporal:
+		if e.Namespace == "" {
+			e.Namespace = "default"
+		}
+		if e.Signal == "" {
+			e.Signal = "state_changed"
+		}
+	default:
+		return fmt.Errorf("unknown workflow engine %q", e.Kind)
+	}
+	if _, err := url.ParseRequestURI(e.URL); err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if err := e.validateTemplate(tenant); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	rClient := storages.GetRedisClient()
+	return storages.Classify(rClient.Set(engineKey(tenant), data, 0).Err())
+}
+
+// GetEngine returns the engine of the tenant.
+func GetEngine(tenant string) (Engine, error) {
+	rClient := storages.GetRedisClient()
+	var data []byte
+	err := storages.WithRetry(func() (err error) {
+		data, err = rClient.Get(engineKey(tenant)).Bytes()
+		return err
+	})
+	if err == redis.Nil {
+		return Engine{}, ErrNotConfigured
+	}
+	if err != nil {
+		return Engine{}, err
+	}
+
+	var e Engine
+	err = json.Unmarshal(data, &e)
+	return e, err
+}
+
+// request returns the HTTP request that delivers the event to the engine.
+func (e Engine) request(ctx context.Context, ev Event) (*http.Request, error) {
+	var target string
+	var data []byte
+	var err error
+	switch e.Kind {
+	case EngineTemporal:
+		workflowID := fmt.Sprintf("%s-%s", ev.Entity, ev.ID)
+		target = fmt.Sprintf("%s/api/v1/namespaces/%s/workflows/%s/signal/%s",
+			e.URL, url.PathEscape(e.Namespace), url.PathEscape(workflowID), url.PathEscape(e.Signal))
+		data, err = json.Marshal(map[string]interface{}{"input": []Event{ev}})
+	default:
+		target = e.URL
+		data, err = e.Render(ev)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", e.BodyType())
+	return req, nil
+}
+
+const (
+	// queueSize is the number of events waiting to be delivered, the events are dropped when it is full.
+	queueSize = 1000
+)
+
+var (
+	events = make(chan Event, queueSize)
+	client = &http.Client{Timeout: time.Second * 5}
+)
+
+// Publish queues the event for the engine of its tenant, the events without tenant are ignored.
+// It does not block, the delivery is done by the dispatcher started with Start.
+func Publish(ev Event) {
+	if ev.Tenant == "" {
+		return
+	}
+	if ev.Occurred.IsZero() {
+		ev.Occurred = time.Now().UTC()
+	}
+
+	select {
+	case events <- ev:
+	default:
+		logging.Logger.Warn("workflow queue is full, event dropped", "tenant", ev.Tenant, "entity", ev.Entity, "id", ev.ID, "state", ev.State)
+	}
+}
+
+// Start launches the dispatcher that delivers the events in order.
+func Start() {
+	go func() {
+		for ev := range events {
+			if err := deliver(context.Background(), ev); err != nil {
+				logging.Logger.Error("could not deliver workflow event", "tenant", ev.Tenant, "entity", ev.Entity, "id", ev.ID, "state", ev.State, "error", err)
+			}
+		}
+	}()
+}
+
+// deliver sends the event to the engine of the tenant, it is retried with the workflow policy.
+func deliver(ctx context.Context, ev Event) error {
+	e, err := GetEngine(ev.Tenant)
+	if err == ErrNotConfigured {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return retry.For(retry.Workflow).Do(ctx, retry.Workflow, func() error {
+		return send(ctx, e, ev)
+	})
+}
+
+func send(ctx context.Context, e Engine, ev Event) error {
+	req, err := e.request(ctx, ev)
+	if err != nil {
+		// The template fails the same way on every attempt.
+		return retry.Permanent(err)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		err := fmt.Errorf("workflow engine returned %s", res.Status)
+		// The engine rejected the event, sending it again does not help.
+		if res.StatusCode >= 400 && res.StatusCode < 500 && res.StatusCode != http.StatusTooManyRequests {
+			return retry.Permanent(err)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package workflow
+
+import (
+	"context"
+	"testing"
+)
+
+func TestEngineRequest(t *testing.T) {
+	ev := Event{Tenant: "acme", Entity: EntityRequest, ID: "42", State: "matched"}
+
+	e := Engine{Kind: EngineTemporal, URL: "http://temporal:7243", Namespace: "default", Signal: "state_changed"}
+	req, err := e.request(context.Background(), ev)
+	if err != nil {
+		t.Fatalf("could not create request: %v", err)
+	}
+	if want := "http://temporal:7243/api/v1/namespaces/default/workflows/request-42/signal/state_changed"; req.URL.String() != want {
+		t.Errorf("unexpected url %s, want %s", req.URL, want)
+	}
+
+	e = Engine{Kind: EngineHTTP, URL: "http://example.com/hooks"}
+	if req, err = e.request(context.Background(), ev); err != nil || req.URL.String() != e.URL {
+		t.Errorf("unexpected request %v %v", req, err)
+	}
+}
+
+func TestEngineRender(t *testing.T) {
+	ev := Event{Tenant: "acme", Entity: EntityRequest, ID: "42", State: "matched", Data: map[string]string{"driver_id": "7"}}
+
+	e := Engine{Kind: EngineHTTP, URL: "http://example.com/hooks", Template: `{"ref": {{json .ID}}, "status": "{{upper .State}}", "driver": {{json .Data.driver_id}}}`}
+	body, err := e.Render(ev)
+	if err != nil {
+		t.Fatalf("could not render: %v", err)
+	}
+	if want := `{"ref": "42", "status": "MATCHED", "driver": "7"}`; string(body) != want {
+		t.Errorf("unexpected body %s, want %s", body, want)
+	}
+
+	e.Template = `ref={{.ID}}`
+	if _, err := e.Render(ev); err != ErrInvalidJSON {
+		t.Errorf("expected ErrInvalidJSON, got %v", err)
+	}
+	e.ContentType = "application/x-www-form-urlencoded"
+	if body, err := e.Render(ev); err != nil || string(body) != "ref=42" {
+		t.Errorf("unexpected body %s %v", body, err)
+	}
+}
+
+func TestEngineValidateTemplate(t *testing.T) {
+	cases := []struct {
+		engine Engine
+		valid  bool
+	}{
+		{Engine{Kind: EngineHTTP}, true},
+		{Engine{Kind: EngineHTTP, Template: `{"id": {{json .ID}}}`}, true},
+		{Engine{Kind: EngineHTTP, Template: `{"id": {{.Unknown}}}`}, false},
+		{Engine{Kind: EngineHTTP, Template: `{{if}}`}, false},
+		{Engine{Kind: EngineHTTP, ContentType: "text/plain"}, false},
+		{Engine{Kind: EngineTemporal, Template: `{"id": {{json .ID}}}`}, false},
+	}
+	for _, c := range cases {
+		if err := c.engine.validateTemplate("acme"); (err == nil) != c.valid {
+			t.Errorf("%+v: expected valid %v, got %v", c.engine, c.valid, err)
+		}
+	}
+}